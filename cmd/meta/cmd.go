@@ -0,0 +1,121 @@
+package meta
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sjqzhang/go-fastdfs/server"
+	"github.com/spf13/cobra"
+)
+
+// Cmd export and import the metadata of the node
+var Cmd = &cobra.Command{
+	Use:   "meta",
+	Short: "Export, import or restore metadata",
+	Long:  `Export, import or restore the metadata of fileserver.db and log.db, the server must be stopped`,
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export metadata",
+	Long:  `Export every file info of fileserver.db and log.db as json lines`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			err   error
+			w     io.Writer
+			count int
+		)
+		w = os.Stdout
+		if output != "" && output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				fail(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		server.InitServer()
+		filter := &server.MetaFilter{Scene: scene, DateFrom: dateFrom, DateTo: dateTo}
+		if count, err = server.ExportMeta(w, filter); err != nil {
+			fail(err)
+		}
+		fmt.Fprintf(os.Stderr, "%d records exported\n", count)
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import metadata",
+	Long:  `Import the json lines of meta export, taken keys are handled by --policy: skip, overwrite or newer`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			err  error
+			r    io.Reader
+			stat *server.MetaImportStat
+		)
+		r = os.Stdin
+		if input != "" && input != "-" {
+			f, err := os.Open(input)
+			if err != nil {
+				fail(err)
+			}
+			defer f.Close()
+			r = f
+		}
+		server.InitServer()
+		if stat, err = server.ImportMeta(r, policy); err != nil {
+			fail(err)
+		}
+		fmt.Fprintf(os.Stderr, "%d records, %d imported, %d skipped, %d malformed\n",
+			stat.Total, stat.Imported, stat.Skipped, stat.Malformed)
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore metadata backups",
+	Long:  `Restore the data/<date>/meta.data backups of the days from --from to --to into fileserver.db and log.db`,
+	Run: func(cmd *cobra.Command, args []string) {
+		server.InitServer()
+		report, err := server.RestoreMetaData(dateFrom, dateTo, force, fetch)
+		if err != nil {
+			fail(err)
+		}
+		for _, v := range report.Missing {
+			fmt.Println(v)
+		}
+		fmt.Fprintf(os.Stderr, "%d days, %d files, %d restored, %d skipped, %d fetched, %d missing\n",
+			len(report.Dates), report.Files, report.Restored, report.Skipped, report.Fetched, len(report.Missing))
+	},
+}
+
+var (
+	force    bool
+	fetch    bool
+	output   string
+	input    string
+	scene    string
+	dateFrom string
+	dateTo   string
+	policy   string
+)
+
+func init() {
+	exportCmd.Flags().StringVar(&output, "output", "-", "file to write, - for stdout")
+	exportCmd.Flags().StringVar(&scene, "scene", "", "export the files of the scene only")
+	exportCmd.Flags().StringVar(&dateFrom, "from", "", "export the files uploaded from the day, yyyyMMdd")
+	exportCmd.Flags().StringVar(&dateTo, "to", "", "export the files uploaded until the day, yyyyMMdd")
+	importCmd.Flags().StringVar(&input, "input", "-", "file to read, - for stdin")
+	importCmd.Flags().StringVar(&policy, "policy", "skip", "when a key is taken: skip, overwrite or newer")
+	restoreCmd.Flags().StringVar(&dateFrom, "from", "", "restore the backups from the day, yyyyMMdd")
+	restoreCmd.Flags().StringVar(&dateTo, "to", "", "restore the backups until the day, yyyyMMdd")
+	restoreCmd.Flags().BoolVar(&force, "force", false, "restore the paths known already too")
+	restoreCmd.Flags().BoolVar(&fetch, "fetch", false, "fetch the missing files from the peers")
+	Cmd.AddCommand(exportCmd, importCmd, restoreCmd)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
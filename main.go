@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/sjqzhang/go-fastdfs/cmd/doc"
+	"github.com/sjqzhang/go-fastdfs/cmd/meta"
 	"github.com/sjqzhang/go-fastdfs/cmd/server"
 	"github.com/sjqzhang/go-fastdfs/cmd/version"
 	dfs "github.com/sjqzhang/go-fastdfs/server"
@@ -27,6 +28,7 @@ func main() {
 		version.Cmd,
 		doc.Cmd,
 		server.Cmd,
+		meta.Cmd,
 	)
 	root.Execute()
 }
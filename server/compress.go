@@ -0,0 +1,257 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sjqzhang/seelog"
+)
+
+// CompressPolicy stores the files of a scene compressed with Codec when
+// their extension or mime type is listed, mime types may end with /*.
+type CompressPolicy struct {
+	Codec      string   `json:"codec"`
+	Extensions []string `json:"extensions"`
+	MimeTypes  []string `json:"mime_types"`
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n = w.n + int64(len(p))
+	return len(p), nil
+}
+
+type decompressReader struct {
+	io.ReadCloser
+	src io.Reader
+}
+
+func (r *decompressReader) Close() error {
+	err := r.ReadCloser.Close()
+	if closer, ok := r.src.(io.Closer); ok {
+		if e := closer.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// GetCompressCodec returns the codec a file of scene is stored with, "" when
+// it is stored as uploaded.
+func (c *Server) GetCompressCodec(scene string, name string, mimeType string) string {
+	var (
+		ext string
+	)
+	policy, ok := Config().SceneCompression[scene]
+	if !ok || policy.Codec == "" {
+		return ""
+	}
+	ext = strings.ToLower(path.Ext(name))
+	for _, v := range policy.Extensions {
+		if v = strings.ToLower(v); ext != "" && (v == ext || "."+v == ext) {
+			return policy.Codec
+		}
+	}
+	mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = strings.Split(mime.TypeByExtension(ext), ";")[0]
+	}
+	if mimeType == "" {
+		return ""
+	}
+	for _, v := range policy.MimeTypes {
+		if v == mimeType || (strings.HasSuffix(v, "/*") && strings.HasPrefix(mimeType, v[:len(v)-1])) {
+			return policy.Codec
+		}
+	}
+	return ""
+}
+
+// GetContentSize returns the size of the file as uploaded.
+func (c *Server) GetContentSize(fileInfo *FileInfo) int64 {
+	if fileInfo.Codec != "" || fileInfo.KeyId != "" {
+		return fileInfo.OrigSize
+	}
+	return fileInfo.Size
+}
+
+func NewCompressWriter(codec string, writer io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CONST_CODEC_GZIP:
+		return gzip.NewWriter(writer), nil
+	case CONST_CODEC_ZSTD:
+		return zstd.NewWriter(writer)
+	}
+	return nil, fmt.Errorf("unsupported codec %s", codec)
+}
+
+// NewDecompressReader decompresses reader, closing the result closes reader
+// too when it is an io.Closer.
+func NewDecompressReader(codec string, reader io.Reader) (io.ReadCloser, error) {
+	var (
+		err     error
+		gz      *gzip.Reader
+		decoder *zstd.Decoder
+	)
+	switch codec {
+	case CONST_CODEC_GZIP:
+		if gz, err = gzip.NewReader(reader); err != nil {
+			return nil, err
+		}
+		return &decompressReader{ReadCloser: gz, src: reader}, nil
+	case CONST_CODEC_ZSTD:
+		if decoder, err = zstd.NewReader(reader); err != nil {
+			return nil, err
+		}
+		return &decompressReader{ReadCloser: decoder.IOReadCloser(), src: reader}, nil
+	}
+	return nil, fmt.Errorf("unsupported codec %s", codec)
+}
+
+// CompressReader returns the compressed form of reader, it is produced while
+// the result is read. Closing the result stops the compression.
+func CompressReader(codec string, reader io.Reader) (io.ReadCloser, error) {
+	var (
+		err    error
+		writer io.WriteCloser
+	)
+	pr, pw := io.Pipe()
+	if writer, err = NewCompressWriter(codec, pw); err != nil {
+		return nil, err
+	}
+	go func() {
+		_, err := io.Copy(writer, reader)
+		if e := writer.Close(); err == nil {
+			err = e
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// AcceptEncoding reports whether the client takes the response encoded with codec.
+func (c *Server) AcceptEncoding(r *http.Request, codec string) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		if strings.TrimSpace(parts[0]) != codec {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(param), "q="), 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// ServeFileContent serves the stored content of fileInfo. An encrypted file is
+// decrypted unless a peer asks for the raw bytes. A compressed file is passed
+// through when the client accepts its codec and decompressed on the fly
+// otherwise.
+func (c *Server) ServeFileContent(w http.ResponseWriter, r *http.Request, fileInfo *FileInfo, name string, modTime time.Time, content io.ReadSeeker) {
+	var (
+		err       error
+		reader    io.ReadCloser
+		decrypted *decryptReader
+	)
+	if fileInfo != nil && fileInfo.KeyId != "" {
+		if c.IsRawRequest(r) {
+			http.ServeContent(w, r, name, modTime, content)
+			return
+		}
+		if decrypted, err = c.NewDecryptReader(content); err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		content = decrypted
+	}
+	if fileInfo == nil || fileInfo.Codec == "" {
+		http.ServeContent(w, r, name, modTime, content)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	c.setContentType(w, name)
+	if c.AcceptEncoding(r, fileInfo.Codec) {
+		w.Header().Set("Content-Encoding", fileInfo.Codec)
+		http.ServeContent(w, r, name, modTime, content)
+		return
+	}
+	if reader, err = NewDecompressReader(fileInfo.Codec, content); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	c.ServeDecompressed(w, r, fileInfo, modTime, reader)
+}
+
+// setContentType sets the type of name unless the caller did, the content of
+// a compressed file can't be sniffed.
+func (c *Server) setContentType(w http.ResponseWriter, name string) {
+	if w.Header().Get("Content-Type") == "" {
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ctype)
+	}
+}
+
+// decompressSeeker lets http.ServeContent serve ranges of a decompressed
+// stream of known size: a seek forward skips the bytes before the range, a
+// seek back to bytes read already fails.
+type decompressSeeker struct {
+	reader io.Reader
+	size   int64
+	pos    int64
+	off    int64
+}
+
+func (s *decompressSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < s.off {
+		return s.pos, fmt.Errorf("seek back to %d, %d bytes are read", offset, s.off)
+	}
+	s.pos = offset
+	return s.pos, nil
+}
+
+func (s *decompressSeeker) Read(p []byte) (int, error) {
+	if s.pos > s.off {
+		n, err := io.CopyN(ioutil.Discard, s.reader, s.pos-s.off)
+		if s.off += n; err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.reader.Read(p)
+	s.off += int64(n)
+	s.pos = s.off
+	return n, err
+}
+
+// ServeDecompressed sends the decompressed content of fileInfo read from
+// reader, with the Range and conditional headers of r.
+func (c *Server) ServeDecompressed(w http.ResponseWriter, r *http.Request, fileInfo *FileInfo, modTime time.Time, reader io.Reader) {
+	c.setContentType(w, fileInfo.Name)
+	http.ServeContent(w, r, fileInfo.Name, modTime, &decompressSeeker{reader: reader, size: fileInfo.OrigSize})
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/sjqzhang/goutil"
+)
+
+func TestCompress(t *testing.T) {
+	old := atomic.LoadPointer(&ptr)
+	defer atomic.StorePointer(&ptr, old)
+	atomic.StorePointer(&ptr, unsafe.Pointer(&GlobalConfig{
+		SceneCompression: map[string]CompressPolicy{
+			"logs": {Codec: CONST_CODEC_ZSTD, Extensions: []string{"log"}, MimeTypes: []string{"text/*", "application/json"}},
+		},
+	}))
+	c := &Server{util: &goutil.Common{}}
+	for _, v := range []struct {
+		scene, name, mimeType, codec string
+	}{
+		{"logs", "a.LOG", "", CONST_CODEC_ZSTD},
+		{"logs", "a.json", "application/octet-stream", CONST_CODEC_ZSTD},
+		{"logs", "a.bin", "text/plain; charset=utf-8", CONST_CODEC_ZSTD},
+		{"logs", "a.jpg", "", ""},
+		{"default", "a.log", "", ""},
+	} {
+		if codec := c.GetCompressCodec(v.scene, v.name, v.mimeType); codec != v.codec {
+			t.Error(v, codec)
+		}
+	}
+	data := []byte(strings.Repeat("2019-01-01 00:00:00 [INF] compress me\n", 100))
+	for _, codec := range []string{CONST_CODEC_GZIP, CONST_CODEC_ZSTD} {
+		compressed, err := CompressReader(codec, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ioutil.ReadAll(compressed)
+		if err != nil || len(stored) >= len(data) {
+			t.Fatal(codec, len(stored), err)
+		}
+		reader, err := NewDecompressReader(codec, bytes.NewReader(stored))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, err := ioutil.ReadAll(reader); err != nil || !bytes.Equal(result, data) {
+			t.Error(codec, "roundtrip", err)
+		}
+		reader.Close()
+	}
+	// a range of the decompressed content, unless If-Range does not match
+	modTime := time.Unix(1000, 0)
+	for _, v := range []struct {
+		rangeHeader, ifRange string
+		code                 int
+		body                 []byte
+	}{
+		{"bytes=10-19", "", http.StatusPartialContent, data[10:20]},
+		{"bytes=-5", modTime.UTC().Format(http.TimeFormat), http.StatusPartialContent, data[len(data)-5:]},
+		{"bytes=10-19", modTime.Add(time.Hour).UTC().Format(http.TimeFormat), http.StatusOK, data},
+		{"bytes=99999-", "", http.StatusRequestedRangeNotSatisfiable, nil},
+	} {
+		compressed, _ := CompressReader(CONST_CODEC_GZIP, bytes.NewReader(data))
+		reader, _ := NewDecompressReader(CONST_CODEC_GZIP, compressed)
+		r := httptest.NewRequest("GET", "/a.log", nil)
+		r.Header.Set("Range", v.rangeHeader)
+		r.Header.Set("If-Range", v.ifRange)
+		w := httptest.NewRecorder()
+		c.ServeDecompressed(w, r, &FileInfo{Name: "a.log", Codec: CONST_CODEC_GZIP, OrigSize: int64(len(data))}, modTime, reader)
+		if w.Code != v.code || v.body != nil && !bytes.Equal(w.Body.Bytes(), v.body) {
+			t.Errorf("range %s if-range %s: %d %q", v.rangeHeader, v.ifRange, w.Code, w.Body.String())
+		}
+		reader.Close()
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+	for header, accept := range map[string]bool{"gzip, zstd": true, "gzip;q=0.5,zstd;q=0": false, "gzip": false, "": false} {
+		r.Header.Set("Accept-Encoding", header)
+		if c.AcceptEncoding(r, CONST_CODEC_ZSTD) != accept {
+			t.Error("accept encoding", header)
+		}
+	}
+}
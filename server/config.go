@@ -38,8 +38,14 @@ var (
 	CONST_CONF_FILE_NAME        = CONF_DIR + "/cfg.json"
 	CONST_SERVER_CRT_FILE_NAME  = CONF_DIR + "/server.crt"
 	CONST_SERVER_KEY_FILE_NAME  = CONF_DIR + "/server.key"
-	CONST_SEARCH_FILE_NAME      = DATA_DIR + "/search.txt"
 	CONST_UPLOAD_COUNTER_KEY    = "__CONST_UPLOAD_COUNTER_KEY__"
+	CONST_S3_INDEX_VERSION_KEY  = "__CONST_S3_INDEX_VERSION_KEY__"
+	CONST_FILE_REF_VERSION_KEY  = "__CONST_FILE_REF_VERSION_KEY__"
+	CONST_INDEX_VERSION_KEY     = "__CONST_INDEX_VERSION_KEY__"
+	CONST_SCRUB_TIME_KEY        = "__CONST_SCRUB_TIME_KEY__"
+	CONST_MEMBERS_KEY           = "__CONST_MEMBERS_KEY__"
+	CONST_MERKLE_KEY            = "__CONST_MERKLE_KEY__"
+	CONST_OPLOG_SEQ_KEY         = "__CONST_OPLOG_SEQ_KEY__"
 	logConfigStr                = `
 <seelog type="asynctimer" asyncinterval="1000" minlevel="trace" maxlevel="error">  
 	<outputs formatid="common">  
@@ -80,6 +86,93 @@ const (
 	CONST_FILE_Md5_FILE_NAME       = "files.md5"
 	CONST_REMOME_Md5_FILE_NAME     = "removes.md5"
 	CONST_SMALL_FILE_SIZE          = 1024 * 1024
+	CONST_S3_OBJECT_KEY_PREFIX     = "s3_object_"
+	CONST_FILE_REF_KEY_PREFIX      = "file_ref_"
+	CONST_DISTINCT_LINK_HARDLINK   = "hardlink"
+	CONST_DISTINCT_LINK_REF        = "ref"
+	CONST_FILE_VERSION_KEY_PREFIX  = "file_version_"
+	CONST_VERSION_DIR_NAME         = "_versions"
+	CONST_TRASH_KEY_PREFIX         = "trash_"
+	CONST_TRASH_DIR_NAME           = "_trash"
+	CONST_META_FIELD_PREFIX        = "meta_"
+	CONST_META_MAX_SIZE            = 4096
+	CONST_INDEX_KEY_PREFIX         = "idx_"
+	CONST_INDEX_MAX_TOKEN          = 64
+	CONST_INDEX_MAX_TOKENS         = 32
+	CONST_SEARCH_INDEX_VERSION     = "2"
+	CONST_META_POLICY_SKIP         = "skip"
+	CONST_META_POLICY_OVERWRITE    = "overwrite"
+	CONST_META_POLICY_NEWER        = "newer"
+	CONST_META_RECORD_FILE         = "file"
+	CONST_META_RECORD_TRASH        = "trash"
+	CONST_META_RECORD_VERSION      = "version"
+	CONST_SCRUB_KEY_PREFIX         = "scrub_bad_"
+	CONST_SCRUB_STATE_CORRUPT      = "corrupt"
+	CONST_SCRUB_STATE_MISSING      = "missing"
+	CONST_RECONCILE_DISK_ONLY      = "disk_only"
+	CONST_RECONCILE_META_ONLY      = "meta_only"
+	CONST_RECONCILE_SIZE           = "size_mismatch"
+	CONST_RECONCILE_STALE_TMP      = "stale_tmp"
+	CONST_RECONCILE_ADOPT          = "adopt"
+	CONST_RECONCILE_REFETCH        = "refetch"
+	CONST_RECONCILE_DELETE         = "delete"
+	CONST_RECONCILE_GRACE          = 3600
+	CONST_RECONCILE_TMP_EXPIRE     = 24 * 3600
+	CONST_RECONCILE_MAX_ITEMS      = 10000
+	CONST_MEMBER_ALIVE             = "alive"
+	CONST_MEMBER_SUSPECT           = "suspect"
+	CONST_MEMBER_DEAD              = "dead"
+	CONST_MEMBER_LEFT              = "left"
+	CONST_GOSSIP_FANOUT            = 3
+	CONST_MERKLE_KEY_PREFIX        = "merkle_"
+	CONST_MERKLE_ROOT_PREFIX       = "merkle_root_"
+	CONST_MERKLE_DIRTY_PREFIX      = "merkle_dirty_"
+	CONST_MERKLE_DEPTH             = 2
+	CONST_MERKLE_MAX_RANGES        = 1000
+	CONST_OPLOG_KEY_PREFIX         = "oplog_"
+	CONST_CHECKPOINT_KEY_PREFIX    = "checkpoint_"
+	CONST_TOMBSTONE_KEY_PREFIX     = "tombstone_"
+	CONST_OPLOG_PAGE_SIZE          = 1000
+	CONST_OP_DELETE                = "delete"
+	CONST_OP_META                  = "meta"
+	CONST_OP_RESTORE               = "restore"
+	CONST_OP_PURGE                 = "purge"
+	CONST_OP_DELETE_VERSION        = "delete_version"
+	CONST_OP_REF                   = "ref"
+	CONST_OP_VERSION               = "version"
+	CONST_QUEUE_KEY_PREFIX         = "queue_"
+	CONST_DEAD_LETTER_KEY_PREFIX   = "dead_letter_"
+	CONST_QUEUE_TO_PEERS           = "to_peers"
+	CONST_QUEUE_FROM_PEERS         = "from_peers"
+	CONST_QUEUE_FILE_LOG           = "file_log"
+	CONST_QUEUE_RELEASE            = "release"
+	CONST_QUEUE_MAX_BACKOFF        = 3600
+	CONST_QUEUE_MAX_DEAD_LETTERS   = 1000
+	CONST_QUEUE_PEER_PREFIX        = "peer_"
+	CONST_BREAKER_CLOSED           = "closed"
+	CONST_BREAKER_OPEN             = "open"
+	CONST_BREAKER_HALF_OPEN        = "half_open"
+	CONST_SEARCH_PAGE_SIZE         = 100
+	CONST_SEARCH_MAX_PAGE_SIZE     = 1000
+	CONST_SHARD_DIR_NAME           = "_shards"
+	CONST_BIG_DIR_NAME             = "_big"
+	CONST_SMALL_FILE_DELETED_FLAG  = '0'
+	CONST_RETIRED_VOLUME_PREFIX    = "haystack_retired_"
+	CONST_NEEDLE_MAGIC             = "HSN1"
+	CONST_NEEDLE_MAX_NAME          = 255
+	CONST_NEEDLE_MAX_HEADER        = 1024
+	CONST_VOLUME_INDEX_SUFFIX      = ".idx"
+	CONST_VOLUME_CACHE_SIZE        = 1024
+	CONST_CODEC_GZIP               = "gzip"
+	CONST_CODEC_ZSTD               = "zstd"
+	CONST_ENCRYPT_MAGIC            = "FDE1"
+	CONST_ENCRYPT_CHUNK_SIZE       = 64 * 1024
+	CONST_ENCRYPT_OVERHEAD         = 12 + 16
+	CONST_SHARD_BLOCK_SIZE         = 1024 * 1024
+	CONST_DISK_CHECK_INTERVAL      = 10
+	CONST_DISK_STATE_OK            = "ok"
+	CONST_DISK_STATE_LOW           = "low"
+	CONST_DISK_STATE_CRITICAL      = "critical"
 	CONST_MESSAGE_CLUSTER_IP       = "Can only be called by the cluster ip or 127.0.0.1 or admin_ips(cfg.json),current ip:%s"
 	cfgJson                        = `{
 	"绑定端号": "端口",
@@ -98,6 +191,8 @@ const (
 	"support_group_manage": true,
 	"是否合并小文件": "默认不合并,合并可以解决inode不够用的情况（当前对于小于1M文件）进行合并",
 	"enable_merge_small_file": false,
+	"小文件卷压缩阈值": "合并小文件删除后只做标记,卷中已删除空间占比达到该值时后台重写卷回收空间,默认0.5",
+	"haystack_compact_ratio": 0.5,
     "允许后缀名": "允许可以上传的文件后缀名，如jpg,jpeg,png等。留空允许所有。",
 	"图片是否缩放": "默认是",
 	"enable_image_resize": true,
@@ -114,6 +209,8 @@ const (
 	"enable_web_upload": true,
 	"是否支持非日期路径": "默认支持非日期路径,也即支持自定义路径,需要上传文件时指定path",
 	"enable_custom_path": true,
+	"多版本场景": "可选,列表中的场景上传到已存在的自定义路径时保存为新版本,原地址返回最新版本,?version=版本号 访问旧版本,合并存储的小文件不支持,如 [\"docs\"]",
+	"version_scenes": [],
 	"下载域名": "用于外网下载文件的域名",
 	"download_domain": "",
 	"场景列表": "当设定后，用户指的场景必项在列表中，默认不做限制(注意：如果想开启场景认功能，格式如下：'场景名:googleauth_secret' 如 default:N7IET373HB2C5M6D ",
@@ -146,6 +243,42 @@ const (
 	"enable_migrate": false,
 	"文件是否去重": "默认去重",
 	"enable_distinct_file": true,
+	"重复文件地址": "去重时重复上传的文件的访问地址,默认为空返回已有文件的地址,hardlink 在上传路径创建硬链接并返回新地址,ref 只在上传路径创建引用并返回新地址,文件内容在最后一个引用删除后才删除",
+	"distinct_link": "",
+	"是否开启回收站": "开启后删除的文件先移入所在场景的回收站,可通过list_trash查看,restore恢复,purge彻底删除,合并存储的小文件与纠删码文件不移动,由回收站引用其所在的卷与分片保留至彻底删除",
+	"enable_trash": true,
+	"回收站保留天数": "超过该天数的文件自动彻底删除,默认7",
+	"trash_expire_days": 7,
+	"搜索候选上限": "带过滤条件搜索时按索引取出的候选文件数上限,超过后改为按排序索引逐个过滤,默认10000",
+	"search_max_candidates": 10000,
+	"是否开启数据巡检": "开启后后台按元数据逐个重新计算文件的md5或sha1(与file_sum_arithmetic一致),损坏或丢失的文件从校验通过的其它节点下载修复,通过scrub查看进度与结果,默认不开启",
+	"enable_scrub": false,
+	"巡检间隔": "两轮巡检之间的小时数,默认24",
+	"scrub_interval": 24,
+	"巡检读取限速": "巡检每秒读取的最大MB数,默认10",
+	"scrub_rate_limit": 10,
+	"是否开启动态集群成员": "开启后节点通过gossip交换心跳(peer_id、组、版本、磁盘使用率、只读状态),新节点只需在peers中配置任一已有节点即可加入,同步与修复只使用存活的节点,需要admin_ips放行集群内的地址,默认不开启",
+	"enable_gossip": false,
+	"心跳间隔": "两次gossip之间的秒数,默认2",
+	"gossip_interval": 2,
+	"疑似故障超时": "超过该秒数未收到节点心跳则标记为suspect,默认10",
+	"suspect_timeout": 10,
+	"故障超时": "超过该秒数未收到节点心跳则标记为dead,不再向其同步,默认60",
+	"dead_timeout": 60,
+	"操作日志拉取间隔": "各节点拉取其它节点的删除、回收站、版本删除与元数据修改等操作日志的秒数间隔,有新操作时也会立即通知拉取,默认10",
+	"oplog_interval": 10,
+	"删除标记保留天数": "操作日志与删除标记(防止修复时把已删除的文件同步回来)保留的天数,默认30",
+	"tombstone_days": 30,
+	"同步重试次数": "同步到其它节点或从其它节点下载失败后的重试次数,超过后进入死信队列,可通过queue查看与重试,默认3",
+	"retry_count": 3,
+	"同步重试间隔": "第一次重试前等待的秒数,之后每次翻倍(最多1小时)并加入随机抖动,默认10",
+	"retry_interval": 10,
+	"每个节点的同步并发数": "向每个节点同步文件的并发数,各节点有独立的队列,慢节点不影响其它节点,默认10",
+	"peer_sync_worker": 10,
+	"熔断失败次数": "向某节点连续同步失败该次数后暂停向其同步,默认5",
+	"breaker_failures": 5,
+	"熔断恢复时间": "暂停同步的秒数,之后试探一次,成功则恢复,失败则时间翻倍(最多1小时),默认30",
+	"breaker_cooldown": 30,
 	"是否开启跨站访问": "默认开启",
 	"enable_cross_origin": true,
 	"是否开启Google认证，实现安全的上传、下载": "默认不开启",
@@ -158,66 +291,133 @@ const (
 	"default_download": true,
 	"本机是否只读": "默认可读可写",
 	"read_only": false,
+	"磁盘低水位": "磁盘已用空间百分比达到该值时记录日志并告警,默认85",
+	"disk_low_watermark": 85,
+	"磁盘临界水位": "磁盘已用空间百分比达到该值时本机自动只读,上传返回507且不再接收其他节点同步的文件,空间释放后自动恢复,默认95",
+	"disk_critical_watermark": 95,
 	"是否开启断点续传": "默认开启",
 	"enable_tus": true,
 	"同步单一文件超时时间（单位秒）": "默认为0,程序自动计算，在特殊情况下，自已设定",
-	"sync_timeout": 0
+	"sync_timeout": 0,
+	"是否开启S3兼容接口": "默认不开启,bucket对应场景(scene),key对应场景目录下的路径+文件名,如 files/default/a/b.jpg 对应 bucket default key a/b.jpg",
+	"enable_s3": false,
+	"S3接口监听地址": "默认:9000",
+	"s3_addr": ":9000",
+	"S3区域": "默认us-east-1",
+	"s3_region": "us-east-1",
+	"S3访问密钥列表": "格式 access_key:secret_key,为空时只允许管理ip访问",
+	"s3_access_keys": [],
+	"副本数": "每个文件在集群内保存的副本数,默认0表示集群内每台机器都保存一份,大于0时按文件md5哈希选择存储节点,增加节点可扩容",
+	"replication_factor": 0,
+	"节点区域": "可选,节点所在的区域/机架,副本会尽量分布在不同区域,格式 {\"http://10.1.5.4:8080\": \"zone1\"}",
+	"peer_zones": {},
+	"场景存储策略": "可选,按场景设置副本数或限定存储节点,格式 {\"场景名\": {\"replication_factor\": 2, \"peers\": [\"http://10.1.5.4:8080\"]}}",
+	"scene_placement": {},
+	"是否开启纠删码存储": "默认不开启,开启后大于erasure_min_size的文件切分为数据块+校验块(Reed-Solomon)分散存储到各节点,不再全量复制,下载时实时还原,最多允许erasure_parity_shards个块不可用,集群节点数少于数据块数+校验块数时仍全量复制",
+	"enable_erasure_code": false,
+	"纠删码数据块数": "默认4",
+	"erasure_data_shards": 4,
+	"纠删码校验块数": "默认2",
+	"erasure_parity_shards": 2,
+	"纠删码最小文件大小(单位字节)": "默认104857600(100M)",
+	"erasure_min_size": 104857600,
+	"场景压缩存储": "可选,按场景压缩存储指定扩展名或mime类型的文件(gzip或zstd),下载时自动解压,客户端支持该编码(Accept-Encoding)时直接返回压缩数据,合并存储的小文件不压缩,格式 {\"场景名\": {\"codec\": \"gzip\", \"extensions\": [\".txt\", \".json\"], \"mime_types\": [\"text/*\"]}}",
+	"scene_compression": {},
+	"静态加密密钥文件": "可选,配置后按场景对落盘文件进行AES-GCM加密,如 conf/keys.json,格式 {\"keys\": {\"密钥ID\": \"base64编码的16/24/32字节密钥\"}, \"scenes\": {\"场景名\": \"密钥ID\"}},轮换密钥时增加新密钥并将场景指向新密钥ID,旧密钥需保留以读取旧文件,修改后reload生效",
+	"encrypt_key_file": "",
+	"存储目录列表": "可选,多块磁盘时每块盘配置一个目录,如 [\"/data1/files\", \"/data2/files\"],新文件写入剩余空间最大的目录,为空时使用files目录,磁盘故障时其上的文件会从其他节点重新同步,修改后需重启",
+	"store_dirs": []
 }
 	`
 )
 
 type GlobalConfig struct {
-	Addr                 string   `json:"addr"`
-	Peers                []string `json:"peers"`
-	EnableHttps          bool     `json:"enable_https"`
-	Group                string   `json:"group"`
-	RenameFile           bool     `json:"rename_file"`
-	ShowDir              bool     `json:"show_dir"`
-	Extensions           []string `json:"extensions"`
-	RefreshInterval      int      `json:"refresh_interval"`
-	EnableWebUpload      bool     `json:"enable_web_upload"`
-	DownloadDomain       string   `json:"download_domain"`
-	EnableCustomPath     bool     `json:"enable_custom_path"`
-	Scenes               []string `json:"scenes"`
-	AlarmReceivers       []string `json:"alarm_receivers"`
-	DefaultScene         string   `json:"default_scene"`
-	Mail                 Mail     `json:"mail"`
-	AlarmUrl             string   `json:"alarm_url"`
-	DownloadUseToken     bool     `json:"download_use_token"`
-	DownloadTokenExpire  int      `json:"download_token_expire"`
-	QueueSize            int      `json:"queue_size"`
-	AutoRepair           bool     `json:"auto_repair"`
-	Host                 string   `json:"host"`
-	FileSumArithmetic    string   `json:"file_sum_arithmetic"`
-	PeerId               string   `json:"peer_id"`
-	SupportGroupManage   bool     `json:"support_group_manage"`
-	AdminIps             []string `json:"admin_ips"`
-	EnableMergeSmallFile bool     `json:"enable_merge_small_file"`
-	EnableMigrate        bool     `json:"enable_migrate"`
-	EnableDistinctFile   bool     `json:"enable_distinct_file"`
-	ReadOnly             bool     `json:"read_only"`
-	EnableCrossOrigin    bool     `json:"enable_cross_origin"`
-	EnableGoogleAuth     bool     `json:"enable_google_auth"`
-	AuthUrl              string   `json:"auth_url"`
-	EnableDownloadAuth   bool     `json:"enable_download_auth"`
-	DefaultDownload      bool     `json:"default_download"`
-	EnableTus            bool     `json:"enable_tus"`
-	SyncTimeout          int64    `json:"sync_timeout"`
-	EnableFsNotify       bool     `json:"enable_fsnotify"`
-	EnableDiskCache      bool     `json:"enable_disk_cache"`
-	ConnectTimeout       bool     `json:"connect_timeout"`
-	ReadTimeout          int      `json:"read_timeout"`
-	WriteTimeout         int      `json:"write_timeout"`
-	IdleTimeout          int      `json:"idle_timeout"`
-	ReadHeaderTimeout    int      `json:"read_header_timeout"`
-	SyncWorker           int      `json:"sync_worker"`
-	UploadWorker         int      `json:"upload_worker"`
-	UploadQueueSize      int      `json:"upload_queue_size"`
-	RetryCount           int      `json:"retry_count"`
-	SyncDelay            int64    `json:"sync_delay"`
-	WatchChanSize        int      `json:"watch_chan_size"`
-	ImageMaxWidth        int      `json:"image_max_width"`
-	ImageMaxHeight       int      `json:"image_max_height"`
+	Addr                 string                    `json:"addr"`
+	Peers                []string                  `json:"peers"`
+	EnableHttps          bool                      `json:"enable_https"`
+	Group                string                    `json:"group"`
+	RenameFile           bool                      `json:"rename_file"`
+	ShowDir              bool                      `json:"show_dir"`
+	Extensions           []string                  `json:"extensions"`
+	RefreshInterval      int                       `json:"refresh_interval"`
+	EnableWebUpload      bool                      `json:"enable_web_upload"`
+	DownloadDomain       string                    `json:"download_domain"`
+	EnableCustomPath     bool                      `json:"enable_custom_path"`
+	VersionScenes        []string                  `json:"version_scenes"`
+	Scenes               []string                  `json:"scenes"`
+	AlarmReceivers       []string                  `json:"alarm_receivers"`
+	DefaultScene         string                    `json:"default_scene"`
+	Mail                 Mail                      `json:"mail"`
+	AlarmUrl             string                    `json:"alarm_url"`
+	DownloadUseToken     bool                      `json:"download_use_token"`
+	DownloadTokenExpire  int                       `json:"download_token_expire"`
+	QueueSize            int                       `json:"queue_size"`
+	AutoRepair           bool                      `json:"auto_repair"`
+	Host                 string                    `json:"host"`
+	FileSumArithmetic    string                    `json:"file_sum_arithmetic"`
+	PeerId               string                    `json:"peer_id"`
+	SupportGroupManage   bool                      `json:"support_group_manage"`
+	AdminIps             []string                  `json:"admin_ips"`
+	EnableMergeSmallFile bool                      `json:"enable_merge_small_file"`
+	EnableMigrate        bool                      `json:"enable_migrate"`
+	EnableDistinctFile   bool                      `json:"enable_distinct_file"`
+	DistinctLink         string                    `json:"distinct_link"`
+	EnableTrash          bool                      `json:"enable_trash"`
+	TrashExpireDays      int                       `json:"trash_expire_days"`
+	SearchMaxCandidates  int                       `json:"search_max_candidates"`
+	EnableScrub          bool                      `json:"enable_scrub"`
+	ScrubInterval        int                       `json:"scrub_interval"`
+	ScrubRateLimit       int                       `json:"scrub_rate_limit"`
+	EnableGossip         bool                      `json:"enable_gossip"`
+	GossipInterval       int                       `json:"gossip_interval"`
+	SuspectTimeout       int                       `json:"suspect_timeout"`
+	DeadTimeout          int                       `json:"dead_timeout"`
+	OplogInterval        int                       `json:"oplog_interval"`
+	TombstoneDays        int                       `json:"tombstone_days"`
+	ReadOnly             bool                      `json:"read_only"`
+	DiskLowWatermark     float64                   `json:"disk_low_watermark"`
+	DiskCritWatermark    float64                   `json:"disk_critical_watermark"`
+	EnableCrossOrigin    bool                      `json:"enable_cross_origin"`
+	EnableGoogleAuth     bool                      `json:"enable_google_auth"`
+	AuthUrl              string                    `json:"auth_url"`
+	EnableDownloadAuth   bool                      `json:"enable_download_auth"`
+	DefaultDownload      bool                      `json:"default_download"`
+	EnableTus            bool                      `json:"enable_tus"`
+	SyncTimeout          int64                     `json:"sync_timeout"`
+	EnableFsNotify       bool                      `json:"enable_fsnotify"`
+	EnableDiskCache      bool                      `json:"enable_disk_cache"`
+	ConnectTimeout       bool                      `json:"connect_timeout"`
+	ReadTimeout          int                       `json:"read_timeout"`
+	WriteTimeout         int                       `json:"write_timeout"`
+	IdleTimeout          int                       `json:"idle_timeout"`
+	ReadHeaderTimeout    int                       `json:"read_header_timeout"`
+	SyncWorker           int                       `json:"sync_worker"`
+	UploadWorker         int                       `json:"upload_worker"`
+	UploadQueueSize      int                       `json:"upload_queue_size"`
+	RetryCount           int                       `json:"retry_count"`
+	RetryInterval        int                       `json:"retry_interval"`
+	PeerSyncWorker       int                       `json:"peer_sync_worker"`
+	BreakerFailures      int                       `json:"breaker_failures"`
+	BreakerCooldown      int                       `json:"breaker_cooldown"`
+	SyncDelay            int64                     `json:"sync_delay"`
+	WatchChanSize        int                       `json:"watch_chan_size"`
+	ImageMaxWidth        int                       `json:"image_max_width"`
+	ImageMaxHeight       int                       `json:"image_max_height"`
+	EnableS3             bool                      `json:"enable_s3"`
+	S3Addr               string                    `json:"s3_addr"`
+	S3Region             string                    `json:"s3_region"`
+	S3AccessKeys         []string                  `json:"s3_access_keys"`
+	ReplicationFactor    int                       `json:"replication_factor"`
+	PeerZones            map[string]string         `json:"peer_zones"`
+	ScenePlacement       map[string]ScenePlacement `json:"scene_placement"`
+	HaystackCompactRatio float64                   `json:"haystack_compact_ratio"`
+	EnableErasureCode    bool                      `json:"enable_erasure_code"`
+	ErasureDataShards    int                       `json:"erasure_data_shards"`
+	ErasureParityShards  int                       `json:"erasure_parity_shards"`
+	ErasureMinSize       int64                     `json:"erasure_min_size"`
+	SceneCompression     map[string]CompressPolicy `json:"scene_compression"`
+	EncryptKeyFile       string                    `json:"encrypt_key_file"`
+	StoreDirs            []string                  `json:"store_dirs"`
 }
 
 func Config() *GlobalConfig {
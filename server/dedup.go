@@ -0,0 +1,468 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Every upload of a content holds a reference to it, kept as
+// file_ref_<md5>_<ref_id> in leveldb. The content is only deleted with its
+// last reference. A reference either shares the path the content is stored
+// at, or has a path of its own (distinct_link) backed by a hardlink or, with
+// Ref set, by the metadata only.
+
+func (c *Server) fileRefKey(md5sum string, refId string) string {
+	return CONST_FILE_REF_KEY_PREFIX + md5sum + "_" + refId
+}
+
+func (c *Server) AddFileRef(ref *FileInfo) error {
+	var (
+		err  error
+		data []byte
+	)
+	if ref.Md5 == "" || ref.RefId == "" {
+		return errors.New("(error) md5 or ref_id is null")
+	}
+	if data, err = json.Marshal(ref); err != nil {
+		return err
+	}
+	return c.ldb.Put([]byte(c.fileRefKey(ref.Md5, ref.RefId)), data, nil)
+}
+
+// GetFileRefs returns the references to md5sum ordered by ref_id.
+func (c *Server) GetFileRefs(md5sum string) []*FileInfo {
+	var (
+		refs []*FileInfo
+	)
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(c.fileRefKey(md5sum, ""))), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var ref FileInfo
+		if err := json.Unmarshal(iter.Value(), &ref); err != nil {
+			log.Error(err)
+			continue
+		}
+		refs = append(refs, &ref)
+	}
+	return refs
+}
+
+// newRefId is the ref_id of the upload of fileInfo to its path.
+func (c *Server) newRefId(fileInfo *FileInfo) string {
+	return c.util.MD5(c.GetFilePathByInfo(fileInfo, false) + fileInfo.Version)
+}
+
+// hasOwnPath reports whether ref gives the content a path of its own rather
+// than sharing the path the content is stored at.
+func (c *Server) hasOwnPath(ref *FileInfo, content *FileInfo) bool {
+	if content != nil {
+		return c.GetFilePathByInfo(ref, false) != c.GetFilePathByInfo(content, false)
+	}
+	return ref.RefId == c.newRefId(ref)
+}
+
+// SaveFileRef records ref, and the metadata of its path when it has one.
+func (c *Server) SaveFileRef(ref *FileInfo) error {
+	if err := c.AddFileRef(ref); err != nil {
+		return err
+	}
+	content, _ := c.GetFileInfoFromLevelDB(ref.Md5)
+	if !c.hasOwnPath(ref, content) {
+		return nil
+	}
+	return c.saveRefPath(ref)
+}
+
+func (c *Server) saveRefPath(ref *FileInfo) error {
+	var (
+		err  error
+		data []byte
+	)
+	// not through SaveFileInfoToLevelDB, the log db keeps the content by md5
+	if data, err = json.Marshal(ref); err != nil {
+		return err
+	}
+	if err = c.ldb.Put([]byte(c.util.MD5(c.GetFilePathByInfo(ref, false))), data, nil); err != nil {
+		return err
+	}
+	c.SaveS3ObjectIndex(ref)
+	c.IndexFile(ref)
+	return nil
+}
+
+// NewFileRef returns a reference to content at the path of target.
+func (c *Server) NewFileRef(content *FileInfo, target *FileInfo) *FileInfo {
+	ref := *content
+	ref.Name = target.Name
+	ref.ReName = target.ReName
+	ref.Path = target.Path
+	ref.Scene = target.Scene
+	ref.Version = target.Version
+	ref.Meta = target.Meta
+	ref.TimeStamp = time.Now().Unix()
+	ref.OffSet = -1
+	ref.Shards = nil
+	ref.Disk = ""
+	ref.RefId = c.newRefId(target)
+	ref.Ref = true
+	return &ref
+}
+
+// linkFileRef hardlinks the path of ref to content where the storage allows
+// it, ref is left a metadata reference otherwise.
+func (c *Server) linkFileRef(content *FileInfo, ref *FileInfo) {
+	linker, ok := c.storage.(Linker)
+	if !ok || content.OffSet >= 0 || content.Shards != nil {
+		return
+	}
+	if err := linker.Link(c.GetFilePathByInfo(content, false), c.GetFilePathByInfo(ref, false)); err != nil {
+		log.Warn(err)
+		return
+	}
+	ref.Ref = false
+	ref.Disk = content.Disk
+}
+
+// AddDedupRef adds a reference to content for upload, whose bytes turned out
+// to be stored already. The reference shares the url of content unless
+// distinct_link gives it the path of upload.
+func (c *Server) AddDedupRef(content *FileInfo, upload *FileInfo) *FileInfo {
+	var (
+		ref *FileInfo
+	)
+	fpath := c.GetFilePathByInfo(upload, false)
+	mode := Config().DistinctLink
+	if mode == "" && (upload.Version != "" || c.IsTrashPath(c.GetFilePathByInfo(content, false))) {
+		// a version, or content waiting in the trash, is served at its own path
+		mode = CONST_DISTINCT_LINK_REF
+	}
+	if mode == "" || fpath == c.GetFilePathByInfo(content, false) {
+		info := *content
+		info.TimeStamp = time.Now().Unix()
+		info.RefId = c.util.MD5(c.util.GetUUID())
+		info.Meta = upload.Meta
+		ref = &info
+	} else {
+		c.storage.Delete(fpath)
+		ref = c.NewFileRef(content, upload)
+		if mode == CONST_DISTINCT_LINK_HARDLINK {
+			c.linkFileRef(content, ref)
+		}
+	}
+	if err := c.SaveFileRef(ref); err != nil {
+		log.Error(err)
+	}
+	c.SyncFileRefToPeers(ref)
+	return ref
+}
+
+// SyncFileRefToPeers logs the creation of ref, the peers replay it from the
+// operation log.
+func (c *Server) SyncFileRefToPeers(ref *FileInfo) {
+	if err := c.LogOp(&Op{Type: CONST_OP_REF, Md5: ref.Md5, RefId: ref.RefId, File: ref}); err != nil {
+		log.Error(err)
+	}
+}
+
+// applyFileRef saves the reference ref a peer made.
+func (c *Server) applyFileRef(ref *FileInfo) error {
+	if c.IsDeleted(ref) {
+		return errors.New("(error) deleted")
+	}
+	if !c.acceptFileVersion(ref) {
+		return nil
+	}
+	content, _ := c.GetFileInfoFromLevelDB(ref.Md5)
+	if c.hasOwnPath(ref, content) && !ref.Ref {
+		// the hardlink of the sender is made again here
+		ref.Ref = true
+		if content != nil && c.CheckFileExistByInfo(content.Md5, content) {
+			c.linkFileRef(content, ref)
+		}
+	}
+	return c.SaveFileRef(ref)
+}
+
+func (c *Server) SyncFileRef(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		ref    FileInfo
+		result JsonResult
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		w.Write([]byte(c.GetClusterNotPermitMessage(r)))
+		return
+	}
+	if err = json.Unmarshal([]byte(r.FormValue("fileInfo")), &ref); err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if err = c.applyFileRef(&ref); err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+// ReleaseFileRef drops the reference refId to the content of fileInfo, or
+// when refId is empty one of the references at the path of fileInfo. It
+// returns the dropped ref_id and whether that was the last reference, the
+// content itself is then left to the caller to delete. When the path the
+// content is stored at is released, the content moves to the path of a
+// remaining reference, or stays where it is without a path when it is merged
+// or erasure coded.
+func (c *Server) ReleaseFileRef(fileInfo *FileInfo, refId string) (string, bool) {
+	var (
+		err     error
+		content *FileInfo
+		ref     *FileInfo
+		refs    []*FileInfo
+		rest    []*FileInfo
+		fpath   string
+	)
+	if content, err = c.GetFileInfoFromLevelDB(fileInfo.Md5); err != nil {
+		content = fileInfo
+	}
+	if refs = c.GetFileRefs(fileInfo.Md5); len(refs) == 0 {
+		// stored before references were kept
+		return refId, true
+	}
+	fpath = c.GetFilePathByInfo(fileInfo, false)
+	for _, v := range refs {
+		if refId != "" {
+			if v.RefId == refId {
+				ref = v
+			}
+			continue
+		}
+		// the own reference of the content goes last
+		if c.GetFilePathByInfo(v, false) == fpath && (ref == nil || ref.RefId == content.RefId) {
+			ref = v
+		}
+	}
+	if ref == nil {
+		return "", false
+	}
+	if err = c.RemoveKeyFromLevelDB(c.fileRefKey(ref.Md5, ref.RefId), c.ldb); err != nil {
+		log.Error(err)
+	}
+	for _, v := range refs {
+		if v != ref {
+			rest = append(rest, v)
+		}
+	}
+	if c.hasOwnPath(ref, content) {
+		fpath = c.GetFilePathByInfo(ref, false)
+		c.RemoveKeyFromLevelDB(c.util.MD5(fpath), c.ldb)
+		c.RemoveS3ObjectIndex(ref)
+		c.UnindexFile(fpath)
+		if !ref.Ref {
+			c.storage.Delete(fpath)
+		}
+		return ref.RefId, len(rest) == 0
+	}
+	if len(rest) == 0 {
+		return ref.RefId, true
+	}
+	for _, v := range rest {
+		if !c.hasOwnPath(v, content) {
+			return ref.RefId, false
+		}
+	}
+	if content.OffSet < 0 && content.Shards == nil {
+		// the trash only holds the content when nothing else does
+		next := rest[0]
+		for _, v := range rest {
+			if !c.IsTrashRef(v) {
+				next = v
+				break
+			}
+		}
+		c.promoteFileRef(content, next)
+	} else {
+		// merged or erasure coded content cannot move, only its path goes
+		cpath := c.GetFilePathByInfo(content, false)
+		c.RemoveKeyFromLevelDB(c.util.MD5(cpath), c.ldb)
+		c.RemoveS3ObjectIndex(content)
+		c.UnindexFile(cpath)
+	}
+	return ref.RefId, false
+}
+
+// promoteFileRef moves content to the path of ref, whose reference becomes
+// the one of the content.
+func (c *Server) promoteFileRef(content *FileInfo, ref *FileInfo) {
+	var (
+		err error
+	)
+	cpath := c.GetFilePathByInfo(content, false)
+	rpath := c.GetFilePathByInfo(ref, false)
+	if ref.Ref {
+		err = c.storage.Rename(cpath, rpath)
+	} else {
+		err = c.storage.Delete(cpath)
+	}
+	if err != nil && c.StorageFileExists(cpath) {
+		log.Error(err)
+		return
+	}
+	info := *content
+	info.Name = ref.Name
+	info.ReName = ref.ReName
+	info.Path = ref.Path
+	info.Scene = ref.Scene
+	info.RefId = ref.RefId
+	info.Version = ref.Version
+	info.Meta = ref.Meta
+	info.Ref = false
+	c.RemoveKeyFromLevelDB(c.util.MD5(cpath), c.ldb)
+	c.RemoveS3ObjectIndex(content)
+	c.UnindexFile(cpath)
+	c.saveFileMd5Log(&info, CONST_FILE_Md5_FILE_NAME)
+	log.Info(fmt.Sprintf("file %s moved from %s to %s", content.Md5, cpath, rpath))
+}
+
+// DownloadRefFileByURI serves a path that only references its content.
+func (c *Server) DownloadRefFileByURI(w http.ResponseWriter, r *http.Request) (bool, error) {
+	var (
+		err      error
+		fullpath string
+		ref      *FileInfo
+		content  *FileInfo
+	)
+	fullpath, _ = c.GetFilePathFromRequest(w, r)
+	if ref, err = c.GetFileInfoFromLevelDB(c.util.MD5(c.GetStoragePath(fullpath))); err != nil {
+		return false, err
+	}
+	if !ref.Ref {
+		return false, errors.New("not a reference")
+	}
+	if content, err = c.GetFileInfoFromLevelDB(ref.Md5); err != nil {
+		return false, err
+	}
+	if !c.IsRawRequest(r) && (r.FormValue("download") == "1" || (r.FormValue("download") == "" && Config().DefaultDownload)) {
+		c.SetDownloadHeader(w, r)
+	}
+	return c.ServeFileByInfo(w, r, content, ref.Name, time.Unix(ref.TimeStamp, 0))
+}
+
+// ServeFileByInfo serves the content described by fileInfo, wherever and
+// however it is stored.
+func (c *Server) ServeFileByInfo(w http.ResponseWriter, r *http.Request, fileInfo *FileInfo, name string, modTime time.Time) (bool, error) {
+	var (
+		err    error
+		file   StorageFile
+		data   []byte
+		reader *erasureReader
+	)
+	if fileInfo.Shards != nil {
+		if reader, err = c.NewErasureReader(fileInfo); err != nil {
+			return false, err
+		}
+		defer reader.Close()
+		c.ServeFileContent(w, r, fileInfo, name, modTime, reader)
+		return true, nil
+	}
+	if fileInfo.OffSet >= 0 {
+		body, err := c.GetFileReaderByInfo(fileInfo)
+		if err != nil {
+			return false, err
+		}
+		defer body.Close()
+		if data, err = ioutil.ReadAll(body); err != nil {
+			return false, err
+		}
+		http.ServeContent(w, r, name, modTime, bytes.NewReader(data))
+		return true, nil
+	}
+	if file, err = c.storage.Get(c.GetFilePathByInfo(fileInfo, false)); err != nil {
+		return false, err
+	}
+	defer file.Close()
+	c.ServeFileContent(w, r, fileInfo, name, modTime, file)
+	return true, nil
+}
+
+// MigrateFileRefs gives the files stored before references were kept the
+// reference of their path, and deduped S3 keys a reference of their own. It
+// runs once and is marked done in leveldb.
+func (c *Server) MigrateFileRefs() {
+	var (
+		err   error
+		count int
+		data  []byte
+	)
+	if ok, _ := c.IsExistFromLevelDB(CONST_FILE_REF_VERSION_KEY, c.ldb); ok {
+		return
+	}
+	iter := c.ldb.NewIterator(nil, nil)
+	for iter.Next() {
+		var fileInfo FileInfo
+		if len(iter.Key()) != 32 {
+			continue
+		}
+		if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil || fileInfo.Md5 == "" || fileInfo.RefId != "" {
+			continue
+		}
+		fileInfo.RefId = c.newRefId(&fileInfo)
+		if data, err = json.Marshal(&fileInfo); err != nil {
+			continue
+		}
+		if err = c.ldb.Put(iter.Key(), data, nil); err != nil {
+			log.Error(err)
+			continue
+		}
+		if string(iter.Key()) == fileInfo.Md5 {
+			if err = c.AddFileRef(&fileInfo); err != nil {
+				log.Error(err)
+				continue
+			}
+			count++
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		log.Error(err)
+		return
+	}
+	// deduped S3 keys only had an index entry pointing at the content
+	iter = c.ldb.NewIterator(util.BytesPrefix([]byte(CONST_S3_OBJECT_KEY_PREFIX)), nil)
+	for iter.Next() {
+		var fileInfo FileInfo
+		parts := strings.SplitN(string(iter.Key()[len(CONST_S3_OBJECT_KEY_PREFIX):]), "/", 2)
+		if len(parts) != 2 || json.Unmarshal(iter.Value(), &fileInfo) != nil || fileInfo.Ref {
+			continue
+		}
+		target := &FileInfo{Name: path.Base(parts[1]), Path: path.Dir(STORE_DIR_NAME + "/" + parts[0] + "/" + parts[1]), Scene: parts[0]}
+		if c.GetFilePathByInfo(target, false) == c.GetFilePathByInfo(&fileInfo, false) {
+			continue
+		}
+		ref := c.NewFileRef(&fileInfo, target)
+		ref.TimeStamp = fileInfo.TimeStamp
+		if err = c.SaveFileRef(ref); err != nil {
+			log.Error(err)
+			continue
+		}
+		count++
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		log.Error(err)
+		return
+	}
+	c.ldb.Put([]byte(CONST_FILE_REF_VERSION_KEY), []byte("1"), nil)
+	log.Info(fmt.Sprintf("MigrateFileRefs %d files", count))
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFileRefs(t *testing.T) {
+	var (
+		err     error
+		refId   string
+		last    bool
+		content *FileInfo
+	)
+	cfg := &GlobalConfig{EnableDistinctFile: true}
+	c := newTestServer(t, "http://10.0.0.1:8080", cfg)
+	dir := STORE_DIR_NAME + "/default"
+	md5sum := c.util.MD5("a")
+	c.storage.Put(dir+"/a.txt", strings.NewReader("a"))
+	c.saveFileMd5Log(&FileInfo{Name: "a.txt", Path: dir, Md5: md5sum, Size: 1, OffSet: -1}, CONST_FILE_Md5_FILE_NAME)
+	// the same bytes uploaded twice more, sharing the url and at a path of its own
+	content, _ = c.GetFileInfoFromLevelDB(md5sum)
+	shared := c.AddDedupRef(content, &FileInfo{Name: "b.txt", Path: dir, Md5: md5sum})
+	cfg.DistinctLink = CONST_DISTINCT_LINK_REF
+	c.storage.Put(dir+"/c.txt", strings.NewReader("a"))
+	c.AddDedupRef(content, &FileInfo{Name: "c.txt", Path: dir, Md5: md5sum})
+	if refs := c.GetFileRefs(md5sum); len(refs) != 3 {
+		t.Fatal("refs", len(refs))
+	}
+	if ref, err := c.GetFileInfoFromLevelDB(c.util.MD5(dir + "/c.txt")); err != nil || !ref.Ref || c.StorageFileExists(dir+"/c.txt") {
+		t.Fatal("distinct path", ref, err)
+	}
+	// deleting the url twice drops the shared reference first, then moves
+	// the content to the path still referenced
+	if refId, last = c.ReleaseFileRef(content, ""); refId != shared.RefId || last {
+		t.Fatal("shared ref", refId, last)
+	}
+	if refId, last = c.ReleaseFileRef(content, ""); refId != content.RefId || last {
+		t.Fatal("own ref", refId, last)
+	}
+	if content, err = c.GetFileInfoFromLevelDB(md5sum); err != nil || content.Name != "c.txt" || content.Ref {
+		t.Fatal("content not moved", content, err)
+	}
+	if !c.StorageFileExists(dir+"/c.txt") || c.StorageFileExists(dir+"/a.txt") {
+		t.Error("file not moved")
+	}
+	if _, err = c.GetFileInfoFromLevelDB(c.util.MD5(dir + "/a.txt")); err == nil {
+		t.Error("released path still known")
+	}
+	// an S3 key with the same bytes references the content too
+	if info, _, err := c.SaveS3Object("default", "s3.txt", strings.NewReader("a"), "", nil); err != nil || !info.Ref {
+		t.Fatal("s3 dedup", info, err)
+	}
+	if _, last = c.ReleaseFileRef(content, ""); last {
+		t.Error("content of the S3 key deleted")
+	}
+	if info, err := c.GetS3Object("default", "s3.txt"); err != nil || c.GetFilePathByInfo(info, false) != dir+"/s3.txt" {
+		t.Fatal("s3 object", info, err)
+	} else if etag := c.s3ETag(info); etag != "\""+c.util.MD5("a")+"\"" {
+		t.Error("etag of the content", etag)
+	} else if info.Md5 = c.util.MD5(dir + "/s3.txt"); strings.HasPrefix(c.s3ETag(info), "\""+info.Md5) || !strings.HasSuffix(c.s3ETag(info), "-1\"") {
+		t.Error("md5 of the path as etag", c.s3ETag(info))
+	}
+	if err = c.DeleteS3Object("default", "s3.txt"); err != nil || c.StorageFileExists(dir+"/s3.txt") {
+		t.Error("delete s3 object", err)
+	}
+	if _, err = c.GetFileInfoFromLevelDB(md5sum); err == nil {
+		t.Error("content kept after its last reference")
+	}
+	// files stored before references were kept
+	legacy := &FileInfo{Name: "d.txt", Path: dir, Md5: c.util.MD5("d"), OffSet: -1}
+	c.SaveFileInfoToLevelDB(legacy.Md5, legacy, c.ldb)
+	c.MigrateFileRefs()
+	if refs := c.GetFileRefs(legacy.Md5); len(refs) != 1 || refs[0].RefId != c.util.MD5(dir+"/d.txt") {
+		t.Error("migrate", refs)
+	}
+	if ok, _ := c.IsExistFromLevelDB(CONST_FILE_REF_VERSION_KEY, c.ldb); !ok {
+		t.Error("migration not marked done")
+	}
+}
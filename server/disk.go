@@ -0,0 +1,455 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	log "github.com/sjqzhang/seelog"
+)
+
+// StoreDisk is one of store_dirs, it holds the part of files/ placed on it.
+type StoreDisk struct {
+	Dir     string
+	storage *LocalStorage
+	offline int32
+}
+
+func (d *StoreDisk) Online() bool {
+	return atomic.LoadInt32(&d.offline) == 0
+}
+
+// DiskStatus is the usage of a store directory as reported by /status.
+type DiskStatus struct {
+	Dir         string  `json:"dir"`
+	Online      bool    `json:"online"`
+	Total       uint64  `json:"total"`
+	Free        uint64  `json:"free"`
+	Used        uint64  `json:"used"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+var ErrNoDiskOnline = errors.New("no store dir online")
+
+// DiskStorage spreads files/ over several directories, usually one per disk.
+// A new file is put on the online disk with the most free space and stays
+// there, an existing one is found through Resolve, which returns the disk the
+// metadata records, or by looking at every online disk. Paths outside files/
+// are kept under the root of LocalStorage.
+type DiskStorage struct {
+	*LocalStorage
+	Disks   []*StoreDisk
+	Resolve func(fpath string) string
+}
+
+func NewDiskStorage(root string, dirs []string) *DiskStorage {
+	s := &DiskStorage{LocalStorage: NewLocalStorage(root)}
+	for _, dir := range dirs {
+		dir = strings.TrimSuffix(dir, "/")
+		if !filepath.IsAbs(dir) {
+			dir = root + dir
+		}
+		os.MkdirAll(dir, 0775)
+		s.Disks = append(s.Disks, &StoreDisk{Dir: dir, storage: NewLocalStorage(dir + "/")})
+	}
+	return s
+}
+
+// storePath returns the path of fpath inside a store directory, false when
+// fpath is not under files/.
+func (s *DiskStorage) storePath(fpath string) (string, bool) {
+	if fpath == STORE_DIR_NAME {
+		return "", true
+	}
+	if strings.HasPrefix(fpath, STORE_DIR_NAME+"/") {
+		return fpath[len(STORE_DIR_NAME)+1:], true
+	}
+	return "", false
+}
+
+// Locate returns the online disk holding fpath, nil when there is none.
+func (s *DiskStorage) Locate(fpath string) *StoreDisk {
+	var (
+		hint string
+	)
+	rel, ok := s.storePath(fpath)
+	if !ok {
+		return nil
+	}
+	if s.Resolve != nil {
+		hint = s.Resolve(fpath)
+	}
+	for _, d := range s.Disks {
+		if d.Dir == hint && d.Online() {
+			if _, err := d.storage.Stat(rel); err == nil {
+				return d
+			}
+		}
+	}
+	for _, d := range s.Disks {
+		if d.Dir != hint && d.Online() {
+			if _, err := d.storage.Stat(rel); err == nil {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+// Pick returns the online disk with the most free space.
+func (s *DiskStorage) Pick() (*StoreDisk, error) {
+	var (
+		best *StoreDisk
+		free uint64
+	)
+	for _, d := range s.Disks {
+		if !d.Online() {
+			continue
+		}
+		usage, err := disk.Usage(d.Dir)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if best == nil || usage.Free > free {
+			best, free = d, usage.Free
+		}
+	}
+	if best == nil {
+		return nil, ErrNoDiskOnline
+	}
+	return best, nil
+}
+
+// target returns the disk fpath is written to, the one already holding it or
+// the one picked for a new file.
+func (s *DiskStorage) target(fpath string) (*StoreDisk, error) {
+	if d := s.Locate(fpath); d != nil {
+		return d, nil
+	}
+	return s.Pick()
+}
+
+func (s *DiskStorage) Put(fpath string, reader io.Reader) (int64, error) {
+	rel, ok := s.storePath(fpath)
+	if !ok {
+		return s.LocalStorage.Put(fpath, reader)
+	}
+	d, err := s.target(fpath)
+	if err != nil {
+		return 0, err
+	}
+	return d.storage.Put(rel, reader)
+}
+
+func (s *DiskStorage) Append(fpath string, reader io.Reader) (int64, int64, error) {
+	rel, ok := s.storePath(fpath)
+	if !ok {
+		return s.LocalStorage.Append(fpath, reader)
+	}
+	d, err := s.target(fpath)
+	if err != nil {
+		return -1, 0, err
+	}
+	return d.storage.Append(rel, reader)
+}
+
+func (s *DiskStorage) WriteAt(fpath string, offset int64, data []byte) error {
+	rel, ok := s.storePath(fpath)
+	if !ok {
+		return s.LocalStorage.WriteAt(fpath, offset, data)
+	}
+	d, err := s.target(fpath)
+	if err != nil {
+		return err
+	}
+	return d.storage.WriteAt(rel, offset, data)
+}
+
+func (s *DiskStorage) Get(fpath string) (StorageFile, error) {
+	rel, ok := s.storePath(fpath)
+	if !ok {
+		return s.LocalStorage.Get(fpath)
+	}
+	if d := s.Locate(fpath); d != nil {
+		return d.storage.Get(rel)
+	}
+	return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrNotExist}
+}
+
+func (s *DiskStorage) Range(fpath string, offset int64, length int64) ([]byte, error) {
+	rel, ok := s.storePath(fpath)
+	if !ok {
+		return s.LocalStorage.Range(fpath, offset, length)
+	}
+	if d := s.Locate(fpath); d != nil {
+		return d.storage.Range(rel, offset, length)
+	}
+	return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrNotExist}
+}
+
+func (s *DiskStorage) Stat(fpath string) (os.FileInfo, error) {
+	rel, ok := s.storePath(fpath)
+	if !ok {
+		return s.LocalStorage.Stat(fpath)
+	}
+	if d := s.Locate(fpath); d != nil {
+		return d.storage.Stat(rel)
+	}
+	return nil, &os.PathError{Op: "stat", Path: fpath, Err: os.ErrNotExist}
+}
+
+// Rename keeps a file of files/ on the disk it is on, so it never copies data.
+func (s *DiskStorage) Rename(src string, dst string) error {
+	srcRel, ok := s.storePath(src)
+	dstRel, ok2 := s.storePath(dst)
+	if !ok && !ok2 {
+		return s.LocalStorage.Rename(src, dst)
+	}
+	if !ok || !ok2 {
+		return s.copyFile(src, dst)
+	}
+	d := s.Locate(src)
+	if d == nil {
+		return &os.PathError{Op: "rename", Path: src, Err: os.ErrNotExist}
+	}
+	for _, v := range s.Disks {
+		// an older copy on another disk would shadow the renamed file
+		if v != d && v.Online() {
+			v.storage.Delete(dstRel)
+		}
+	}
+	return d.storage.Rename(srcRel, dstRel)
+}
+
+// Link hardlinks dst to src on the disk holding src.
+func (s *DiskStorage) Link(src string, dst string) error {
+	srcRel, ok := s.storePath(src)
+	dstRel, ok2 := s.storePath(dst)
+	if !ok && !ok2 {
+		return s.LocalStorage.Link(src, dst)
+	}
+	d := s.Locate(src)
+	if !ok || !ok2 || d == nil {
+		return &os.LinkError{Op: "link", Old: src, New: dst, Err: os.ErrNotExist}
+	}
+	return d.storage.Link(srcRel, dstRel)
+}
+
+// copyFile moves a file in or out of files/, which may be on another device.
+func (s *DiskStorage) copyFile(src string, dst string) error {
+	file, err := s.Get(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = s.Put(dst, file); err != nil {
+		s.Delete(dst)
+		return err
+	}
+	file.Close()
+	return s.Delete(src)
+}
+
+func (s *DiskStorage) Delete(fpath string) error {
+	rel, ok := s.storePath(fpath)
+	if !ok {
+		return s.LocalStorage.Delete(fpath)
+	}
+	err := error(&os.PathError{Op: "remove", Path: fpath, Err: os.ErrNotExist})
+	for _, d := range s.Disks {
+		if !d.Online() {
+			continue
+		}
+		if e := d.storage.Delete(rel); e == nil || !os.IsNotExist(e) {
+			err = e
+		}
+	}
+	return err
+}
+
+// List merges the directory of every online disk.
+func (s *DiskStorage) List(dir string) ([]os.FileInfo, error) {
+	var (
+		found bool
+		fis   []os.FileInfo
+	)
+	err := ErrNoDiskOnline
+	rel, ok := s.storePath(dir)
+	if !ok {
+		return s.LocalStorage.List(dir)
+	}
+	names := make(map[string]bool)
+	for _, d := range s.Disks {
+		if !d.Online() {
+			continue
+		}
+		list, e := d.storage.List(rel)
+		if e != nil {
+			err = e
+			continue
+		}
+		found = true
+		for _, fi := range list {
+			if !names[fi.Name()] {
+				names[fi.Name()] = true
+				fis = append(fis, fi)
+			}
+		}
+	}
+	if !found {
+		return nil, err
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+// CheckDisks probes every disk with a small write and returns the disks that
+// just went offline. A disk that answers again is put back online.
+func (s *DiskStorage) CheckDisks() []*StoreDisk {
+	var (
+		failed []*StoreDisk
+	)
+	for _, d := range s.Disks {
+		probe := d.Dir + "/.probe"
+		err := ioutil.WriteFile(probe, []byte(time.Now().String()), 0664)
+		if err == nil {
+			err = os.Remove(probe)
+		}
+		if err != nil {
+			if atomic.CompareAndSwapInt32(&d.offline, 0, 1) {
+				log.Error(fmt.Sprintf("store dir %s offline: %v", d.Dir, err))
+				failed = append(failed, d)
+			}
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&d.offline, 1, 0) {
+			log.Warn(fmt.Sprintf("store dir %s online", d.Dir))
+		}
+	}
+	return failed
+}
+
+// GetStoreRoots returns the directories holding files/ on this node, the
+// online store_dirs or STORE_DIR with its symlink resolved.
+func (c *Server) GetStoreRoots() []string {
+	var (
+		roots []string
+	)
+	if s, ok := c.storage.(*DiskStorage); ok {
+		for _, d := range s.Disks {
+			if d.Online() {
+				roots = append(roots, d.Dir)
+			}
+		}
+		return roots
+	}
+	if dir, err := filepath.EvalSymlinks(STORE_DIR); err == nil {
+		return []string{dir}
+	}
+	return []string{STORE_DIR}
+}
+
+// GetStoreRelPath converts the path of a file found under root into a
+// Storage path.
+func (c *Server) GetStoreRelPath(root string, fpath string) string {
+	fpath = STORE_DIR_NAME + strings.TrimPrefix(fpath, root)
+	return strings.Replace(fpath, string(os.PathSeparator), "/", -1)
+}
+
+// GetFileDisk returns the store directory holding the content of fileInfo,
+// "" when the node has a single one.
+func (c *Server) GetFileDisk(fileInfo *FileInfo) string {
+	var (
+		fpath string
+	)
+	s, ok := c.storage.(*DiskStorage)
+	if !ok || fileInfo.Shards != nil {
+		return ""
+	}
+	fpath = c.GetFilePathByInfo(fileInfo, false)
+	if fileInfo.OffSet >= 0 {
+		fpath = c.GetSmallFileVolume(fileInfo)
+	}
+	if d := s.Locate(fpath); d != nil {
+		return d.Dir
+	}
+	return ""
+}
+
+func (c *Server) resolveDisk(fpath string) string {
+	if fileInfo, err := c.GetFileInfoFromLevelDB(c.util.MD5(fpath)); err == nil {
+		return fileInfo.Disk
+	}
+	return ""
+}
+
+func (c *Server) GetDiskStatus() []DiskStatus {
+	var (
+		disks  []*StoreDisk
+		result []DiskStatus
+	)
+	if s, ok := c.storage.(*DiskStorage); ok {
+		disks = s.Disks
+	} else {
+		disks = []*StoreDisk{{Dir: STORE_DIR}}
+	}
+	for _, d := range disks {
+		status := DiskStatus{Dir: d.Dir, Online: d.Online()}
+		if usage, err := disk.Usage(d.Dir); err == nil {
+			status.Total = usage.Total
+			status.Free = usage.Free
+			status.Used = usage.Used
+			status.UsedPercent = usage.UsedPercent
+		} else {
+			status.Online = false
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// WatchStoreDisks probes the store_dirs and fetches the files of a disk that
+// went offline back from the peers, onto the disks still online. It also
+// keeps the free space watermark state.
+func (c *Server) WatchStoreDisks() {
+	for {
+		if s, ok := c.storage.(*DiskStorage); ok {
+			for _, d := range s.CheckDisks() {
+				go c.RefetchDiskFiles(d.Dir)
+			}
+		}
+		c.CheckDiskWatermark()
+		time.Sleep(time.Second * CONST_DISK_CHECK_INTERVAL)
+	}
+}
+
+func (c *Server) RefetchDiskFiles(dir string) {
+	var (
+		count int
+	)
+	iter := c.ldb.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		var fileInfo FileInfo
+		if err := json.Unmarshal(iter.Value(), &fileInfo); err != nil {
+			continue
+		}
+		// every file is also indexed by its path, queue it once
+		if fileInfo.Disk != dir || string(iter.Key()) != fileInfo.Md5 {
+			continue
+		}
+		fileInfo.Peers = c.GetHolderPeers(&fileInfo)
+		c.AppendToDownloadQueue(&fileInfo)
+		count++
+	}
+	log.Warn(fmt.Sprintf("store dir %s offline, %d files queued to fetch from peers", dir, count))
+}
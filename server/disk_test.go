@@ -0,0 +1,102 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDiskStorage(t *testing.T) {
+	var (
+		err  error
+		data []byte
+		fis  []os.FileInfo
+	)
+	root := t.TempDir() + "/"
+	s := NewDiskStorage(root, []string{"disk1", root + "disk2"})
+	if s.Disks[0].Dir != root+"disk1" || s.Disks[1].Dir != root+"disk2" {
+		t.Fatal(s.Disks[0].Dir, s.Disks[1].Dir)
+	}
+	d1, d2 := s.Disks[0].storage, s.Disks[1].storage
+	// files already on a disk are found wherever they are
+	d2.Put("default/a.txt", strings.NewReader("a"))
+	d1.Put("default/b.txt", strings.NewReader("b"))
+	if _, err = s.Put("files/default/a.txt", strings.NewReader("aa")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d2.Stat("default/a.txt"); err != nil || s.Locate("files/default/a.txt") != s.Disks[1] {
+		t.Error("existing file not replaced in place", err)
+	}
+	if err = s.Rename("files/default/a.txt", "files/default/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d2.Stat("default/c.txt"); err != nil {
+		t.Error("file moved to another disk", err)
+	}
+	if fis, err = s.List("files/default"); err != nil || len(fis) != 2 || fis[0].Name() != "b.txt" || fis[1].Name() != "c.txt" {
+		t.Error("list", fis, err)
+	}
+	// the metadata names the disk to look at first
+	d1.Put("default/c.txt", strings.NewReader("old"))
+	s.Resolve = func(fpath string) string { return root + "disk2" }
+	if file, err := s.Get("files/default/c.txt"); err != nil {
+		t.Fatal(err)
+	} else if data, _ = ioutil.ReadAll(file); string(data) != "aa" {
+		t.Error("resolve", string(data))
+	} else {
+		file.Close()
+	}
+	// paths outside files/ stay under the root
+	if _, err = s.Put("data/x", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(root + "data/x"); err != nil {
+		t.Error("data path", err)
+	}
+	if failed := s.CheckDisks(); len(failed) != 0 {
+		t.Fatal("healthy disk offline", failed)
+	}
+	os.RemoveAll(root + "disk2")
+	if failed := s.CheckDisks(); len(failed) != 1 || failed[0] != s.Disks[1] || s.Disks[1].Online() {
+		t.Fatal("failed disk not offline")
+	}
+	if _, err = s.Put("files/default/d.txt", strings.NewReader("d")); err != nil || s.Locate("files/default/d.txt") != s.Disks[0] {
+		t.Error("new file on offline disk", err)
+	}
+	os.MkdirAll(root+"disk2", 0775)
+	if s.CheckDisks(); !s.Disks[1].Online() {
+		t.Error("disk not back online")
+	}
+	s.Disks[0].offline, s.Disks[1].offline = 1, 1
+	if _, err = s.Put("files/default/e.txt", strings.NewReader("e")); err != ErrNoDiskOnline {
+		t.Error("put without disks", err)
+	}
+}
+
+func TestStorageFS(t *testing.T) {
+	root := t.TempDir() + "/"
+	c := newTestServer(t, "http://10.0.0.1:8080", nil)
+	c.SetStorage(NewDiskStorage(root, []string{"disk1", "disk2"}))
+	c.storage.(*DiskStorage).Disks[0].storage.Put("default/a.txt", strings.NewReader("a"))
+	c.storage.(*DiskStorage).Disks[1].storage.Put("default/b.txt", strings.NewReader("b"))
+	handler := http.StripPrefix("/group1/", http.FileServer(NewStorageFS(c)))
+	// the listing covers every disk
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/group1/default/", nil))
+	if body := w.Body.String(); !strings.Contains(body, "a.txt") || !strings.Contains(body, "b.txt") {
+		t.Error("listing", w.Code, body)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/group1/default/b.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "b" {
+		t.Error("file on the second disk", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/group1/default/c.txt", nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("missing file", w.Code)
+	}
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// An encrypted file is a header naming its key followed by AES-GCM sealed
+// chunks of CONST_ENCRYPT_CHUNK_SIZE bytes, so any range is read by opening
+// the chunks it spans:
+//
+//	magic(4) key_id_len(1) key_id [nonce(12) sealed_chunk tag(16)]...
+//
+// The additional data of a chunk is its index and whether it is the last
+// one, chunks can neither be reordered nor the file cut at a chunk boundary.
+
+// KeyRing holds the keys of encrypt_key_file. Scenes maps a scene to the id
+// of the key its new files are encrypted with. A key is rotated by adding a
+// new one and pointing the scene at it, the files written before keep the id
+// of their key and stay readable as long as that key is kept.
+type KeyRing struct {
+	Keys   map[string]string `json:"keys"`
+	Scenes map[string]string `json:"scenes"`
+	aeads  map[string]cipher.AEAD
+}
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+func LoadKeyRing(fpath string) (*KeyRing, error) {
+	var (
+		err   error
+		data  []byte
+		key   []byte
+		ring  KeyRing
+		block cipher.Block
+	)
+	if data, err = ioutil.ReadFile(fpath); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &ring); err != nil {
+		return nil, err
+	}
+	ring.aeads = make(map[string]cipher.AEAD)
+	for id, v := range ring.Keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if key, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		if block, err = aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		if ring.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	for scene, id := range ring.Scenes {
+		if _, ok := ring.aeads[id]; !ok {
+			return nil, fmt.Errorf("key %s of scene %s not found", id, scene)
+		}
+	}
+	return &ring, nil
+}
+
+// LoadKeyRing reads encrypt_key_file, a broken keyfile keeps the keys
+// loaded before.
+func (c *Server) LoadKeyRing() error {
+	var (
+		err  error
+		ring *KeyRing
+	)
+	if Config().EncryptKeyFile == "" {
+		c.keyRing.Store(&KeyRing{})
+		return nil
+	}
+	if ring, err = LoadKeyRing(Config().EncryptKeyFile); err != nil {
+		return err
+	}
+	c.keyRing.Store(ring)
+	return nil
+}
+
+func (c *Server) getKeyRing() *KeyRing {
+	if ring, ok := c.keyRing.Load().(*KeyRing); ok {
+		return ring
+	}
+	return &KeyRing{}
+}
+
+// GetSceneKeyId returns the key new files of scene are encrypted with, ""
+// when the scene is not encrypted.
+func (c *Server) GetSceneKeyId(scene string) string {
+	return c.getKeyRing().Scenes[scene]
+}
+
+func (c *Server) getAEAD(keyId string) (cipher.AEAD, error) {
+	if aead, ok := c.getKeyRing().aeads[keyId]; ok {
+		return aead, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func encryptAdditionalData(index int64, last bool) []byte {
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint64(data, uint64(index))
+	if last {
+		data[8] = 1
+	}
+	return data
+}
+
+func encryptStream(keyId string, aead cipher.AEAD, reader io.Reader, writer io.Writer) error {
+	var (
+		err   error
+		n     int
+		m     int
+		last  bool
+		index int64
+	)
+	header := append([]byte(CONST_ENCRYPT_MAGIC), byte(len(keyId)))
+	if _, err = writer.Write(append(header, keyId...)); err != nil {
+		return err
+	}
+	cur := make([]byte, CONST_ENCRYPT_CHUNK_SIZE)
+	next := make([]byte, CONST_ENCRYPT_CHUNK_SIZE)
+	sealed := make([]byte, 0, CONST_ENCRYPT_CHUNK_SIZE+CONST_ENCRYPT_OVERHEAD)
+	if n, err = io.ReadFull(reader, cur); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	for index = 0; ; index++ {
+		// read ahead to know whether cur is the last chunk
+		if last = n < len(cur); !last {
+			if m, err = io.ReadFull(reader, next); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			last = m == 0
+		}
+		sealed = sealed[:12]
+		if _, err = io.ReadFull(rand.Reader, sealed); err != nil {
+			return err
+		}
+		sealed = aead.Seal(sealed, sealed[:12], cur[:n], encryptAdditionalData(index, last))
+		if _, err = writer.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		cur, next, n = next, cur, m
+	}
+}
+
+// EncryptReader returns reader encrypted with keyId, it is produced while the
+// result is read. Closing the result stops the encryption.
+func (c *Server) EncryptReader(keyId string, reader io.Reader) (io.ReadCloser, error) {
+	aead, err := c.getAEAD(keyId)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encryptStream(keyId, aead, reader, pw))
+	}()
+	return pr, nil
+}
+
+func (c *Server) EncryptBytes(keyId string, data []byte) ([]byte, error) {
+	aead, err := c.getAEAD(keyId)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err = encryptStream(keyId, aead, bytes.NewReader(data), buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Server) DecryptBytes(data []byte) ([]byte, error) {
+	reader, err := c.NewDecryptReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// ParseEncryptHeader returns the key id of encrypted data and the size of the
+// content it holds.
+func ParseEncryptHeader(data []byte, size int64) (string, int64, error) {
+	pos := len(CONST_ENCRYPT_MAGIC)
+	if len(data) < pos+1 || string(data[:pos]) != CONST_ENCRYPT_MAGIC || len(data) < pos+1+int(data[pos]) {
+		return "", 0, errors.New("not encrypted")
+	}
+	header := int64(pos + 1 + int(data[pos]))
+	chunks := (size - header + CONST_ENCRYPT_CHUNK_SIZE + CONST_ENCRYPT_OVERHEAD - 1) / (CONST_ENCRYPT_CHUNK_SIZE + CONST_ENCRYPT_OVERHEAD)
+	if chunks <= 0 || size-header-chunks*CONST_ENCRYPT_OVERHEAD < 0 {
+		return "", 0, errors.New("invalid encrypted size")
+	}
+	return string(data[pos+1 : header]), size - header - chunks*CONST_ENCRYPT_OVERHEAD, nil
+}
+
+// decryptReader decrypts the chunks of an encrypted file as they are read.
+type decryptReader struct {
+	src    io.ReadSeeker
+	aead   cipher.AEAD
+	header int64
+	stored int64
+	size   int64
+	chunks int64
+	offset int64
+	index  int64
+	data   []byte
+	buf    []byte
+}
+
+func (c *Server) NewDecryptReader(src io.ReadSeeker) (*decryptReader, error) {
+	var (
+		err    error
+		keyId  string
+		header []byte
+		reader *decryptReader
+	)
+	reader = &decryptReader{src: src, index: -1}
+	if reader.stored, err = src.Seek(0, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	if _, err = src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header = make([]byte, len(CONST_ENCRYPT_MAGIC)+256)
+	if reader.stored < int64(len(header)) {
+		header = header[:reader.stored]
+	}
+	if _, err = io.ReadFull(src, header); err != nil {
+		return nil, err
+	}
+	if keyId, reader.size, err = ParseEncryptHeader(header, reader.stored); err != nil {
+		return nil, err
+	}
+	if reader.aead, err = c.getAEAD(keyId); err != nil {
+		return nil, fmt.Errorf("%v %s", err, keyId)
+	}
+	reader.header = int64(len(CONST_ENCRYPT_MAGIC) + 1 + len(keyId))
+	reader.chunks = (reader.stored - reader.header + CONST_ENCRYPT_CHUNK_SIZE + CONST_ENCRYPT_OVERHEAD - 1) / (CONST_ENCRYPT_CHUNK_SIZE + CONST_ENCRYPT_OVERHEAD)
+	reader.buf = make([]byte, CONST_ENCRYPT_CHUNK_SIZE+CONST_ENCRYPT_OVERHEAD)
+	return reader, nil
+}
+
+func (r *decryptReader) loadChunk(index int64) error {
+	var (
+		err    error
+		start  int64
+		length int64
+	)
+	start = r.header + index*(CONST_ENCRYPT_CHUNK_SIZE+CONST_ENCRYPT_OVERHEAD)
+	length = CONST_ENCRYPT_CHUNK_SIZE + CONST_ENCRYPT_OVERHEAD
+	if start+length > r.stored {
+		length = r.stored - start
+	}
+	if _, err = r.src.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(r.src, r.buf[:length]); err != nil {
+		return err
+	}
+	if r.data, err = r.aead.Open(r.data[:0], r.buf[:12], r.buf[12:length], encryptAdditionalData(index, index == r.chunks-1)); err != nil {
+		r.index = -1
+		return err
+	}
+	r.index = index
+	return nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	index := r.offset / CONST_ENCRYPT_CHUNK_SIZE
+	if index != r.index {
+		if err := r.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.data[r.offset-index*CONST_ENCRYPT_CHUNK_SIZE:])
+	r.offset = r.offset + int64(n)
+	return n, nil
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset = r.offset + offset
+	case io.SeekEnd:
+		offset = r.size + offset
+	}
+	if offset < 0 {
+		return r.offset, errors.New("seek before start")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *decryptReader) Close() error {
+	if closer, ok := r.src.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// IsRawRequest reports whether a peer asks for the stored bytes of an
+// encrypted file, replication ships the ciphertext.
+func (c *Server) IsRawRequest(r *http.Request) bool {
+	return r.FormValue("raw") == "1" && c.IsPeer(r)
+}
+
+// EncryptStorageFile writes src encrypted with keyId to dst and removes src.
+func (c *Server) EncryptStorageFile(keyId string, src string, dst string) (int64, error) {
+	var (
+		err       error
+		size      int64
+		file      StorageFile
+		encrypted io.ReadCloser
+	)
+	if file, err = c.storage.Get(src); err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if encrypted, err = c.EncryptReader(keyId, file); err != nil {
+		return 0, err
+	}
+	defer encrypted.Close()
+	if size, err = c.storage.Put(dst, encrypted); err != nil {
+		c.storage.Delete(dst)
+		return 0, err
+	}
+	file.Close()
+	c.storage.Delete(src)
+	return size, nil
+}
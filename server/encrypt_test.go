@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	var (
+		err       error
+		ring      *KeyRing
+		stored    []byte
+		encrypted io.ReadCloser
+		reader    *decryptReader
+	)
+	keyfile := path.Join(t.TempDir(), "keys.json")
+	keys := `{"keys":{"k1":"` + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)) +
+		`","k2":"` + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 16)) + `"},"scenes":{"default":"k1"}}`
+	if err = ioutil.WriteFile(keyfile, []byte(keys), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ring, err = LoadKeyRing(keyfile); err != nil {
+		t.Fatal(err)
+	}
+	c := &Server{}
+	c.keyRing.Store(ring)
+	if c.GetSceneKeyId("default") != "k1" || c.GetSceneKeyId("other") != "" {
+		t.Error("scene keys", ring.Scenes)
+	}
+	data := []byte(strings.Repeat("0123456789", CONST_ENCRYPT_CHUNK_SIZE/5+3))
+	if encrypted, err = c.EncryptReader("k1", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err = ioutil.ReadAll(encrypted); err != nil || bytes.Contains(stored, data[:100]) {
+		t.Fatal("encrypt", err)
+	}
+	if keyId, size, err := ParseEncryptHeader(stored, int64(len(stored))); err != nil || keyId != "k1" || size != int64(len(data)) {
+		t.Error("header", keyId, size, err)
+	}
+	if reader, err = c.NewDecryptReader(bytes.NewReader(stored)); err != nil {
+		t.Fatal(err)
+	}
+	// a range across the chunk boundary
+	part := make([]byte, 100)
+	if _, err = reader.Seek(CONST_ENCRYPT_CHUNK_SIZE-50, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(reader, part); err != nil || !bytes.Equal(part, data[CONST_ENCRYPT_CHUNK_SIZE-50:CONST_ENCRYPT_CHUNK_SIZE+50]) {
+		t.Error("range", err)
+	}
+	reader.Seek(0, io.SeekStart)
+	if result, err := ioutil.ReadAll(reader); err != nil || !bytes.Equal(result, data) {
+		t.Error("roundtrip", err)
+	}
+	// dropping the last chunk or flipping a byte is detected
+	if _, err = c.DecryptBytes(stored[:len(stored)-(len(data)%CONST_ENCRYPT_CHUNK_SIZE+CONST_ENCRYPT_OVERHEAD)]); err == nil {
+		t.Error("truncated file decrypted")
+	}
+	stored[len(stored)-1] ^= 1
+	if _, err = c.DecryptBytes(stored); err == nil {
+		t.Error("tampered file decrypted")
+	}
+	// files of a rotated key stay readable while the key is kept
+	for _, v := range [][]byte{{}, []byte("small")} {
+		if stored, err = c.EncryptBytes("k2", v); err != nil {
+			t.Fatal(err)
+		}
+		if result, err := c.DecryptBytes(stored); err != nil || !bytes.Equal(result, v) {
+			t.Error("rotated key", err)
+		}
+	}
+	c.keyRing.Store(&KeyRing{})
+	if _, err = c.DecryptBytes(stored); err == nil {
+		t.Error("decrypted without its key")
+	}
+}
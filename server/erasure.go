@@ -0,0 +1,639 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/httplib"
+	"github.com/klauspost/reedsolomon"
+	log "github.com/sjqzhang/seelog"
+)
+
+// ShardLayout records how an erasure coded file is split. The file is cut in
+// stripes of DataShards blocks of BlockSize bytes (the last one zero padded),
+// ParityShards blocks are computed for every stripe, and block i of every
+// stripe is appended to shard i, which is kept by Peers[i].
+type ShardLayout struct {
+	DataShards   int      `json:"data_shards"`
+	ParityShards int      `json:"parity_shards"`
+	BlockSize    int64    `json:"block_size"`
+	ShardSize    int64    `json:"shard_size"`
+	Peers        []string `json:"peers"`
+	Md5s         []string `json:"md5s"`
+}
+
+func (l *ShardLayout) Total() int {
+	return l.DataShards + l.ParityShards
+}
+
+func (l *ShardLayout) StripeSize() int64 {
+	return int64(l.DataShards) * l.BlockSize
+}
+
+func (c *Server) GetShardPath(md5sum string, index int) string {
+	return fmt.Sprintf("%s/%s/%s/%s_%d", STORE_DIR_NAME, CONST_SHARD_DIR_NAME, md5sum[:2], md5sum, index)
+}
+
+// NeedErasureCode reports whether fileInfo should be stored as shards instead
+// of being copied to every node of its placement set. With fewer placement
+// nodes than shards a node would keep several shards and losing it could
+// lose more than the parity shards, such files are replicated.
+func (c *Server) NeedErasureCode(fileInfo *FileInfo) bool {
+	return Config().EnableErasureCode && fileInfo.Shards == nil && fileInfo.OffSet == -1 &&
+		fileInfo.Size >= Config().ErasureMinSize &&
+		len(c.GetPlacementNodes(fileInfo)) >= Config().ErasureDataShards+Config().ErasureParityShards
+}
+
+// NewShardLayout assigns the shards of fileInfo round robin over its ranked
+// placement nodes, every shard lands on a different node when NeedErasureCode
+// holds.
+func (c *Server) NewShardLayout(fileInfo *FileInfo) *ShardLayout {
+	var (
+		nodes  []string
+		layout *ShardLayout
+	)
+	nodes = c.GetPlacementNodes(fileInfo)
+	layout = &ShardLayout{
+		DataShards:   Config().ErasureDataShards,
+		ParityShards: Config().ErasureParityShards,
+		BlockSize:    CONST_SHARD_BLOCK_SIZE,
+	}
+	layout.ShardSize = (fileInfo.Size + layout.StripeSize() - 1) / layout.StripeSize() * layout.BlockSize
+	for i := 0; i < layout.Total(); i++ {
+		layout.Peers = append(layout.Peers, nodes[i%len(nodes)])
+	}
+	return layout
+}
+
+// EncodeFile splits the local copy of fileInfo into shards, records the layout
+// in the metadata and removes the full copy. The shards assigned to other
+// nodes are kept here until those nodes have pulled them.
+func (c *Server) EncodeFile(fileInfo *FileInfo) error {
+	var (
+		err    error
+		layout *ShardLayout
+		info   *FileInfo
+		file   StorageFile
+		fpath  string
+	)
+	fpath = c.GetFilePathByInfo(fileInfo, false)
+	c.lockMap.LockKey(fpath)
+	defer c.lockMap.UnLockKey(fpath)
+	if info, err = c.GetFileInfoFromLevelDB(fileInfo.Md5); err == nil && info.Shards != nil {
+		// encoded by another worker
+		fileInfo.Shards = info.Shards
+		return nil
+	}
+	if file, err = c.storage.Get(fpath); err != nil {
+		return err
+	}
+	layout = c.NewShardLayout(fileInfo)
+	err = c.WriteShards(fileInfo, layout, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	fileInfo.Shards = layout
+	c.saveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
+	if err = c.storage.Delete(fpath); err != nil {
+		log.Error(err)
+	}
+	log.Info(fmt.Sprintf("EncodeFile %s into %d+%d shards", fpath, layout.DataShards, layout.ParityShards))
+	return nil
+}
+
+// WriteShards encodes the content of fileInfo read from reader into the local
+// shards of layout and fills in their md5s.
+func (c *Server) WriteShards(fileInfo *FileInfo, layout *ShardLayout, reader io.Reader) error {
+	var (
+		err     error
+		enc     reedsolomon.Encoder
+		size    int64
+		writers []*io.PipeWriter
+		hashes  []hash.Hash
+		errs    []error
+		wg      sync.WaitGroup
+	)
+	if enc, err = reedsolomon.New(layout.DataShards, layout.ParityShards); err != nil {
+		return err
+	}
+	errs = make([]error, layout.Total())
+	for i := 0; i < layout.Total(); i++ {
+		pr, pw := io.Pipe()
+		writers = append(writers, pw)
+		hashes = append(hashes, md5.New())
+		wg.Add(1)
+		go func(i int, pr *io.PipeReader) {
+			defer wg.Done()
+			_, errs[i] = c.storage.Put(c.GetShardPath(fileInfo.Md5, i), pr)
+			pr.CloseWithError(errs[i])
+		}(i, pr)
+	}
+	size, err = c.encodeStripes(enc, layout, reader, writers, hashes)
+	for _, pw := range writers {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+	for _, e := range errs {
+		if err == nil && e != nil {
+			err = e
+		}
+	}
+	if err == nil && size != fileInfo.Size {
+		err = fmt.Errorf("size of %s is %d, expected %d", fileInfo.Md5, size, fileInfo.Size)
+	}
+	if err != nil {
+		c.RemoveShards(&FileInfo{Md5: fileInfo.Md5, Shards: layout})
+		return err
+	}
+	layout.Md5s = nil
+	for _, h := range hashes {
+		layout.Md5s = append(layout.Md5s, hex.EncodeToString(h.Sum(nil)))
+	}
+	return nil
+}
+
+func (c *Server) encodeStripes(enc reedsolomon.Encoder, layout *ShardLayout, reader io.Reader, writers []*io.PipeWriter, hashes []hash.Hash) (int64, error) {
+	var (
+		err    error
+		n      int
+		size   int64
+		buffer []byte
+		shards [][]byte
+	)
+	buffer = make([]byte, int64(layout.Total())*layout.BlockSize)
+	for i := 0; i < layout.Total(); i++ {
+		shards = append(shards, buffer[int64(i)*layout.BlockSize:int64(i+1)*layout.BlockSize])
+	}
+	for {
+		n, err = io.ReadFull(reader, buffer[:layout.StripeSize()])
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return size, err
+		}
+		size = size + int64(n)
+		for i := int64(n); i < layout.StripeSize(); i++ {
+			buffer[i] = 0
+		}
+		if err = enc.Encode(shards); err != nil {
+			return size, err
+		}
+		for i, shard := range shards {
+			hashes[i].Write(shard)
+			if _, err = writers[i].Write(shard); err != nil {
+				return size, err
+			}
+		}
+		if n < int(layout.StripeSize()) {
+			return size, nil
+		}
+	}
+}
+
+// GetShardPeers returns the other nodes that may have shard index of
+// fileInfo: the node it is assigned to first, then the holders of the file.
+func (c *Server) GetShardPeers(fileInfo *FileInfo, index int) []string {
+	var (
+		peers []string
+	)
+	if peer := fileInfo.Shards.Peers[index]; peer != c.host {
+		peers = append(peers, peer)
+	}
+	for _, peer := range c.GetHolderPeers(fileInfo) {
+		if !c.util.Contains(peer, peers) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (c *Server) getShardURL(peer string, fileInfo *FileInfo, index int) string {
+	return fmt.Sprintf("%s%s?md5=%s&index=%d", peer, c.getRequestURI("get_shard"), fileInfo.Md5, index)
+}
+
+func (c *Server) getShardTimeout(fileInfo *FileInfo) time.Duration {
+	if Config().SyncTimeout > 0 {
+		return time.Second * time.Duration(Config().SyncTimeout)
+	}
+	return time.Second * time.Duration(fileInfo.Shards.ShardSize/1024/1024+30)
+}
+
+func (c *Server) HasShard(fileInfo *FileInfo, index int) bool {
+	fi, err := c.storage.Stat(c.GetShardPath(fileInfo.Md5, index))
+	return err == nil && fi.Size() == fileInfo.Shards.ShardSize
+}
+
+// HasAssignedShards reports whether every shard of fileInfo assigned to this
+// node is stored locally.
+func (c *Server) HasAssignedShards(fileInfo *FileInfo) bool {
+	for i, peer := range fileInfo.Shards.Peers {
+		if peer == c.host && !c.HasShard(fileInfo, i) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Server) RemoveShards(fileInfo *FileInfo) {
+	for i := 0; i < fileInfo.Shards.Total(); i++ {
+		fpath := c.GetShardPath(fileInfo.Md5, i)
+		if c.StorageFileExists(fpath) {
+			if err := c.storage.Delete(fpath); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// saveShard writes reader to shard index of fileInfo through a temporary
+// file, it is only renamed into place when the md5 matches the layout.
+func (c *Server) saveShard(fileInfo *FileInfo, index int, reader io.Reader) error {
+	var (
+		err   error
+		fpath string
+		h     hash.Hash
+		n     int64
+	)
+	fpath = c.GetShardPath(fileInfo.Md5, index)
+	h = md5.New()
+	n, err = c.storage.Put(fpath+"_tmp", io.TeeReader(reader, h))
+	if err == nil && (n != fileInfo.Shards.ShardSize || hex.EncodeToString(h.Sum(nil)) != fileInfo.Shards.Md5s[index]) {
+		err = fmt.Errorf("shard %s check error", fpath)
+	}
+	if err == nil {
+		err = c.storage.Rename(fpath+"_tmp", fpath)
+	}
+	if err != nil {
+		c.storage.Delete(fpath + "_tmp")
+	}
+	return err
+}
+
+// FetchShard copies shard index of fileInfo from the first peer that has it.
+func (c *Server) FetchShard(fileInfo *FileInfo, index int) error {
+	var (
+		err  error
+		resp *http.Response
+	)
+	err = fmt.Errorf("shard %d of %s not found", index, fileInfo.Md5)
+	for _, peer := range c.GetShardPeers(fileInfo, index) {
+		req := httplib.Get(c.getShardURL(peer, fileInfo, index))
+		req.SetTimeout(time.Second*30, c.getShardTimeout(fileInfo))
+		if resp, err = req.DoRequest(); err != nil {
+			log.Warn(err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("get shard from %s status code:%d", peer, resp.StatusCode)
+			continue
+		}
+		err = c.saveShard(fileInfo, index, resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			return nil
+		}
+		log.Warn(err)
+	}
+	return err
+}
+
+// RebuildShard recomputes shard index of fileInfo from any DataShards of the
+// other shards.
+func (c *Server) RebuildShard(fileInfo *FileInfo, index int) error {
+	var (
+		err    error
+		reader *erasureReader
+	)
+	if reader, err = c.NewErasureReader(fileInfo); err != nil {
+		return err
+	}
+	defer reader.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		var (
+			err    error
+			blocks [][]byte
+		)
+		for stripe := int64(0); stripe*fileInfo.Shards.BlockSize < fileInfo.Shards.ShardSize; stripe++ {
+			if blocks, err = reader.readStripe(stripe, true); err != nil {
+				break
+			}
+			if _, err = pw.Write(blocks[index]); err != nil {
+				break
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	err = c.saveShard(fileInfo, index, pr)
+	pr.CloseWithError(err)
+	return err
+}
+
+// DownloadShardsFromPeer stores the shards of fileInfo assigned to this node,
+// copying them from the peers or rebuilding them when no peer has them.
+func (c *Server) DownloadShardsFromPeer(fileInfo *FileInfo) error {
+	var (
+		err    error
+		failed error
+	)
+	for i, peer := range fileInfo.Shards.Peers {
+		if peer != c.host || c.HasShard(fileInfo, i) {
+			continue
+		}
+		fpath := c.GetShardPath(fileInfo.Md5, i)
+		c.lockMap.LockKey(fpath)
+		if err = c.FetchShard(fileInfo, i); err != nil {
+			log.Warn(err)
+			err = c.RebuildShard(fileInfo, i)
+		}
+		c.lockMap.UnLockKey(fpath)
+		if err != nil {
+			log.Error("DownloadShardsFromPeer ", err)
+			failed = err
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	c.SaveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
+	return nil
+}
+
+// RemoveSurplusShards deletes the local shards assigned to other nodes once
+// those nodes report having them.
+func (c *Server) RemoveSurplusShards(fileInfo *FileInfo) {
+	var (
+		err  error
+		resp *http.Response
+	)
+	for i, peer := range fileInfo.Shards.Peers {
+		fpath := c.GetShardPath(fileInfo.Md5, i)
+		if peer == c.host || !c.StorageFileExists(fpath) {
+			continue
+		}
+		req := httplib.Head(c.getShardURL(peer, fileInfo, i))
+		req.SetTimeout(time.Second*5, time.Second*10)
+		if resp, err = req.DoRequest(); err != nil {
+			log.Warn(err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && resp.ContentLength == fileInfo.Shards.ShardSize {
+			log.Info(fmt.Sprintf("RemoveSurplusShards %s held by %s", fpath, peer))
+			if err = c.storage.Delete(fpath); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// GetShard serves one shard of an erasure coded file to the other nodes.
+func (c *Server) GetShard(w http.ResponseWriter, r *http.Request) {
+	var (
+		err      error
+		fileInfo *FileInfo
+		index    int
+		file     StorageFile
+	)
+	if !c.IsPeer(r) {
+		w.Write([]byte(c.GetClusterNotPermitMessage(r)))
+		return
+	}
+	r.ParseForm()
+	if fileInfo, err = c.GetFileInfoFromLevelDB(r.FormValue("md5")); err != nil || fileInfo.Shards == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if index, err = strconv.Atoi(r.FormValue("index")); err != nil || index < 0 || index >= fileInfo.Shards.Total() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !c.HasShard(fileInfo, index) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if file, err = c.storage.Get(c.GetShardPath(fileInfo.Md5, index)); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	http.ServeContent(w, r, "", time.Unix(fileInfo.TimeStamp, 0), file)
+}
+
+// DownloadErasureFileByURI serves a file whose content only exists as shards.
+func (c *Server) DownloadErasureFileByURI(w http.ResponseWriter, r *http.Request) (bool, error) {
+	var (
+		err      error
+		fullpath string
+		fileInfo *FileInfo
+		reader   *erasureReader
+	)
+	fullpath, _ = c.GetFilePathFromRequest(w, r)
+	if fileInfo, err = c.GetFileInfoFromLevelDB(c.util.MD5(c.GetStoragePath(fullpath))); err != nil {
+		return false, err
+	}
+	if fileInfo.Shards == nil {
+		return false, errors.New("not erasure coded")
+	}
+	if reader, err = c.NewErasureReader(fileInfo); err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	if r.FormValue("download") == "1" || (r.FormValue("download") == "" && Config().DefaultDownload) {
+		c.SetDownloadHeader(w, r)
+	}
+	c.ServeFileContent(w, r, fileInfo, fileInfo.Name, time.Unix(fileInfo.TimeStamp, 0), reader)
+	return true, nil
+}
+
+type shardStream struct {
+	reader io.ReadCloser
+	pos    int64
+	failed bool
+}
+
+// erasureReader reads an erasure coded file stripe by stripe, from the local
+// shards when present and from the peers otherwise, and reconstructs the
+// blocks of unavailable shards. Up to ParityShards shards may be missing.
+type erasureReader struct {
+	c        *Server
+	fileInfo *FileInfo
+	layout   *ShardLayout
+	enc      reedsolomon.Encoder
+	streams  []*shardStream
+	offset   int64
+	stripe   int64
+	data     []byte
+}
+
+func (c *Server) NewErasureReader(fileInfo *FileInfo) (*erasureReader, error) {
+	var (
+		err    error
+		reader *erasureReader
+	)
+	reader = &erasureReader{c: c, fileInfo: fileInfo, layout: fileInfo.Shards, stripe: -1}
+	if reader.enc, err = reedsolomon.New(reader.layout.DataShards, reader.layout.ParityShards); err != nil {
+		return nil, err
+	}
+	for i := 0; i < reader.layout.Total(); i++ {
+		reader.streams = append(reader.streams, &shardStream{})
+	}
+	return reader, nil
+}
+
+func (e *erasureReader) openShard(index int, offset int64) (io.ReadCloser, error) {
+	var (
+		err  error
+		file StorageFile
+		resp *http.Response
+	)
+	if e.c.HasShard(e.fileInfo, index) {
+		if file, err = e.c.storage.Get(e.c.GetShardPath(e.fileInfo.Md5, index)); err == nil {
+			if _, err = file.Seek(offset, io.SeekStart); err == nil {
+				return file, nil
+			}
+			file.Close()
+		}
+	}
+	for _, peer := range e.c.GetShardPeers(e.fileInfo, index) {
+		req := httplib.Get(e.c.getShardURL(peer, e.fileInfo, index))
+		req.Header("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.SetTimeout(time.Second*5, e.c.getShardTimeout(e.fileInfo))
+		if resp, err = req.DoRequest(); err != nil {
+			log.Warn(err)
+			continue
+		}
+		if resp.StatusCode == http.StatusPartialContent || (resp.StatusCode == http.StatusOK && offset == 0) {
+			return resp.Body, nil
+		}
+		resp.Body.Close()
+	}
+	return nil, fmt.Errorf("shard %d of %s is unavailable", index, e.fileInfo.Md5)
+}
+
+func (e *erasureReader) readBlock(index int, offset int64) ([]byte, error) {
+	var (
+		err    error
+		block  []byte
+		stream *shardStream
+	)
+	stream = e.streams[index]
+	if stream.failed {
+		return nil, fmt.Errorf("shard %d of %s is unavailable", index, e.fileInfo.Md5)
+	}
+	if stream.reader == nil || stream.pos != offset {
+		if stream.reader != nil {
+			stream.reader.Close()
+		}
+		if stream.reader, err = e.openShard(index, offset); err != nil {
+			log.Warn(err)
+			stream.failed = true
+			return nil, err
+		}
+		stream.pos = offset
+	}
+	block = make([]byte, e.layout.BlockSize)
+	if _, err = io.ReadFull(stream.reader, block); err != nil {
+		log.Warn(err)
+		stream.reader.Close()
+		stream.reader = nil
+		stream.failed = true
+		return nil, err
+	}
+	stream.pos = stream.pos + e.layout.BlockSize
+	return block, nil
+}
+
+// readStripe returns the blocks of stripe, with all the parity blocks when all
+// is set and only the data blocks otherwise.
+func (e *erasureReader) readStripe(stripe int64, all bool) ([][]byte, error) {
+	var (
+		err    error
+		count  int
+		blocks [][]byte
+	)
+	blocks = make([][]byte, e.layout.Total())
+	for i := 0; i < e.layout.Total() && count < e.layout.DataShards; i++ {
+		if blocks[i], err = e.readBlock(i, stripe*e.layout.BlockSize); err != nil {
+			continue
+		}
+		count++
+	}
+	if count < e.layout.DataShards {
+		return nil, fmt.Errorf("only %d shards of %s are available", count, e.fileInfo.Md5)
+	}
+	if all {
+		err = e.enc.Reconstruct(blocks)
+	} else {
+		err = e.enc.ReconstructData(blocks)
+	}
+	return blocks, err
+}
+
+func (e *erasureReader) Read(p []byte) (int, error) {
+	var (
+		err    error
+		blocks [][]byte
+		stripe int64
+		start  int64
+		end    int64
+	)
+	if e.offset >= e.fileInfo.Size {
+		return 0, io.EOF
+	}
+	stripe = e.offset / e.layout.StripeSize()
+	if stripe != e.stripe {
+		if blocks, err = e.readStripe(stripe, false); err != nil {
+			return 0, err
+		}
+		e.data = e.data[:0]
+		for _, block := range blocks[:e.layout.DataShards] {
+			e.data = append(e.data, block...)
+		}
+		e.stripe = stripe
+	}
+	start = e.offset - stripe*e.layout.StripeSize()
+	end = e.fileInfo.Size - stripe*e.layout.StripeSize()
+	if end > int64(len(e.data)) {
+		end = int64(len(e.data))
+	}
+	n := copy(p, e.data[start:end])
+	e.offset = e.offset + int64(n)
+	return n, nil
+}
+
+func (e *erasureReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset = e.offset + offset
+	case io.SeekEnd:
+		offset = e.fileInfo.Size + offset
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	e.offset = offset
+	return offset, nil
+}
+
+func (e *erasureReader) Close() error {
+	for _, stream := range e.streams {
+		if stream.reader != nil {
+			stream.reader.Close()
+			stream.reader = nil
+		}
+	}
+	return nil
+}
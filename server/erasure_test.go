@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/sjqzhang/goutil"
+)
+
+func TestErasureCode(t *testing.T) {
+	var (
+		err    error
+		data   []byte
+		reader *erasureReader
+	)
+	old := atomic.LoadPointer(&ptr)
+	defer atomic.StorePointer(&ptr, old)
+	atomic.StorePointer(&ptr, unsafe.Pointer(&GlobalConfig{ErasureDataShards: 4, ErasureParityShards: 2}))
+	c := &Server{util: &goutil.Common{}, host: "http://10.0.0.1:8080", storage: NewMemoryStorage()}
+	content := make([]byte, 9*CONST_SHARD_BLOCK_SIZE+12345)
+	rand.New(rand.NewSource(1)).Read(content)
+	fileInfo := &FileInfo{Md5: c.util.MD5("erasure"), Size: int64(len(content)), OffSet: -1}
+	layout := c.NewShardLayout(fileInfo)
+	if layout.ShardSize != 3*CONST_SHARD_BLOCK_SIZE {
+		t.Fatal("shard size", layout.ShardSize)
+	}
+	if err = c.WriteShards(fileInfo, layout, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	fileInfo.Shards = layout
+	// lose as many shards as there are parity shards
+	c.storage.Delete(c.GetShardPath(fileInfo.Md5, 1))
+	c.storage.Delete(c.GetShardPath(fileInfo.Md5, 4))
+	if reader, err = c.NewErasureReader(fileInfo); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = ioutil.ReadAll(reader); err != nil || !bytes.Equal(data, content) {
+		t.Error("reconstruct", len(data), err)
+	}
+	reader.Seek(int64(len(content))-20000, io.SeekStart)
+	if data, err = ioutil.ReadAll(reader); err != nil || !bytes.Equal(data, content[len(content)-20000:]) {
+		t.Error("seek", len(data), err)
+	}
+	reader.Close()
+	if err = c.RebuildShard(fileInfo, 1); err != nil || !c.HasShard(fileInfo, 1) {
+		t.Error("rebuild data shard", err)
+	}
+	if err = c.RebuildShard(fileInfo, 4); err != nil || !c.HasShard(fileInfo, 4) {
+		t.Error("rebuild parity shard", err)
+	}
+	c.storage.Delete(c.GetShardPath(fileInfo.Md5, 0))
+	c.storage.Delete(c.GetShardPath(fileInfo.Md5, 2))
+	c.storage.Delete(c.GetShardPath(fileInfo.Md5, 3))
+	reader, _ = c.NewErasureReader(fileInfo)
+	if _, err = ioutil.ReadAll(reader); err == nil {
+		t.Error("expected error with too many shards lost")
+	}
+}
+
+func TestNeedErasureCode(t *testing.T) {
+	old := atomic.LoadPointer(&ptr)
+	defer atomic.StorePointer(&ptr, old)
+	cfg := &GlobalConfig{EnableErasureCode: true, ErasureDataShards: 4, ErasureParityShards: 2, ErasureMinSize: 1,
+		Peers: []string{"http://b", "http://c", "http://d", "http://e"}}
+	atomic.StorePointer(&ptr, unsafe.Pointer(cfg))
+	c := &Server{util: &goutil.Common{}, host: "http://a"}
+	fileInfo := &FileInfo{Md5: c.util.MD5("erasure"), Size: 10, OffSet: -1}
+	// with 5 nodes one of them would keep two shards
+	if c.NeedErasureCode(fileInfo) {
+		t.Error("erasure coded over fewer nodes than shards")
+	}
+	cfg.Peers = append(cfg.Peers, "http://f")
+	if !c.NeedErasureCode(fileInfo) {
+		t.Error("not erasure coded over as many nodes as shards")
+	}
+	layout := c.NewShardLayout(fileInfo)
+	seen := make(map[string]bool)
+	for _, peer := range layout.Peers {
+		if seen[peer] {
+			t.Fatal("two shards on", peer)
+		}
+		seen[peer] = true
+	}
+}
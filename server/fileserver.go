@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -30,24 +29,27 @@ import (
 )
 
 type FileInfo struct {
-	Name      string   `json:"name"`
-	ReName    string   `json:"rename"`
-	Path      string   `json:"path"`
-	Md5       string   `json:"md5"`
-	Size      int64    `json:"size"`
-	Peers     []string `json:"peers"`
-	Scene     string   `json:"scene"`
-	TimeStamp int64    `json:"timeStamp"`
-	OffSet    int64    `json:"offset"`
-	retry     int
+	Name      string       `json:"name"`
+	ReName    string       `json:"rename"`
+	Path      string       `json:"path"`
+	Md5       string       `json:"md5"`
+	Size      int64        `json:"size"`
+	Peers     []string     `json:"peers"`
+	Scene     string       `json:"scene"`
+	TimeStamp int64        `json:"timeStamp"`
+	OffSet    int64        `json:"offset"`
+	Shards    *ShardLayout `json:"shards,omitempty"`
+	Codec     string       `json:"codec,omitempty"`
+	OrigSize  int64        `json:"orig_size,omitempty"`
+	KeyId     string       `json:"key_id,omitempty"`
+	Disk      string       `json:"disk,omitempty"`
+	RefId     string       `json:"ref_id,omitempty"`
+	Ref       bool         `json:"ref,omitempty"`
+	Version   string       `json:"version,omitempty"`
+	Meta      FileMeta     `json:"meta,omitempty"`
 	op        string
 }
 
-type FileLog struct {
-	FileInfo *FileInfo
-	FileName string
-}
-
 type WrapReqResp struct {
 	w    *http.ResponseWriter
 	r    *http.Request
@@ -94,18 +96,19 @@ func (c *Server) WatchFilesChange() {
 	var (
 		w *watcher.Watcher
 		//fileInfo FileInfo
-		curDir string
-		err    error
-		qchan  chan *FileInfo
-		isLink bool
+		err   error
+		qchan chan *FileInfo
+		roots []string
 	)
 	qchan = make(chan *FileInfo, Config().WatchChanSize)
 	w = watcher.New()
 	w.FilterOps(watcher.Create)
 	//w.FilterOps(watcher.Create, watcher.Remove)
-	curDir, err = filepath.Abs(filepath.Dir(STORE_DIR_NAME))
-	if err != nil {
-		log.Error(err)
+	roots = c.GetStoreRoots()
+	for i := range roots {
+		if roots[i], err = filepath.Abs(roots[i]); err != nil {
+			log.Error(err)
+		}
 	}
 	go func() {
 		for {
@@ -115,11 +118,16 @@ func (c *Server) WatchFilesChange() {
 					continue
 				}
 
-				fpath := strings.Replace(event.Path, curDir+string(os.PathSeparator), "", 1)
-				if isLink {
-					fpath = strings.Replace(event.Path, curDir, STORE_DIR_NAME, 1)
+				fpath := ""
+				for _, root := range roots {
+					if strings.HasPrefix(event.Path, root+string(os.PathSeparator)) {
+						fpath = c.GetStoreRelPath(root, event.Path)
+						break
+					}
+				}
+				if fpath == "" {
+					continue
 				}
-				fpath = strings.Replace(fpath, string(os.PathSeparator), "/", -1)
 				sum := c.util.MD5(fpath)
 				fileInfo := FileInfo{
 					Size:      event.Size(),
@@ -164,24 +172,14 @@ func (c *Server) WatchFilesChange() {
 			}
 		}
 	}()
-	if dir, err := os.Readlink(STORE_DIR_NAME); err == nil {
-
-		if strings.HasSuffix(dir, string(os.PathSeparator)) {
-			dir = strings.TrimSuffix(dir, string(os.PathSeparator))
-		}
-		curDir = dir
-		isLink = true
-		if err := w.AddRecursive(dir); err != nil {
+	for _, root := range roots {
+		if err := w.AddRecursive(root); err != nil {
 			log.Error(err)
 		}
-		w.Ignore(dir + "/_tmp/")
-		w.Ignore(dir + "/" + LARGE_DIR_NAME + "/")
-	}
-	if err := w.AddRecursive("./" + STORE_DIR_NAME); err != nil {
-		log.Error(err)
+		w.Ignore(root + "/_tmp/")
+		w.Ignore(root + "/" + LARGE_DIR_NAME + "/")
+		w.Ignore(root + "/" + CONST_SHARD_DIR_NAME + "/")
 	}
-	w.Ignore("./" + STORE_DIR_NAME + "/_tmp/")
-	w.Ignore("./" + STORE_DIR_NAME + "/" + LARGE_DIR_NAME + "/")
 	if err := w.Start(time.Millisecond * 100); err != nil {
 		log.Error(err)
 	}
@@ -211,16 +209,24 @@ func (c *Server) CheckFileExistByInfo(md5s string, fileInfo *FileInfo) bool {
 	if fileInfo == nil {
 		return false
 	}
+	if !c.IsPlacedOn(fileInfo, c.host) && !c.util.Contains(c.host, fileInfo.Peers) {
+		// only the metadata is kept on this node
+		return false
+	}
 	if fileInfo.OffSet >= 0 {
-		//small file
-		if info, err = c.GetFileInfoFromLevelDB(fileInfo.Md5); err == nil && info.Md5 == fileInfo.Md5 {
-			return true
+		//small file, the needle moves when its volume is compacted
+		if info, err = c.GetFileInfoFromLevelDB(fileInfo.Md5); err == nil && info.Md5 == fileInfo.Md5 && info.ReName == fileInfo.ReName {
+			// the volume is gone with a failed disk
+			return c.StorageFileExists(c.GetSmallFileVolume(info))
 		} else {
 			return false
 		}
 	}
-	fullpath = c.GetFilePathByInfo(fileInfo, true)
-	if fi, err = os.Stat(fullpath); err != nil {
+	if fileInfo.Shards != nil {
+		return c.HasAssignedShards(fileInfo)
+	}
+	fullpath = c.GetFilePathByInfo(fileInfo, false)
+	if fi, err = c.storage.Stat(fullpath); err != nil {
 		return false
 	}
 	if fi.Size() == fileInfo.Size {
@@ -254,7 +260,7 @@ func (c *Server) ParseSmallFile(filename string) (string, int64, int, error) {
 	if length, err = strconv.Atoi(pos[2]); err != nil {
 		return filename, offset, -1, err
 	}
-	if length > CONST_SMALL_FILE_SIZE || offset < 0 {
+	if length > CONST_SMALL_FILE_SIZE+CONST_NEEDLE_MAX_HEADER || offset < 0 {
 		err = errors.New("invalid filesize or offset")
 		return filename, -1, -1, err
 	}
@@ -288,30 +294,46 @@ func (c *Server) GetFilePathFromRequest(w http.ResponseWriter, r *http.Request)
 	return fullpath, smallPath
 }
 
-func (c *Server) GetSmallFileByURI(w http.ResponseWriter, r *http.Request) ([]byte, bool, error) {
+func (c *Server) GetSmallFileByURI(w http.ResponseWriter, r *http.Request) (*Needle, bool, error) {
 	var (
-		err      error
-		data     []byte
-		offset   int64
-		length   int
-		fullpath string
-		info     os.FileInfo
+		err       error
+		needle    *Needle
+		offset    int64
+		length    int
+		fullpath  string
+		smallPath string
+		info      os.FileInfo
+		fileInfo  *FileInfo
 	)
-	fullpath, _ = c.GetFilePathFromRequest(w, r)
-	if _, offset, length, err = c.ParseSmallFile(r.RequestURI); err != nil {
+	fullpath, smallPath = c.GetFilePathFromRequest(w, r)
+	fullpath = c.GetStoragePath(fullpath)
+	smallPath = c.GetStoragePath(smallPath)
+	if fileInfo, err = c.GetFileInfoFromLevelDB(c.util.MD5(smallPath)); err == nil && fileInfo.OffSet >= 0 {
+		// the volume may have been compacted since the url was handed out
+		smallPath = c.GetFilePathByInfo(fileInfo, false)
+		fullpath = c.GetSmallFileVolume(fileInfo)
+	} else {
+		fileInfo = nil
+	}
+	if _, offset, length, err = c.ParseSmallFile(smallPath); err != nil {
 		return nil, false, err
 	}
-	if info, err = os.Stat(fullpath); err != nil {
+	if info, err = c.storage.Stat(fullpath); err != nil {
 		return nil, false, err
 	}
 	if info.Size() < offset+int64(length) {
 		return nil, true, errors.New("noFound")
 	} else {
-		data, err = c.util.ReadFileByOffSet(fullpath, offset, length)
+		needle, err = c.ReadNeedle(fullpath, offset, length)
 		if err != nil {
 			return nil, false, err
 		}
-		return data, false, err
+		if fileInfo != nil && fileInfo.KeyId != "" && needle.Flag == '1' && !c.IsRawRequest(r) {
+			if needle.Data, err = c.DecryptBytes(needle.Data); err != nil {
+				return nil, false, err
+			}
+		}
+		return needle, false, err
 	}
 }
 
@@ -346,7 +368,7 @@ func (c *Server) CheckFileAndSendToPeer(date string, filename string, isForceUpl
 			if isForceUpload {
 				fileInfo.Peers = []string{}
 			}
-			if len(fileInfo.Peers) > len(Config().Peers) {
+			if c.IsReplicated(fileInfo) {
 				continue
 			}
 			if !c.util.Contains(c.host, fileInfo.Peers) {
@@ -361,18 +383,12 @@ func (c *Server) CheckFileAndSendToPeer(date string, filename string, isForceUpl
 	}
 }
 
-func (c *Server) postFileToPeer(fileInfo *FileInfo) {
+// postFileToPeer queues fileInfo for the peers not in its Peers, each peer
+// is sent its files by its own workers, see consumePeerQueue.
+func (c *Server) postFileToPeer(fileInfo *FileInfo) error {
 	var (
-		err      error
-		peer     string
-		filename string
-		info     *FileInfo
-		postURL  string
-		result   string
-		fi       os.FileInfo
-		i        int
-		data     []byte
-		fpath    string
+		err    error
+		failed error
 	)
 	defer func() {
 		if re := recover(); re != nil {
@@ -382,89 +398,130 @@ func (c *Server) postFileToPeer(fileInfo *FileInfo) {
 			log.Error(string(buffer))
 		}
 	}()
-	//fmt.Println("postFile",fileInfo)
-	for i, peer = range Config().Peers {
-		_ = i
-		if fileInfo.Peers == nil {
-			fileInfo.Peers = []string{}
+	if c.NeedErasureCode(fileInfo) {
+		if err = c.EncodeFile(fileInfo); err != nil {
+			log.Error("EncodeFile ", err)
 		}
-		if c.util.Contains(peer, fileInfo.Peers) {
-			continue
-		}
-		filename = fileInfo.Name
-		if fileInfo.ReName != "" {
-			filename = fileInfo.ReName
-			if fileInfo.OffSet != -1 {
-				filename = strings.Split(fileInfo.ReName, ",")[0]
-			}
-		}
-		fpath = DOCKER_DIR + fileInfo.Path + "/" + filename
-		if !c.util.FileExists(fpath) {
-			log.Warn(fmt.Sprintf("file '%s' not found", fpath))
+	}
+	for _, peer := range c.GetKnownPeers() {
+		if peer == c.host || c.util.Contains(peer, fileInfo.Peers) {
 			continue
-		} else {
-			if fileInfo.Size == 0 {
-				if fi, err = os.Stat(fpath); err != nil {
-					log.Error(err)
-				} else {
-					fileInfo.Size = fi.Size()
-				}
-			}
 		}
-		if fileInfo.OffSet != -2 && Config().EnableDistinctFile {
-			//not migrate file should check or update file
-			// where not EnableDistinctFile should check
-			if info, err = c.checkPeerFileExist(peer, fileInfo.Md5, ""); info.Md5 != "" {
-				fileInfo.Peers = append(fileInfo.Peers, peer)
-				if _, err = c.SaveFileInfoToLevelDB(fileInfo.Md5, fileInfo, c.ldb); err != nil {
-					log.Error(err)
-				}
-				continue
-			}
+		if err = c.getPeerSync(peer).queue.Put(&QueueItem{FileInfo: fileInfo}); err != nil {
+			log.Error(err)
+			failed = err
 		}
-		postURL = fmt.Sprintf("%s%s", peer, c.getRequestURI("syncfile_info"))
-		b := httplib.Post(postURL)
-		b.SetTimeout(time.Second*30, time.Second*30)
-		if data, err = json.Marshal(fileInfo); err != nil {
+	}
+	if failed == nil && c.HasUnplacedCopy(fileInfo) {
+		if err = c.queueRelease.Put(&QueueItem{FileInfo: fileInfo}); err != nil {
 			log.Error(err)
-			return
 		}
-		b.Param("fileInfo", string(data))
-		result, err = b.String()
-		if err != nil {
-			if fileInfo.retry <= Config().RetryCount {
-				fileInfo.retry = fileInfo.retry + 1
-				c.AppendToQueue(fileInfo)
+	}
+	return failed
+}
+
+// postFileToOnePeer sends fileInfo to peer, sent tells whether peer was
+// asked at all. The error is returned when the file is worth a retry.
+func (c *Server) postFileToOnePeer(fileInfo *FileInfo, peer string) (sent bool, err error) {
+	var (
+		filename string
+		info     *FileInfo
+		postURL  string
+		result   string
+		fi       os.FileInfo
+		data     []byte
+		fpath    string
+		placed   bool
+	)
+	if c.util.Contains(peer, fileInfo.Peers) {
+		return false, nil
+	}
+	// peers outside the placement set only keep the metadata
+	placed = c.IsPlacedOn(fileInfo, peer)
+	filename = fileInfo.Name
+	if fileInfo.ReName != "" {
+		filename = fileInfo.ReName
+		if fileInfo.OffSet != -1 {
+			filename = strings.Split(fileInfo.ReName, ",")[0]
+		}
+	}
+	fpath = fileInfo.Path + "/" + filename
+	if fileInfo.Shards != nil {
+		// erasure coded, the peers pull their shards with get_shard
+	} else if !c.StorageFileExists(fpath) {
+		log.Warn(fmt.Sprintf("file '%s' not found", fpath))
+		return false, nil
+	} else {
+		if fileInfo.Size == 0 {
+			if fi, err = c.storage.Stat(fpath); err != nil {
+				log.Error(err)
+			} else {
+				fileInfo.Size = fi.Size()
 			}
-			log.Error(err, fmt.Sprintf(" path:%s", fileInfo.Path+"/"+fileInfo.Name))
 		}
-		if !strings.HasPrefix(result, "http://") || err != nil {
-			c.SaveFileMd5Log(fileInfo, CONST_Md5_ERROR_FILE_NAME)
+	}
+	if placed && fileInfo.OffSet != -2 && Config().EnableDistinctFile {
+		//not migrate file should check or update file
+		// where not EnableDistinctFile should check
+		if info, err = c.checkPeerFileExist(peer, fileInfo.Md5, ""); info.Md5 != "" && info.ReName == fileInfo.ReName {
+			c.addFilePeer(fileInfo, peer)
+			return true, nil
 		}
-		if strings.HasPrefix(result, "http://") {
-			log.Info(result)
-			if !c.util.Contains(peer, fileInfo.Peers) {
-				fileInfo.Peers = append(fileInfo.Peers, peer)
-				if _, err = c.SaveFileInfoToLevelDB(fileInfo.Md5, fileInfo, c.ldb); err != nil {
-					log.Error(err)
-				}
+	}
+	postURL = fmt.Sprintf("%s%s", peer, c.getRequestURI("syncfile_info"))
+	b := httplib.Post(postURL)
+	b.SetTimeout(time.Second*30, time.Second*30)
+	if data, err = json.Marshal(fileInfo); err != nil {
+		log.Error(err)
+		return false, err
+	}
+	b.Param("fileInfo", string(data))
+	if result, err = b.String(); err != nil {
+		log.Error(err, fmt.Sprintf(" path:%s", fileInfo.Path+"/"+fileInfo.Name))
+		return true, err
+	}
+	if result == "(error) deleted" {
+		// the delete is replayed here soon, nothing to retry
+		log.Warn(fmt.Sprintf("peer %s has deleted %s", peer, fileInfo.Md5))
+		return true, nil
+	}
+	if !strings.HasPrefix(result, "http://") {
+		return true, fmt.Errorf("sync %s to %s: %s", fileInfo.Md5, peer, result)
+	}
+	log.Info(result)
+	if placed {
+		c.addFilePeer(fileInfo, peer)
+	}
+	return true, nil
+}
+
+// addFilePeer records in the metadata of fileInfo that peer has it. The
+// workers of the other peers update the same metadata, their peers are kept.
+func (c *Server) addFilePeer(fileInfo *FileInfo, peer string) {
+	key := "file_peers_" + fileInfo.Md5
+	c.lockMap.LockKey(key)
+	defer c.lockMap.UnLockKey(key)
+	if !c.util.Contains(peer, fileInfo.Peers) {
+		fileInfo.Peers = append(fileInfo.Peers, peer)
+	}
+	info := *fileInfo
+	info.Peers = append([]string{}, fileInfo.Peers...)
+	if stored, err := c.GetFileInfoFromLevelDB(fileInfo.Md5); err == nil {
+		for _, p := range stored.Peers {
+			if !c.util.Contains(p, info.Peers) {
+				info.Peers = append(info.Peers, p)
 			}
 		}
-		if err != nil {
-			log.Error(err)
-		}
+	}
+	if _, err := c.SaveFileInfoToLevelDB(info.Md5, &info, c.ldb); err != nil {
+		log.Error(err)
 	}
 }
 
 func (c *Server) SaveFileMd5Log(fileInfo *FileInfo, filename string) {
-	var (
-		info FileInfo
-	)
-	for len(c.queueFileLog)+len(c.queueFileLog)/10 > CONST_QUEUE_SIZE {
-		time.Sleep(time.Second * 1)
+	if err := c.queueFileLog.Put(&QueueItem{FileInfo: fileInfo, FileName: filename}); err != nil {
+		log.Error(err)
 	}
-	info = *fileInfo
-	c.queueFileLog <- &FileLog{FileInfo: &info, FileName: filename}
 }
 
 func (c *Server) saveFileMd5Log(fileInfo *FileInfo, filename string) {
@@ -497,7 +554,12 @@ func (c *Server) saveFileMd5Log(fileInfo *FileInfo, filename string) {
 	fullpath = fileInfo.Path + "/" + outname
 	logKey = fmt.Sprintf("%s_%s_%s", logDate, filename, fileInfo.Md5)
 	if filename == CONST_FILE_Md5_FILE_NAME {
-		//c.searchMap.Put(fileInfo.Md5, fileInfo.Name)
+		if fileInfo.RefId == "" {
+			fileInfo.RefId = c.newRefId(fileInfo)
+		}
+		if err = c.AddFileRef(fileInfo); err != nil {
+			log.Error(err)
+		}
 		if ok, err = c.IsExistFromLevelDB(fileInfo.Md5, c.ldb); !ok {
 			c.statMap.AddCountInt64(logDate+"_"+CONST_STAT_FILE_COUNT_KEY, 1)
 			c.statMap.AddCountInt64(logDate+"_"+CONST_STAT_FILE_TOTAL_SIZE_KEY, fileInfo.Size)
@@ -512,10 +574,11 @@ func (c *Server) saveFileMd5Log(fileInfo *FileInfo, filename string) {
 		if _, err = c.SaveFileInfoToLevelDB(c.util.MD5(fullpath), fileInfo, c.ldb); err != nil {
 			log.Error("saveToLevelDB", err, fileInfo)
 		}
+		c.SaveS3ObjectIndex(fileInfo)
+		c.IndexFile(fileInfo)
 		return
 	}
 	if filename == CONST_REMOME_Md5_FILE_NAME {
-		//c.searchMap.Remove(fileInfo.Md5)
 		if ok, err = c.IsExistFromLevelDB(fileInfo.Md5, c.ldb); ok {
 			c.statMap.AddCountInt64(logDate+"_"+CONST_STAT_FILE_COUNT_KEY, -1)
 			c.statMap.AddCountInt64(logDate+"_"+CONST_STAT_FILE_TOTAL_SIZE_KEY, -fileInfo.Size)
@@ -529,6 +592,11 @@ func (c *Server) saveFileMd5Log(fileInfo *FileInfo, filename string) {
 		if err = c.RemoveKeyFromLevelDB(md5Path, c.ldb); err != nil {
 			log.Error("RemoveKeyFromLevelDB", err, fileInfo)
 		}
+		c.RemoveS3ObjectIndex(fileInfo)
+		c.UnindexFile(fullpath)
+		if fileInfo.RefId != "" {
+			c.RemoveKeyFromLevelDB(c.fileRefKey(fileInfo.Md5, fileInfo.RefId), c.ldb)
+		}
 		// remove files.md5 for stat info(repair from logDB)
 		logKey = fmt.Sprintf("%s_%s_%s", logDate, CONST_FILE_Md5_FILE_NAME, fileInfo.Md5)
 		c.RemoveKeyFromLevelDB(logKey, c.logDB)
@@ -606,6 +674,9 @@ func (c *Server) RemoveKeyFromLevelDB(key string, db *leveldb.DB) error {
 		err error
 	)
 	err = db.Delete([]byte(key), nil)
+	if db == c.logDB {
+		c.markMerkleDirty(key)
+	}
 	return err
 }
 
@@ -617,6 +688,10 @@ func (c *Server) SaveFileInfoToLevelDB(key string, fileInfo *FileInfo, db *level
 	if fileInfo == nil || db == nil {
 		return nil, errors.New("fileInfo is null or db is null")
 	}
+	if db == c.ldb {
+		// the disk of a peer says nothing about where the file is here
+		fileInfo.Disk = c.GetFileDisk(fileInfo)
+	}
 	if data, err = json.Marshal(fileInfo); err != nil {
 		return fileInfo, err
 	}
@@ -627,6 +702,9 @@ func (c *Server) SaveFileInfoToLevelDB(key string, fileInfo *FileInfo, db *level
 		logDate := c.util.GetDayFromTimeStamp(fileInfo.TimeStamp)
 		logKey := fmt.Sprintf("%s_%s_%s", logDate, CONST_FILE_Md5_FILE_NAME, fileInfo.Md5)
 		c.logDB.Put([]byte(logKey), data, nil)
+		c.markMerkleDirty(logKey)
+	} else if db == c.logDB {
+		c.markMerkleDirty(key)
 	}
 	return fileInfo, nil
 }
@@ -688,7 +766,7 @@ func (c *Server) IsPeer(r *http.Request) bool {
 	}
 	ip = "http://" + ip
 	bflag = false
-	for _, peer = range Config().Peers {
+	for _, peer = range c.GetKnownPeers() {
 		if strings.HasPrefix(peer, ip) {
 			bflag = true
 			break
@@ -819,7 +897,7 @@ func (c *Server) BuildFileResult(fileInfo *FileInfo, r *http.Request) FileResult
 	fileResult.Path = "/" + p
 	fileResult.Domain = domain
 	fileResult.Scene = fileInfo.Scene
-	fileResult.Size = fileInfo.Size
+	fileResult.Size = c.GetContentSize(fileInfo)
 	fileResult.ModTime = fileInfo.TimeStamp
 	// Just for Compatibility
 	fileResult.Src = fileResult.Path
@@ -893,82 +971,37 @@ func (c *Server) RegisterExit() {
 }
 
 func (c *Server) AppendToQueue(fileInfo *FileInfo) {
-
-	for (len(c.queueToPeers) + CONST_QUEUE_SIZE/10) > CONST_QUEUE_SIZE {
-		time.Sleep(time.Millisecond * 50)
+	if err := c.queueToPeers.Put(&QueueItem{FileInfo: fileInfo}); err != nil {
+		log.Error(err)
 	}
-	c.queueToPeers <- *fileInfo
 }
 
 func (c *Server) AppendToDownloadQueue(fileInfo *FileInfo) {
-	for (len(c.queueFromPeers) + CONST_QUEUE_SIZE/10) > CONST_QUEUE_SIZE {
-		time.Sleep(time.Millisecond * 50)
+	if err := c.queueFromPeers.Put(&QueueItem{FileInfo: fileInfo}); err != nil {
+		log.Error(err)
 	}
-	c.queueFromPeers <- *fileInfo
 }
 
 func (c *Server) ConsumerLog() {
 	go func() {
-		var (
-			fileLog *FileLog
-		)
 		for {
-			fileLog = <-c.queueFileLog
-			c.saveFileMd5Log(fileLog.FileInfo, fileLog.FileName)
+			item := c.queueFileLog.Take()
+			c.saveFileMd5Log(item.FileInfo, item.FileName)
+			c.queueFileLog.Ack(item)
 		}
 	}()
 }
 
-func (c *Server) LoadSearchDict() {
-	go func() {
-		log.Info("Load search dict ....")
-		f, err := os.Open(CONST_SEARCH_FILE_NAME)
-		if err != nil {
-			log.Error(err)
-			return
-		}
-		defer f.Close()
-		r := bufio.NewReader(f)
-		for {
-			line, isprefix, err := r.ReadLine()
-			for isprefix && err == nil {
-				kvs := strings.Split(string(line), "\t")
-				if len(kvs) == 2 {
-					c.searchMap.Put(kvs[0], kvs[1])
-				}
-			}
-		}
-		log.Info("finish load search dict")
-	}()
-}
-
-func (c *Server) SaveSearchDict() {
-	var (
-		err        error
-		fp         *os.File
-		searchDict map[string]interface{}
-		k          string
-		v          interface{}
-	)
-	c.lockMap.LockKey(CONST_SEARCH_FILE_NAME)
-	defer c.lockMap.UnLockKey(CONST_SEARCH_FILE_NAME)
-	searchDict = c.searchMap.Get()
-	fp, err = os.OpenFile(CONST_SEARCH_FILE_NAME, os.O_RDWR, 0755)
-	if err != nil {
-		log.Error(err)
-		return
-	}
-	defer fp.Close()
-	for k, v = range searchDict {
-		fp.WriteString(fmt.Sprintf("%s\t%s", k, v.(string)))
-	}
-}
-
 func (c *Server) ConsumerPostToPeer() {
 	ConsumerFunc := func() {
 		for {
-			fileInfo := <-c.queueToPeers
-			c.postFileToPeer(&fileInfo)
+			item := c.queueToPeers.Take()
+			// the peers done are kept in item.FileInfo for the retry
+			if err := c.postFileToPeer(item.FileInfo); err != nil {
+				c.queueToPeers.Retry(item, err)
+			} else {
+				c.queueToPeers.Ack(item)
+			}
 		}
 	}
 	for i := 0; i < Config().SyncWorker; i++ {
@@ -1080,13 +1113,20 @@ func (c *Server) LoadFileInfoByDate(date string, filename string) (mapset.Set, e
 	return fileInfos, nil
 }
 
-func (c *Server) LoadQueueSendToPeer() {
-	if queue, err := c.LoadFileInfoByDate(c.util.GetToDay(), CONST_Md5_QUEUE_FILE_NAME); err != nil {
-		log.Error(err)
-	} else {
-		for fileInfo := range queue.Iter() {
-			//c.queueFromPeers <- *fileInfo.(*FileInfo)
-			c.AppendToDownloadQueue(fileInfo.(*FileInfo))
+// SendAlarm mails alarm_receivers and posts to alarm_url.
+func (c *Server) SendAlarm(subject string, body string) {
+	for _, to := range Config().AlarmReceivers {
+		if err := c.SendToMail(to, subject, body, "text"); err != nil {
+			log.Error(err)
+		}
+	}
+	if Config().AlarmUrl != "" {
+		req := httplib.Post(Config().AlarmUrl)
+		req.SetTimeout(time.Second*10, time.Second*10)
+		req.Param("message", body)
+		req.Param("subject", subject)
+		if _, err := req.String(); err != nil {
+			log.Error(err)
 		}
 	}
 }
@@ -1109,31 +1149,18 @@ func (c *Server) CheckClusterStatus() {
 			req     *httplib.BeegoHTTPRequest
 			data    []byte
 		)
-		for _, peer := range Config().Peers {
+		for _, peer := range c.GetKnownPeers() {
 			req = httplib.Get(fmt.Sprintf("%s%s", peer, c.getRequestURI("status")))
 			req.SetTimeout(time.Second*5, time.Second*5)
 			err = req.ToJSON(&status)
 			if err != nil || status.Status != "ok" {
-				for _, to := range Config().AlarmReceivers {
-					subject = "fastdfs server error"
-					if err != nil {
-						body = fmt.Sprintf("%s\nserver:%s\nerror:\n%s", subject, peer, err.Error())
-					} else {
-						body = fmt.Sprintf("%s\nserver:%s\n", subject, peer)
-					}
-					if err = c.SendToMail(to, subject, body, "text"); err != nil {
-						log.Error(err)
-					}
-				}
-				if Config().AlarmUrl != "" {
-					req = httplib.Post(Config().AlarmUrl)
-					req.SetTimeout(time.Second*10, time.Second*10)
-					req.Param("message", body)
-					req.Param("subject", subject)
-					if _, err = req.String(); err != nil {
-						log.Error(err)
-					}
+				subject = "fastdfs server error"
+				if err != nil {
+					body = fmt.Sprintf("%s\nserver:%s\nerror:\n%s", subject, peer, err.Error())
+				} else {
+					body = fmt.Sprintf("%s\nserver:%s\n", subject, peer)
 				}
+				c.SendAlarm(subject, body)
 				log.Error(err)
 			} else {
 				var statusMap map[string]interface{}
@@ -1166,21 +1193,6 @@ func (c *Server) CheckClusterStatus() {
 	}()
 }
 
-func (c *Server) SearchDict(kw string) []FileInfo {
-	var (
-		fileInfos []FileInfo
-		fileInfo  *FileInfo
-	)
-	for dict := range c.searchMap.Iter() {
-		if strings.Contains(dict.Val.(string), kw) {
-			if fileInfo, _ = c.GetFileInfoFromLevelDB(dict.Key); fileInfo != nil {
-				fileInfos = append(fileInfos, *fileInfo)
-			}
-		}
-	}
-	return fileInfos
-}
-
 func (c *Server) test() {
 
 	testLock := func() {
@@ -0,0 +1,599 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// VolumeCache keeps haystack volumes open for reading instead of opening
+// the volume for every small file served. Whoever writes to a volume must
+// Close it afterwards so no stale handle is kept.
+type VolumeCache struct {
+	sync.RWMutex
+	files map[string]StorageFile
+	size  int
+}
+
+type NeedleIndex struct {
+	Offset int64
+	Size   int
+}
+
+func NewVolumeCache(size int) *VolumeCache {
+	return &VolumeCache{files: make(map[string]StorageFile), size: size}
+}
+
+func (v *VolumeCache) ReadAt(storage Storage, volume string, offset int64, length int64) ([]byte, error) {
+	var (
+		err  error
+		ok   bool
+		file StorageFile
+	)
+	v.RLock()
+	if file, ok = v.files[volume]; ok {
+		defer v.RUnlock()
+		return readFullAt(file, offset, length)
+	}
+	v.RUnlock()
+	v.Lock()
+	defer v.Unlock()
+	if file, ok = v.files[volume]; !ok {
+		if file, err = storage.Get(volume); err != nil {
+			return nil, err
+		}
+		if len(v.files) >= v.size {
+			for name, f := range v.files {
+				f.Close()
+				delete(v.files, name)
+				break
+			}
+		}
+		v.files[volume] = file
+	}
+	return readFullAt(file, offset, length)
+}
+
+func (v *VolumeCache) Close(volume string) {
+	v.Lock()
+	defer v.Unlock()
+	if file, ok := v.files[volume]; ok {
+		file.Close()
+		delete(v.files, volume)
+	}
+}
+
+func readFullAt(reader io.ReaderAt, offset int64, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	n, err := reader.ReadAt(data, offset)
+	if int64(n) == length {
+		return data, nil
+	}
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// GetSmallFileVolume returns the haystack volume a merged small file is
+// stored in, e.g. files/haystack/<peer_id>/123.
+func (c *Server) GetSmallFileVolume(fileInfo *FileInfo) string {
+	return fileInfo.Path + "/" + strings.Split(fileInfo.ReName, ",")[0]
+}
+
+// LockSmallFileVolume locks the volume fpath for appending, following the
+// volumes it was compacted into so nothing is appended to a retired volume.
+func (c *Server) LockSmallFileVolume(fpath string) string {
+	for {
+		c.lockMap.LockKey(fpath)
+		data, err := c.ldb.Get([]byte(CONST_RETIRED_VOLUME_PREFIX+fpath), nil)
+		if err != nil {
+			return fpath
+		}
+		c.lockMap.UnLockKey(fpath)
+		fpath = string(data)
+	}
+}
+
+// ReadNeedle reads and verifies the needle at offset through the volume cache.
+func (c *Server) ReadNeedle(volume string, offset int64, length int) (*Needle, error) {
+	data, err := c.volumes.ReadAt(c.storage, volume, offset, int64(length))
+	if err != nil {
+		return nil, err
+	}
+	return ParseNeedle(data)
+}
+
+// WriteNeedle writes needle at offset, or appends it when offset is -1, and
+// records it in the volume index. The caller holds the lock of the volume.
+func (c *Server) WriteNeedle(volume string, offset int64, needle *Needle) (int64, error) {
+	var (
+		err  error
+		data []byte
+	)
+	data = needle.Bytes()
+	if offset < 0 {
+		offset, _, err = c.storage.Append(volume, bytes.NewReader(data))
+	} else {
+		err = c.storage.WriteAt(volume, offset, data)
+	}
+	c.volumes.Close(volume)
+	if err != nil {
+		return offset, err
+	}
+	if !needle.Legacy {
+		err = c.AppendVolumeIndex(volume, NeedleIndex{Offset: offset, Size: len(data)})
+	}
+	return offset, err
+}
+
+func (c *Server) AppendVolumeIndex(volume string, index NeedleIndex) error {
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint64(entry, uint64(index.Offset))
+	binary.BigEndian.PutUint32(entry[8:], uint32(index.Size))
+	_, _, err := c.storage.Append(volume+CONST_VOLUME_INDEX_SUFFIX, bytes.NewReader(entry))
+	return err
+}
+
+// ReadVolumeIndex returns the needles recorded in the index of volume, an
+// entry cut short by a crash is ignored.
+func (c *Server) ReadVolumeIndex(volume string) ([]NeedleIndex, error) {
+	var (
+		err     error
+		data    []byte
+		file    StorageFile
+		indexes []NeedleIndex
+	)
+	if file, err = c.storage.Get(volume + CONST_VOLUME_INDEX_SUFFIX); err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if data, err = ioutil.ReadAll(file); err != nil {
+		return nil, err
+	}
+	for i := 0; i+12 <= len(data); i = i + 12 {
+		indexes = append(indexes, NeedleIndex{
+			Offset: int64(binary.BigEndian.Uint64(data[i:])),
+			Size:   int(binary.BigEndian.Uint32(data[i+8:])),
+		})
+	}
+	return indexes, nil
+}
+
+// RemoveVolume deletes a haystack volume together with its index.
+func (c *Server) RemoveVolume(volume string) error {
+	c.volumes.Close(volume)
+	c.storage.Delete(volume + CONST_VOLUME_INDEX_SUFFIX)
+	return c.storage.Delete(volume)
+}
+
+// RemoveSmallFile marks the needle of a merged small file as deleted and
+// removes its metadata, the space is reclaimed by CompactSmallFiles.
+func (c *Server) RemoveSmallFile(fileInfo *FileInfo) error {
+	var (
+		err    error
+		offset int64
+		length int
+		pos    int64
+		head   []byte
+		volume string
+	)
+	if _, offset, length, err = c.ParseSmallFile(fileInfo.ReName); err != nil {
+		return err
+	}
+	volume = c.GetSmallFileVolume(fileInfo)
+	c.lockMap.LockKey(volume)
+	defer c.lockMap.UnLockKey(volume)
+	if length > len(CONST_NEEDLE_MAGIC) {
+		length = len(CONST_NEEDLE_MAGIC) + 1
+	}
+	// a needle not synced yet only has its metadata removed
+	if head, err = c.volumes.ReadAt(c.storage, volume, offset, int64(length)); err == nil {
+		if bytes.HasPrefix(head, []byte(CONST_NEEDLE_MAGIC)) {
+			pos = int64(len(CONST_NEEDLE_MAGIC))
+		}
+		if head[pos] == '1' {
+			err = c.storage.WriteAt(volume, offset+pos, []byte{CONST_SMALL_FILE_DELETED_FLAG})
+			c.volumes.Close(volume)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	c.SaveFileMd5Log(fileInfo, CONST_REMOME_Md5_FILE_NAME)
+	return nil
+}
+
+// CompactSmallFiles rewrites the haystack volumes of this node whose deleted
+// ratio reaches haystack_compact_ratio, and deletes the copies of other
+// nodes' volumes nothing refers to anymore. The peers follow the compaction
+// of a volume through the usual sync of the moved files.
+func (c *Server) CompactSmallFiles() {
+	var (
+		err       error
+		dirs      []os.FileInfo
+		fis       []os.FileInfo
+		volumes   map[string][]*FileInfo
+		own       string
+		count     int
+		compacted bool
+	)
+	if c.lockMap.IsLock("CompactSmallFiles") {
+		log.Warn("Lock CompactSmallFiles")
+		return
+	}
+	c.lockMap.LockKey("CompactSmallFiles")
+	defer c.lockMap.UnLockKey("CompactSmallFiles")
+	volumes = make(map[string][]*FileInfo)
+	iter := c.ldb.NewIterator(nil, nil)
+	for iter.Next() {
+		var fileInfo FileInfo
+		if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil || fileInfo.OffSet < 0 || fileInfo.Md5 != string(iter.Key()) {
+			continue
+		}
+		volume := c.GetSmallFileVolume(&fileInfo)
+		volumes[volume] = append(volumes[volume], &fileInfo)
+	}
+	iter.Release()
+	own = c.GetStoragePath(LARGE_DIR + "/" + Config().PeerId)
+	if dirs, err = c.storage.List(STORE_DIR_NAME + "/" + LARGE_DIR_NAME); err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if fis, err = c.storage.List(STORE_DIR_NAME + "/" + LARGE_DIR_NAME + "/" + dir.Name()); err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, fi := range fis {
+			volume := STORE_DIR_NAME + "/" + LARGE_DIR_NAME + "/" + dir.Name() + "/" + fi.Name()
+			if fi.IsDir() || fi.Size() == 0 || strings.HasSuffix(volume, CONST_VOLUME_INDEX_SUFFIX) {
+				continue
+			}
+			if path.Dir(volume) != own {
+				// volumes of other nodes may still be filling up, leave recent ones
+				if len(volumes[volume]) == 0 && time.Since(fi.ModTime()) > time.Hour {
+					if err = c.RemoveUnusedVolume(volume); err != nil {
+						log.Error(err)
+					}
+				}
+				continue
+			}
+			if compacted, err = c.CompactVolume(volume, volumes[volume]); err != nil {
+				log.Error("CompactVolume ", volume, " ", err)
+				continue
+			}
+			if compacted {
+				count++
+			}
+		}
+	}
+	log.Info(fmt.Sprintf("CompactSmallFiles %d volumes compacted", count))
+}
+
+func (c *Server) NeedCompactVolume(size int64, fileInfos []*FileInfo) bool {
+	var (
+		live int64
+	)
+	for _, fileInfo := range fileInfos {
+		if _, _, length, err := c.ParseSmallFile(fileInfo.ReName); err == nil {
+			live = live + int64(length)
+		}
+	}
+	return float64(size-live)/float64(size) >= Config().HaystackCompactRatio
+}
+
+// GetLiveNeedles returns the metadata of the live needles of volume. They
+// are found through the volume index, and through fileInfos for the legacy
+// needles, which have none. A live needle whose md5 has no metadata yet, e.g.
+// one just uploaded whose metadata is still queued, is an error: the volume
+// must not be rewritten without it. The caller holds the lock of the volume.
+func (c *Server) GetLiveNeedles(volume string, fileInfos []*FileInfo) ([]*FileInfo, error) {
+	var (
+		err      error
+		offset   int64
+		indexes  []NeedleIndex
+		needle   *Needle
+		fileInfo *FileInfo
+		live     []*FileInfo
+	)
+	known := make(map[int64]*FileInfo)
+	for _, fileInfo = range fileInfos {
+		if _, offset, _, err = c.ParseSmallFile(fileInfo.ReName); err == nil {
+			known[offset] = fileInfo
+		}
+	}
+	if indexes, err = c.ReadVolumeIndex(volume); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	indexed := make(map[int64]bool)
+	for _, index := range indexes {
+		indexed[index.Offset] = true
+		if needle, err = c.ReadNeedle(volume, index.Offset, index.Size); err != nil {
+			log.Warn(fmt.Sprintf("GetLiveNeedles %s offset %d %v", volume, index.Offset, err))
+			continue
+		}
+		if needle.Flag != '1' {
+			continue
+		}
+		if fileInfo = known[index.Offset]; fileInfo == nil {
+			if fileInfo, err = c.GetFileInfoFromLevelDB(needle.Md5); err != nil {
+				return nil, fmt.Errorf("needle %s at offset %d of %s has no metadata, repair_small_files restores it", needle.Md5, index.Offset, volume)
+			}
+			if c.GetSmallFileVolume(fileInfo) != volume || fileInfo.OffSet != index.Offset {
+				// the content is kept by another needle
+				continue
+			}
+		}
+		live = append(live, fileInfo)
+	}
+	for offset, fileInfo = range known {
+		if !indexed[offset] {
+			live = append(live, fileInfo)
+		}
+	}
+	return live, nil
+}
+
+// RemoveUnusedVolume deletes the copy of a volume of another node once none
+// of its live needles is referred to anymore.
+func (c *Server) RemoveUnusedVolume(volume string) error {
+	c.lockMap.LockKey(volume)
+	defer c.lockMap.UnLockKey(volume)
+	live, err := c.GetLiveNeedles(volume, nil)
+	if err != nil || len(live) > 0 {
+		return err
+	}
+	log.Info(fmt.Sprintf("CompactSmallFiles remove unused volume %s", volume))
+	return c.RemoveVolume(volume)
+}
+
+// CompactVolume copies the live needles of volume into a new volume and
+// switches their metadata in one leveldb batch, when its deleted ratio
+// reaches haystack_compact_ratio. The live needles are read under the lock of
+// the volume, so none appended since fileInfos were read is lost. The
+// metadata stays reachable by the old path so the urls handed out before
+// keep working. Legacy needles get a header on the way.
+func (c *Server) CompactVolume(volume string, fileInfos []*FileInfo) (bool, error) {
+	var (
+		err    error
+		name   string
+		dest   string
+		offset int64
+		length int
+		data   []byte
+		fi     os.FileInfo
+		needle *Needle
+		batch  *leveldb.Batch
+		moved  []*FileInfo
+	)
+	c.lockMap.LockKey(volume)
+	defer c.lockMap.UnLockKey(volume)
+	if ok, _ := c.IsExistFromLevelDB(CONST_RETIRED_VOLUME_PREFIX+volume, c.ldb); ok {
+		return false, errors.New("volume is retired")
+	}
+	if fileInfos, err = c.GetLiveNeedles(volume, fileInfos); err != nil {
+		return false, err
+	}
+	if len(fileInfos) == 0 {
+		return true, c.RemoveVolume(volume)
+	}
+	if fi, err = c.storage.Stat(volume); err != nil {
+		return false, err
+	}
+	if !c.NeedCompactVolume(fi.Size(), fileInfos) {
+		return false, nil
+	}
+	sort.Slice(fileInfos, func(i, j int) bool {
+		_, oi, _, _ := c.ParseSmallFile(fileInfos[i].ReName)
+		_, oj, _, _ := c.ParseSmallFile(fileInfos[j].ReName)
+		return oi < oj
+	})
+	name = fmt.Sprintf("%s_%d", strings.Split(path.Base(volume), "_")[0], time.Now().UnixNano())
+	dest = path.Dir(volume) + "/" + name
+	batch = new(leveldb.Batch)
+	for _, fileInfo := range fileInfos {
+		if _, offset, length, err = c.ParseSmallFile(fileInfo.ReName); err != nil {
+			log.Warn(err, fileInfo.ReName)
+			continue
+		}
+		if needle, err = c.ReadNeedle(volume, offset, length); err != nil || needle.Flag != '1' {
+			log.Warn(fmt.Sprintf("CompactVolume skip needle %s %v", fileInfo.ReName, err))
+			continue
+		}
+		info := *fileInfo
+		needle = NewNeedle(&info, needle.Data)
+		if info.OffSet, err = c.WriteNeedle(dest, -1, needle); err != nil {
+			c.RemoveVolume(dest)
+			return false, err
+		}
+		parts := strings.SplitN(fileInfo.ReName, ",", 4)
+		info.ReName = fmt.Sprintf("%s,%d,%d,%s", name, info.OffSet, needle.Size(), parts[len(parts)-1])
+		info.Size = int64(len(needle.Data))
+		// the peers are asked to fetch the needle at its new offset
+		info.Peers = []string{c.host}
+		if data, err = json.Marshal(&info); err != nil {
+			c.RemoveVolume(dest)
+			return false, err
+		}
+		batch.Put([]byte(info.Md5), data)
+		batch.Put([]byte(c.util.MD5(c.GetFilePathByInfo(&info, false))), data)
+		batch.Put([]byte(c.util.MD5(c.GetFilePathByInfo(fileInfo, false))), data)
+		moved = append(moved, &info)
+	}
+	batch.Put([]byte(CONST_RETIRED_VOLUME_PREFIX+volume), []byte(dest))
+	if err = c.ldb.Write(batch, nil); err != nil {
+		c.RemoveVolume(dest)
+		return false, err
+	}
+	for _, info := range moved {
+		logKey := fmt.Sprintf("%s_%s_%s", c.util.GetDayFromTimeStamp(info.TimeStamp), CONST_FILE_Md5_FILE_NAME, info.Md5)
+		c.SaveFileInfoToLevelDB(logKey, info, c.logDB)
+		c.AppendToQueue(info)
+	}
+	if err = c.RemoveVolume(volume); err != nil {
+		log.Error(err)
+	}
+	log.Info(fmt.Sprintf("CompactVolume %s into %s, %d needles", volume, dest, len(moved)))
+	return true, nil
+}
+
+func (c *Server) CompactSmallFileWeb(w http.ResponseWriter, r *http.Request) {
+	var (
+		result JsonResult
+	)
+	if !c.IsPeer(r) {
+		w.Write([]byte(c.GetClusterNotPermitMessage(r)))
+		return
+	}
+	go c.CompactSmallFiles()
+	result.Status = "ok"
+	result.Message = "compact job start"
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+// RepairSmallFiles restores the metadata of merged small files from the
+// needle headers, e.g. after leveldb was lost. A volume without an index is
+// walked needle by needle and gets its index written again.
+func (c *Server) RepairSmallFiles() {
+	var (
+		err   error
+		dirs  []os.FileInfo
+		fis   []os.FileInfo
+		count int
+		n     int
+	)
+	if c.lockMap.IsLock("RepairSmallFiles") {
+		log.Warn("Lock RepairSmallFiles")
+		return
+	}
+	c.lockMap.LockKey("RepairSmallFiles")
+	defer c.lockMap.UnLockKey("RepairSmallFiles")
+	if dirs, err = c.storage.List(STORE_DIR_NAME + "/" + LARGE_DIR_NAME); err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if fis, err = c.storage.List(STORE_DIR_NAME + "/" + LARGE_DIR_NAME + "/" + dir.Name()); err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, fi := range fis {
+			if fi.IsDir() || strings.HasSuffix(fi.Name(), CONST_VOLUME_INDEX_SUFFIX) {
+				continue
+			}
+			if n, err = c.RepairVolume(STORE_DIR_NAME + "/" + LARGE_DIR_NAME + "/" + dir.Name() + "/" + fi.Name()); err != nil {
+				log.Error(err)
+			}
+			count = count + n
+		}
+	}
+	log.Info(fmt.Sprintf("RepairSmallFiles %d files repaired", count))
+}
+
+func (c *Server) RepairVolume(volume string) (int, error) {
+	var (
+		err     error
+		count   int
+		size    int
+		offset  int64
+		data    []byte
+		file    StorageFile
+		needle  *Needle
+		indexes []NeedleIndex
+		walked  bool
+	)
+	c.lockMap.LockKey(volume)
+	defer c.lockMap.UnLockKey(volume)
+	if file, err = c.storage.Get(volume); err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if indexes, err = c.ReadVolumeIndex(volume); err != nil {
+		for {
+			if _, size, err = ReadNeedleAt(file, offset); err != nil {
+				break
+			}
+			indexes = append(indexes, NeedleIndex{Offset: offset, Size: size})
+			offset = offset + int64(size)
+		}
+		// legacy needles and holes left by peers not synced yet stop the walk
+		if walked = err == io.EOF; !walked {
+			log.Warn(fmt.Sprintf("RepairVolume %s stop at offset %d %v", volume, offset, err))
+		}
+	}
+	for _, index := range indexes {
+		if data, err = readFullAt(file, index.Offset, int64(index.Size)); err != nil {
+			log.Warn(fmt.Sprintf("RepairVolume %s offset %d %v", volume, index.Offset, err))
+			continue
+		}
+		if needle, err = ParseNeedle(data); err != nil {
+			log.Warn(fmt.Sprintf("RepairVolume %s offset %d %v", volume, index.Offset, err))
+			continue
+		}
+		if needle.Flag != '1' || needle.Legacy {
+			continue
+		}
+		if _, err = c.GetFileInfoFromLevelDB(needle.Md5); err == nil {
+			continue
+		}
+		fileInfo := &FileInfo{
+			Name:      needle.Name,
+			ReName:    fmt.Sprintf("%s,%d,%d,%s", path.Base(volume), index.Offset, index.Size, path.Ext(needle.Name)),
+			Path:      path.Dir(volume),
+			Md5:       needle.Md5,
+			Size:      int64(len(needle.Data)),
+			TimeStamp: needle.TimeStamp,
+			OffSet:    index.Offset,
+			Peers:     []string{c.host},
+		}
+		if keyId, size, err := ParseEncryptHeader(needle.Data, fileInfo.Size); err == nil {
+			fileInfo.KeyId = keyId
+			fileInfo.OrigSize = size
+		}
+		c.SaveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
+		count++
+	}
+	if walked {
+		buf := new(bytes.Buffer)
+		for _, index := range indexes {
+			binary.Write(buf, binary.BigEndian, uint64(index.Offset))
+			binary.Write(buf, binary.BigEndian, uint32(index.Size))
+		}
+		if _, err = c.storage.Put(volume+CONST_VOLUME_INDEX_SUFFIX, buf); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (c *Server) RepairSmallFileWeb(w http.ResponseWriter, r *http.Request) {
+	var (
+		result JsonResult
+	)
+	if !c.IsPeer(r) {
+		w.Write([]byte(c.GetClusterNotPermitMessage(r)))
+		return
+	}
+	go c.RepairSmallFiles()
+	result.Status = "ok"
+	result.Message = "repair job start"
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"testing"
+)
+
+func TestCompactSmallFiles(t *testing.T) {
+	var (
+		err       error
+		data      []byte
+		offset    int64
+		needle    *Needle
+		fileInfo  *FileInfo
+		fileInfos []*FileInfo
+	)
+	c := newTestServer(t, "http://10.0.0.1:8080", &GlobalConfig{PeerId: "1", HaystackCompactRatio: 0.5})
+	c.volumes = NewVolumeCache(2)
+	volume := STORE_DIR_NAME + "/" + LARGE_DIR_NAME + "/1/100"
+	for i := 0; i < 3; i++ {
+		data = []byte(fmt.Sprintf("content %d", i))
+		fileInfo = &FileInfo{
+			Name: fmt.Sprintf("%d.txt", i),
+			Path: STORE_DIR_NAME + "/" + LARGE_DIR_NAME + "/1",
+			Md5:  c.util.MD5(string(data)),
+			Size: int64(len(data)),
+		}
+		needle = NewNeedle(fileInfo, data)
+		// the second needle is written the way volumes were before needle headers
+		needle.Legacy = i == 1
+		if offset, err = c.WriteNeedle(volume, -1, needle); err != nil {
+			t.Fatal(err)
+		}
+		fileInfo.OffSet = offset
+		fileInfo.ReName = fmt.Sprintf("100,%d,%d,.txt", offset, needle.Size())
+		c.saveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
+		fileInfos = append(fileInfos, fileInfo)
+	}
+	for _, i := range []int{0, 2} {
+		if err = c.RemoveSmallFile(fileInfos[i]); err != nil {
+			t.Fatal(err)
+		}
+		item := c.queueFileLog.Take()
+		c.saveFileMd5Log(item.FileInfo, item.FileName)
+		c.queueFileLog.Ack(item)
+	}
+	if needle, err = c.ReadNeedle(volume, 0, needle.Size()); err != nil || !needle.Deleted() {
+		t.Error("needle not marked deleted", needle, err)
+	}
+	c.CompactSmallFiles()
+	if c.StorageFileExists(volume) {
+		t.Error("volume not compacted")
+	}
+	dest := c.LockSmallFileVolume(volume)
+	c.lockMap.UnLockKey(dest)
+	if dest == volume {
+		t.Error("volume not retired")
+	}
+	if fileInfo, err = c.GetFileInfoFromLevelDB(fileInfos[1].Md5); err != nil || fileInfo.OffSet != 0 ||
+		c.GetSmallFileVolume(fileInfo) != dest {
+		t.Fatal("metadata not moved", fileInfo, err)
+	}
+	if _, _, length, _ := c.ParseSmallFile(fileInfo.ReName); fileInfo.Size != 9 {
+		t.Error("size", fileInfo.Size)
+	} else if needle, err = c.ReadNeedle(dest, 0, length); err != nil || needle.Legacy || string(needle.Data) != "content 1" {
+		t.Error("needle not moved", needle, err)
+	}
+	if fileInfo, err = c.GetFileInfoFromLevelDB(c.util.MD5(c.GetFilePathByInfo(fileInfos[1], false))); err != nil ||
+		c.GetSmallFileVolume(fileInfo) != dest {
+		t.Error("old path not redirected", fileInfo, err)
+	}
+	if c.queueToPeers.Stats().Pending != 1 {
+		t.Error("moved file not queued for the peers")
+	}
+	// leveldb is lost, the metadata comes back from the needle headers
+	c.ldb.Delete([]byte(fileInfo.Md5), nil)
+	c.storage.Delete(dest + CONST_VOLUME_INDEX_SUFFIX)
+	if n, err := c.RepairVolume(dest); err != nil || n != 1 {
+		t.Fatal("repair", n, err)
+	}
+	if info := c.queueFileLog.Take().FileInfo; info.ReName != fileInfo.ReName || info.Name != "1.txt" || info.Size != fileInfo.Size {
+		t.Error("repaired metadata", info)
+	}
+	if indexes, err := c.ReadVolumeIndex(dest); err != nil || len(indexes) != 1 {
+		t.Error("index not rebuilt", indexes, err)
+	}
+}
+
+func TestNeedle(t *testing.T) {
+	fileInfo := &FileInfo{Name: "a.txt", Md5: "0cc175b9c0f1b6a831c399e269772661", TimeStamp: 1546272000}
+	data := NewNeedle(fileInfo, []byte("hello")).Bytes()
+	needle, err := ParseNeedle(data)
+	if err != nil || needle.Name != "a.txt" || needle.Md5 != fileInfo.Md5 || needle.TimeStamp != fileInfo.TimeStamp ||
+		string(needle.Data) != "hello" || needle.Size() != len(data) {
+		t.Fatal(needle, err)
+	}
+	if needle, _, err = ReadNeedleAt(bytes.NewReader(append(data, 0, 0)), 0); err != nil || string(needle.Data) != "hello" {
+		t.Error("read needle at", needle, err)
+	}
+	// deleting only flips the flag, the checksum still holds
+	data[len(CONST_NEEDLE_MAGIC)] = CONST_SMALL_FILE_DELETED_FLAG
+	if needle, err = ParseNeedle(data); err != nil || !needle.Deleted() {
+		t.Error("deleted needle", needle, err)
+	}
+	data[len(data)-5] = 'x'
+	if _, err = ParseNeedle(data); err != ErrNeedleCrc {
+		t.Error("corrupted needle", err)
+	}
+	if needle, err = ParseNeedle([]byte("1hello")); err != nil || !needle.Legacy || string(needle.Data) != "hello" {
+		t.Error("legacy needle", needle, err)
+	}
+}
+
+func TestCompactKeepsQueuedNeedles(t *testing.T) {
+	var (
+		err       error
+		offset    int64
+		needle    *Needle
+		fileInfos []*FileInfo
+	)
+	c := newTestServer(t, "http://10.0.0.1:8080", &GlobalConfig{PeerId: "1", HaystackCompactRatio: 0.3})
+	c.volumes = NewVolumeCache(2)
+	volume := STORE_DIR_NAME + "/" + LARGE_DIR_NAME + "/1/100"
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("content %d", i))
+		fileInfo := &FileInfo{Name: fmt.Sprintf("%d.txt", i), Path: path.Dir(volume), Md5: c.util.MD5(string(data)), Size: int64(len(data))}
+		needle = NewNeedle(fileInfo, data)
+		if offset, err = c.WriteNeedle(volume, -1, needle); err != nil {
+			t.Fatal(err)
+		}
+		fileInfo.OffSet = offset
+		fileInfo.ReName = fmt.Sprintf("100,%d,%d,.txt", offset, needle.Size())
+		fileInfos = append(fileInfos, fileInfo)
+	}
+	// the metadata of the last upload is still in the file log queue
+	c.saveFileMd5Log(fileInfos[0], CONST_FILE_Md5_FILE_NAME)
+	c.saveFileMd5Log(fileInfos[1], CONST_FILE_Md5_FILE_NAME)
+	if err = c.RemoveSmallFile(fileInfos[0]); err != nil {
+		t.Fatal(err)
+	}
+	c.CompactSmallFiles()
+	if !c.StorageFileExists(volume) {
+		t.Fatal("volume compacted without the metadata of a needle")
+	}
+	// the needle written after the metadata was read is kept
+	item := c.queueFileLog.Take()
+	c.saveFileMd5Log(item.FileInfo, item.FileName)
+	c.queueFileLog.Ack(item)
+	c.saveFileMd5Log(fileInfos[2], CONST_FILE_Md5_FILE_NAME)
+	if compacted, err := c.CompactVolume(volume, fileInfos[1:2]); err != nil || !compacted {
+		t.Fatal("compact", compacted, err)
+	}
+	for _, fileInfo := range fileInfos[1:] {
+		info, err := c.GetFileInfoFromLevelDB(fileInfo.Md5)
+		if err != nil || c.GetSmallFileVolume(info) == volume {
+			t.Fatal("metadata not moved", info, err)
+		}
+		_, offset, length, _ := c.ParseSmallFile(info.ReName)
+		if needle, err = c.ReadNeedle(c.GetSmallFileVolume(info), offset, length); err != nil || needle.Md5 != fileInfo.Md5 {
+			t.Error("needle lost", fileInfo.Name, err)
+		}
+	}
+}
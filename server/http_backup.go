@@ -58,7 +58,7 @@ func (c *Server) BackUpMetaDataByDate(date string) {
 	defer fileMeta.Close()
 	keyPrefix = "%s_%s_"
 	keyPrefix = fmt.Sprintf(keyPrefix, date, CONST_FILE_Md5_FILE_NAME)
-	iter := server.logDB.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	iter := c.logDB.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
 	defer iter.Release()
 	for iter.Next() {
 		if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil {
@@ -112,7 +112,7 @@ func (c *Server) BackUp(w http.ResponseWriter, r *http.Request) {
 	}
 	if c.IsPeer(r) {
 		if inner != "1" {
-			for _, peer := range Config().Peers {
+			for _, peer := range c.GetKnownPeers() {
 				backUp := func(peer string, date string) {
 					url = fmt.Sprintf("%s%s", peer, c.getRequestURI("backup"))
 					req := httplib.Post(url)
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -29,10 +30,11 @@ func (c *Server) SetDownloadHeader(w http.ResponseWriter, r *http.Request) {
 func (c *Server) ConsumerDownLoad() {
 	ConsumerFunc := func() {
 		for {
-			fileInfo := <-c.queueFromPeers
+			var err error
+			item := c.queueFromPeers.Take()
+			fileInfo := item.FileInfo
 			if len(fileInfo.Peers) <= 0 {
 				log.Warn("Peer is null", fileInfo)
-				continue
 			}
 			for _, peer := range fileInfo.Peers {
 				if strings.Contains(peer, "127.0.0.1") {
@@ -40,10 +42,15 @@ func (c *Server) ConsumerDownLoad() {
 					continue
 				}
 				if peer != c.host {
-					c.DownloadFromPeer(peer, &fileInfo)
+					err = c.DownloadFromPeer(peer, fileInfo)
 					break
 				}
 			}
+			if err != nil {
+				c.queueFromPeers.Retry(item, err)
+			} else {
+				c.queueFromPeers.Ack(item)
+			}
 		}
 	}
 	for i := 0; i < Config().SyncWorker; i++ {
@@ -51,7 +58,9 @@ func (c *Server) ConsumerDownLoad() {
 	}
 }
 
-func (c *Server) DownloadFromPeer(peer string, fileInfo *FileInfo) {
+// DownloadFromPeer copies the content of fileInfo from peer, the error is
+// returned when the download is worth a retry.
+func (c *Server) DownloadFromPeer(peer string, fileInfo *FileInfo) error {
 	var (
 		err         error
 		filename    string
@@ -62,15 +71,20 @@ func (c *Server) DownloadFromPeer(peer string, fileInfo *FileInfo) {
 		data        []byte
 		downloadUrl string
 	)
-	if Config().ReadOnly {
+	if c.IsReadOnly() {
 		log.Warn("ReadOnly", fileInfo)
-		return
+		return nil
 	}
-	if Config().RetryCount > 0 && fileInfo.retry >= Config().RetryCount {
-		log.Error("DownloadFromPeer Error ", fileInfo)
-		return
-	} else {
-		fileInfo.retry = fileInfo.retry + 1
+	if !c.IsPlacedOn(fileInfo, c.host) {
+		log.Info("DownloadFromPeer not in placement set ", fileInfo.Md5)
+		return nil
+	}
+	if fileInfo.Ref {
+		// no bytes of its own, the content is synced by its md5
+		return nil
+	}
+	if fileInfo.Shards != nil {
+		return c.DownloadShardsFromPeer(fileInfo)
 	}
 	filename = fileInfo.Name
 	if fileInfo.ReName != "" {
@@ -79,34 +93,25 @@ func (c *Server) DownloadFromPeer(peer string, fileInfo *FileInfo) {
 	if fileInfo.OffSet != -2 && Config().EnableDistinctFile && c.CheckFileExistByInfo(fileInfo.Md5, fileInfo) {
 		// ignore migrate file
 		log.Info(fmt.Sprintf("DownloadFromPeer file Exist, path:%s", fileInfo.Path+"/"+fileInfo.Name))
-		return
+		return nil
 	}
-	if (!Config().EnableDistinctFile || fileInfo.OffSet == -2) && c.util.FileExists(c.GetFilePathByInfo(fileInfo, true)) {
+	if !Config().EnableDistinctFile || fileInfo.OffSet == -2 {
 		// ignore migrate file
-		if fi, err = os.Stat(c.GetFilePathByInfo(fileInfo, true)); err == nil {
+		if fi, err = c.storage.Stat(c.GetFilePathByInfo(fileInfo, false)); err == nil {
 			if fi.ModTime().Unix() > fileInfo.TimeStamp {
 				log.Info(fmt.Sprintf("ignore file sync path:%s", c.GetFilePathByInfo(fileInfo, false)))
 				fileInfo.TimeStamp = fi.ModTime().Unix()
 				c.postFileToPeer(fileInfo) // keep newer
-				return
+				return nil
 			}
-			os.Remove(c.GetFilePathByInfo(fileInfo, true))
+			c.storage.Delete(c.GetFilePathByInfo(fileInfo, false))
 		}
 	}
-	if _, err = os.Stat(fileInfo.Path); err != nil {
-		os.MkdirAll(DOCKER_DIR+fileInfo.Path, 0775)
-	}
 	//fmt.Println("downloadFromPeer",fileInfo)
-	p := strings.Replace(fileInfo.Path, STORE_DIR_NAME+"/", "", 1)
-	//filename=c.util.UrlEncode(filename)
-	if Config().SupportGroupManage {
-		downloadUrl = peer + "/" + Config().Group + "/" + p + "/" + filename
-	} else {
-		downloadUrl = peer + "/" + p + "/" + filename
-	}
+	downloadUrl = c.getPeerFileURL(peer, fileInfo)
 	log.Info("DownloadFromPeer: ", downloadUrl)
-	fpath = DOCKER_DIR + fileInfo.Path + "/" + filename
-	fpathTmp = DOCKER_DIR + fileInfo.Path + "/" + fmt.Sprintf("%s_%s", "tmp_", filename)
+	fpath = fileInfo.Path + "/" + filename
+	fpathTmp = fileInfo.Path + "/" + fmt.Sprintf("%s_%s", "tmp_", filename)
 	timeout := fileInfo.Size/1024/1024/1 + 30
 	if Config().SyncTimeout > 0 {
 		timeout = Config().SyncTimeout
@@ -120,92 +125,136 @@ func (c *Server) DownloadFromPeer(peer string, fileInfo *FileInfo) {
 	}()
 	if fileInfo.OffSet == -2 {
 		//migrate file
-		if fi, err = os.Stat(fpath); err == nil && fi.Size() == fileInfo.Size {
+		if fi, err = c.storage.Stat(fpath); err == nil && fi.Size() == fileInfo.Size {
 			//prevent double download
 			c.SaveFileInfoToLevelDB(fileInfo.Md5, fileInfo, c.ldb)
 			//log.Info(fmt.Sprintf("file '%s' has download", fpath))
-			return
+			return nil
 		}
 		req := httplib.Get(downloadUrl)
 		req.SetTimeout(time.Second*30, time.Second*time.Duration(timeout))
-		if err = req.ToFile(fpathTmp); err != nil {
-			c.AppendToDownloadQueue(fileInfo) //retry
-			os.Remove(fpathTmp)
+		if fileInfo.Codec != "" {
+			// take the stored form, the peer decompresses otherwise
+			req.Header("Accept-Encoding", fileInfo.Codec)
+		}
+		if err = c.DownloadToStorage(req, fpathTmp); err != nil {
+			c.storage.Delete(fpathTmp)
 			log.Error(err, fpathTmp)
-			return
+			return err
 		}
-		if fi, err = os.Stat(fpathTmp); err != nil {
-			os.Remove(fpathTmp)
-			return
+		if fi, err = c.storage.Stat(fpathTmp); err != nil {
+			c.storage.Delete(fpathTmp)
+			return nil
 		}
 		if fi.Size() != fileInfo.Size {
 			log.Error("file size check error")
-			os.Remove(fpathTmp)
+			c.storage.Delete(fpathTmp)
 		}
-		if os.Rename(fpathTmp, fpath) == nil {
+		if c.storage.Rename(fpathTmp, fpath) == nil {
 			//c.SaveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
 			c.SaveFileInfoToLevelDB(fileInfo.Md5, fileInfo, c.ldb)
 		}
-		return
+		return nil
 	}
 	req := httplib.Get(downloadUrl)
 	req.SetTimeout(time.Second*30, time.Second*time.Duration(timeout))
+	if fileInfo.Codec != "" {
+		req.Header("Accept-Encoding", fileInfo.Codec)
+	}
 	if fileInfo.OffSet >= 0 {
 		//small file download
 		data, err = req.Bytes()
 		if err != nil {
-			c.AppendToDownloadQueue(fileInfo) //retry
 			log.Error(err)
-			return
-		}
-		data2 := make([]byte, len(data)+1)
-		data2[0] = '1'
-		for i, v := range data {
-			data2[i+1] = v
-		}
-		data = data2
-		if int64(len(data)) != fileInfo.Size {
-			log.Warn("file size is error")
-			return
+			return err
+		}
+		needle := NewNeedle(fileInfo, data)
+		if _, _, length, _ := c.ParseSmallFile(fileInfo.ReName); needle.Size() != length {
+			// the volume was written before needles had a header
+			if needle.Legacy = true; needle.Size() != length {
+				log.Warn("file size is error")
+				return nil
+			}
 		}
 		fpath = strings.Split(fpath, ",")[0]
-		err = c.util.WriteFileByOffSet(fpath, fileInfo.OffSet, data)
+		c.lockMap.LockKey(fpath)
+		_, err = c.WriteNeedle(fpath, fileInfo.OffSet, needle)
+		c.lockMap.UnLockKey(fpath)
 		if err != nil {
 			log.Warn(err)
-			return
+			return nil
 		}
 		c.SaveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
-		return
+		return nil
 	}
-	if err = req.ToFile(fpathTmp); err != nil {
-		c.AppendToDownloadQueue(fileInfo) //retry
-		os.Remove(fpathTmp)
+	if err = c.DownloadToStorage(req, fpathTmp); err != nil {
+		c.storage.Delete(fpathTmp)
 		log.Error(err)
-		return
+		return err
 	}
-	if fi, err = os.Stat(fpathTmp); err != nil {
-		os.Remove(fpathTmp)
-		return
+	if fi, err = c.storage.Stat(fpathTmp); err != nil {
+		c.storage.Delete(fpathTmp)
+		return nil
 	}
-	_ = sum
-	//if Config().EnableDistinctFile {
-	//	//DistinctFile
-	//	if sum, err = c.util.GetFileSumByName(fpathTmp, Config().FileSumArithmetic); err != nil {
-	//		log.Error(err)
-	//		return
-	//	}
-	//} else {
-	//	//DistinctFile By path
-	//	sum = c.util.MD5(c.GetFilePathByInfo(fileInfo, false))
-	//}
-	if fi.Size() != fileInfo.Size { //  maybe has bug remove || sum != fileInfo.Md5
-		log.Error("file sum check error")
-		os.Remove(fpathTmp)
-		return
+	if fi.Size() != fileInfo.Size {
+		log.Error("file size check error")
+		c.storage.Delete(fpathTmp)
+		return nil
 	}
-	if os.Rename(fpathTmp, fpath) == nil {
+	if c.CanVerifyFileSum(fileInfo) {
+		// the md5 is the sum of the content, not the one of the path
+		tmpInfo := *fileInfo
+		tmpInfo.ReName = path.Base(fpathTmp)
+		if sum, _, err = c.GetContentSum(&tmpInfo, nil); err != nil || sum != fileInfo.Md5 {
+			log.Error(fmt.Sprintf("file sum check error, %s from %s: %s", fpath, peer, sum))
+			c.storage.Delete(fpathTmp)
+			return nil
+		}
+	}
+	if c.storage.Rename(fpathTmp, fpath) == nil {
 		c.SaveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
 	}
+	return nil
+}
+
+// getPeerFileURL is the url the stored form of fileInfo is downloaded from
+// peer at.
+func (c *Server) getPeerFileURL(peer string, fileInfo *FileInfo) string {
+	var (
+		downloadUrl string
+	)
+	filename := fileInfo.Name
+	if fileInfo.ReName != "" {
+		filename = fileInfo.ReName
+	}
+	p := strings.Replace(fileInfo.Path, STORE_DIR_NAME+"/", "", 1)
+	if Config().SupportGroupManage {
+		downloadUrl = peer + "/" + Config().Group + "/" + p + "/" + filename
+	} else {
+		downloadUrl = peer + "/" + p + "/" + filename
+	}
+	if fileInfo.KeyId != "" {
+		// ship the ciphertext, the content is never decrypted for a copy
+		downloadUrl = downloadUrl + "?raw=1"
+	}
+	return downloadUrl
+}
+
+// DownloadToStorage streams the response body of req into fpath of the storage backend.
+func (c *Server) DownloadToStorage(req *httplib.BeegoHTTPRequest, fpath string) error {
+	var (
+		err  error
+		resp *http.Response
+	)
+	if resp, err = req.DoRequest(); err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s error,status code:%d", fpath, resp.StatusCode)
+	}
+	_, err = c.storage.Put(fpath, resp.Body)
+	return err
 }
 
 func (c *Server) CheckDownloadAuth(w http.ResponseWriter, r *http.Request) (bool, error) {
@@ -283,7 +332,7 @@ func (c *Server) CheckDownloadAuth(w http.ResponseWriter, r *http.Request) (bool
 func (c *Server) DownloadSmallFileByURI(w http.ResponseWriter, r *http.Request) (bool, error) {
 	var (
 		err        error
-		data       []byte
+		needle     *Needle
 		isDownload bool
 		imgWidth   int
 		imgHeight  int
@@ -319,17 +368,24 @@ func (c *Server) DownloadSmallFileByURI(w http.ResponseWriter, r *http.Request)
 			imgHeight = Config().ImageMaxHeight
 		}
 	}
-	data, notFound, err = c.GetSmallFileByURI(w, r)
+	needle, notFound, err = c.GetSmallFileByURI(w, r)
 	_ = notFound
-	if data != nil && string(data[0]) == "1" {
+	if err == ErrNeedleCrc {
+		log.Error(r.RequestURI, " ", err)
+	}
+	if needle != nil && needle.Deleted() {
+		w.WriteHeader(http.StatusNotFound)
+		return true, nil
+	}
+	if needle != nil && needle.Flag == '1' {
 		if isDownload {
 			c.SetDownloadHeader(w, r)
 		}
 		if imgWidth != 0 || imgHeight != 0 {
-			c.ResizeImageByBytes(w, data[1:], uint(imgWidth), uint(imgHeight))
+			c.ResizeImageByBytes(w, needle.Data, uint(imgWidth), uint(imgHeight))
 			return true, nil
 		}
-		w.Write(data[1:])
+		w.Write(needle.Data)
 		return true, nil
 	}
 	return false, errors.New("not found")
@@ -343,6 +399,9 @@ func (c *Server) DownloadNormalFileByURI(w http.ResponseWriter, r *http.Request)
 		imgHeight  int
 		width      string
 		height     string
+		fi         os.FileInfo
+		file       StorageFile
+		fileInfo   *FileInfo
 	)
 	r.ParseForm()
 	isDownload = true
@@ -376,11 +435,26 @@ func (c *Server) DownloadNormalFileByURI(w http.ResponseWriter, r *http.Request)
 		c.SetDownloadHeader(w, r)
 	}
 	fullpath, _ := c.GetFilePathFromRequest(w, r)
+	fullpath = c.GetStoragePath(fullpath)
 	if imgWidth != 0 || imgHeight != 0 {
 		c.ResizeImage(w, fullpath, uint(imgWidth), uint(imgHeight))
 		return true, nil
 	}
-	staticHandler.ServeHTTP(w, r)
+	if fi, err = c.storage.Stat(fullpath); err != nil {
+		return false, err
+	}
+	if fi.IsDir() {
+		staticHandler.ServeHTTP(w, r)
+		return true, nil
+	}
+	if file, err = c.storage.Get(fullpath); err != nil {
+		return false, err
+	}
+	defer file.Close()
+	if fileInfo, err = c.GetFileInfoFromLevelDB(c.util.MD5(fullpath)); err != nil || fileInfo.Size != fi.Size() {
+		fileInfo = nil
+	}
+	c.ServeFileContent(w, r, fileInfo, fi.Name(), fi.ModTime(), file)
 	return true, nil
 }
 
@@ -393,6 +467,7 @@ func (c *Server) DownloadNotFound(w http.ResponseWriter, r *http.Request) {
 		pathMd5    string
 		peer       string
 		fileInfo   *FileInfo
+		peers      []string
 	)
 	fullpath, smallPath = c.GetFilePathFromRequest(w, r)
 	isDownload = true
@@ -407,13 +482,29 @@ func (c *Server) DownloadNotFound(w http.ResponseWriter, r *http.Request) {
 	} else {
 		pathMd5 = c.util.MD5(fullpath)
 	}
-	for _, peer = range Config().Peers {
+	peers = c.GetLivePeers()
+	if fileInfo, err = c.GetFileInfoFromLevelDB(pathMd5); err == nil {
+		// the metadata is known, only ask the nodes holding the content
+		peers = c.GetHolderPeers(fileInfo)
+	}
+	for _, peer = range peers {
+		if !c.IsPeerAlive(peer) {
+			continue
+		}
 		if fileInfo, err = c.checkPeerFileExist(peer, pathMd5, fullpath); err != nil {
 			log.Error(err)
 			continue
 		}
+		if c.IsDeleted(fileInfo) {
+			// the peer has not replayed the delete yet
+			continue
+		}
 		if fileInfo.Md5 != "" {
-			go c.DownloadFromPeer(peer, fileInfo)
+			go func(peer string, fileInfo *FileInfo) {
+				if err := c.DownloadFromPeer(peer, fileInfo); err != nil {
+					c.AppendToDownloadQueue(fileInfo)
+				}
+			}(peer, fileInfo)
 			//http.Redirect(w, r, peer+r.RequestURI, 302)
 			if isDownload {
 				c.SetDownloadHeader(w, r)
@@ -451,8 +542,25 @@ func (c *Server) Download(w http.ResponseWriter, r *http.Request) {
 		c.CrossOrigin(w, r)
 	}
 	fullpath, smallPath = c.GetFilePathFromRequest(w, r)
+	if c.IsTrashPath(c.GetStoragePath(fullpath)) {
+		// not fetched from the peers either
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if smallPath == "" && r.FormValue("version") != "" {
+		if ok, _ = c.DownloadVersionFileByURI(w, r); !ok {
+			c.DownloadNotFound(w, r)
+		}
+		return
+	}
 	if smallPath == "" {
-		if fi, err = os.Stat(fullpath); err != nil {
+		if fi, err = c.storage.Stat(c.GetStoragePath(fullpath)); err != nil {
+			if ok, _ = c.DownloadRefFileByURI(w, r); ok {
+				return
+			}
+			if ok, _ = c.DownloadErasureFileByURI(w, r); ok {
+				return
+			}
 			c.DownloadNotFound(w, r)
 			return
 		}
@@ -7,8 +7,8 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
 	"net/http"
-	"os"
 
 	"github.com/nfnt/resize"
 	log "github.com/sjqzhang/seelog"
@@ -42,19 +42,35 @@ func (c *Server) ResizeImage(w http.ResponseWriter, fullpath string, width, heig
 		img     image.Image
 		err     error
 		imgType string
-		file    *os.File
+		file    StorageFile
 	)
-	file, err = os.Open(fullpath)
+	if fileInfo, err := c.GetFileInfoFromLevelDB(c.util.MD5(fullpath)); err == nil && (fileInfo.KeyId != "" || fileInfo.Codec != "") {
+		// the stored bytes are not an image, decode them first
+		reader, err := c.GetFileReaderByInfo(fileInfo)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		c.ResizeImageByBytes(w, data, width, height)
+		return
+	}
+	file, err = c.storage.Get(fullpath)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	defer file.Close()
 	img, imgType, err = image.Decode(file)
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	file.Close()
 	img = resize.Resize(width, height, img, resize.Lanczos3)
 	if imgType == "jpg" || imgType == "jpeg" {
 		jpeg.Encode(w, img, nil)
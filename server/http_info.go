@@ -35,18 +35,23 @@ func (c *Server) CheckFileExist(w http.ResponseWriter, r *http.Request) {
 	md5sum = r.FormValue("md5")
 	fpath = r.FormValue("path")
 	if fileInfo, err = c.GetFileInfoFromLevelDB(md5sum); fileInfo != nil {
-		if fileInfo.OffSet != -1 {
+		if fileInfo.OffSet != -1 && (c.IsPlacedOn(fileInfo, c.host) || c.util.Contains(c.host, fileInfo.Peers)) {
 			if data, err = json.Marshal(fileInfo); err != nil {
 				log.Error(err)
 			}
 			w.Write(data)
 			return
 		}
-		fpath = DOCKER_DIR + fileInfo.Path + "/" + fileInfo.Name
-		if fileInfo.ReName != "" {
-			fpath = DOCKER_DIR + fileInfo.Path + "/" + fileInfo.ReName
+		if fileInfo.Shards != nil {
+			if !c.CheckFileExistByInfo(md5sum, fileInfo) {
+				fileInfo = &FileInfo{}
+			}
+			data, _ = json.Marshal(fileInfo)
+			w.Write(data)
+			return
 		}
-		if c.util.IsExist(fpath) {
+		fpath = c.GetFilePathByInfo(fileInfo, false)
+		if c.StorageFileExists(fpath) {
 			if data, err = json.Marshal(fileInfo); err == nil {
 				w.Write(data)
 				return
@@ -54,13 +59,14 @@ func (c *Server) CheckFileExist(w http.ResponseWriter, r *http.Request) {
 				log.Error(err)
 			}
 		} else {
-			if fileInfo.OffSet == -1 {
-				c.RemoveKeyFromLevelDB(md5sum, c.ldb) // when file delete,delete from leveldb
+			if fileInfo.OffSet == -1 && c.IsPlacedOn(fileInfo, c.host) {
+				// the record is kept, /reconcile reports it
+				log.Warn(fmt.Sprintf("file of %s is missing: %s", md5sum, fpath))
 			}
 		}
 	} else {
 		if fpath != "" {
-			fi, err = os.Stat(fpath)
+			fi, err = c.storage.Stat(fpath)
 			if err == nil {
 				sum := c.util.MD5(fpath)
 				//if Config().EnableDistinctFile {
@@ -113,11 +119,8 @@ func (c *Server) CheckFilesExist(w http.ResponseWriter, r *http.Request) {
 				fileInfos = append(fileInfos, fileInfo)
 				continue
 			}
-			fpath = DOCKER_DIR + fileInfo.Path + "/" + fileInfo.Name
-			if fileInfo.ReName != "" {
-				fpath = DOCKER_DIR + fileInfo.Path + "/" + fileInfo.ReName
-			}
-			if c.util.IsExist(fpath) {
+			fpath = c.GetFilePathByInfo(fileInfo, false)
+			if c.StorageFileExists(fpath) {
 				if data, err = json.Marshal(fileInfo); err == nil {
 					fileInfos = append(fileInfos, fileInfo)
 					//w.Write(data)
@@ -254,6 +257,8 @@ func (c *Server) ReceiveMd5s(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	md5str = r.FormValue("md5s")
 	md5s = strings.Split(md5str, ",")
+	// the peer asking lost the files even if they list it
+	peer := r.FormValue("peer")
 	AppendFunc := func(md5s []string) {
 		for _, m := range md5s {
 			if m != "" {
@@ -261,6 +266,9 @@ func (c *Server) ReceiveMd5s(w http.ResponseWriter, r *http.Request) {
 					log.Error(err)
 					continue
 				}
+				if peer != "" {
+					fileInfo = withoutPeer(fileInfo, peer)
+				}
 				c.AppendToQueue(fileInfo)
 			}
 		}
@@ -338,9 +346,11 @@ func (c *Server) Status(w http.ResponseWriter, r *http.Request) {
 	runtime.ReadMemStats(memStat)
 	today = c.util.GetToDay()
 	sts = make(map[string]interface{})
-	sts["Fs.QueueFromPeers"] = len(c.queueFromPeers)
-	sts["Fs.QueueToPeers"] = len(c.queueToPeers)
-	sts["Fs.QueueFileLog"] = len(c.queueFileLog)
+	sts["Fs.QueueFromPeers"] = c.queueFromPeers.Stats().Pending
+	sts["Fs.QueueToPeers"] = c.queueToPeers.Stats().Pending
+	sts["Fs.QueueFileLog"] = c.queueFileLog.Stats().Pending
+	sts["Fs.Queues"] = c.GetQueueStats()
+	sts["Fs.PeerSyncs"] = c.GetPeerSyncStatus()
 	for _, k := range []string{CONST_FILE_Md5_FILE_NAME, CONST_Md5_ERROR_FILE_NAME, CONST_Md5_QUEUE_FILE_NAME} {
 		k2 := fmt.Sprintf("%s_%s", today, k)
 		if v, ok = c.sumMap.GetValue(k2); ok {
@@ -357,9 +367,12 @@ func (c *Server) Status(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	sts["Fs.AutoRepair"] = Config().AutoRepair
+	sts["Fs.ReadOnly"] = c.IsReadOnly()
+	sts["Fs.DiskState"] = c.GetDiskState()
 	sts["Fs.QueueUpload"] = len(c.queueUpload)
 	sts["Fs.RefreshInterval"] = Config().RefreshInterval
 	sts["Fs.Peers"] = Config().Peers
+	sts["Fs.ReplicationFactor"] = Config().ReplicationFactor
 	sts["Fs.Local"] = c.host
 	sts["Fs.FileStats"] = c.GetStat()
 	sts["Fs.ShowDir"] = Config().ShowDir
@@ -383,6 +396,7 @@ func (c *Server) Status(w http.ResponseWriter, r *http.Request) {
 		log.Error(err)
 	}
 	sts["Sys.DiskInfo"] = diskInfo
+	sts["Sys.StoreDirs"] = c.GetDiskStatus()
 	memInfo, err = mem.VirtualMemory()
 	if err != nil {
 		log.Error(err)
@@ -393,9 +407,6 @@ func (c *Server) Status(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(c.util.JsonEncodePretty(status)))
 }
 
-func (c *Server) HeartBeat(w http.ResponseWriter, r *http.Request) {
-}
-
 func (c *Server) ListDir(w http.ResponseWriter, r *http.Request) {
 	var (
 		result      JsonResult
@@ -420,7 +431,7 @@ func (c *Server) ListDir(w http.ResponseWriter, r *http.Request) {
 	if tmpDir, err = os.Readlink(dir); err == nil {
 		dir = tmpDir
 	}
-	filesInfo, err = ioutil.ReadDir(DOCKER_DIR + STORE_DIR_NAME + "/" + dir)
+	filesInfo, err = c.storage.List(STORE_DIR_NAME + "/" + dir)
 	if err != nil {
 		log.Error(err)
 		result.Message = err.Error()
@@ -524,47 +535,32 @@ func (c *Server) Index(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Notice: performance is poor,just for low capacity,but low memory , if you want to high performance,use searchMap for search,but memory ....
+// Search finds files through the search indexes, see ParseSearchQuery for
+// the filters. A page holds limit files and the cursor of the next page,
+// empty on the last one.
 func (c *Server) Search(w http.ResponseWriter, r *http.Request) {
 	var (
-		result    JsonResult
-		err       error
-		kw        string
-		count     int
-		fileInfos []FileInfo
-		md5s      []string
+		result JsonResult
+		err    error
+		q      *SearchQuery
+		data   *SearchResult
 	)
-	kw = r.FormValue("kw")
+	result.Status = "fail"
 	if !c.IsPeer(r) {
 		result.Message = c.GetClusterNotPermitMessage(r)
 		w.Write([]byte(c.util.JsonEncodePretty(result)))
 		return
 	}
-	iter := c.ldb.NewIterator(nil, nil)
-	for iter.Next() {
-		var fileInfo FileInfo
-		value := iter.Value()
-		if err = json.Unmarshal(value, &fileInfo); err != nil {
-			log.Error(err)
-			continue
-		}
-		if strings.Contains(fileInfo.Name, kw) && !c.util.Contains(fileInfo.Md5, md5s) {
-			count = count + 1
-			fileInfos = append(fileInfos, fileInfo)
-			md5s = append(md5s, fileInfo.Md5)
-		}
-		if count >= 100 {
-			break
-		}
+	if q, err = c.ParseSearchQuery(r); err == nil {
+		data, err = c.SearchFiles(q)
 	}
-	iter.Release()
-	err = iter.Error()
 	if err != nil {
-		log.Error()
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
 	}
-	//fileInfos=c.SearchDict(kw) // serch file from map for huge capacity
 	result.Status = "ok"
-	result.Data = fileInfos
+	result.Data = data
 	w.Write([]byte(c.util.JsonEncodePretty(result)))
 }
 
@@ -590,7 +586,7 @@ func (c *Server) Sync(w http.ResponseWriter, r *http.Request) {
 		isForceUpload = true
 	}
 	if inner != "1" {
-		for _, peer := range Config().Peers {
+		for _, peer := range c.GetKnownPeers() {
 			req := httplib.Post(peer + c.getRequestURI("sync"))
 			req.Param("force", force)
 			req.Param("inner", "1")
@@ -1,15 +1,12 @@
 package server
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/astaxie/beego/httplib"
-	log "github.com/sjqzhang/seelog"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -22,7 +19,7 @@ func (c *Server) RemoveDownloading() {
 				keys := strings.Split(string(key), "_")
 				if len(keys) == 3 {
 					if t, err := strconv.ParseInt(keys[1], 10, 64); err == nil && time.Now().Unix()-t > 60*10 {
-						os.Remove(DOCKER_DIR + keys[2])
+						c.storage.Delete(keys[2])
 					}
 				}
 			}
@@ -40,7 +37,9 @@ func (c *Server) RemoveEmptyDir(w http.ResponseWriter, r *http.Request) {
 	result.Status = "ok"
 	if c.IsPeer(r) {
 		go c.util.RemoveEmptyDir(DATA_DIR)
-		go c.util.RemoveEmptyDir(STORE_DIR)
+		for _, dir := range c.GetStoreRoots() {
+			go c.util.RemoveEmptyDir(dir)
+		}
 		result.Message = "clean job start ..,don't try again!!!"
 		w.Write([]byte(c.util.JsonEncodePretty(result)))
 	} else {
@@ -58,7 +57,9 @@ func (c *Server) RemoveFile(w http.ResponseWriter, r *http.Request) {
 		delUrl   string
 		result   JsonResult
 		inner    string
-		name     string
+		refId    string
+		trashId  string
+		trash    *TrashFile
 	)
 	_ = delUrl
 	_ = inner
@@ -66,6 +67,8 @@ func (c *Server) RemoveFile(w http.ResponseWriter, r *http.Request) {
 	md5sum = r.FormValue("md5")
 	fpath = r.FormValue("path")
 	inner = r.FormValue("inner")
+	refId = r.FormValue("ref_id")
+	trashId = r.FormValue("trash_id")
 	result.Status = "fail"
 	if !c.IsPeer(r) {
 		w.Write([]byte(c.GetClusterNotPermitMessage(r)))
@@ -79,54 +82,96 @@ func (c *Server) RemoveFile(w http.ResponseWriter, r *http.Request) {
 		fpath = strings.Replace(fpath, "/"+Config().Group+"/", STORE_DIR_NAME+"/", 1)
 		md5sum = c.util.MD5(fpath)
 	}
-	if inner != "1" {
-		for _, peer := range Config().Peers {
-			delFile := func(peer string, md5sum string, fileInfo *FileInfo) {
-				delUrl = fmt.Sprintf("%s%s", peer, c.getRequestURI("delete"))
-				req := httplib.Post(delUrl)
-				req.Param("md5", md5sum)
-				req.Param("inner", "1")
-				req.SetTimeout(time.Second*5, time.Second*10)
-				if _, err = req.String(); err != nil {
-					log.Error(err)
-				}
-			}
-			go delFile(peer, md5sum, fileInfo)
-		}
-	}
 	if len(md5sum) < 32 {
 		result.Message = "md5 unvalid"
 		w.Write([]byte(c.util.JsonEncodePretty(result)))
 		return
 	}
+	if Config().EnableTrash && trashId == "" {
+		trashId = c.NewTrashId(md5sum)
+	}
 	if fileInfo, err = c.GetFileInfoFromLevelDB(md5sum); err != nil {
+		if inner != "1" {
+			c.RemoveFileFromPeers(md5sum, refId, trashId, md5sum)
+		}
 		result.Message = err.Error()
 		w.Write([]byte(c.util.JsonEncodePretty(result)))
 		return
 	}
-	if fileInfo.OffSet >= 0 {
-		result.Message = "small file delete not support"
+	trash, refId, err = c.DeleteFile(fileInfo, refId, trashId)
+	if inner != "1" && (err == nil || refId != "") {
+		// the peers drop the same reference
+		c.RemoveFileFromPeers(md5sum, refId, trashId, fileInfo.Md5)
+	}
+	if err != nil {
+		result.Message = err.Error()
 		w.Write([]byte(c.util.JsonEncodePretty(result)))
 		return
 	}
-	name = fileInfo.Name
-	if fileInfo.ReName != "" {
-		name = fileInfo.ReName
+	result.Data = trash
+	result.Message = "remove success"
+	result.Status = "ok"
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+// DeleteFile drops the reference refId to fileInfo, or one at its path, into
+// the trash as trashId when it is set, and deletes the content with its last
+// reference. It returns the trash entry and the dropped ref_id.
+func (c *Server) DeleteFile(fileInfo *FileInfo, refId string, trashId string) (*TrashFile, string, error) {
+	var (
+		err   error
+		trash *TrashFile
+		last  bool
+	)
+	if Config().EnableTrash && trashId != "" {
+		if trash, err = c.MoveToTrash(fileInfo, refId, trashId); err != nil {
+			return nil, "", err
+		}
+		if trash != nil {
+			return trash, trash.File.RefId, nil
+		}
+	}
+	if refId, last = c.ReleaseFileRef(fileInfo, refId); !last {
+		if refId == "" {
+			return nil, "", errors.New("no reference at this path")
+		}
+		return nil, refId, nil
+	}
+	if content, err := c.GetFileInfoFromLevelDB(fileInfo.Md5); err == nil {
+		fileInfo = content
+	}
+	return nil, refId, c.RemoveFileContent(fileInfo)
+}
+
+// RemoveFileContent deletes the stored content of fileInfo with its metadata.
+func (c *Server) RemoveFileContent(fileInfo *FileInfo) error {
+	var (
+		err   error
+		fpath string
+	)
+	if fileInfo.OffSet >= 0 {
+		return c.RemoveSmallFile(fileInfo)
+	}
+	if fileInfo.Shards != nil {
+		c.SaveFileMd5Log(fileInfo, CONST_REMOME_Md5_FILE_NAME)
+		c.RemoveShards(fileInfo)
+		return nil
 	}
-	fpath = fileInfo.Path + "/" + name
-	if fileInfo.Path != "" && c.util.FileExists(DOCKER_DIR+fpath) {
+	fpath = c.GetFilePathByInfo(fileInfo, false)
+	if fileInfo.Path != "" && c.StorageFileExists(fpath) {
 		c.SaveFileMd5Log(fileInfo, CONST_REMOME_Md5_FILE_NAME)
-		if err = os.Remove(DOCKER_DIR + fpath); err != nil {
-			result.Message = err.Error()
-			w.Write([]byte(c.util.JsonEncodePretty(result)))
-			return
-		} else {
-			result.Message = "remove success"
-			result.Status = "ok"
-			w.Write([]byte(c.util.JsonEncodePretty(result)))
-			return
+		if err = c.storage.Delete(fpath); err != nil {
+			return err
 		}
+		return nil
 	}
-	result.Message = "fail remove"
-	w.Write([]byte(c.util.JsonEncodePretty(result)))
+	return errors.New("fail remove")
+}
+
+// RemoveFileFromPeers records in the operation log that the reference refId
+// to the file with md5sum was dropped, into the trash as trashId when it is
+// set. The peers replay it, content is the md5 of the content left with a
+// tombstone when it is gone.
+func (c *Server) RemoveFileFromPeers(md5sum string, refId string, trashId string, content string) {
+	c.LogOp(&Op{Type: CONST_OP_DELETE, Md5: md5sum, RefId: refId, TrashId: trashId, Content: content})
 }
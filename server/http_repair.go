@@ -9,7 +9,6 @@ import (
 	"regexp"
 	"runtime/debug"
 	"strings"
-	"time"
 
 	"github.com/astaxie/beego/httplib"
 	mapset "github.com/deckarep/golang-set"
@@ -19,9 +18,9 @@ import (
 
 func (c *Server) RepairFileInfoFromFile() {
 	var (
-		pathPrefix string
-		err        error
-		fi         os.FileInfo
+		root string
+		err  error
+		fi   os.FileInfo
 	)
 	defer func() {
 		if re := recover(); re != nil {
@@ -51,21 +50,18 @@ func (c *Server) RepairFileInfoFromFile() {
 			if err != nil {
 				return err
 			}
+			file_path = c.GetStoreRelPath(root, file_path)
 			for _, fi = range files {
 				if fi.IsDir() || fi.Size() == 0 {
 					continue
 				}
-				file_path = strings.Replace(file_path, "\\", "/", -1)
-				if DOCKER_DIR != "" {
-					file_path = strings.Replace(file_path, DOCKER_DIR, "", 1)
-				}
-				if pathPrefix != "" {
-					file_path = strings.Replace(file_path, pathPrefix, STORE_DIR_NAME, 1)
-				}
 				if strings.HasPrefix(file_path, STORE_DIR_NAME+"/"+LARGE_DIR_NAME) {
 					log.Info(fmt.Sprintf("ignore small file file %s", file_path+"/"+fi.Name()))
 					continue
 				}
+				if strings.HasPrefix(file_path, STORE_DIR_NAME+"/"+CONST_SHARD_DIR_NAME) {
+					continue
+				}
 				pathMd5 = c.util.MD5(file_path + "/" + fi.Name())
 				//if finfo, _ := c.GetFileInfoFromLevelDB(pathMd5); finfo != nil && finfo.Md5 != "" {
 				//	log.Info(fmt.Sprintf("exist ignore file %s", file_path+"/"+fi.Name()))
@@ -96,23 +92,16 @@ func (c *Server) RepairFileInfoFromFile() {
 		}
 		return nil
 	}
-	pathname := STORE_DIR
-	pathPrefix, err = os.Readlink(pathname)
-	if err == nil {
-		//link
-		pathname = pathPrefix
-		if strings.HasSuffix(pathPrefix, "/") {
-			//bugfix fullpath
-			pathPrefix = pathPrefix[0 : len(pathPrefix)-1]
+	for _, root = range c.GetStoreRoots() {
+		if fi, err = os.Stat(root); err != nil {
+			log.Error(err)
+			continue
+		}
+		if fi.IsDir() {
+			filepath.Walk(root, handlefunc)
 		}
 	}
-	fi, err = os.Stat(pathname)
-	if err != nil {
-		log.Error(err)
-	}
-	if fi.IsDir() {
-		filepath.Walk(pathname, handlefunc)
-	}
+	c.RepairSmallFiles()
 	log.Info("RepairFileInfoFromFile is finish.")
 }
 
@@ -135,7 +124,7 @@ func (c *Server) RepairStatByDate(date string) StatDateFileInfo {
 	)
 	keyPrefix = "%s_%s_"
 	keyPrefix = fmt.Sprintf(keyPrefix, date, CONST_FILE_Md5_FILE_NAME)
-	iter := server.logDB.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	iter := c.logDB.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
 	defer iter.Release()
 	for iter.Next() {
 		if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil {
@@ -161,17 +150,6 @@ func (c *Server) AutoRepair(forceRepair bool) {
 	c.lockMap.LockKey("AutoRepair")
 	defer c.lockMap.UnLockKey("AutoRepair")
 	AutoRepairFunc := func(forceRepair bool) {
-		var (
-			dateStats []StatDateFileInfo
-			err       error
-			countKey  string
-			md5s      string
-			localSet  mapset.Set
-			remoteSet mapset.Set
-			allSet    mapset.Set
-			tmpSet    mapset.Set
-			fileInfo  *FileInfo
-		)
 		defer func() {
 			if re := recover(); re != nil {
 				buffer := debug.Stack()
@@ -180,73 +158,53 @@ func (c *Server) AutoRepair(forceRepair bool) {
 				log.Error(string(buffer))
 			}
 		}()
-		Update := func(peer string, dateStat StatDateFileInfo) {
-			//从远端拉数据过来
-			req := httplib.Get(fmt.Sprintf("%s%s?date=%s&force=%s", peer, c.getRequestURI("sync"), dateStat.Date, "1"))
-			req.SetTimeout(time.Second*5, time.Second*5)
-			if _, err = req.String(); err != nil {
-				log.Error(err)
-			}
-			log.Info(fmt.Sprintf("syn file from %s date %s", peer, dateStat.Date))
-		}
-		for _, peer := range Config().Peers {
-			req := httplib.Post(fmt.Sprintf("%s%s", peer, c.getRequestURI("stat")))
-			req.Param("inner", "1")
-			req.SetTimeout(time.Second*5, time.Second*15)
-			if err = req.ToJSON(&dateStats); err != nil {
-				log.Error(err)
-				continue
-			}
-			for _, dateStat := range dateStats {
-				if dateStat.Date == "all" {
-					continue
-				}
-				countKey = dateStat.Date + "_" + CONST_STAT_FILE_COUNT_KEY
-				if v, ok := c.statMap.GetValue(countKey); ok {
-					switch v.(type) {
-					case int64:
-						if v.(int64) != dateStat.FileCount || forceRepair {
-							//不相等,找差异
-							//TODO
-							req := httplib.Post(fmt.Sprintf("%s%s", peer, c.getRequestURI("get_md5s_by_date")))
-							req.SetTimeout(time.Second*15, time.Second*60)
-							req.Param("date", dateStat.Date)
-							if md5s, err = req.String(); err != nil {
-								continue
-							}
-							if localSet, err = c.GetMd5sByDate(dateStat.Date, CONST_FILE_Md5_FILE_NAME); err != nil {
-								log.Error(err)
-								continue
-							}
-							remoteSet = c.util.StrToMapSet(md5s, ",")
-							allSet = localSet.Union(remoteSet)
-							md5s = c.util.MapSetToStr(allSet.Difference(localSet), ",")
-							req = httplib.Post(fmt.Sprintf("%s%s", peer, c.getRequestURI("receive_md5s")))
-							req.SetTimeout(time.Second*15, time.Second*60)
-							req.Param("md5s", md5s)
-							req.String()
-							tmpSet = allSet.Difference(remoteSet)
-							for v := range tmpSet.Iter() {
-								if v != nil {
-									if fileInfo, err = c.GetFileInfoFromLevelDB(v.(string)); err != nil {
-										log.Error(err)
-										continue
-									}
-									c.AppendToQueue(fileInfo)
-								}
-							}
-							//Update(peer,dateStat)
-						}
-					}
-				} else {
-					Update(peer, dateStat)
+		report := c.RepairByMerkle()
+		log.Info(fmt.Sprintf("AutoRepair push %d pull %d files in %d ranges", report.Pushed, report.Pulled, len(report.Ranges)))
+		dates := []string{c.util.GetToDay()}
+		if forceRepair {
+			dates = []string{}
+			for _, dateStat := range c.GetStat() {
+				if dateStat.Date != "all" {
+					dates = append(dates, dateStat.Date)
 				}
 			}
 		}
+		for _, date := range dates {
+			c.RepairPlacement(date)
+		}
 	}
 	AutoRepairFunc(forceRepair)
 }
 
+// RepairPlacement downloads the files of date that this node should hold by
+// its placement set but only has the metadata of, rebuilding missing shards of
+// erasure coded files and dropping the shards already moved to their nodes.
+func (c *Server) RepairPlacement(date string) {
+	var (
+		err       error
+		fileInfos mapset.Set
+		count     int
+	)
+	if fileInfos, err = c.LoadFileInfoByDate(date, CONST_FILE_Md5_FILE_NAME); err != nil {
+		log.Error(err)
+		return
+	}
+	for v := range fileInfos.Iter() {
+		fileInfo := v.(*FileInfo)
+		if fileInfo.Shards != nil {
+			c.RemoveSurplusShards(fileInfo)
+		}
+		if fileInfo.OffSet == -2 || !c.IsPlacedOn(fileInfo, c.host) || c.CheckFileExistByInfo(fileInfo.Md5, fileInfo) {
+			continue
+		}
+		c.AppendToDownloadQueue(fileInfo)
+		count++
+	}
+	if count > 0 {
+		log.Info(fmt.Sprintf("RepairPlacement date %s download %d files", date, count))
+	}
+}
+
 func (c *Server) RepairFileInfo(w http.ResponseWriter, r *http.Request) {
 	var (
 		result JsonResult
@@ -287,7 +245,7 @@ func (c *Server) RepairStatWeb(w http.ResponseWriter, r *http.Request) {
 		date = c.util.GetToDay()
 	}
 	if inner != "1" {
-		for _, peer := range Config().Peers {
+		for _, peer := range c.GetKnownPeers() {
 			req := httplib.Post(peer + c.getRequestURI("repair_stat"))
 			req.Param("inner", "1")
 			req.Param("date", date)
@@ -313,7 +271,10 @@ func (c *Server) Repair(w http.ResponseWriter, r *http.Request) {
 	if force == "1" {
 		forceRepair = true
 	}
-	if c.IsPeer(r) {
+	if c.IsPeer(r) && r.FormValue("report") == "1" {
+		result.Data = c.GetRepairReport()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+	} else if c.IsPeer(r) {
 		go c.AutoRepair(forceRepair)
 		result.Message = "repair job start..."
 		w.Write([]byte(c.util.JsonEncodePretty(result)))
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/sjqzhang/seelog"
+)
+
+// The daily backup writes data/<date>/meta.data, a line <key>\t<file info>
+// for the md5 and for the path of every file uploaded that day. Restoring a
+// backup saves the file infos again like an upload does, so the entries of
+// fileserver.db and log.db, the references and the indexes come back with
+// the original names, scenes and small file offsets.
+
+type RestoreReport struct {
+	Dates    []string `json:"dates"`
+	Files    int      `json:"files"`
+	Restored int      `json:"restored"`
+	Skipped  int      `json:"skipped"`
+	Fetched  int      `json:"fetched"`
+	Missing  []string `json:"missing"`
+}
+
+// GetBackUpDates returns the days from dateFrom to dateTo, in yyyyMMdd, that
+// have a meta.data backup. Empty bounds are open.
+func (c *Server) GetBackUpDates(dateFrom string, dateTo string) ([]string, error) {
+	var (
+		dates []string
+	)
+	fis, err := ioutil.ReadDir(DATA_DIR)
+	if err != nil {
+		return nil, err
+	}
+	ex := regexp.MustCompile(`^\d{8}$`)
+	for _, fi := range fis {
+		date := fi.Name()
+		if !fi.IsDir() || !ex.MatchString(date) {
+			continue
+		}
+		if (dateFrom != "" && date < dateFrom) || (dateTo != "" && date > dateTo) {
+			continue
+		}
+		if c.util.FileExists(DATA_DIR + "/" + date + "/meta.data") {
+			dates = append(dates, date)
+		}
+	}
+	return dates, nil
+}
+
+// RestoreMetaData restores the backups of the days from dateFrom to dateTo.
+// The paths known already are left as they are unless force is set. Files
+// missing on this node are reported, and fetched from the peers that have
+// them with fetch.
+func (c *Server) RestoreMetaData(dateFrom string, dateTo string, force bool, fetch bool) (*RestoreReport, error) {
+	var (
+		err   error
+		dates []string
+	)
+	if c.lockMap.IsLock("RestoreMetaData") {
+		return nil, errors.New("restore is running")
+	}
+	c.lockMap.LockKey("RestoreMetaData")
+	defer c.lockMap.UnLockKey("RestoreMetaData")
+	if dates, err = c.GetBackUpDates(dateFrom, dateTo); err != nil {
+		return nil, err
+	}
+	report := &RestoreReport{Dates: dates, Missing: []string{}}
+	for _, date := range dates {
+		if err = c.restoreMetaDataByDate(date, force, fetch, report); err != nil {
+			return report, err
+		}
+		c.RepairStatByDate(date)
+	}
+	log.Info(fmt.Sprintf("restore %s-%s: %d files, %d restored, %d missing", dateFrom, dateTo,
+		report.Files, report.Restored, len(report.Missing)))
+	return report, nil
+}
+
+func (c *Server) restoreMetaDataByDate(date string, force bool, fetch bool, report *RestoreReport) error {
+	var (
+		seen = make(map[string]bool)
+	)
+	f, err := os.Open(DATA_DIR + "/" + date + "/meta.data")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var fileInfo FileInfo
+		kv := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if err = json.Unmarshal([]byte(kv[1]), &fileInfo); err != nil || fileInfo.Md5 == "" {
+			log.Error(fmt.Sprintf("invalid backup of %s: %s", date, kv[0]))
+			continue
+		}
+		fpath := c.GetFilePathByInfo(&fileInfo, false)
+		pathMd5 := c.util.MD5(fpath)
+		if seen[pathMd5] {
+			// the line of the md5 and the one of the path
+			continue
+		}
+		seen[pathMd5] = true
+		report.Files++
+		if ok, _ := c.IsExistFromLevelDB(pathMd5, c.ldb); ok && !force {
+			report.Skipped++
+		} else {
+			c.saveFileMd5Log(&fileInfo, CONST_FILE_Md5_FILE_NAME)
+			report.Restored++
+		}
+		if c.CheckFileExistByInfo(fileInfo.Md5, &fileInfo) || !c.IsPlacedOn(&fileInfo, c.host) {
+			continue
+		}
+		if fetch && c.fetchFromPeers(&fileInfo) {
+			report.Fetched++
+			continue
+		}
+		report.Missing = append(report.Missing, fpath)
+	}
+	return scanner.Err()
+}
+
+// fetchFromPeers downloads the content of fileInfo from the first peer that
+// has it.
+func (c *Server) fetchFromPeers(fileInfo *FileInfo) bool {
+	for _, peer := range fileInfo.Peers {
+		if peer == c.host || strings.Contains(peer, "127.0.0.1") {
+			continue
+		}
+		c.DownloadFromPeer(peer, fileInfo)
+		if c.CheckFileExistByInfo(fileInfo.Md5, fileInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// RestoreBackUp restores the meta.data backups of the days from date_from to
+// date_to, or of date, see RestoreMetaData.
+func (c *Server) RestoreBackUp(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		result JsonResult
+		report *RestoreReport
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	dateFrom, dateTo := r.FormValue("date_from"), r.FormValue("date_to")
+	if date := r.FormValue("date"); date != "" {
+		dateFrom, dateTo = date, date
+	}
+	ex := regexp.MustCompile(`^(\d{8})?$`)
+	if !ex.MatchString(dateFrom) || !ex.MatchString(dateTo) {
+		result.Message = "invalid date"
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if report, err = c.RestoreMetaData(dateFrom, dateTo, r.FormValue("force") == "1", r.FormValue("fetch") == "1"); err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	result.Data = report
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+// RestoreMetaData restores the backups into the node initialized by
+// InitServer.
+func RestoreMetaData(dateFrom string, dateTo string, force bool, fetch bool) (*RestoreReport, error) {
+	if server == nil {
+		return nil, errors.New("server not initialized")
+	}
+	return server.RestoreMetaData(dateFrom, dateTo, force, fetch)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRestoreMetaData(t *testing.T) {
+	var (
+		err    error
+		report *RestoreReport
+	)
+	dataDir := DATA_DIR
+	defer func() { DATA_DIR = dataDir }()
+	DATA_DIR = t.TempDir()
+	c := newTestServer(t, "http://10.0.0.1:8080", &GlobalConfig{EnableDistinctFile: true})
+	dir := STORE_DIR_NAME + "/docs"
+	a := &FileInfo{Name: "a.txt", Path: dir, Scene: "docs", Md5: c.util.MD5("a"), Size: 1, OffSet: -1, TimeStamp: 1000, Peers: []string{c.host}}
+	b := &FileInfo{Name: "b.txt", Path: dir, Scene: "docs", Md5: c.util.MD5("b"), Size: 1, OffSet: -1, TimeStamp: 1000, Peers: []string{c.host}}
+	var lines []string
+	for _, v := range []*FileInfo{a, b} {
+		data, _ := json.Marshal(v)
+		lines = append(lines, v.Md5+"\t"+string(data), c.util.MD5(c.GetFilePathByInfo(v, false))+"\t"+string(data))
+	}
+	os.MkdirAll(DATA_DIR+"/19700101", 0775)
+	os.WriteFile(DATA_DIR+"/19700101/meta.data", []byte(strings.Join(lines, "\n")+"\n"), 0664)
+	os.MkdirAll(DATA_DIR+"/19700105", 0775)
+	c.storage.Put(dir+"/a.txt", strings.NewReader("a"))
+	if report, err = c.RestoreMetaData("19700101", "19700110", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Dates) != 1 || report.Files != 2 || report.Restored != 2 || len(report.Missing) != 1 || report.Missing[0] != dir+"/b.txt" {
+		t.Fatalf("report %+v", *report)
+	}
+	if fileInfo, err := c.GetFileInfoFromLevelDB(c.util.MD5(dir + "/a.txt")); err != nil || fileInfo.Scene != "docs" {
+		t.Error("path not restored", fileInfo, err)
+	}
+	if refs := c.GetFileRefs(a.Md5); len(refs) != 1 {
+		t.Error("reference not restored", refs)
+	}
+	// the paths restored already are kept
+	if report, _ = c.RestoreMetaData("", "", false, false); report.Skipped != 2 || report.Restored != 0 {
+		t.Errorf("second restore %+v", *report)
+	}
+}
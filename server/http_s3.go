@@ -0,0 +1,1127 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/httplib"
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const CONST_S3_XMLNS = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+type S3Handler struct{}
+
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestId string   `xml:"RequestId"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int              `xml:"KeyCount"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// s3MultipartUpload is kept next to the parts of a multipart upload until it
+// is completed or aborted.
+type s3MultipartUpload struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	TimeStamp int64  `json:"timeStamp"`
+}
+
+var s3ErrorStatus = map[string]int{
+	"AccessDenied":              http.StatusForbidden,
+	"SignatureDoesNotMatch":     http.StatusForbidden,
+	"InvalidAccessKeyId":        http.StatusForbidden,
+	"RequestTimeTooSkewed":      http.StatusForbidden,
+	"NoSuchBucket":              http.StatusNotFound,
+	"NoSuchKey":                 http.StatusNotFound,
+	"NoSuchUpload":              http.StatusNotFound,
+	"InvalidArgument":           http.StatusBadRequest,
+	"InvalidDigest":             http.StatusBadRequest,
+	"BadDigest":                 http.StatusBadRequest,
+	"InvalidPart":               http.StatusBadRequest,
+	"InvalidPartOrder":          http.StatusBadRequest,
+	"MalformedXML":              http.StatusBadRequest,
+	"IncompleteBody":            http.StatusBadRequest,
+	"XAmzContentSHA256Mismatch": http.StatusBadRequest,
+	"MethodNotAllowed":          http.StatusMethodNotAllowed,
+	"OperationAborted":          http.StatusConflict,
+	"InsufficientStorage":       http.StatusInsufficientStorage,
+	"NotImplemented":            http.StatusNotImplemented,
+	"InternalError":             http.StatusInternalServerError,
+}
+
+func (S3Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	defer func(t time.Time) {
+		logStr := fmt.Sprintf("[Access] %s | %s | %s | %s | S3 |%s",
+			time.Now().Format("2006/01/02 - 15:04:05"),
+			time.Since(t).String(),
+			server.util.GetClientIp(req),
+			req.Method,
+			req.RequestURI,
+		)
+		logacc.Info(logStr)
+	}(time.Now())
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error(err)
+			server.s3WriteError(res, req, "InternalError", fmt.Sprint(err))
+		}
+	}()
+	server.ServeS3(res, req)
+}
+
+// StartS3 serves the S3 compatible api on s3_addr.
+func (c *Server) StartS3() {
+	fmt.Println("S3 Listen on " + Config().S3Addr)
+	srv := &http.Server{
+		Addr:              Config().S3Addr,
+		Handler:           new(S3Handler),
+		ReadTimeout:       time.Duration(Config().ReadTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(Config().ReadHeaderTimeout) * time.Second,
+		WriteTimeout:      time.Duration(Config().WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(Config().IdleTimeout) * time.Second,
+	}
+	err := srv.ListenAndServe()
+	log.Error(err)
+	fmt.Println(err)
+}
+
+func (c *Server) s3WriteXML(w http.ResponseWriter, status int, v interface{}) {
+	var (
+		err  error
+		data []byte
+	)
+	if data, err = xml.Marshal(v); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func (c *Server) s3WriteError(w http.ResponseWriter, r *http.Request, code string, message string) {
+	status, ok := s3ErrorStatus[code]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	c.s3WriteXML(w, status, s3Error{
+		Code:      code,
+		Message:   message,
+		Resource:  r.URL.Path,
+		RequestId: c.util.MD5(c.util.GetUUID())[:16],
+	})
+}
+
+func (c *Server) s3ErrorCode(err error) string {
+	if e, ok := err.(*S3Error); ok {
+		return e.Code
+	}
+	return "InternalError"
+}
+
+// s3ETag returns the md5 of the content of fileInfo when its md5 is that
+// sum. The md5 of a path or a sha1 is no checksum of the body a client can
+// check, those files get an opaque tag in the form of a multipart one.
+func (c *Server) s3ETag(fileInfo *FileInfo) string {
+	if c.CanVerifyFileSum(fileInfo) && len(fileInfo.Md5) == 32 {
+		return "\"" + fileInfo.Md5 + "\""
+	}
+	return fmt.Sprintf("\"%s-1\"", c.util.MD5(fmt.Sprintf("%s_%d_%d", fileInfo.Md5, fileInfo.Size, fileInfo.TimeStamp)))
+}
+
+func (c *Server) s3ParsePath(r *http.Request) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// CheckS3Bucket accepts the scenes that can be uploaded to, except names that
+// clash with the internal directories under files/.
+func (c *Server) CheckS3Bucket(bucket string) bool {
+	if bucket == "" || strings.HasPrefix(bucket, "_") || bucket == LARGE_DIR_NAME ||
+		strings.ContainsAny(bucket, "/\\") || bucket == "." || bucket == ".." {
+		return false
+	}
+	ok, _ := c.CheckScene(bucket)
+	return ok
+}
+
+func (c *Server) CheckS3Key(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	return path.Clean(key) == key
+}
+
+// GetS3ObjectKey maps a file to its bucket and key, only files kept under the
+// directory of their scene can be addressed through the S3 api.
+func (c *Server) GetS3ObjectKey(fileInfo *FileInfo) (string, string, bool) {
+	var (
+		name   string
+		prefix string
+	)
+	if fileInfo == nil || fileInfo.Scene == "" || fileInfo.OffSet >= 0 {
+		return "", "", false
+	}
+	name = fileInfo.Name
+	if fileInfo.ReName != "" {
+		name = fileInfo.ReName
+	}
+	prefix = STORE_DIR_NAME + "/" + fileInfo.Scene
+	if fileInfo.Path == prefix {
+		return fileInfo.Scene, name, true
+	}
+	if !strings.HasPrefix(fileInfo.Path, prefix+"/") {
+		return "", "", false
+	}
+	return fileInfo.Scene, fileInfo.Path[len(prefix)+1:] + "/" + name, true
+}
+
+func (c *Server) s3IndexKey(bucket string, key string) string {
+	return CONST_S3_OBJECT_KEY_PREFIX + bucket + "/" + key
+}
+
+func (c *Server) SaveS3ObjectIndex(fileInfo *FileInfo) {
+	var (
+		err  error
+		data []byte
+	)
+	bucket, key, ok := c.GetS3ObjectKey(fileInfo)
+	if !ok {
+		return
+	}
+	if data, err = json.Marshal(fileInfo); err != nil {
+		log.Error(err)
+		return
+	}
+	if err = c.ldb.Put([]byte(c.s3IndexKey(bucket, key)), data, nil); err != nil {
+		log.Error(err)
+	}
+}
+
+func (c *Server) RemoveS3ObjectIndex(fileInfo *FileInfo) {
+	if bucket, key, ok := c.GetS3ObjectKey(fileInfo); ok {
+		c.RemoveKeyFromLevelDB(c.s3IndexKey(bucket, key), c.ldb)
+	}
+}
+
+func (c *Server) GetS3Object(bucket string, key string) (*FileInfo, error) {
+	var (
+		err      error
+		data     []byte
+		fileInfo FileInfo
+	)
+	if data, err = c.ldb.Get([]byte(c.s3IndexKey(bucket, key)), nil); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &fileInfo); err != nil {
+		return nil, err
+	}
+	if fileInfo.Ref {
+		// the content is read from wherever it is stored now
+		content, err := c.GetFileInfoFromLevelDB(fileInfo.Md5)
+		if err != nil {
+			return nil, err
+		}
+		content.Name, content.TimeStamp = fileInfo.Name, fileInfo.TimeStamp
+		return content, nil
+	}
+	return &fileInfo, nil
+}
+
+// RebuildS3ObjectIndex indexes the files uploaded before the S3 api existed,
+// it runs once and is marked done in leveldb.
+func (c *Server) RebuildS3ObjectIndex() {
+	var (
+		err   error
+		count int
+	)
+	if ok, _ := c.IsExistFromLevelDB(CONST_S3_INDEX_VERSION_KEY, c.ldb); ok {
+		return
+	}
+	iter := c.ldb.NewIterator(nil, nil)
+	for iter.Next() {
+		var fileInfo FileInfo
+		if len(iter.Key()) != 32 {
+			continue
+		}
+		if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil {
+			continue
+		}
+		if _, _, ok := c.GetS3ObjectKey(&fileInfo); ok {
+			c.SaveS3ObjectIndex(&fileInfo)
+			count++
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		log.Error(err)
+		return
+	}
+	c.ldb.Put([]byte(CONST_S3_INDEX_VERSION_KEY), []byte("1"), nil)
+	log.Info(fmt.Sprintf("RebuildS3ObjectIndex %d objects", count))
+}
+
+func (c *Server) ServeS3(w http.ResponseWriter, r *http.Request) {
+	var (
+		err  error
+		sign *s3Signature
+	)
+	if len(Config().S3AccessKeys) == 0 {
+		if !c.IsPeer(r) {
+			c.s3WriteError(w, r, "AccessDenied", c.GetClusterNotPermitMessage(r))
+			return
+		}
+	} else if sign, err = c.VerifyS3Signature(r, time.Now()); err != nil {
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	bucket, key := c.s3ParsePath(r)
+	query := r.URL.Query()
+	if bucket == "" {
+		if r.Method == http.MethodGet {
+			c.S3ListBuckets(w, r)
+		} else {
+			c.s3WriteError(w, r, "MethodNotAllowed", r.Method)
+		}
+		return
+	}
+	if !c.CheckS3Bucket(bucket) {
+		c.s3WriteError(w, r, "NoSuchBucket", bucket)
+		return
+	}
+	if key == "" {
+		switch r.Method {
+		case http.MethodGet:
+			c.S3ListObjectsV2(w, r, bucket)
+		case http.MethodHead, http.MethodPut:
+			w.WriteHeader(http.StatusOK)
+		default:
+			c.s3WriteError(w, r, "MethodNotAllowed", r.Method)
+		}
+		return
+	}
+	if !c.CheckS3Key(key) {
+		c.s3WriteError(w, r, "InvalidArgument", "invalid key")
+		return
+	}
+	if Config().ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		c.s3WriteError(w, r, "AccessDenied", "(error) readonly")
+		return
+	}
+	if r.Method == http.MethodPut || r.Method == http.MethodPost {
+		// deletes still go through, they free space
+		if err := c.CheckDiskSpace(r.ContentLength); err != nil {
+			c.s3WriteError(w, r, "InsufficientStorage", err.Error())
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		c.S3GetObject(w, r, bucket, key)
+	case http.MethodPut:
+		if query.Get("uploadId") != "" {
+			c.S3UploadPart(w, r, sign, bucket, key)
+		} else if r.Header.Get("X-Amz-Copy-Source") != "" {
+			c.S3CopyObject(w, r, bucket, key)
+		} else {
+			c.S3PutObject(w, r, sign, bucket, key)
+		}
+	case http.MethodPost:
+		if _, ok := query["uploads"]; ok {
+			c.S3CreateMultipartUpload(w, r, bucket, key)
+		} else if query.Get("uploadId") != "" {
+			c.S3CompleteMultipartUpload(w, r, bucket, key)
+		} else {
+			c.s3WriteError(w, r, "NotImplemented", r.URL.RawQuery)
+		}
+	case http.MethodDelete:
+		if query.Get("uploadId") != "" {
+			c.S3AbortMultipartUpload(w, r, bucket, key)
+		} else {
+			c.S3DeleteObject(w, r, bucket, key)
+		}
+	default:
+		c.s3WriteError(w, r, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (c *Server) S3ListBuckets(w http.ResponseWriter, r *http.Request) {
+	var (
+		result  s3ListAllMyBucketsResult
+		buckets []string
+	)
+	buckets = append(buckets, Config().DefaultScene)
+	for _, s := range Config().Scenes {
+		scene := strings.Split(s, ":")[0]
+		if !c.util.Contains(scene, buckets) {
+			buckets = append(buckets, scene)
+		}
+	}
+	result.Xmlns = CONST_S3_XMLNS
+	result.Owner = s3Owner{ID: Config().Group, DisplayName: Config().Group}
+	for _, bucket := range buckets {
+		if !c.CheckS3Bucket(bucket) {
+			continue
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{
+			Name:         bucket,
+			CreationDate: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	c.s3WriteXML(w, http.StatusOK, result)
+}
+
+func (c *Server) S3ListObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) {
+	var (
+		err        error
+		result     s3ListBucketResult
+		startAfter string
+		lastPrefix string
+		lastKey    string
+		data       []byte
+	)
+	query := r.URL.Query()
+	result.Xmlns = CONST_S3_XMLNS
+	result.Name = bucket
+	result.Prefix = query.Get("prefix")
+	result.Delimiter = query.Get("delimiter")
+	result.StartAfter = query.Get("start-after")
+	result.ContinuationToken = query.Get("continuation-token")
+	result.MaxKeys = 1000
+	if v := query.Get("max-keys"); v != "" {
+		if result.MaxKeys, err = strconv.Atoi(v); err != nil || result.MaxKeys < 0 {
+			c.s3WriteError(w, r, "InvalidArgument", "max-keys")
+			return
+		}
+		if result.MaxKeys > 1000 {
+			result.MaxKeys = 1000
+		}
+	}
+	startAfter = result.StartAfter
+	if result.ContinuationToken != "" {
+		if data, err = base64.StdEncoding.DecodeString(result.ContinuationToken); err != nil {
+			c.s3WriteError(w, r, "InvalidArgument", "continuation-token")
+			return
+		}
+		startAfter = string(data)
+	}
+	base := c.s3IndexKey(bucket, "")
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(base+result.Prefix)), nil)
+	defer iter.Release()
+	ok := iter.First()
+	if startAfter != "" {
+		ok = iter.Seek([]byte(base + startAfter + "\x00"))
+	}
+	for ; ok; ok = iter.Next() {
+		var fileInfo FileInfo
+		key := string(iter.Key())[len(base):]
+		if result.Delimiter != "" && strings.HasSuffix(startAfter, result.Delimiter) && strings.HasPrefix(key, startAfter) {
+			continue
+		}
+		if result.Delimiter != "" {
+			if i := strings.Index(key[len(result.Prefix):], result.Delimiter); i >= 0 {
+				commonPrefix := key[:len(result.Prefix)+i+len(result.Delimiter)]
+				if commonPrefix == lastPrefix {
+					continue
+				}
+				if result.KeyCount >= result.MaxKeys {
+					result.IsTruncated = true
+					break
+				}
+				lastPrefix = commonPrefix
+				lastKey = commonPrefix
+				result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: commonPrefix})
+				result.KeyCount++
+				continue
+			}
+		}
+		if result.KeyCount >= result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil {
+			log.Error(err)
+			continue
+		}
+		lastKey = key
+		result.Contents = append(result.Contents, s3Object{
+			Key:          key,
+			LastModified: time.Unix(fileInfo.TimeStamp, 0).UTC().Format(time.RFC3339),
+			ETag:         c.s3ETag(&fileInfo),
+			Size:         c.GetContentSize(&fileInfo),
+			StorageClass: "STANDARD",
+		})
+		result.KeyCount++
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(lastKey))
+	}
+	c.s3WriteXML(w, http.StatusOK, result)
+}
+
+// getS3ObjectReader opens an object for http.ServeContent, merged small files
+// are read into memory since they are below CONST_SMALL_FILE_SIZE.
+func (c *Server) getS3ObjectReader(fileInfo *FileInfo) (io.ReadSeeker, io.Closer, error) {
+	var (
+		err    error
+		reader io.ReadCloser
+		data   []byte
+	)
+	if reader, err = c.GetFileReaderByInfo(fileInfo); err != nil {
+		return nil, nil, err
+	}
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		return seeker, reader, nil
+	}
+	defer reader.Close()
+	if data, err = ioutil.ReadAll(reader); err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(data), ioutil.NopCloser(nil), nil
+}
+
+func (c *Server) S3GetObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	var (
+		err      error
+		fileInfo *FileInfo
+		reader   io.ReadSeeker
+		closer   io.Closer
+	)
+	if fileInfo, err = c.GetS3Object(bucket, key); err != nil {
+		c.s3WriteError(w, r, "NoSuchKey", key)
+		return
+	}
+	if fileInfo.Codec != "" {
+		// stream compressed objects instead of reading them into memory
+		if content, err := c.GetFileReaderByInfo(fileInfo); err == nil {
+			defer content.Close()
+			w.Header().Set("ETag", c.s3ETag(fileInfo))
+			c.ServeDecompressed(w, r, fileInfo, time.Unix(fileInfo.TimeStamp, 0), content)
+			return
+		}
+	}
+	if reader, closer, err = c.getS3ObjectReader(fileInfo); err != nil {
+		// the content may be kept by other nodes only
+		if !c.proxyS3ObjectFromPeers(w, r, fileInfo) {
+			log.Error(err)
+			c.s3WriteError(w, r, "NoSuchKey", key)
+		}
+		return
+	}
+	defer closer.Close()
+	w.Header().Set("ETag", c.s3ETag(fileInfo))
+	http.ServeContent(w, r, path.Base(key), time.Unix(fileInfo.TimeStamp, 0), reader)
+}
+
+func (c *Server) proxyS3ObjectFromPeers(w http.ResponseWriter, r *http.Request, fileInfo *FileInfo) bool {
+	var (
+		err         error
+		req         *httplib.BeegoHTTPRequest
+		resp        *http.Response
+		downloadUrl string
+		filename    string
+	)
+	filename = fileInfo.Name
+	if fileInfo.ReName != "" {
+		filename = fileInfo.ReName
+	}
+	p := strings.Replace(fileInfo.Path, STORE_DIR_NAME+"/", "", 1)
+	for _, peer := range c.GetHolderPeers(fileInfo) {
+		if Config().SupportGroupManage {
+			downloadUrl = peer + "/" + Config().Group + "/" + p + "/" + filename
+		} else {
+			downloadUrl = peer + "/" + p + "/" + filename
+		}
+		req = httplib.NewBeegoRequest(downloadUrl+"?download=0", r.Method)
+		req.SetTimeout(time.Second*5, time.Second*600)
+		if v := r.Header.Get("Range"); v != "" {
+			req.Header("Range", v)
+		}
+		if resp, err = req.DoRequest(); err != nil {
+			log.Error(err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			continue
+		}
+		for _, h := range []string{"Content-Length", "Content-Range", "Content-Type", "Last-Modified", "Accept-Ranges"} {
+			if v := resp.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+		w.Header().Set("ETag", c.s3ETag(fileInfo))
+		w.WriteHeader(resp.StatusCode)
+		if _, err = io.Copy(w, resp.Body); err != nil {
+			log.Error(err)
+		}
+		resp.Body.Close()
+		return true
+	}
+	return false
+}
+
+// s3PayloadReader returns the decoded request body, it is aws-chunked when
+// the client signs every chunk.
+func (c *Server) s3PayloadReader(r *http.Request, sign *s3Signature) (io.Reader, error) {
+	if sign != nil && sign.payloadHash == CONST_S3_STREAMING_PAYLOAD {
+		return c.newS3ChunkedReader(r.Body, sign)
+	}
+	return r.Body, nil
+}
+
+// SaveS3Object stores reader as bucket/key and returns the md5 of the content
+// for the ETag. The metadata, dedup and the sync to peers are the same as for
+// /upload: with enable_distinct_file the key is saved as a reference to the
+// existing content instead of a second copy.
+func (c *Server) SaveS3Object(bucket string, key string, reader io.Reader, payloadHash string, contentMd5 []byte) (*FileInfo, string, error) {
+	var (
+		err      error
+		fileInfo FileInfo
+		old      *FileInfo
+		exist    *FileInfo
+		tmpPath  string
+		fullpath string
+		sum      string
+		size     int64
+		keyId    string
+	)
+	if len(Config().Extensions) > 0 && !c.util.Contains(path.Ext(key), Config().Extensions) {
+		return nil, "", &S3Error{"InvalidArgument", "(error)file extension mismatch"}
+	}
+	tmpPath = STORE_DIR_NAME + "/_tmp/" + time.Now().Format("20060102") + "/" + c.util.GetUUID()
+	sumHash := c.NewFileSumHash()
+	md5Hash := md5.New()
+	shaHash := sha256.New()
+	counter := &countWriter{}
+	reader = io.TeeReader(reader, io.MultiWriter(sumHash, md5Hash, shaHash, counter))
+	if keyId = c.GetSceneKeyId(bucket); keyId != "" {
+		encrypted, err := c.EncryptReader(keyId, reader)
+		if err != nil {
+			return nil, "", err
+		}
+		defer encrypted.Close()
+		reader = encrypted
+	}
+	if size, err = c.storage.Put(tmpPath, reader); err != nil {
+		c.storage.Delete(tmpPath)
+		if _, ok := err.(*S3Error); ok {
+			return nil, "", err
+		}
+		return nil, "", &S3Error{"IncompleteBody", err.Error()}
+	}
+	if payloadHash != "" && payloadHash != CONST_S3_UNSIGNED_PAYLOAD && payloadHash != CONST_S3_STREAMING_PAYLOAD &&
+		payloadHash != hex.EncodeToString(shaHash.Sum(nil)) {
+		c.storage.Delete(tmpPath)
+		return nil, "", &S3Error{"XAmzContentSHA256Mismatch", "x-amz-content-sha256 mismatch"}
+	}
+	sum = hex.EncodeToString(md5Hash.Sum(nil))
+	if contentMd5 != nil && hex.EncodeToString(contentMd5) != sum {
+		c.storage.Delete(tmpPath)
+		return nil, "", &S3Error{"BadDigest", "Content-MD5 mismatch"}
+	}
+	fileInfo.Name = path.Base(key)
+	fileInfo.Path = STORE_DIR_NAME + "/" + bucket
+	if dir := path.Dir(key); dir != "." {
+		fileInfo.Path = fileInfo.Path + "/" + dir
+	}
+	fileInfo.Scene = bucket
+	fileInfo.Size = size
+	if keyId != "" {
+		fileInfo.KeyId = keyId
+		fileInfo.OrigSize = counter.n
+	}
+	fileInfo.TimeStamp = time.Now().Unix()
+	fileInfo.OffSet = -1
+	fileInfo.Peers = []string{c.host}
+	fullpath = c.GetFilePathByInfo(&fileInfo, false)
+	if Config().EnableDistinctFile {
+		fileInfo.Md5 = fmt.Sprintf("%x", sumHash.Sum(nil))
+	} else {
+		fileInfo.Md5 = c.util.MD5(fullpath)
+	}
+	c.lockMap.LockKey(fullpath)
+	defer c.lockMap.UnLockKey(fullpath)
+	if old, _ = c.GetFileInfoFromLevelDB(c.util.MD5(fullpath)); old != nil && old.Md5 != fileInfo.Md5 {
+		// the bytes at fullpath may be the url of other uploads as well
+		for _, v := range c.GetFileRefs(old.Md5) {
+			if v.RefId != old.RefId && !v.Ref && c.GetFilePathByInfo(v, false) == fullpath {
+				c.storage.Delete(tmpPath)
+				return nil, "", &S3Error{"OperationAborted", "the object is shared by other uploads"}
+			}
+		}
+		if err = c.releaseS3Object(old); err != nil {
+			c.storage.Delete(tmpPath)
+			return nil, "", err
+		}
+	}
+	if Config().EnableDistinctFile {
+		if exist, _ = c.GetFileInfoFromLevelDB(fileInfo.Md5); exist != nil && exist.Md5 != "" &&
+			c.GetFilePathByInfo(exist, false) != fullpath && c.CheckFileExistByInfo(exist.Md5, exist) {
+			c.storage.Delete(tmpPath)
+			ref := c.NewFileRef(exist, &fileInfo)
+			if err = c.SaveFileRef(ref); err != nil {
+				return nil, "", err
+			}
+			c.SyncFileRefToPeers(ref)
+			return ref, sum, nil
+		}
+	}
+	if err = c.storage.Rename(tmpPath, fullpath); err != nil {
+		c.storage.Delete(tmpPath)
+		return nil, "", err
+	}
+	log.Info(fmt.Sprintf("s3 upload: %s", fullpath))
+	c.saveFileMd5Log(&fileInfo, CONST_FILE_Md5_FILE_NAME)
+	go c.postFileToPeer(&fileInfo)
+	return &fileInfo, sum, nil
+}
+
+func (c *Server) s3ContentMd5(r *http.Request) ([]byte, error) {
+	var (
+		err    error
+		expect []byte
+	)
+	v := r.Header.Get("Content-Md5")
+	if v == "" {
+		return nil, nil
+	}
+	if expect, err = base64.StdEncoding.DecodeString(v); err != nil || len(expect) != md5.Size {
+		return nil, &S3Error{"InvalidDigest", "invalid Content-MD5"}
+	}
+	return expect, nil
+}
+
+func (c *Server) s3PayloadHash(sign *s3Signature) string {
+	if sign == nil {
+		return ""
+	}
+	return sign.payloadHash
+}
+
+func (c *Server) S3PutObject(w http.ResponseWriter, r *http.Request, sign *s3Signature, bucket string, key string) {
+	var (
+		err        error
+		reader     io.Reader
+		contentMd5 []byte
+		fileInfo   *FileInfo
+	)
+	if contentMd5, err = c.s3ContentMd5(r); err != nil {
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	if reader, err = c.s3PayloadReader(r, sign); err != nil {
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	if fileInfo, _, err = c.SaveS3Object(bucket, key, reader, c.s3PayloadHash(sign), contentMd5); err != nil {
+		log.Error(err)
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	// the same tag as a GET of the object
+	w.Header().Set("ETag", c.s3ETag(fileInfo))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *Server) S3CopyObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	var (
+		err       error
+		source    string
+		srcInfo   *FileInfo
+		fileInfo  *FileInfo
+		reader    io.ReadSeeker
+		closer    io.Closer
+		srcBucket string
+		srcKey    string
+	)
+	if source, err = url.PathUnescape(r.Header.Get("X-Amz-Copy-Source")); err != nil {
+		c.s3WriteError(w, r, "InvalidArgument", "x-amz-copy-source")
+		return
+	}
+	source = strings.SplitN(strings.TrimPrefix(source, "/"), "?", 2)[0]
+	if parts := strings.SplitN(source, "/", 2); len(parts) == 2 {
+		srcBucket, srcKey = parts[0], parts[1]
+	}
+	if !c.CheckS3Bucket(srcBucket) {
+		c.s3WriteError(w, r, "NoSuchBucket", srcBucket)
+		return
+	}
+	if srcInfo, err = c.GetS3Object(srcBucket, srcKey); err != nil {
+		c.s3WriteError(w, r, "NoSuchKey", srcKey)
+		return
+	}
+	if reader, closer, err = c.getS3ObjectReader(srcInfo); err != nil {
+		log.Error(err)
+		c.s3WriteError(w, r, "NoSuchKey", srcKey)
+		return
+	}
+	defer closer.Close()
+	if fileInfo, _, err = c.SaveS3Object(bucket, key, reader, "", nil); err != nil {
+		log.Error(err)
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	c.s3WriteXML(w, http.StatusOK, s3CopyObjectResult{
+		LastModified: time.Unix(fileInfo.TimeStamp, 0).UTC().Format(time.RFC3339),
+		ETag:         c.s3ETag(fileInfo),
+	})
+}
+
+// releaseS3Object drops the reference of the key old is stored at to its
+// content, the content is deleted with its last reference.
+func (c *Server) releaseS3Object(old *FileInfo) error {
+	var (
+		err     error
+		content *FileInfo
+	)
+	c.RemoveS3ObjectIndex(old)
+	if _, last := c.ReleaseFileRef(old, old.RefId); !last {
+		return nil
+	}
+	if content, err = c.GetFileInfoFromLevelDB(old.Md5); err != nil {
+		content = old
+	}
+	c.saveFileMd5Log(content, CONST_REMOME_Md5_FILE_NAME)
+	if content.Shards != nil {
+		c.RemoveShards(content)
+		return nil
+	}
+	cpath := c.GetFilePathByInfo(content, false)
+	if err = c.storage.Delete(cpath); err != nil && c.StorageFileExists(cpath) {
+		return err
+	}
+	return nil
+}
+
+// DeleteS3Object removes bucket/key, the content is only deleted (here and on
+// the peers) with its last reference.
+func (c *Server) DeleteS3Object(bucket string, key string) error {
+	var (
+		err      error
+		fileInfo *FileInfo
+		fullpath string
+	)
+	fullpath = STORE_DIR_NAME + "/" + bucket + "/" + key
+	c.lockMap.LockKey(fullpath)
+	defer c.lockMap.UnLockKey(fullpath)
+	if fileInfo, err = c.GetFileInfoFromLevelDB(c.util.MD5(fullpath)); err != nil {
+		// an index entry of a deduped key written before references were kept
+		return c.RemoveKeyFromLevelDB(c.s3IndexKey(bucket, key), c.ldb)
+	}
+	if err = c.releaseS3Object(fileInfo); err != nil {
+		return err
+	}
+	c.RemoveFileFromPeers(fileInfo.Md5, fileInfo.RefId, "", fileInfo.Md5)
+	return nil
+}
+
+func (c *Server) S3DeleteObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	if err := c.DeleteS3Object(bucket, key); err != nil {
+		log.Error(err)
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Server) s3UploadDir(uploadId string) string {
+	return STORE_DIR_NAME + "/_tmp/s3/" + uploadId
+}
+
+func (c *Server) getS3MultipartUpload(bucket string, key string, uploadId string) (*s3MultipartUpload, error) {
+	var (
+		err    error
+		data   []byte
+		upload s3MultipartUpload
+		file   StorageFile
+	)
+	if len(uploadId) != 32 || strings.ContainsAny(uploadId, "/.") {
+		return nil, &S3Error{"NoSuchUpload", uploadId}
+	}
+	if file, err = c.storage.Get(c.s3UploadDir(uploadId) + "/upload.json"); err != nil {
+		return nil, &S3Error{"NoSuchUpload", uploadId}
+	}
+	defer file.Close()
+	if data, err = ioutil.ReadAll(file); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &upload); err != nil || upload.Bucket != bucket || upload.Key != key {
+		return nil, &S3Error{"NoSuchUpload", uploadId}
+	}
+	return &upload, nil
+}
+
+func (c *Server) S3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	var (
+		err      error
+		data     []byte
+		uploadId string
+	)
+	uploadId = c.util.MD5(c.util.GetUUID())
+	data, _ = json.Marshal(s3MultipartUpload{Bucket: bucket, Key: key, TimeStamp: time.Now().Unix()})
+	if _, err = c.storage.Put(c.s3UploadDir(uploadId)+"/upload.json", bytes.NewReader(data)); err != nil {
+		log.Error(err)
+		c.s3WriteError(w, r, "InternalError", err.Error())
+		return
+	}
+	c.s3WriteXML(w, http.StatusOK, s3InitiateMultipartUploadResult{
+		Xmlns:    CONST_S3_XMLNS,
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: uploadId,
+	})
+}
+
+func (c *Server) S3UploadPart(w http.ResponseWriter, r *http.Request, sign *s3Signature, bucket string, key string) {
+	var (
+		err        error
+		partNumber int
+		reader     io.Reader
+		contentMd5 []byte
+	)
+	uploadId := r.URL.Query().Get("uploadId")
+	if _, err = c.getS3MultipartUpload(bucket, key, uploadId); err != nil {
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	if partNumber, err = strconv.Atoi(r.URL.Query().Get("partNumber")); err != nil || partNumber < 1 || partNumber > 10000 {
+		c.s3WriteError(w, r, "InvalidArgument", "partNumber")
+		return
+	}
+	if contentMd5, err = c.s3ContentMd5(r); err != nil {
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	if reader, err = c.s3PayloadReader(r, sign); err != nil {
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	md5Hash := md5.New()
+	shaHash := sha256.New()
+	partPath := fmt.Sprintf("%s/%05d", c.s3UploadDir(uploadId), partNumber)
+	if _, err = c.storage.Put(partPath, io.TeeReader(reader, io.MultiWriter(md5Hash, shaHash))); err != nil {
+		c.storage.Delete(partPath)
+		c.s3WriteError(w, r, "IncompleteBody", err.Error())
+		return
+	}
+	payloadHash := c.s3PayloadHash(sign)
+	if payloadHash != "" && payloadHash != CONST_S3_UNSIGNED_PAYLOAD && payloadHash != CONST_S3_STREAMING_PAYLOAD &&
+		payloadHash != hex.EncodeToString(shaHash.Sum(nil)) {
+		c.storage.Delete(partPath)
+		c.s3WriteError(w, r, "XAmzContentSHA256Mismatch", "x-amz-content-sha256 mismatch")
+		return
+	}
+	if contentMd5 != nil && !bytes.Equal(contentMd5, md5Hash.Sum(nil)) {
+		c.storage.Delete(partPath)
+		c.s3WriteError(w, r, "BadDigest", "Content-MD5 mismatch")
+		return
+	}
+	w.Header().Set("ETag", "\""+hex.EncodeToString(md5Hash.Sum(nil))+"\"")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *Server) S3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	var (
+		err      error
+		complete s3CompleteMultipartUpload
+		readers  []io.Reader
+		files    []StorageFile
+		sum      []byte
+		data     []byte
+		fileInfo *FileInfo
+	)
+	uploadId := r.URL.Query().Get("uploadId")
+	if _, err = c.getS3MultipartUpload(bucket, key, uploadId); err != nil {
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	if data, err = ioutil.ReadAll(io.LimitReader(r.Body, 10*1024*1024)); err != nil {
+		c.s3WriteError(w, r, "IncompleteBody", err.Error())
+		return
+	}
+	if err = xml.Unmarshal(data, &complete); err != nil || len(complete.Parts) == 0 {
+		c.s3WriteError(w, r, "MalformedXML", "CompleteMultipartUpload")
+		return
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			c.s3WriteError(w, r, "InvalidPartOrder", strconv.Itoa(part.PartNumber))
+			return
+		}
+		partPath := fmt.Sprintf("%s/%05d", c.s3UploadDir(uploadId), part.PartNumber)
+		file, err := c.storage.Get(partPath)
+		if err != nil {
+			c.s3WriteError(w, r, "InvalidPart", strconv.Itoa(part.PartNumber))
+			return
+		}
+		files = append(files, file)
+		h := md5.New()
+		if _, err = io.Copy(h, file); err != nil {
+			c.s3WriteError(w, r, "InternalError", err.Error())
+			return
+		}
+		sum = h.Sum(nil)
+		if strings.Trim(part.ETag, "\"") != hex.EncodeToString(sum) {
+			c.s3WriteError(w, r, "InvalidPart", strconv.Itoa(part.PartNumber))
+			return
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			c.s3WriteError(w, r, "InternalError", err.Error())
+			return
+		}
+		readers = append(readers, file)
+	}
+	if fileInfo, _, err = c.SaveS3Object(bucket, key, io.MultiReader(readers...), "", nil); err != nil {
+		log.Error(err)
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	c.removeS3MultipartUpload(uploadId)
+	c.s3WriteXML(w, http.StatusOK, s3CompleteMultipartUploadResult{
+		Xmlns:    CONST_S3_XMLNS,
+		Location: s3ObjectURL(bucket, key),
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     c.s3ETag(fileInfo),
+	})
+}
+
+func (c *Server) removeS3MultipartUpload(uploadId string) {
+	var (
+		err error
+		fis []os.FileInfo
+	)
+	dir := c.s3UploadDir(uploadId)
+	if fis, err = c.storage.List(dir); err != nil {
+		return
+	}
+	for _, fi := range fis {
+		c.storage.Delete(dir + "/" + fi.Name())
+	}
+	c.storage.Delete(dir)
+}
+
+func (c *Server) S3AbortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	uploadId := r.URL.Query().Get("uploadId")
+	if _, err := c.getS3MultipartUpload(bucket, key, uploadId); err != nil {
+		c.s3WriteError(w, r, c.s3ErrorCode(err), err.Error())
+		return
+	}
+	c.removeS3MultipartUpload(uploadId)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestS3MultipartUpload(t *testing.T) {
+	var (
+		initiate s3InitiateMultipartUploadResult
+		complete s3CompleteMultipartUploadResult
+		body     strings.Builder
+	)
+	c := newTestServer(t, "", &GlobalConfig{EnableS3: true})
+	for _, key := range []string{"..", "a/../b", "../a", "a/..", "a//b", "/a", "a/"} {
+		if c.CheckS3Key(key) {
+			t.Error("key accepted", key)
+		}
+	}
+	if !c.CheckS3Key("a/..b/c") {
+		t.Error("key refused", "a/..b/c")
+	}
+	w := httptest.NewRecorder()
+	c.S3CreateMultipartUpload(w, httptest.NewRequest(http.MethodPost, "/bucket/a.txt?uploads", nil), "bucket", "a.txt")
+	if err := xml.Unmarshal(w.Body.Bytes(), &initiate); err != nil || initiate.UploadId == "" {
+		t.Fatal("initiate", w.Body.String(), err)
+	}
+	body.WriteString("<CompleteMultipartUpload>")
+	for i, part := range []string{"hello ", "world"} {
+		w = httptest.NewRecorder()
+		uri := fmt.Sprintf("/bucket/a.txt?partNumber=%d&uploadId=%s", i+1, initiate.UploadId)
+		c.S3UploadPart(w, httptest.NewRequest(http.MethodPut, uri, strings.NewReader(part)), nil, "bucket", "a.txt")
+		fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, w.Header().Get("ETag"))
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/bucket/a.txt?uploadId="+initiate.UploadId, strings.NewReader(body.String()))
+	c.S3CompleteMultipartUpload(w, r, "bucket", "a.txt")
+	if err := xml.Unmarshal(w.Body.Bytes(), &complete); err != nil {
+		t.Fatal("complete", w.Body.String(), err)
+	}
+	// the etag of the upload is the one of the object it made
+	w = httptest.NewRecorder()
+	c.S3GetObject(w, httptest.NewRequest(http.MethodGet, "/bucket/a.txt", nil), "bucket", "a.txt")
+	if w.Body.String() != "hello world" || complete.ETag != w.Header().Get("ETag") {
+		t.Error("etag", complete.ETag, w.Header().Get("ETag"), w.Body.String())
+	}
+}
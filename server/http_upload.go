@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -33,13 +34,33 @@ func (c *Server) SyncFileInfo(w http.ResponseWriter, r *http.Request) {
 		log.Error(err)
 		return
 	}
-	if fileInfo.OffSet == -2 {
+	if c.IsDeleted(&fileInfo) {
+		// the sender has not replayed the delete yet
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte("(error) deleted"))
+		return
+	}
+	if c.IsPlacedOn(&fileInfo, c.host) && c.IsReadOnly() {
+		// nothing is recorded, the sender keeps the file in its error log and retries
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write([]byte("(error) readonly"))
+		return
+	}
+	accepted := c.acceptFileVersion(&fileInfo)
+	if !accepted {
+		// a newer version is here already, the older ones come archived
+	} else if fileInfo.OffSet == -2 {
 		// optimize migrate
 		c.SaveFileInfoToLevelDB(fileInfo.Md5, &fileInfo, c.ldb)
+	} else if !c.IsPlacedOn(&fileInfo, c.host) {
+		// not in the placement set, keep the metadata only
+		c.SaveFileMd5Log(&fileInfo, CONST_FILE_Md5_FILE_NAME)
 	} else {
 		c.SaveFileMd5Log(&fileInfo, CONST_Md5_QUEUE_FILE_NAME)
 	}
-	c.AppendToDownloadQueue(&fileInfo)
+	if accepted && c.IsPlacedOn(&fileInfo, c.host) {
+		c.AppendToDownloadQueue(&fileInfo)
+	}
 	filename = fileInfo.Name
 	if fileInfo.ReName != "" {
 		filename = fileInfo.ReName
@@ -78,6 +99,13 @@ func (c *Server) Upload(w http.ResponseWriter, r *http.Request) {
 		c.upload(w, r)
 		return
 	}
+	if err = c.CheckDiskSpace(r.ContentLength); err != nil {
+		// refuse before the body is spooled to _tmp
+		log.Warn(err)
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	folder = STORE_DIR + "/_tmp/" + time.Now().Format("20060102")
 	if !c.util.FileExists(folder) {
 		if err = os.MkdirAll(folder, 0777); err != nil {
@@ -93,6 +121,8 @@ func (c *Server) Upload(w http.ResponseWriter, r *http.Request) {
 	}
 	if _, err = io.Copy(fpTmp, r.Body); err != nil {
 		log.Error(err)
+		fpTmp.Close()
+		os.Remove(fn)
 		w.Write([]byte(err.Error()))
 		return
 	}
@@ -220,11 +250,21 @@ func (c *Server) upload(w http.ResponseWriter, r *http.Request) {
 			log.Error(err)
 			return
 		}
+		if fileInfo.Meta, err = c.GetRequestMeta(r); err != nil {
+			result.Message = err.Error()
+			w.Write([]byte(c.util.JsonEncodePretty(result)))
+			return
+		}
 		if err != nil {
 			log.Error(err)
 			http.Redirect(w, r, "/", http.StatusMovedPermanently)
 			return
 		}
+		if fpath := c.getUploadVersionPath(&fileInfo, uploadHeader.Filename); fpath != "" {
+			// the latest version is read, archived and replaced by one upload at a time
+			c.lockMap.LockKey(fpath)
+			defer c.lockMap.UnLockKey(fpath)
+		}
 		if _, err = c.SaveUploadFile(uploadFile, uploadHeader, &fileInfo, r); err != nil {
 			result.Message = err.Error()
 			log.Error(err)
@@ -233,9 +273,10 @@ func (c *Server) upload(w http.ResponseWriter, r *http.Request) {
 		}
 		if Config().EnableDistinctFile {
 			if v, _ := c.GetFileInfoFromLevelDB(fileInfo.Md5); v != nil && v.Md5 != "" {
+				v = c.AddDedupRef(v, &fileInfo)
 				fileResult = c.BuildFileResult(v, r)
 				if c.GetFilePathByInfo(&fileInfo, false) != c.GetFilePathByInfo(v, false) {
-					os.Remove(c.GetFilePathByInfo(&fileInfo, false))
+					c.storage.Delete(c.GetFilePathByInfo(&fileInfo, false))
 				}
 				if output == "json" || output == "json2" {
 					if output == "json2" {
@@ -336,10 +377,14 @@ func (c *Server) upload(w http.ResponseWriter, r *http.Request) {
 
 func (c *Server) SaveUploadFile(file multipart.File, header *multipart.FileHeader, fileInfo *FileInfo, r *http.Request) (*FileInfo, error) {
 	var (
-		err     error
-		outFile *os.File
-		folder  string
-		fi      os.FileInfo
+		err    error
+		folder string
+		size   int64
+		codec  string
+		keyId  string
+		reader io.Reader
+		cur    *FileInfo
+		target string
 	)
 	defer file.Close()
 	_, fileInfo.Name = filepath.Split(header.Filename)
@@ -366,55 +411,86 @@ func (c *Server) SaveUploadFile(file multipart.File, header *multipart.FileHeade
 			folder = STORE_DIR + "/" + fileInfo.Path
 		}
 	}
-	if !c.util.FileExists(folder) {
-		if err = os.MkdirAll(folder, 0775); err != nil {
-			log.Error(err)
-		}
-	}
+	folder = c.GetStoragePath(folder)
 	outPath := fmt.Sprintf(folder+"/%s", fileInfo.Name)
 	if fileInfo.ReName != "" {
 		outPath = fmt.Sprintf(folder+"/%s", fileInfo.ReName)
 	}
-	if c.util.FileExists(outPath) && Config().EnableDistinctFile {
+	if fileInfo.Path != "" && c.IsVersionedScene(fileInfo.Scene) {
+		// written aside, the latest version is archived once the upload completed
+		fileInfo.Version = c.NewFileVersion()
+		if cur, _ = c.GetFileInfoFromLevelDB(c.util.MD5(outPath)); cur != nil {
+			target = outPath
+			outPath = outPath + "_" + fileInfo.Version
+		}
+	} else if c.StorageFileExists(outPath) && Config().EnableDistinctFile {
 		for i := 0; i < 10000; i++ {
 			outPath = fmt.Sprintf(folder+"/%d_%s", i, filepath.Base(header.Filename))
 			fileInfo.Name = fmt.Sprintf("%d_%s", i, header.Filename)
-			if !c.util.FileExists(outPath) {
+			if !c.StorageFileExists(outPath) {
 				break
 			}
 		}
 	}
 	log.Info(fmt.Sprintf("upload: %s", outPath))
-	if outFile, err = os.Create(outPath); err != nil {
-		return fileInfo, err
-	}
-	defer outFile.Close()
-	if err != nil {
-		log.Error(err)
-		return fileInfo, errors.New("(error)fail," + err.Error())
+	sumHash := c.NewFileSumHash()
+	counter := &countWriter{}
+	reader = io.TeeReader(file, io.MultiWriter(sumHash, counter))
+	// merged small files are not compressed
+	if !Config().EnableMergeSmallFile || header.Size >= CONST_SMALL_FILE_SIZE {
+		codec = c.GetCompressCodec(fileInfo.Scene, fileInfo.Name, header.Header.Get("Content-Type"))
+	}
+	if codec != "" {
+		compressed, err := CompressReader(codec, reader)
+		if err != nil {
+			return fileInfo, errors.New("(error)fail," + err.Error())
+		}
+		defer compressed.Close()
+		reader = compressed
 	}
-	if _, err = io.Copy(outFile, file); err != nil {
-		log.Error(err)
-		return fileInfo, errors.New("(error)fail," + err.Error())
+	// merged small files carry the ciphertext into their needle
+	if keyId = c.GetSceneKeyId(fileInfo.Scene); keyId != "" {
+		encrypted, err := c.EncryptReader(keyId, reader)
+		if err != nil {
+			return fileInfo, errors.New("(error)fail," + err.Error())
+		}
+		defer encrypted.Close()
+		reader = encrypted
 	}
-	if fi, err = outFile.Stat(); err != nil {
+	if size, err = c.storage.Put(outPath, reader); err != nil {
 		log.Error(err)
+		c.storage.Delete(outPath)
 		return fileInfo, errors.New("(error)fail," + err.Error())
-	} else {
-		fileInfo.Size = fi.Size()
 	}
-	if fi.Size() != header.Size {
+	fileInfo.Size = size
+	if counter.n != header.Size {
+		c.storage.Delete(outPath)
 		return fileInfo, errors.New("(error)file uncomplete")
 	}
+	if target != "" {
+		if cur, err = c.ArchiveFileVersion(cur); err == nil {
+			c.SyncFileVersionToPeers(cur)
+			err = c.storage.Rename(outPath, target)
+		}
+		if err != nil {
+			c.storage.Delete(outPath)
+			return fileInfo, errors.New("(error)fail," + err.Error())
+		}
+		outPath = target
+	}
+	if codec != "" || keyId != "" {
+		fileInfo.Codec = codec
+		fileInfo.KeyId = keyId
+		fileInfo.OrigSize = counter.n
+	}
 	v := "" // c.util.GetFileSum(outFile, Config().FileSumArithmetic)
 	if Config().EnableDistinctFile {
-		v = c.util.GetFileSum(outFile, Config().FileSumArithmetic)
+		v = fmt.Sprintf("%x", sumHash.Sum(nil))
 	} else {
 		v = c.util.MD5(c.GetFilePathByInfo(fileInfo, false))
 	}
 	fileInfo.Md5 = v
-	//fileInfo.Path = folder //strings.Replace( folder,DOCKER_DIR,"",1)
-	fileInfo.Path = strings.Replace(folder, DOCKER_DIR, "", 1)
+	fileInfo.Path = folder
 	fileInfo.Peers = append(fileInfo.Peers, c.host)
 	//fmt.Println("upload", fileInfo)
 	return fileInfo, nil
@@ -425,8 +501,8 @@ func (c *Server) SaveSmallFile(fileInfo *FileInfo) error {
 		err      error
 		filename string
 		fpath    string
-		srcFile  *os.File
-		desFile  *os.File
+		data     []byte
+		srcFile  StorageFile
 		largeDir string
 		destPath string
 		reName   string
@@ -437,44 +513,29 @@ func (c *Server) SaveSmallFile(fileInfo *FileInfo) error {
 	if fileInfo.ReName != "" {
 		filename = fileInfo.ReName
 	}
-	fpath = DOCKER_DIR + fileInfo.Path + "/" + filename
-	largeDir = LARGE_DIR + "/" + Config().PeerId
-	if !c.util.FileExists(largeDir) {
-		os.MkdirAll(largeDir, 0775)
-	}
+	fpath = fileInfo.Path + "/" + filename
+	largeDir = c.GetStoragePath(LARGE_DIR + "/" + Config().PeerId)
 	reName = fmt.Sprintf("%d", c.util.RandInt(100, 300))
-	destPath = largeDir + "/" + reName
-	c.lockMap.LockKey(destPath)
+	destPath = c.LockSmallFileVolume(largeDir + "/" + reName)
 	defer c.lockMap.UnLockKey(destPath)
-	if c.util.FileExists(fpath) {
-		srcFile, err = os.OpenFile(fpath, os.O_CREATE|os.O_RDONLY, 06666)
-		if err != nil {
+	reName = path.Base(destPath)
+	if c.StorageFileExists(fpath) {
+		if srcFile, err = c.storage.Get(fpath); err != nil {
 			return err
 		}
 		defer srcFile.Close()
-		desFile, err = os.OpenFile(destPath, os.O_CREATE|os.O_RDWR, 06666)
-		if err != nil {
+		if data, err = ioutil.ReadAll(srcFile); err != nil {
 			return err
 		}
-		defer desFile.Close()
-		fileInfo.OffSet, err = desFile.Seek(0, 2)
-		if _, err = desFile.Write([]byte("1")); err != nil {
-			//first byte set 1
-			return err
-		}
-		fileInfo.OffSet, err = desFile.Seek(0, 2)
-		if err != nil {
-			return err
-		}
-		fileInfo.OffSet = fileInfo.OffSet - 1 //minus 1 byte
-		fileInfo.Size = fileInfo.Size + 1
-		fileInfo.ReName = fmt.Sprintf("%s,%d,%d,%s", reName, fileInfo.OffSet, fileInfo.Size, fileExt)
-		if _, err = io.Copy(desFile, srcFile); err != nil {
+		needle := NewNeedle(fileInfo, data)
+		if fileInfo.OffSet, err = c.WriteNeedle(destPath, -1, needle); err != nil {
 			return err
 		}
+		fileInfo.Size = int64(len(data))
+		fileInfo.ReName = fmt.Sprintf("%s,%d,%d,%s", reName, fileInfo.OffSet, needle.Size(), fileExt)
 		srcFile.Close()
-		os.Remove(fpath)
-		fileInfo.Path = strings.Replace(largeDir, DOCKER_DIR, "", 1)
+		c.storage.Delete(fpath)
+		fileInfo.Path = largeDir
 	}
 	return nil
 }
@@ -511,4 +572,4 @@ func (c *Server) Report(w http.ResponseWriter, r *http.Request) {
 	} else {
 		w.Write([]byte(c.GetClusterNotPermitMessage(r)))
 	}
-}
\ No newline at end of file
+}
@@ -1,22 +1,17 @@
 package server
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
-	"io"
 	slog "log"
 	"net/http"
 	"os"
 	"path"
 	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/astaxie/beego/httplib"
-	"github.com/busyfree/tusd/pkg/filestore"
 	"github.com/busyfree/tusd/pkg/handler"
 	log "github.com/sjqzhang/seelog"
 )
@@ -27,11 +22,11 @@ func (c *Server) initTus() {
 		fileLog *os.File
 		bigDir  string
 	)
-	BIG_DIR := STORE_DIR + "/_big/" + Config().PeerId
-	os.MkdirAll(BIG_DIR, 0775)
+	BIG_DIR := c.GetStoragePath(STORE_DIR + "/" + CONST_BIG_DIR_NAME + "/" + Config().PeerId)
 	os.MkdirAll(LOG_DIR, 0775)
-	store := filestore.FileStore{
-		Path: BIG_DIR,
+	store := &StorageTusStore{
+		Path:   BIG_DIR,
+		server: c,
 	}
 	if fileLog, err = os.OpenFile(LOG_DIR+"/tusd.log", os.O_CREATE|os.O_RDWR, 0666); err != nil {
 		log.Error(err)
@@ -59,57 +54,6 @@ func (c *Server) initTus() {
 		bigDir = fmt.Sprintf("/%s%s", Config().Group, CONST_BIG_UPLOAD_PATH_SUFFIX)
 	}
 	composer := handler.NewStoreComposer()
-	// support raw tus upload and download
-	store.GetReaderExt = func(id string) (io.Reader, error) {
-		var (
-			offset int64
-			err    error
-			length int
-			buffer []byte
-			fi     *FileInfo
-			fn     string
-		)
-		if fi, err = c.GetFileInfoFromLevelDB(id); err != nil {
-			log.Error(err)
-			return nil, err
-		} else {
-			if Config().AuthUrl != "" {
-				fileResult := c.util.JsonEncodePretty(c.BuildFileResult(fi, nil))
-				bufferReader := bytes.NewBuffer([]byte(fileResult))
-				return bufferReader, nil
-			}
-			fn = fi.Name
-			if fi.ReName != "" {
-				fn = fi.ReName
-			}
-			fp := DOCKER_DIR + fi.Path + "/" + fn
-			if c.util.FileExists(fp) {
-				log.Info(fmt.Sprintf("download:%s", fp))
-				return os.Open(fp)
-			}
-			ps := strings.Split(fp, ",")
-			if len(ps) > 2 && c.util.FileExists(ps[0]) {
-				if length, err = strconv.Atoi(ps[2]); err != nil {
-					return nil, err
-				}
-				if offset, err = strconv.ParseInt(ps[1], 10, 64); err != nil {
-					return nil, err
-				}
-				if buffer, err = c.util.ReadFileByOffSet(ps[0], offset, length); err != nil {
-					return nil, err
-				}
-				if buffer[0] == '1' {
-					bufferReader := bytes.NewBuffer(buffer[1:])
-					return bufferReader, nil
-				} else {
-					msg := "data no sync"
-					log.Error(msg)
-					return nil, errors.New(msg)
-				}
-			}
-			return nil, errors.New(fmt.Sprintf("%s not found", fp))
-		}
-	}
 	store.UseIn(composer)
 	SetupPreHooks := func(composer *handler.StoreComposer) {
 		composer.UseCore(hookDataStore{
@@ -154,9 +98,9 @@ func (c *Server) initTus() {
 				}
 				var err error
 				md5sum := ""
-				oldFullPath := BIG_DIR + "/" + info.Upload.ID + ".bin"
-				infoFullPath := BIG_DIR + "/" + info.Upload.ID + ".info"
-				if md5sum, err = c.util.GetFileSumByName(oldFullPath, Config().FileSumArithmetic); err != nil {
+				oldFullPath := store.binPath(info.Upload.ID)
+				infoFullPath := store.infoPath(info.Upload.ID)
+				if md5sum, err = c.GetFileSumFromStorage(oldFullPath); err != nil {
 					log.Error(err)
 					continue
 				}
@@ -173,15 +117,15 @@ func (c *Server) initTus() {
 				if pathCustom != "" {
 					fpath = "/" + strings.Replace(pathCustom, ".", "", -1) + "/"
 				}
-				newFullPath := STORE_DIR + "/" + scene + fpath + Config().PeerId + "/" + filename
+				newFullPath := STORE_DIR_NAME + "/" + scene + fpath + Config().PeerId + "/" + filename
 				if pathCustom != "" {
-					newFullPath = STORE_DIR + "/" + scene + fpath + filename
+					newFullPath = STORE_DIR_NAME + "/" + scene + fpath + filename
 				}
 				if fi, err := c.GetFileInfoFromLevelDB(md5sum); err != nil {
 					log.Error(err)
 				} else {
-					tpath := c.GetFilePathByInfo(fi, true)
-					if fi.Md5 != "" && c.util.FileExists(tpath) {
+					tpath := c.GetFilePathByInfo(fi, false)
+					if fi.Md5 != "" && c.StorageFileExists(tpath) {
 						var err error
 						var fileInfo *FileInfo
 						if fileInfo, err = c.SaveFileInfoToLevelDB(info.Upload.ID, fi, c.ldb); err != nil {
@@ -190,8 +134,8 @@ func (c *Server) initTus() {
 						log.Info(fmt.Sprintf("file is found md5:%s", fi.Md5))
 						log.Info("remove file:", oldFullPath)
 						log.Info("remove file:", infoFullPath)
-						os.Remove(oldFullPath)
-						os.Remove(infoFullPath)
+						c.storage.Delete(oldFullPath)
+						c.storage.Delete(infoFullPath)
 						go callBack(info.Upload, fileInfo)
 						continue
 					}
@@ -202,8 +146,7 @@ func (c *Server) initTus() {
 					fpath2 = STORE_DIR_NAME + "/" + Config().DefaultScene + fpath
 					fpath2 = strings.TrimRight(fpath2, "/")
 				}
-
-				os.MkdirAll(DOCKER_DIR+fpath2, 0775)
+				meta, _ := c.GetTusMeta(info.Upload.MetaData)
 				fileInfo := &FileInfo{
 					Name:      name,
 					Path:      fpath2,
@@ -213,13 +156,21 @@ func (c *Server) initTus() {
 					Md5:       md5sum,
 					Peers:     []string{c.host},
 					OffSet:    -1,
+					Meta:      meta,
 				}
-				if err = os.Rename(oldFullPath, newFullPath); err != nil {
+				if keyId := c.GetSceneKeyId(scene); keyId != "" {
+					if fileInfo.Size, err = c.EncryptStorageFile(keyId, oldFullPath, newFullPath); err != nil {
+						log.Error(err)
+						continue
+					}
+					fileInfo.KeyId = keyId
+					fileInfo.OrigSize = info.Upload.Size
+				} else if err = c.storage.Rename(oldFullPath, newFullPath); err != nil {
 					log.Error(err)
 					continue
 				}
 				log.Info(fileInfo)
-				os.Remove(infoFullPath)
+				c.storage.Delete(infoFullPath)
 				if _, err = c.SaveFileInfoToLevelDB(info.Upload.ID, fileInfo, c.ldb); err != nil {
 					//assosiate file id
 					log.Error(err)
@@ -304,6 +255,18 @@ func (c *Server) initComponent(isReload bool) {
 	if Config().RetryCount == 0 {
 		Config().RetryCount = 3
 	}
+	if Config().RetryInterval <= 0 {
+		Config().RetryInterval = 10
+	}
+	if Config().PeerSyncWorker <= 0 {
+		Config().PeerSyncWorker = 10
+	}
+	if Config().BreakerFailures <= 0 {
+		Config().BreakerFailures = 5
+	}
+	if Config().BreakerCooldown <= 0 {
+		Config().BreakerCooldown = 30
+	}
 	if Config().SyncDelay == 0 {
 		Config().SyncDelay = 60
 	}
@@ -316,4 +279,62 @@ func (c *Server) initComponent(isReload bool) {
 	if Config().ImageMaxWidth == 0 {
 		Config().ImageMaxWidth = 2000
 	}
+	if Config().S3Addr == "" {
+		Config().S3Addr = ":9000"
+	}
+	if Config().S3Region == "" {
+		Config().S3Region = "us-east-1"
+	}
+	if Config().DiskLowWatermark <= 0 {
+		Config().DiskLowWatermark = 85
+	}
+	if Config().DiskCritWatermark <= 0 {
+		Config().DiskCritWatermark = 95
+	}
+	if Config().TrashExpireDays <= 0 {
+		Config().TrashExpireDays = 7
+	}
+	if Config().SearchMaxCandidates <= 0 {
+		Config().SearchMaxCandidates = 10000
+	}
+	if Config().ScrubInterval <= 0 {
+		Config().ScrubInterval = 24
+	}
+	if Config().ScrubRateLimit <= 0 {
+		Config().ScrubRateLimit = 10
+	}
+	if Config().GossipInterval <= 0 {
+		Config().GossipInterval = 2
+	}
+	if Config().SuspectTimeout <= 0 {
+		Config().SuspectTimeout = 10
+	}
+	if Config().DeadTimeout <= Config().SuspectTimeout {
+		Config().DeadTimeout = 6 * Config().SuspectTimeout
+	}
+	if Config().OplogInterval <= 0 {
+		Config().OplogInterval = 10
+	}
+	if Config().TombstoneDays <= 0 {
+		Config().TombstoneDays = 30
+	}
+	if Config().HaystackCompactRatio <= 0 {
+		Config().HaystackCompactRatio = 0.5
+	}
+	if Config().ErasureDataShards <= 0 {
+		Config().ErasureDataShards = 4
+	}
+	if Config().ErasureParityShards <= 0 {
+		Config().ErasureParityShards = 2
+	}
+	if Config().ErasureMinSize <= 0 {
+		Config().ErasureMinSize = 100 * 1024 * 1024
+	}
+	if err := c.LoadKeyRing(); err != nil {
+		log.Error("LoadKeyRing ", err)
+		if !isReload {
+			// never store files in clear when the keys cannot be read
+			panic(err)
+		}
+	}
 }
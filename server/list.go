@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The directory index keeps the metadata of every path under the key
+// idx_dir_<scene>/<path under files>/<name>_<md5 of the path>, maintained
+// with the search indexes. /list_files walks it like a file system: the
+// files right under a prefix and the folders below it, page by page. Merged
+// small files are listed by the name they were uploaded with, not as the
+// volume they are stored in.
+
+type DirEntry struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Md5     string `json:"md5"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+type DirListing struct {
+	Files     []*DirEntry `json:"files"`
+	Prefixes  []string    `json:"prefixes"`
+	NextToken string      `json:"next_token"`
+}
+
+func (c *Server) dirIndexBase(scene string) string {
+	if scene == "" {
+		scene = Config().DefaultScene
+	}
+	return CONST_INDEX_KEY_PREFIX + "dir_" + scene + "/"
+}
+
+// getDirEntryName is the name fileInfo is listed by.
+func (c *Server) getDirEntryName(fileInfo *FileInfo) string {
+	if fileInfo.ReName != "" && fileInfo.OffSet < 0 {
+		return fileInfo.ReName
+	}
+	return fileInfo.Name
+}
+
+func (c *Server) dirIndexKey(fileInfo *FileInfo, pathMd5 string) string {
+	dir := strings.TrimPrefix(fileInfo.Path, STORE_DIR_NAME+"/")
+	return c.dirIndexBase(fileInfo.Scene) + dir + "/" + c.getDirEntryName(fileInfo) + "_" + pathMd5
+}
+
+func (c *Server) newDirEntry(fileInfo *FileInfo) *DirEntry {
+	p := strings.Replace(c.GetFilePathByInfo(fileInfo, false), STORE_DIR_NAME+"/", "", 1)
+	if Config().SupportGroupManage {
+		p = Config().Group + "/" + p
+	}
+	return &DirEntry{
+		Name:    c.getDirEntryName(fileInfo),
+		Path:    "/" + p,
+		Md5:     fileInfo.Md5,
+		Size:    c.GetContentSize(fileInfo),
+		ModTime: fileInfo.TimeStamp,
+	}
+}
+
+// ListDirIndex returns up to limit files and folders of scene under prefix, a
+// path under files/, from the directory index. With an empty delimiter the
+// files below the folders are listed instead of the folders. date, in
+// yyyyMMdd, lists the files uploaded that day only. token is the next_token
+// of the previous page.
+func (c *Server) ListDirIndex(scene string, prefix string, delimiter string, date string, limit int, token string) (*DirListing, error) {
+	var (
+		ok      bool
+		lastKey string
+		data    []byte
+		err     error
+	)
+	listing := &DirListing{Files: []*DirEntry{}, Prefixes: []string{}}
+	base := c.dirIndexBase(scene)
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(base+prefix)), nil)
+	defer iter.Release()
+	if token == "" {
+		ok = iter.First()
+	} else {
+		if data, err = base64.RawURLEncoding.DecodeString(token); err != nil {
+			return nil, errors.New("(error) invalid token")
+		}
+		ok = iter.Seek(data)
+	}
+	count := 0
+	for ok {
+		key := string(iter.Key())
+		if len(key) < len(base)+len(prefix)+33 {
+			ok = iter.Next()
+			continue
+		}
+		rest := key[len(base)+len(prefix) : len(key)-33]
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			if count >= limit {
+				listing.NextToken = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+				break
+			}
+			folder := prefix + rest[:i+len(delimiter)]
+			listing.Prefixes = append(listing.Prefixes, folder)
+			count++
+			// past every key in the folder
+			lastKey = base + folder + "\xff"
+			ok = iter.Seek([]byte(lastKey))
+			continue
+		}
+		var fileInfo FileInfo
+		if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil {
+			log.Error(err)
+		} else if date == "" || c.util.GetDayFromTimeStamp(fileInfo.TimeStamp) == date {
+			if count >= limit {
+				listing.NextToken = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+				break
+			}
+			listing.Files = append(listing.Files, c.newDirEntry(&fileInfo))
+			count++
+		}
+		lastKey = key + "\x00"
+		ok = iter.Next()
+	}
+	return listing, iter.Error()
+}
+
+// ListFiles lists the files and folders of a scene under a path prefix from
+// the metadata, see ListDirIndex for the parameters.
+func (c *Server) ListFiles(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		result  JsonResult
+		listing *DirListing
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	r.ParseForm()
+	prefix := strings.TrimPrefix(r.FormValue("prefix"), "/")
+	prefix = strings.TrimPrefix(prefix, Config().Group+"/")
+	delimiter := "/"
+	if _, ok := r.Form["delimiter"]; ok {
+		delimiter = r.FormValue("delimiter")
+	}
+	limit := CONST_SEARCH_PAGE_SIZE
+	if v := r.FormValue("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			result.Message = "(error) invalid limit"
+			w.Write([]byte(c.util.JsonEncodePretty(result)))
+			return
+		}
+		if limit > CONST_SEARCH_MAX_PAGE_SIZE {
+			limit = CONST_SEARCH_MAX_PAGE_SIZE
+		}
+	}
+	if listing, err = c.ListDirIndex(r.FormValue("scene"), prefix, delimiter, r.FormValue("date"), limit, r.FormValue("token")); err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	result.Data = listing
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
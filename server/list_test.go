@@ -0,0 +1,53 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestListDirIndex(t *testing.T) {
+	var (
+		err     error
+		listing *DirListing
+	)
+	c := newTestServer(t, "", &GlobalConfig{EnableDistinctFile: true, DefaultScene: "default", Group: "group1", SupportGroupManage: true})
+	for _, v := range []string{"docs/a.txt", "docs/b.txt", "docs/2026/c.txt", "docs/2027/d.txt", "e.txt"} {
+		dir, name := STORE_DIR_NAME, v
+		if i := strings.LastIndex(v, "/"); i >= 0 {
+			dir, name = dir+"/"+v[:i], v[i+1:]
+		}
+		c.saveFileMd5Log(&FileInfo{Name: name, Path: dir, Md5: c.util.MD5(v), Size: 1, OffSet: -1}, CONST_FILE_Md5_FILE_NAME)
+	}
+	// a merged small file is listed by its name
+	c.saveFileMd5Log(&FileInfo{Name: "small.txt", ReName: "123,0,64,.txt", Path: STORE_DIR_NAME + "/haystack/1",
+		Md5: c.util.MD5("small"), Size: 1, OffSet: 0}, CONST_FILE_Md5_FILE_NAME)
+	var got []string
+	token := ""
+	for i := 0; i < 10; i++ {
+		if listing, err = c.ListDirIndex("", "docs/", "/", "", 2, token); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range listing.Prefixes {
+			got = append(got, v)
+		}
+		for _, v := range listing.Files {
+			got = append(got, v.Name)
+		}
+		if token = listing.NextToken; token == "" {
+			break
+		}
+	}
+	if strings.Join(got, ",") != "docs/2026/,docs/2027/,a.txt,b.txt" {
+		t.Error("pages", got)
+	}
+	if listing, _ = c.ListDirIndex("default", "docs/2027/", "", "", 10, ""); len(listing.Files) != 1 || listing.Files[0].Path != "/group1/docs/2027/d.txt" {
+		t.Error("files", listing.Files)
+	}
+	if listing, _ = c.ListDirIndex("", "haystack/", "", "", 10, ""); len(listing.Files) != 1 || listing.Files[0].Name != "small.txt" {
+		t.Error("merged files", listing.Files)
+	}
+	c.saveFileMd5Log(&FileInfo{Name: "a.txt", Path: STORE_DIR_NAME + "/docs", Md5: c.util.MD5("docs/a.txt"), OffSet: -1}, CONST_REMOME_Md5_FILE_NAME)
+	if listing, _ = c.ListDirIndex("", "docs/a", "/", "", 10, ""); len(listing.Files) != 0 {
+		t.Error("deleted file listed", listing.Files)
+	}
+}
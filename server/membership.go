@@ -0,0 +1,380 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/httplib"
+	log "github.com/sjqzhang/seelog"
+)
+
+// With enable_gossip the nodes of a group find each other instead of being
+// listed in every cfg.json. A node only needs one existing node in peers:
+// every gossip_interval seconds it posts its view of the group to a few
+// nodes on /heartbeat and merges the view they answer with. Each node bumps
+// its own heartbeat counter every round, a node whose counter has not moved
+// for suspect_timeout seconds is suspect and after dead_timeout dead. Files
+// are only pushed to and fetched from alive nodes, placement keeps counting
+// suspect and dead nodes so a short outage does not move files around. A
+// node removed with /members?action=remove is left until it heartbeats
+// again. Without enable_gossip the peers of cfg.json are the group and are
+// taken as alive.
+
+type Member struct {
+	Host       string  `json:"host"`
+	PeerId     string  `json:"peer_id"`
+	Group      string  `json:"group"`
+	Version    string  `json:"version"`
+	DiskUsage  float64 `json:"disk_usage"`
+	ReadOnly   bool    `json:"read_only"`
+	Heartbeat  int64   `json:"heartbeat"`
+	State      string  `json:"state"`
+	UpdateTime int64   `json:"update_time"`
+}
+
+type Membership struct {
+	sync.RWMutex
+	members   map[string]*Member
+	heartbeat int64
+	changed   bool
+}
+
+func NewMembership() *Membership {
+	// a restarted node starts above the counter it had before, one round
+	// takes longer than a millisecond. Kept below 2^53 for JsonEncodePretty.
+	return &Membership{members: make(map[string]*Member), heartbeat: time.Now().UnixNano() / int64(time.Millisecond)}
+}
+
+func (c *Server) gossipEnabled() bool {
+	return Config().EnableGossip && c.members != nil
+}
+
+// getPeersByState returns the other nodes of the group in one of states.
+func (c *Server) getPeersByState(states ...string) []string {
+	var (
+		peers []string
+	)
+	c.members.RLock()
+	defer c.members.RUnlock()
+	for host, m := range c.members.members {
+		if host != c.host && c.util.Contains(m.State, states) {
+			peers = append(peers, host)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// GetKnownPeers returns the other nodes of the group that were not removed,
+// whatever their state.
+func (c *Server) GetKnownPeers() []string {
+	if !c.gossipEnabled() {
+		return Config().Peers
+	}
+	return c.getPeersByState(CONST_MEMBER_ALIVE, CONST_MEMBER_SUSPECT, CONST_MEMBER_DEAD)
+}
+
+// GetLivePeers returns the other nodes of the group that are alive.
+func (c *Server) GetLivePeers() []string {
+	if !c.gossipEnabled() {
+		return Config().Peers
+	}
+	return c.getPeersByState(CONST_MEMBER_ALIVE)
+}
+
+func (c *Server) IsPeerAlive(peer string) bool {
+	if !c.gossipEnabled() {
+		return true
+	}
+	c.members.RLock()
+	defer c.members.RUnlock()
+	m, ok := c.members.members[peer]
+	return ok && m.State == CONST_MEMBER_ALIVE
+}
+
+// localMember is the heartbeat of this node.
+func (c *Server) localMember(heartbeat int64) *Member {
+	m := &Member{
+		Host:       c.host,
+		PeerId:     Config().PeerId,
+		Group:      Config().Group,
+		Version:    VERSION,
+		ReadOnly:   c.IsReadOnly(),
+		Heartbeat:  heartbeat,
+		State:      CONST_MEMBER_ALIVE,
+		UpdateTime: time.Now().Unix(),
+	}
+	if usage, err := c.getPlacementUsage(); err == nil {
+		m.DiskUsage = usedPercent(usage, 0)
+	}
+	return m
+}
+
+// GetMembers returns the view of the group of this node, itself included.
+func (c *Server) GetMembers() []*Member {
+	var (
+		members []*Member
+	)
+	c.members.RLock()
+	heartbeat := c.members.heartbeat
+	for _, m := range c.members.members {
+		member := *m
+		members = append(members, &member)
+	}
+	c.members.RUnlock()
+	members = append(members, c.localMember(heartbeat))
+	sort.Slice(members, func(i, j int) bool { return members[i].Host < members[j].Host })
+	return members
+}
+
+// MergeMembers merges the view of another node into the one of this node.
+// Newer heartbeats win, the failure detection stays local.
+func (c *Server) MergeMembers(members []*Member) {
+	now := time.Now().Unix()
+	c.members.Lock()
+	defer c.members.Unlock()
+	for _, m := range members {
+		if m.Host == "" || m.Host == c.host || m.Group != Config().Group {
+			continue
+		}
+		old, ok := c.members.members[m.Host]
+		switch {
+		case !ok || m.Heartbeat > old.Heartbeat:
+			member := *m
+			member.UpdateTime = now
+			if member.State != CONST_MEMBER_LEFT && (ok || member.State != CONST_MEMBER_DEAD) {
+				member.State = CONST_MEMBER_ALIVE
+			}
+			if !ok || old.State != member.State {
+				log.Info(fmt.Sprintf("member %s is %s", member.Host, member.State))
+			}
+			c.members.members[m.Host] = &member
+			c.peerReadOnly.Put(m.Host, m.ReadOnly)
+		case m.Heartbeat == old.Heartbeat && m.State == CONST_MEMBER_LEFT && old.State != CONST_MEMBER_LEFT:
+			old.State = CONST_MEMBER_LEFT
+			log.Info(fmt.Sprintf("member %s is %s", old.Host, old.State))
+		default:
+			continue
+		}
+		c.members.changed = true
+	}
+}
+
+// CheckMembers adds the peers of cfg.json not known yet and marks the nodes
+// whose heartbeat stopped.
+func (c *Server) CheckMembers() {
+	now := time.Now().Unix()
+	c.members.Lock()
+	defer c.members.Unlock()
+	for _, peer := range Config().Peers {
+		if _, ok := c.members.members[peer]; !ok && peer != c.host {
+			c.members.members[peer] = &Member{Host: peer, Group: Config().Group, State: CONST_MEMBER_ALIVE, UpdateTime: now}
+			c.members.changed = true
+		}
+	}
+	for _, m := range c.members.members {
+		if m.State == CONST_MEMBER_LEFT {
+			continue
+		}
+		// only a newer heartbeat brings a member back
+		state := m.State
+		if now-m.UpdateTime > int64(Config().DeadTimeout) {
+			state = CONST_MEMBER_DEAD
+		} else if now-m.UpdateTime > int64(Config().SuspectTimeout) && state == CONST_MEMBER_ALIVE {
+			state = CONST_MEMBER_SUSPECT
+		}
+		if state != m.State {
+			log.Warn(fmt.Sprintf("member %s is %s", m.Host, state))
+			m.State = state
+			c.members.changed = true
+		}
+	}
+}
+
+// RemoveMember marks peer as left, the other nodes learn it by gossip.
+func (c *Server) RemoveMember(peer string) error {
+	c.members.Lock()
+	defer c.members.Unlock()
+	m, ok := c.members.members[peer]
+	if !ok {
+		return errors.New("(error) unknown member " + peer)
+	}
+	m.State = CONST_MEMBER_LEFT
+	c.members.changed = true
+	log.Info(fmt.Sprintf("member %s is %s", peer, m.State))
+	return nil
+}
+
+// gossipTo exchanges the views of the group with peer.
+func (c *Server) gossipTo(peer string) error {
+	var (
+		err     error
+		data    []byte
+		members []*Member
+	)
+	if data, err = json.Marshal(c.GetMembers()); err != nil {
+		return err
+	}
+	result := JsonResult{Data: &members}
+	req := httplib.Post(fmt.Sprintf("%s%s", peer, c.getRequestURI("heartbeat")))
+	req.Header("Content-Type", "application/json")
+	req.Body(data)
+	req.SetTimeout(time.Second*2, time.Second*5)
+	if err = req.ToJSON(&result); err != nil {
+		return err
+	}
+	if result.Status != "ok" {
+		return errors.New(result.Message)
+	}
+	c.MergeMembers(members)
+	return nil
+}
+
+func (c *Server) loadMembers() {
+	var (
+		members []*Member
+	)
+	data, err := c.ldb.Get([]byte(CONST_MEMBERS_KEY), nil)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &members); err != nil {
+		log.Error(err)
+		return
+	}
+	now := time.Now().Unix()
+	c.members.Lock()
+	for _, m := range members {
+		if m.Host != c.host && m.Group == Config().Group {
+			// the clock of a member starts again from now
+			m.UpdateTime = now
+			c.members.members[m.Host] = m
+		}
+	}
+	c.members.Unlock()
+}
+
+func (c *Server) saveMembers() {
+	c.members.Lock()
+	if !c.members.changed {
+		c.members.Unlock()
+		return
+	}
+	c.members.changed = false
+	var members []*Member
+	for _, m := range c.members.members {
+		members = append(members, m)
+	}
+	data, err := json.Marshal(members)
+	c.members.Unlock()
+	if err == nil {
+		err = c.ldb.Put([]byte(CONST_MEMBERS_KEY), data, nil)
+	}
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Gossip runs the rounds of heartbeats of this node.
+func (c *Server) Gossip() {
+	if !c.gossipEnabled() {
+		return
+	}
+	c.loadMembers()
+	for {
+		c.members.Lock()
+		c.members.heartbeat++
+		c.members.Unlock()
+		c.CheckMembers()
+		peers := c.GetKnownPeers()
+		rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+		if len(peers) > CONST_GOSSIP_FANOUT {
+			peers = peers[:CONST_GOSSIP_FANOUT]
+		}
+		for _, peer := range peers {
+			if err := c.gossipTo(peer); err != nil {
+				log.Debug(fmt.Sprintf("gossip to %s: %s", peer, err.Error()))
+			}
+		}
+		c.saveMembers()
+		time.Sleep(time.Second * time.Duration(Config().GossipInterval))
+	}
+}
+
+// HeartBeat merges the view of the group posted by another node and answers
+// with the one of this node.
+func (c *Server) HeartBeat(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		data    []byte
+		result  JsonResult
+		members []*Member
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if !c.gossipEnabled() {
+		result.Message = "gossip is disabled"
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if data, err = ioutil.ReadAll(r.Body); err != nil || json.Unmarshal(data, &members) != nil {
+		result.Message = "invalid members"
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	c.MergeMembers(members)
+	result.Status = "ok"
+	result.Data = c.GetMembers()
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+// Members shows the view of the group of this node. action=join joins the
+// group of peer, action=remove removes peer from the group.
+func (c *Server) Members(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		result JsonResult
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if !c.gossipEnabled() {
+		result.Message = "gossip is disabled"
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	peer := r.FormValue("peer")
+	if peer != "" {
+		peer = c.normalizePeer(peer)
+	}
+	switch r.FormValue("action") {
+	case "join":
+		err = c.gossipTo(peer)
+	case "remove":
+		err = c.RemoveMember(peer)
+	case "":
+	default:
+		err = errors.New("(error) action must be join or remove")
+	}
+	if err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	result.Data = c.GetMembers()
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
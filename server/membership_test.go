@@ -0,0 +1,66 @@
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/sjqzhang/goutil"
+)
+
+func TestMembership(t *testing.T) {
+	old := atomic.LoadPointer(&ptr)
+	defer atomic.StorePointer(&ptr, old)
+	atomic.StorePointer(&ptr, unsafe.Pointer(&GlobalConfig{EnableGossip: true, Group: "group1",
+		Peers: []string{"http://n2"}, SuspectTimeout: 10, DeadTimeout: 60}))
+	c := &Server{
+		util:         &goutil.Common{},
+		peerReadOnly: goutil.NewCommonMap(0),
+		members:      NewMembership(),
+		host:         "http://n1",
+	}
+	peers := func() string {
+		return strings.Join(c.GetLivePeers(), ",") + "|" + strings.Join(c.GetKnownPeers(), ",")
+	}
+	age := func(host string, seconds int64) {
+		c.members.members[host].UpdateTime -= seconds
+		c.CheckMembers()
+	}
+	c.CheckMembers()
+	c.MergeMembers([]*Member{
+		{Host: "http://n3", Group: "group1", Heartbeat: 5, ReadOnly: true},
+		{Host: "http://x1", Group: "group2", Heartbeat: 5},
+		{Host: "http://n1", Group: "group1", Heartbeat: 5, State: CONST_MEMBER_DEAD},
+	})
+	if got := peers(); got != "http://n2,http://n3|http://n2,http://n3" || !c.IsPeerReadOnly("http://n3") {
+		t.Fatal("join", got)
+	}
+	// gossip is the only source of the read only state, /status is not polled
+	c.WatchPeerStatus()
+	age("http://n3", 20)
+	if got := peers(); got != "http://n2|http://n2,http://n3" || c.IsPeerAlive("http://n3") {
+		t.Error("suspect", got)
+	}
+	age("http://n3", 60)
+	c.MergeMembers([]*Member{{Host: "http://n3", Group: "group1", Heartbeat: 5, State: CONST_MEMBER_ALIVE}})
+	if m := c.members.members["http://n3"]; m.State != CONST_MEMBER_DEAD {
+		t.Error("a stale heartbeat brought back a dead member", m.State)
+	}
+	c.MergeMembers([]*Member{{Host: "http://n3", Group: "group1", Heartbeat: 6, State: CONST_MEMBER_SUSPECT}})
+	if !c.IsPeerAlive("http://n3") {
+		t.Error("a newer heartbeat did not bring back n3")
+	}
+	if err := c.RemoveMember("http://n2"); err != nil || peers() != "http://n3|http://n3" {
+		t.Error("remove", peers())
+	}
+	c.CheckMembers()
+	if peers() != "http://n3|http://n3" {
+		t.Error("a removed seed came back", peers())
+	}
+	// the removal spreads to the nodes that had the same heartbeat
+	c.MergeMembers([]*Member{{Host: "http://n3", Group: "group1", Heartbeat: 6, State: CONST_MEMBER_LEFT}})
+	if peers() != "|" {
+		t.Error("left", peers())
+	}
+}
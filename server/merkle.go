@@ -0,0 +1,466 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/httplib"
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The md5s of files.md5 in logDB are summed up per day and scene in Merkle
+// trees kept in ldb: a leaf holds the md5s starting with the same
+// CONST_MERKLE_DEPTH characters, a node hashes the hashes of its children,
+// the root of a day hashes the roots of its scenes. Writing files.md5 of a
+// day marks the day dirty and its trees are built again before they are read.
+// AutoRepair walks down only the nodes whose hashes differ on a peer, so the
+// md5s exchanged are the ones of the leaves that really diverge.
+//
+//	merkle_root_<date>             root of the day
+//	merkle_<date>/<scene>/<prefix> node of a scene, prefix "" is its root
+//	merkle_dirty_<date>            the trees of the day are outdated
+
+type MerkleNode struct {
+	Hash  string `json:"hash"`
+	Count int64  `json:"count"`
+}
+
+// MerkleView is one level of the trees: the nodes under date/scene/prefix,
+// or the md5s of a leaf.
+type MerkleView struct {
+	Nodes map[string]*MerkleNode `json:"nodes"`
+	Md5s  []string               `json:"md5s"`
+}
+
+// MerkleRange is a leaf that differed on a peer and what was done about it.
+type MerkleRange struct {
+	Peer    string   `json:"peer"`
+	Date    string   `json:"date"`
+	Scene   string   `json:"scene"`
+	Prefix  string   `json:"prefix"`
+	Pushed  []string `json:"pushed"`
+	Pulled  []string `json:"pulled"`
+	Deleted []string `json:"deleted"`
+}
+
+type MerkleRepairReport struct {
+	Running   bool           `json:"running"`
+	StartTime int64          `json:"start_time"`
+	EndTime   int64          `json:"end_time"`
+	Peers     int            `json:"peers"`
+	Requests  int            `json:"requests"`
+	Pushed    int            `json:"pushed"`
+	Pulled    int            `json:"pulled"`
+	Errors    []string       `json:"errors"`
+	Ranges    []*MerkleRange `json:"ranges"`
+}
+
+func merkleScene(fileInfo *FileInfo) string {
+	if fileInfo.Scene == "" {
+		return "default"
+	}
+	return fileInfo.Scene
+}
+
+func merkleKey(date string, scene string, prefix string) string {
+	if scene == "" {
+		return CONST_MERKLE_ROOT_PREFIX + date
+	}
+	return CONST_MERKLE_KEY_PREFIX + date + "/" + scene + "/" + prefix
+}
+
+// markMerkleDirty outdates the trees of the day of a files.md5 key of logDB.
+func (c *Server) markMerkleDirty(logKey string) {
+	if c.ldb == nil || len(logKey) < 9 || !strings.HasPrefix(logKey[8:], "_"+CONST_FILE_Md5_FILE_NAME+"_") {
+		return
+	}
+	if err := c.ldb.Put([]byte(CONST_MERKLE_DIRTY_PREFIX+logKey[:8]), []byte("1"), nil); err != nil {
+		log.Error(err)
+	}
+}
+
+// BuildMerkleTrees outdates the trees of every day once, after an upgrade
+// they are built when first read.
+func (c *Server) BuildMerkleTrees() {
+	if ok, _ := c.IsExistFromLevelDB(CONST_MERKLE_KEY, c.ldb); ok {
+		return
+	}
+	iter := c.logDB.NewIterator(nil, nil)
+	for iter.Next() {
+		c.markMerkleDirty(string(iter.Key()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		log.Error(err)
+		return
+	}
+	c.ldb.Put([]byte(CONST_MERKLE_KEY), []byte("1"), nil)
+}
+
+// BuildMerkleTree builds the trees of date from logDB.
+func (c *Server) BuildMerkleTree(date string) error {
+	var (
+		err    error
+		leaves = make(map[string]map[string][]string)
+		scenes []string
+	)
+	c.lockMap.LockKey("BuildMerkleTree")
+	defer c.lockMap.UnLockKey("BuildMerkleTree")
+	// writes from now on mark the day again
+	c.ldb.Delete([]byte(CONST_MERKLE_DIRTY_PREFIX+date), nil)
+	keyPrefix := fmt.Sprintf("%s_%s_", date, CONST_FILE_Md5_FILE_NAME)
+	iter := c.logDB.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	for iter.Next() {
+		var fileInfo FileInfo
+		md5 := string(iter.Key()[len(keyPrefix):])
+		if len(md5) < CONST_MERKLE_DEPTH || json.Unmarshal(iter.Value(), &fileInfo) != nil {
+			continue
+		}
+		scene := merkleScene(&fileInfo)
+		if leaves[scene] == nil {
+			leaves[scene] = make(map[string][]string)
+			scenes = append(scenes, scene)
+		}
+		leaf := md5[:CONST_MERKLE_DEPTH]
+		leaves[scene][leaf] = append(leaves[scene][leaf], md5)
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		c.markMerkleDirty(keyPrefix)
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(merkleKey(date, "", "")))
+	iter = c.ldb.NewIterator(util.BytesPrefix([]byte(CONST_MERKLE_KEY_PREFIX+date+"/")), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+	sort.Strings(scenes)
+	var root []string
+	var count int64
+	for _, scene := range scenes {
+		nodes := make(map[string]*MerkleNode)
+		for leaf, md5s := range leaves[scene] {
+			// logDB keeps the md5s of a leaf sorted
+			nodes[leaf] = &MerkleNode{Hash: c.util.MD5(strings.Join(md5s, ",")), Count: int64(len(md5s))}
+		}
+		for depth := CONST_MERKLE_DEPTH; depth > 0; depth-- {
+			parents := make(map[string][]string)
+			for prefix := range nodes {
+				if len(prefix) == depth {
+					parents[prefix[:depth-1]] = append(parents[prefix[:depth-1]], prefix)
+				}
+			}
+			for parent, children := range parents {
+				nodes[parent] = c.sumMerkleNodes(nodes, children)
+			}
+		}
+		for prefix, node := range nodes {
+			data, _ := json.Marshal(node)
+			batch.Put([]byte(merkleKey(date, scene, prefix)), data)
+		}
+		root = append(root, scene+":"+nodes[""].Hash)
+		count += nodes[""].Count
+	}
+	if len(scenes) > 0 {
+		data, _ := json.Marshal(&MerkleNode{Hash: c.util.MD5(strings.Join(root, ",")), Count: count})
+		batch.Put([]byte(merkleKey(date, "", "")), data)
+	}
+	return c.ldb.Write(batch, nil)
+}
+
+func (c *Server) sumMerkleNodes(nodes map[string]*MerkleNode, children []string) *MerkleNode {
+	var (
+		hashes []string
+		node   = &MerkleNode{}
+	)
+	sort.Strings(children)
+	for _, child := range children {
+		hashes = append(hashes, child+":"+nodes[child].Hash)
+		node.Count += nodes[child].Count
+	}
+	node.Hash = c.util.MD5(strings.Join(hashes, ","))
+	return node
+}
+
+// refreshMerkleTrees builds again the outdated trees of date, of every day
+// if date is empty.
+func (c *Server) refreshMerkleTrees(date string) error {
+	var dates []string
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(CONST_MERKLE_DIRTY_PREFIX+date)), nil)
+	for iter.Next() {
+		dates = append(dates, string(iter.Key()[len(CONST_MERKLE_DIRTY_PREFIX):]))
+	}
+	iter.Release()
+	for _, d := range dates {
+		if err := c.BuildMerkleTree(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMerkleView returns the roots of the days if date is empty, the roots of
+// the scenes of date if scene is empty, else the children of prefix or the
+// md5s of the leaf prefix.
+func (c *Server) GetMerkleView(date string, scene string, prefix string) (*MerkleView, error) {
+	var (
+		err       error
+		view      = &MerkleView{Nodes: make(map[string]*MerkleNode)}
+		keyPrefix string
+	)
+	if scene != "" && len(prefix) >= CONST_MERKLE_DEPTH {
+		keyPrefix = fmt.Sprintf("%s_%s_%s", date, CONST_FILE_Md5_FILE_NAME, prefix[:CONST_MERKLE_DEPTH])
+		iter := c.logDB.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+		defer iter.Release()
+		for iter.Next() {
+			var fileInfo FileInfo
+			if json.Unmarshal(iter.Value(), &fileInfo) == nil && merkleScene(&fileInfo) == scene {
+				view.Md5s = append(view.Md5s, string(iter.Key()[len(keyPrefix)-CONST_MERKLE_DEPTH:]))
+			}
+		}
+		return view, iter.Error()
+	}
+	if err = c.refreshMerkleTrees(date); err != nil {
+		return nil, err
+	}
+	if date == "" {
+		keyPrefix = CONST_MERKLE_ROOT_PREFIX
+	} else if scene == "" {
+		keyPrefix = CONST_MERKLE_KEY_PREFIX + date + "/"
+	} else {
+		keyPrefix = merkleKey(date, scene, prefix)
+	}
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var (
+			node MerkleNode
+			name string
+		)
+		rest := string(iter.Key()[len(keyPrefix):])
+		switch {
+		case date == "":
+			name = rest
+		case scene == "":
+			// <scene>/, a scene may have a slash, the prefixes have none
+			i := strings.LastIndex(rest, "/")
+			if i <= 0 || i != len(rest)-1 {
+				continue
+			}
+			name = rest[:i]
+		default:
+			if len(rest) != 1 {
+				continue
+			}
+			name = prefix + rest
+		}
+		if json.Unmarshal(iter.Value(), &node) != nil {
+			continue
+		}
+		view.Nodes[name] = &node
+	}
+	return view, iter.Error()
+}
+
+func (c *Server) getPeerMerkleView(peer string, date string, scene string, prefix string) (*MerkleView, error) {
+	var (
+		err  error
+		view MerkleView
+	)
+	result := JsonResult{Data: &view}
+	req := httplib.Post(fmt.Sprintf("%s%s", peer, c.getRequestURI("merkle")))
+	req.Param("date", date)
+	req.Param("scene", scene)
+	req.Param("prefix", prefix)
+	req.SetTimeout(time.Second*5, time.Second*30)
+	if err = req.ToJSON(&result); err != nil {
+		return nil, err
+	}
+	if result.Status != "ok" {
+		return nil, errors.New(result.Message)
+	}
+	return &view, nil
+}
+
+// diffMerkle walks down the nodes under date/scene/prefix whose hashes differ
+// on peer and repairs the leaves.
+func (c *Server) diffMerkle(peer string, date string, scene string, prefix string, report *MerkleRepairReport) error {
+	var (
+		err    error
+		local  *MerkleView
+		remote *MerkleView
+		names  []string
+	)
+	if local, err = c.GetMerkleView(date, scene, prefix); err != nil {
+		return err
+	}
+	report.Requests++
+	if remote, err = c.getPeerMerkleView(peer, date, scene, prefix); err != nil {
+		return err
+	}
+	if scene != "" && len(prefix) >= CONST_MERKLE_DEPTH {
+		c.repairMerkleRange(peer, date, scene, prefix, local.Md5s, remote.Md5s, report)
+		return nil
+	}
+	for name := range local.Nodes {
+		names = append(names, name)
+	}
+	for name := range remote.Nodes {
+		if _, ok := local.Nodes[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l, r := local.Nodes[name], remote.Nodes[name]
+		if l != nil && r != nil && l.Hash == r.Hash {
+			continue
+		}
+		switch {
+		case date == "":
+			err = c.diffMerkle(peer, name, "", "", report)
+		case scene == "":
+			err = c.diffMerkle(peer, date, name, "", report)
+		default:
+			err = c.diffMerkle(peer, date, scene, name, report)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repairMerkleRange sends peer the files of the leaf it misses and asks it
+// for the ones missing here.
+func (c *Server) repairMerkleRange(peer string, date string, scene string, prefix string, local []string, remote []string, report *MerkleRepairReport) {
+	var (
+		err      error
+		fileInfo *FileInfo
+		item     = &MerkleRange{Peer: peer, Date: date, Scene: scene, Prefix: prefix, Pushed: []string{}, Pulled: []string{}, Deleted: []string{}}
+	)
+	for _, md5 := range local {
+		if c.util.Contains(md5, remote) {
+			continue
+		}
+		if fileInfo, err = c.GetFileInfoFromLevelDB(md5); err != nil {
+			log.Error(err)
+			continue
+		}
+		// the peer may be listed already, it lost the file since
+		c.AppendToQueue(withoutPeer(fileInfo, peer))
+		item.Pushed = append(item.Pushed, md5)
+	}
+	for _, md5 := range remote {
+		if c.util.Contains(md5, local) {
+			continue
+		}
+		if c.GetTombstone(md5) != nil {
+			// deleted here, the peer replays the delete from the oplog
+			item.Deleted = append(item.Deleted, md5)
+			continue
+		}
+		item.Pulled = append(item.Pulled, md5)
+	}
+	if len(item.Pulled) > 0 {
+		req := httplib.Post(fmt.Sprintf("%s%s", peer, c.getRequestURI("receive_md5s")))
+		req.Param("md5s", strings.Join(item.Pulled, ","))
+		req.Param("peer", c.host)
+		req.SetTimeout(time.Second*15, time.Second*60)
+		if _, err = req.String(); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", peer, err.Error()))
+			item.Pulled = []string{}
+		}
+	}
+	if len(item.Pushed) == 0 && len(item.Pulled) == 0 && len(item.Deleted) == 0 {
+		return
+	}
+	log.Info(fmt.Sprintf("merkle repair %s %s/%s/%s push %d pull %d deleted %d", peer, date, scene, prefix, len(item.Pushed), len(item.Pulled), len(item.Deleted)))
+	report.Pushed += len(item.Pushed)
+	report.Pulled += len(item.Pulled)
+	if len(report.Ranges) < CONST_MERKLE_MAX_RANGES {
+		report.Ranges = append(report.Ranges, item)
+	}
+}
+
+// withoutPeer returns a copy of fileInfo that does not list peer.
+func withoutPeer(fileInfo *FileInfo, peer string) *FileInfo {
+	info := *fileInfo
+	info.Peers = []string{}
+	for _, p := range fileInfo.Peers {
+		if p != peer {
+			info.Peers = append(info.Peers, p)
+		}
+	}
+	return &info
+}
+
+// RepairByMerkle compares the trees with the live peers one after another,
+// the report shows the progress.
+func (c *Server) RepairByMerkle() *MerkleRepairReport {
+	report := &MerkleRepairReport{Running: true, StartTime: time.Now().Unix(), Errors: []string{}, Ranges: []*MerkleRange{}}
+	for _, peer := range c.GetLivePeers() {
+		c.repairState.Store(report.copy())
+		if err := c.diffMerkle(peer, "", "", "", report); err != nil {
+			log.Error(err)
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", peer, err.Error()))
+			continue
+		}
+		report.Peers++
+	}
+	report.Running = false
+	report.EndTime = time.Now().Unix()
+	c.repairState.Store(report)
+	return report
+}
+
+func (r *MerkleRepairReport) copy() *MerkleRepairReport {
+	report := *r
+	report.Errors = append([]string{}, r.Errors...)
+	report.Ranges = append([]*MerkleRange{}, r.Ranges...)
+	return &report
+}
+
+func (c *Server) GetRepairReport() *MerkleRepairReport {
+	if report, ok := c.repairState.Load().(*MerkleRepairReport); ok {
+		return report
+	}
+	return &MerkleRepairReport{Errors: []string{}, Ranges: []*MerkleRange{}}
+}
+
+// Merkle answers the nodes of the trees of this node, see GetMerkleView.
+func (c *Server) Merkle(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		result JsonResult
+		view   *MerkleView
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	date := r.FormValue("date")
+	if date != "" && len(c.util.Match("^\\d{8}$", date)) == 0 {
+		result.Message = "invalid date"
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if view, err = c.GetMerkleView(date, r.FormValue("scene"), r.FormValue("prefix")); err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	result.Data = view
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
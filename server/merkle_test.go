@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMerkleRepair(t *testing.T) {
+	var (
+		err   error
+		view  *MerkleView
+		local *MerkleView
+		md5s  string
+	)
+	a := newTestServer(t, "http://a", &GlobalConfig{AdminIps: []string{"127.0.0.1"}})
+	b := newTestServer(t, "http://b", nil)
+	save := func(c *Server, name string, scene string) string {
+		fileInfo := &FileInfo{Name: name, Path: STORE_DIR_NAME + "/" + scene, Md5: c.util.MD5(name), Scene: scene,
+			Size: 5, OffSet: -1, TimeStamp: 1000, Peers: []string{"http://a", "http://b"}}
+		c.saveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
+		return fileInfo.Md5
+	}
+	for i := 0; i < 300; i++ {
+		name := string(rune('a'+i%26)) + a.util.GetUUID()
+		save(a, name, "default")
+		save(b, name, "default")
+	}
+	if view, err = a.GetMerkleView("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if local, err = b.GetMerkleView("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	date := a.util.GetDayFromTimeStamp(1000)
+	if len(view.Nodes) != 1 || view.Nodes[date] == nil || view.Nodes[date].Count != 300 || view.Nodes[date].Hash != local.Nodes[date].Hash {
+		t.Fatalf("roots differ: %+v %+v", view.Nodes[date], local.Nodes[date])
+	}
+	onlyA := save(a, "only on a", "default")
+	onlyB := save(b, "only on b", "photo")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/merkle", b.Merkle)
+	mux.HandleFunc("/receive_md5s", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("peer") != a.host {
+			t.Errorf("receive_md5s from %s", r.FormValue("peer"))
+		}
+		md5s = r.FormValue("md5s")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	report := &MerkleRepairReport{}
+	if err = a.diffMerkle(srv.URL, "", "", "", report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Pushed != 1 || report.Pulled != 1 || md5s != onlyB {
+		t.Fatalf("report %+v pulled %s", report, md5s)
+	}
+	// date, scene, inner nodes and leaf of each side
+	if report.Requests > 2*(3+CONST_MERKLE_DEPTH) {
+		t.Fatalf("%d requests", report.Requests)
+	}
+	info := a.queueToPeers.Take().FileInfo
+	if info.Md5 != onlyA || a.util.Contains(srv.URL, info.Peers) {
+		t.Fatalf("pushed %+v", info)
+	}
+	// removing the file makes the trees of a and b equal again
+	a.saveFileMd5Log(&FileInfo{Name: "only on a", Path: STORE_DIR_NAME + "/default", Md5: onlyA, TimeStamp: 1000}, CONST_REMOME_Md5_FILE_NAME)
+	save(a, "only on b", "photo")
+	if view, err = a.GetMerkleView(date, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if local, err = b.GetMerkleView(date, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(view.Nodes) != 2 || view.Nodes["photo"].Hash != local.Nodes["photo"].Hash || view.Nodes["default"].Hash != local.Nodes["default"].Hash {
+		t.Fatalf("scenes differ: %+v %+v", view.Nodes, local.Nodes)
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/busyfree/tusd/pkg/handler"
+)
+
+// Files carry the metadata given at upload time, the meta_<key> fields of
+// /upload or the keys of the tus Upload-Metadata header, in FileInfo.Meta.
+// The meta is kept in the metadata of the path, replicated with it, and
+// changed afterwards through /update_meta.
+
+type FileMeta map[string]string
+
+// GetRequestMeta returns the meta_<key> fields of r.
+func (c *Server) GetRequestMeta(r *http.Request) (FileMeta, error) {
+	var (
+		meta FileMeta
+	)
+	r.ParseForm()
+	for k, v := range r.Form {
+		if !strings.HasPrefix(k, CONST_META_FIELD_PREFIX) || len(v) == 0 {
+			continue
+		}
+		if meta == nil {
+			meta = make(FileMeta)
+		}
+		meta[strings.TrimPrefix(k, CONST_META_FIELD_PREFIX)] = v[0]
+	}
+	return meta, c.CheckFileMeta(meta)
+}
+
+// GetTusMeta returns the keys of the Upload-Metadata header that are not
+// used by the upload itself.
+func (c *Server) GetTusMeta(metaData handler.MetaData) (FileMeta, error) {
+	var (
+		meta FileMeta
+	)
+	for k, v := range metaData {
+		if c.util.Contains(k, []string{"filename", "scene", "path", "auth_token", "callback_url"}) {
+			continue
+		}
+		if meta == nil {
+			meta = make(FileMeta)
+		}
+		meta[strings.TrimPrefix(k, CONST_META_FIELD_PREFIX)] = v
+	}
+	return meta, c.CheckFileMeta(meta)
+}
+
+func (c *Server) CheckFileMeta(meta FileMeta) error {
+	size := 0
+	for k, v := range meta {
+		if k == "" {
+			return errors.New("(error) meta key is null")
+		}
+		size += len(k) + len(v)
+	}
+	if size > CONST_META_MAX_SIZE {
+		return fmt.Errorf("(error) meta larger than %d bytes", CONST_META_MAX_SIZE)
+	}
+	return nil
+}
+
+// MatchFileMeta reports whether fileInfo has every key of filter, with the
+// same value unless the value in filter is empty.
+func (c *Server) MatchFileMeta(fileInfo *FileInfo, filter FileMeta) bool {
+	for k, v := range filter {
+		if value, ok := fileInfo.Meta[k]; !ok || (v != "" && value != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateFileMeta sets the keys of meta on fileInfo, an empty value removes
+// its key. With replace the meta of fileInfo becomes meta.
+func (c *Server) UpdateFileMeta(fileInfo *FileInfo, meta FileMeta, replace bool) (*FileInfo, error) {
+	var (
+		err     error
+		content *FileInfo
+	)
+	info := *fileInfo
+	info.Meta = make(FileMeta)
+	if !replace {
+		for k, v := range fileInfo.Meta {
+			info.Meta[k] = v
+		}
+	}
+	for k, v := range meta {
+		if v == "" {
+			delete(info.Meta, k)
+		} else {
+			info.Meta[k] = v
+		}
+	}
+	if len(info.Meta) == 0 {
+		info.Meta = nil
+	}
+	if err = c.CheckFileMeta(info.Meta); err != nil {
+		return nil, err
+	}
+	fpath := c.GetFilePathByInfo(&info, false)
+	c.lockMap.LockKey(fpath)
+	defer c.lockMap.UnLockKey(fpath)
+	if content, err = c.GetFileInfoFromLevelDB(info.Md5); err == nil && c.GetFilePathByInfo(content, false) == fpath {
+		// the content is stored at the path, saving it rewrites its record in
+		// the log db of its day too, which the backups are made from
+		content.Meta = info.Meta
+		if _, err = c.SaveFileInfoToLevelDB(content.Md5, content, c.ldb); err != nil {
+			return nil, err
+		}
+		if _, err = c.SaveFileInfoToLevelDB(c.util.MD5(fpath), content, c.ldb); err != nil {
+			return nil, err
+		}
+		c.SaveS3ObjectIndex(content)
+		c.IndexFile(content)
+		info = *content
+	} else if err = c.saveRefPath(&info); err != nil {
+		return nil, err
+	}
+	if info.RefId != "" {
+		if err = c.AddFileRef(&info); err != nil {
+			return nil, err
+		}
+	}
+	return &info, nil
+}
+
+// UpdateMeta changes the meta of the file given by md5 or path, every peer
+// does the same.
+func (c *Server) UpdateMeta(w http.ResponseWriter, r *http.Request) {
+	var (
+		err      error
+		md5sum   string
+		fpath    string
+		meta     FileMeta
+		fileInfo *FileInfo
+		result   JsonResult
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	md5sum = r.FormValue("md5")
+	if fpath = r.FormValue("path"); fpath != "" {
+		fpath = strings.Replace(fpath, "/"+Config().Group+"/", STORE_DIR_NAME+"/", 1)
+		md5sum = c.util.MD5(fpath)
+	}
+	if meta, err = c.GetRequestMeta(r); err == nil {
+		if fileInfo, err = c.GetFileInfoFromLevelDB(md5sum); err == nil {
+			fileInfo, err = c.UpdateFileMeta(fileInfo, meta, r.FormValue("replace") == "1")
+		}
+	}
+	if err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if r.FormValue("inner") != "1" {
+		c.LogOp(&Op{Type: CONST_OP_META, Md5: md5sum, Meta: meta, Replace: r.FormValue("replace") == "1"})
+	}
+	result.Status = "ok"
+	result.Data = fileInfo
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFileMeta(t *testing.T) {
+	var (
+		err      error
+		meta     FileMeta
+		fileInfo *FileInfo
+	)
+	c := newTestServer(t, "", &GlobalConfig{EnableDistinctFile: true})
+	form := url.Values{"meta_owner": {"bob"}, "meta_tag": {"x"}, "scene": {"default"}}
+	r := httptest.NewRequest("POST", "/upload", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if meta, err = c.GetRequestMeta(r); err != nil || len(meta) != 2 || meta["owner"] != "bob" {
+		t.Fatal("request meta", meta, err)
+	}
+	if _, err = c.GetRequestMeta(httptest.NewRequest("GET", "/upload?meta_a="+strings.Repeat("a", CONST_META_MAX_SIZE), nil)); err == nil {
+		t.Error("meta too large accepted")
+	}
+	dir := STORE_DIR_NAME + "/default"
+	c.saveFileMd5Log(&FileInfo{Name: "a.txt", Path: dir, Md5: c.util.MD5("a"), Size: 1, OffSet: -1, Meta: meta}, CONST_FILE_Md5_FILE_NAME)
+	fileInfo, _ = c.GetFileInfoFromLevelDB(c.util.MD5(dir + "/a.txt"))
+	if !c.MatchFileMeta(fileInfo, FileMeta{"owner": "bob", "tag": ""}) || c.MatchFileMeta(fileInfo, FileMeta{"owner": "amy"}) {
+		t.Error("match meta", fileInfo.Meta)
+	}
+	// an empty value removes its key
+	if _, err = c.UpdateFileMeta(fileInfo, FileMeta{"tag": "", "color": "red"}, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{fileInfo.Md5, c.util.MD5(dir + "/a.txt")} {
+		if info, _ := c.GetFileInfoFromLevelDB(key); len(info.Meta) != 2 || info.Meta["color"] != "red" || info.Meta["owner"] != "bob" {
+			t.Fatal("updated meta", info.Meta)
+		}
+	}
+	if fileInfo, err = c.UpdateFileMeta(fileInfo, FileMeta{"color": "blue"}, true); err != nil || len(fileInfo.Meta) != 1 {
+		t.Fatal("replaced meta", fileInfo, err)
+	}
+	if refs := c.GetFileRefs(fileInfo.Md5); len(refs) != 1 || refs[0].Meta["color"] != "blue" {
+		t.Error("meta of the reference", refs)
+	}
+	// the backup of the day has the new meta
+	dataDir := DATA_DIR
+	defer func() { DATA_DIR = dataDir }()
+	DATA_DIR = t.TempDir()
+	date := c.util.GetDayFromTimeStamp(fileInfo.TimeStamp)
+	c.BackUpMetaDataByDate(date)
+	restored := newTestServer(t, "", nil)
+	restored.storage.Put(dir+"/a.txt", strings.NewReader("a"))
+	if _, err = restored.RestoreMetaData(date, date, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := restored.GetFileInfoFromLevelDB(c.util.MD5(dir + "/a.txt")); err != nil || len(info.Meta) != 1 || info.Meta["color"] != "blue" {
+		t.Fatal("meta not backed up", info, err)
+	}
+}
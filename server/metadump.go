@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// `fileserver meta export` dumps the metadata of a node as JSON lines, one
+// MetaRecord for every file kept in fileserver.db and log.db: the md5, path
+// and log keys, references, the S3 index, the trash and the archived
+// versions. `fileserver meta import` loads such a dump back. The operation
+// log, tombstones, checkpoints, queues and the other state of the node are
+// left out. Both work on the db files directly, the server must be stopped.
+// The search indexes are rebuilt and the stat recomputed after an import.
+
+type MetaRecord struct {
+	Db    string     `json:"db"`
+	Key   string     `json:"key"`
+	Type  string     `json:"type,omitempty"`
+	File  *FileInfo  `json:"file"`
+	Trash *TrashFile `json:"trash,omitempty"`
+}
+
+// MetaFilter selects the records of a scene and of the days from DateFrom
+// to DateTo, in yyyyMMdd, by upload time. Empty fields select everything.
+type MetaFilter struct {
+	Scene    string
+	DateFrom string
+	DateTo   string
+}
+
+type MetaImportStat struct {
+	Total     int `json:"total"`
+	Imported  int `json:"imported"`
+	Skipped   int `json:"skipped"`
+	Malformed int `json:"malformed"`
+}
+
+func (f *MetaFilter) Match(fileInfo *FileInfo) bool {
+	if f.Scene != "" && fileInfo.Scene != f.Scene {
+		return false
+	}
+	if f.DateFrom == "" && f.DateTo == "" {
+		return true
+	}
+	date := time.Unix(fileInfo.TimeStamp, 0).Format("20060102")
+	return (f.DateFrom == "" || date >= f.DateFrom) && (f.DateTo == "" || date <= f.DateTo)
+}
+
+func (c *Server) getMetaDb(name string) *leveldb.DB {
+	switch name {
+	case "file":
+		return c.ldb
+	case "log":
+		return c.logDB
+	}
+	return nil
+}
+
+// isSumKey reports whether key is an md5 or sha1 sum, the key of a file by
+// its content or by its path.
+func isSumKey(key string) bool {
+	if len(key) != 32 && len(key) != 40 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if !(key[i] >= '0' && key[i] <= '9' || key[i] >= 'a' && key[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// getMetaRecordType returns the type of the record of key in the db name,
+// "" for the keys that are no metadata of a file.
+func (c *Server) getMetaRecordType(name string, key string) string {
+	switch name {
+	case "file":
+		switch {
+		case strings.HasPrefix(key, CONST_TRASH_KEY_PREFIX):
+			return CONST_META_RECORD_TRASH
+		case strings.HasPrefix(key, CONST_FILE_VERSION_KEY_PREFIX):
+			return CONST_META_RECORD_VERSION
+		case strings.HasPrefix(key, CONST_FILE_REF_KEY_PREFIX), strings.HasPrefix(key, CONST_S3_OBJECT_KEY_PREFIX), isSumKey(key):
+			return CONST_META_RECORD_FILE
+		}
+	case "log":
+		// <yyyyMMdd>_<files.md5>_<md5>
+		if i := strings.LastIndex(key, "_"); len(key) > 9 && key[8] == '_' && isSumKey(key[i+1:]) {
+			if _, err := strconv.Atoi(key[:8]); err == nil {
+				return CONST_META_RECORD_FILE
+			}
+		}
+	}
+	return ""
+}
+
+// ExportMeta writes the records selected by filter to w and returns how many
+// were written. The search indexes are left out, they are rebuilt on import.
+func (c *Server) ExportMeta(w io.Writer, filter *MetaFilter) (int, error) {
+	var (
+		err   error
+		data  []byte
+		count int
+	)
+	bw := bufio.NewWriter(w)
+	for _, name := range []string{"file", "log"} {
+		iter := c.getMetaDb(name).NewIterator(nil, nil)
+		for iter.Next() {
+			var (
+				fileInfo FileInfo
+				trash    TrashFile
+			)
+			key := string(iter.Key())
+			record := &MetaRecord{Db: name, Key: key, Type: c.getMetaRecordType(name, key), File: &fileInfo}
+			if record.Type == "" {
+				continue
+			}
+			if record.Type == CONST_META_RECORD_TRASH {
+				// the file of a trash entry is below its top level, it goes in
+				// the file of the record
+				if err = json.Unmarshal(iter.Value(), &trash); err != nil || trash.File == nil || !filter.Match(trash.File) {
+					continue
+				}
+				record.File, record.Trash = trash.File, &trash
+				trash.File = nil
+			} else if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil || fileInfo.Md5 == "" {
+				continue
+			} else if !filter.Match(&fileInfo) {
+				continue
+			}
+			if data, err = json.Marshal(record); err != nil {
+				iter.Release()
+				return count, err
+			}
+			bw.Write(data)
+			if err = bw.WriteByte('\n'); err != nil {
+				iter.Release()
+				return count, err
+			}
+			count++
+		}
+		iter.Release()
+		if err = iter.Error(); err != nil {
+			return count, err
+		}
+	}
+	return count, bw.Flush()
+}
+
+// ImportMeta loads the records of r. A record whose key is taken already is
+// skipped, written over, or written when its file is newer than the one
+// kept, by policy.
+func (c *Server) ImportMeta(r io.Reader, policy string) (*MetaImportStat, error) {
+	var (
+		err   error
+		data  []byte
+		dates []string
+	)
+	if !c.util.Contains(policy, []string{CONST_META_POLICY_SKIP, CONST_META_POLICY_OVERWRITE, CONST_META_POLICY_NEWER}) {
+		return nil, fmt.Errorf("(error) policy must be %s, %s or %s", CONST_META_POLICY_SKIP, CONST_META_POLICY_OVERWRITE, CONST_META_POLICY_NEWER)
+	}
+	stat := &MetaImportStat{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var (
+			record MetaRecord
+			old    FileInfo
+			trash  TrashFile
+			value  interface{}
+		)
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		stat.Total++
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Key == "" || record.File == nil || record.File.Md5 == "" {
+			stat.Malformed++
+			continue
+		}
+		if record.Type == "" {
+			// dumps from before the records had a type
+			if record.Type = CONST_META_RECORD_FILE; record.Trash != nil {
+				record.Type = CONST_META_RECORD_TRASH
+			} else if strings.HasPrefix(record.Key, CONST_FILE_VERSION_KEY_PREFIX) {
+				record.Type = CONST_META_RECORD_VERSION
+			}
+		}
+		// only the keys of the metadata of files are written, a record of
+		// the operation log or a tombstone would be written over as a file
+		if record.Type != c.getMetaRecordType(record.Db, record.Key) || (record.Trash != nil) != (record.Type == CONST_META_RECORD_TRASH) {
+			stat.Malformed++
+			continue
+		}
+		if value = record.File; record.Trash != nil {
+			if record.Key != CONST_TRASH_KEY_PREFIX+record.Trash.Id {
+				stat.Malformed++
+				continue
+			}
+			record.Trash.File = record.File
+			value = record.Trash
+		}
+		db := c.getMetaDb(record.Db)
+		if db == nil {
+			stat.Malformed++
+			continue
+		}
+		if data, err = db.Get([]byte(record.Key), nil); err == nil {
+			if record.Trash != nil {
+				if json.Unmarshal(data, &trash) == nil && trash.File != nil {
+					old = *trash.File
+				}
+			} else {
+				json.Unmarshal(data, &old)
+			}
+			if !c.keepImported(&old, record.File, policy) {
+				stat.Skipped++
+				continue
+			}
+		}
+		if data, err = json.Marshal(value); err != nil {
+			return stat, err
+		}
+		if err = db.Put([]byte(record.Key), data, nil); err != nil {
+			return stat, err
+		}
+		if db == c.logDB && len(record.Key) > 8 && !c.util.Contains(record.Key[:8], dates) {
+			dates = append(dates, record.Key[:8])
+		}
+		stat.Imported++
+	}
+	if err = scanner.Err(); err != nil {
+		return stat, err
+	}
+	for _, date := range dates {
+		c.RepairStatByDate(date)
+		c.markMerkleDirty(fmt.Sprintf("%s_%s_", date, CONST_FILE_Md5_FILE_NAME))
+	}
+	if stat.Imported > 0 {
+		c.RebuildSearchIndex()
+	}
+	log.Info(fmt.Sprintf("meta imported: %+v", *stat))
+	return stat, nil
+}
+
+// keepImported reports whether the imported file replaces old under policy.
+func (c *Server) keepImported(old *FileInfo, file *FileInfo, policy string) bool {
+	switch policy {
+	case CONST_META_POLICY_OVERWRITE:
+		return true
+	case CONST_META_POLICY_NEWER:
+		return file.TimeStamp > old.TimeStamp
+	}
+	return false
+}
+
+// ExportMeta dumps the metadata of the node initialized by InitServer.
+func ExportMeta(w io.Writer, filter *MetaFilter) (int, error) {
+	if server == nil {
+		return 0, errors.New("server not initialized")
+	}
+	return server.ExportMeta(w, filter)
+}
+
+// ImportMeta loads a dump into the node initialized by InitServer.
+func ImportMeta(r io.Reader, policy string) (*MetaImportStat, error) {
+	if server == nil {
+		return nil, errors.New("server not initialized")
+	}
+	return server.ImportMeta(r, policy)
+}
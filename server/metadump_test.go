@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetaExportImport(t *testing.T) {
+	var (
+		err   error
+		count int
+		stat  *MetaImportStat
+		buf   bytes.Buffer
+	)
+	src, dst := newTestServer(t, "", &GlobalConfig{EnableDistinctFile: true}), newTestServer(t, "", nil)
+	dir := STORE_DIR_NAME + "/default"
+	src.saveFileMd5Log(&FileInfo{Name: "a.txt", Path: dir, Scene: "default", Md5: src.util.MD5("a"), Size: 1, OffSet: -1, TimeStamp: 1000}, CONST_FILE_Md5_FILE_NAME)
+	src.saveFileMd5Log(&FileInfo{Name: "b.txt", Path: dir, Scene: "other", Md5: src.util.MD5("b"), Size: 1, OffSet: -1, TimeStamp: 1000}, CONST_FILE_Md5_FILE_NAME)
+	src.SaveTrashFile(&TrashFile{Id: "1", Scene: "default", DeleteTime: 1500,
+		File: &FileInfo{Name: "c.txt", Path: dir, Scene: "default", Md5: src.util.MD5("c"), Size: 1, OffSet: -1, TimeStamp: 1000}})
+	if count, err = src.ExportMeta(&buf, &MetaFilter{Scene: "default"}); err != nil || count == 0 {
+		t.Fatal("export", count, err)
+	}
+	if strings.Contains(buf.String(), "b.txt") || strings.Contains(buf.String(), CONST_INDEX_KEY_PREFIX) {
+		t.Fatal("filtered records exported", buf.String())
+	}
+	// a newer file of the same path is kept with the newer policy
+	dst.saveFileMd5Log(&FileInfo{Name: "a.txt", Path: dir, Scene: "default", Md5: src.util.MD5("a"), Size: 2, OffSet: -1, TimeStamp: 2000}, CONST_FILE_Md5_FILE_NAME)
+	dump := buf.String() + "not json\n"
+	if stat, err = dst.ImportMeta(strings.NewReader(dump), CONST_META_POLICY_NEWER); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Total != count+1 || stat.Malformed != 1 || stat.Skipped == 0 {
+		t.Error("newer", *stat)
+	}
+	if fileInfo, _ := dst.GetFileInfoFromLevelDB(dst.util.MD5(dir + "/a.txt")); fileInfo.Size != 2 {
+		t.Error("newer file overwritten", fileInfo)
+	}
+	if stat, _ = dst.ImportMeta(strings.NewReader(dump), CONST_META_POLICY_OVERWRITE); stat.Imported != count {
+		t.Error("overwrite", *stat)
+	}
+	if fileInfo, _ := dst.GetFileInfoFromLevelDB(dst.util.MD5(dir + "/a.txt")); fileInfo.Size != 1 {
+		t.Error("file not overwritten", fileInfo)
+	}
+	if trash, err := dst.GetTrashFile("1"); err != nil || trash.File.Name != "c.txt" || trash.DeleteTime != 1500 {
+		t.Error("trash not imported", trash, err)
+	}
+	if result, _ := dst.SearchFiles(&SearchQuery{Keywords: []string{"a"}, Sort: indexTime, Limit: 10}); len(result.Files) != 1 {
+		t.Error("imported file not indexed", result.Files)
+	}
+}
+
+func TestMetaExportSkipsOpLog(t *testing.T) {
+	var (
+		err  error
+		stat *MetaImportStat
+		buf  bytes.Buffer
+	)
+	src, dst := newTestServer(t, "", nil), newTestServer(t, "", nil)
+	dir := STORE_DIR_NAME + "/default"
+	md5sum, pathMd5 := src.util.MD5("a"), src.util.MD5(dir+"/a.txt")
+	src.saveFileMd5Log(&FileInfo{Name: "a.txt", Path: dir, Scene: "default", Md5: md5sum, Size: 1, OffSet: -1, TimeStamp: 1000}, CONST_FILE_Md5_FILE_NAME)
+	src.SaveFileVersion(pathMd5, &FileInfo{Name: "a.txt", Path: dir, Scene: "default", Md5: md5sum, Size: 1, OffSet: -1, TimeStamp: 900, Version: "1"})
+	// an operation and a tombstone both have an md5 at their top level
+	op, _ := json.Marshal(&Op{Seq: 1, Node: src.host, Type: CONST_OP_DELETE, Md5: md5sum, Path: dir + "/b.txt", Content: src.util.MD5("b"), Time: 1000})
+	tomb, _ := json.Marshal(&Tombstone{Md5: src.util.MD5("b"), Node: src.host, Seq: 1, DeleteTime: 1000})
+	src.ldb.Put([]byte(src.opKey(1)), op, nil)
+	src.ldb.Put([]byte(CONST_TOMBSTONE_KEY_PREFIX+src.util.MD5("b")), tomb, nil)
+	if _, err = src.ExportMeta(&buf, &MetaFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+	if strings.Contains(dump, CONST_OPLOG_KEY_PREFIX) || strings.Contains(dump, CONST_TOMBSTONE_KEY_PREFIX) {
+		t.Fatal("oplog exported", dump)
+	}
+	if !strings.Contains(dump, `"type":"`+CONST_META_RECORD_VERSION+`"`) {
+		t.Fatal("version not exported", dump)
+	}
+	// a record forged on the key of an operation is not written over it
+	dump += `{"db":"file","key":"` + src.opKey(1) + `","type":"file","file":{"md5":"` + md5sum + `"}}` + "\n"
+	if stat, err = src.ImportMeta(strings.NewReader(dump), CONST_META_POLICY_OVERWRITE); err != nil || stat.Malformed != 1 {
+		t.Fatal("import", stat, err)
+	}
+	if data, _ := src.ldb.Get([]byte(src.opKey(1)), nil); !bytes.Equal(data, op) {
+		t.Error("oplog entry changed", string(data))
+	}
+	if data, _ := src.ldb.Get([]byte(CONST_TOMBSTONE_KEY_PREFIX+src.util.MD5("b")), nil); !bytes.Equal(data, tomb) {
+		t.Error("tombstone changed", string(data))
+	}
+	if _, err = dst.ImportMeta(strings.NewReader(dump), CONST_META_POLICY_OVERWRITE); err != nil {
+		t.Fatal(err)
+	}
+	if dst.GetTombstone(src.util.MD5("b")) != nil {
+		t.Error("tombstone imported")
+	}
+	if versions := dst.ListFileVersions(dir + "/a.txt"); len(versions) == 0 {
+		t.Error("version not imported")
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// A needle is one merged small file inside a haystack volume:
+//
+//	magic(4) flag(1) md5_len(1) md5 name_len(2) name timestamp(8) size(4) data crc32(4)
+//
+// The header makes a volume readable without leveldb and the crc32 covers
+// header and data. Volumes written before the header existed hold legacy
+// needles, a flag byte followed by the data, which are still served.
+type Needle struct {
+	Flag      byte
+	Md5       string
+	Name      string
+	TimeStamp int64
+	Data      []byte
+	Legacy    bool
+}
+
+var (
+	ErrNeedleMagic = errors.New("not a needle")
+	ErrNeedleCrc   = errors.New("needle crc32 mismatch")
+)
+
+func NewNeedle(fileInfo *FileInfo, data []byte) *Needle {
+	name := fileInfo.Name
+	if len(name) > CONST_NEEDLE_MAX_NAME {
+		name = name[:CONST_NEEDLE_MAX_NAME]
+	}
+	return &Needle{
+		Flag:      '1',
+		Md5:       fileInfo.Md5,
+		Name:      name,
+		TimeStamp: fileInfo.TimeStamp,
+		Data:      data,
+	}
+}
+
+func (n *Needle) Deleted() bool {
+	return n.Flag == CONST_SMALL_FILE_DELETED_FLAG
+}
+
+func (n *Needle) HeaderSize() int {
+	return len(CONST_NEEDLE_MAGIC) + 1 + 1 + len(n.Md5) + 2 + len(n.Name) + 8 + 4
+}
+
+// Size is the number of bytes the needle takes in its volume.
+func (n *Needle) Size() int {
+	if n.Legacy {
+		return 1 + len(n.Data)
+	}
+	return n.HeaderSize() + len(n.Data) + 4
+}
+
+func (n *Needle) Bytes() []byte {
+	if n.Legacy {
+		return append([]byte{n.Flag}, n.Data...)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, n.Size()))
+	buf.WriteString(CONST_NEEDLE_MAGIC)
+	buf.WriteByte(n.Flag)
+	buf.WriteByte(byte(len(n.Md5)))
+	buf.WriteString(n.Md5)
+	binary.Write(buf, binary.BigEndian, uint16(len(n.Name)))
+	buf.WriteString(n.Name)
+	binary.Write(buf, binary.BigEndian, n.TimeStamp)
+	binary.Write(buf, binary.BigEndian, uint32(len(n.Data)))
+	buf.Write(n.Data)
+	binary.Write(buf, binary.BigEndian, n.checksum(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// checksum ignores the flag byte, deleting a needle only flips the flag.
+func (n *Needle) checksum(data []byte) uint32 {
+	pos := len(CONST_NEEDLE_MAGIC)
+	crc := crc32.ChecksumIEEE(data[:pos])
+	return crc32.Update(crc, crc32.IEEETable, data[pos+1:])
+}
+
+// ParseNeedle decodes a whole needle as stored in a volume and verifies its crc32.
+func ParseNeedle(data []byte) (*Needle, error) {
+	var (
+		err    error
+		size   int
+		needle *Needle
+	)
+	if len(data) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if !bytes.HasPrefix(data, []byte(CONST_NEEDLE_MAGIC)) {
+		if data[0] != '1' && data[0] != CONST_SMALL_FILE_DELETED_FLAG {
+			return nil, ErrNeedleMagic
+		}
+		return &Needle{Flag: data[0], Data: data[1:], Legacy: true}, nil
+	}
+	if needle, size, err = parseNeedleHeader(data); err != nil {
+		return nil, err
+	}
+	if len(data) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	needle.Data = data[needle.HeaderSize() : size-4]
+	if binary.BigEndian.Uint32(data[size-4:]) != needle.checksum(data[:size-4]) {
+		return nil, ErrNeedleCrc
+	}
+	return needle, nil
+}
+
+// parseNeedleHeader decodes the header at the start of data and returns the
+// size of the whole needle, data may be cut anywhere after the header.
+func parseNeedleHeader(data []byte) (*Needle, int, error) {
+	var (
+		needle Needle
+		pos    int
+	)
+	pos = len(CONST_NEEDLE_MAGIC)
+	if len(data) < pos+2 || string(data[:pos]) != CONST_NEEDLE_MAGIC {
+		return nil, 0, ErrNeedleMagic
+	}
+	needle.Flag = data[pos]
+	md5Len := int(data[pos+1])
+	pos = pos + 2
+	if len(data) < pos+md5Len+2 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	needle.Md5 = string(data[pos : pos+md5Len])
+	pos = pos + md5Len
+	nameLen := int(binary.BigEndian.Uint16(data[pos:]))
+	pos = pos + 2
+	if len(data) < pos+nameLen+12 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	needle.Name = string(data[pos : pos+nameLen])
+	pos = pos + nameLen
+	needle.TimeStamp = int64(binary.BigEndian.Uint64(data[pos:]))
+	size := int(binary.BigEndian.Uint32(data[pos+8:]))
+	if size > CONST_SMALL_FILE_SIZE {
+		return nil, 0, errors.New("invalid needle size")
+	}
+	return &needle, pos + 12 + size + 4, nil
+}
+
+// ReadNeedleAt reads the needle starting at offset without knowing its size,
+// which is how a volume is walked when its index is lost.
+func ReadNeedleAt(reader io.ReaderAt, offset int64) (*Needle, int, error) {
+	var (
+		err    error
+		n      int
+		size   int
+		data   []byte
+		needle *Needle
+	)
+	data = make([]byte, CONST_NEEDLE_MAX_HEADER)
+	if n, err = reader.ReadAt(data, offset); n == 0 && err != nil {
+		return nil, 0, err
+	}
+	if _, size, err = parseNeedleHeader(data[:n]); err != nil {
+		return nil, 0, err
+	}
+	data = make([]byte, size)
+	if n, err = reader.ReadAt(data, offset); n != size {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if needle, err = ParseNeedle(data); err != nil {
+		return nil, 0, err
+	}
+	return needle, size, nil
+}
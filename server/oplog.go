@@ -0,0 +1,375 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/astaxie/beego/httplib"
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// New references, archived versions, deletes, trash actions, version deletes
+// and meta changes made on a node are kept in its operation log under
+// increasing sequence numbers. The peers pull the log every oplog_interval
+// seconds, and at once when told a new operation is there, from the
+// checkpoint of the last operation they replayed, so a peer that was down
+// catches up when it is back. Deleting the last reference to a content
+// leaves a tombstone of its md5: replicas of the content older than the
+// tombstone are refused by syncfile_info and syncfile_ref and not asked for
+// by the repair. Operations and tombstones are kept tombstone_days days.
+
+type Op struct {
+	Seq     int64     `json:"seq"`
+	Node    string    `json:"node"`
+	Type    string    `json:"type"`
+	Md5     string    `json:"md5,omitempty"`
+	RefId   string    `json:"ref_id,omitempty"`
+	TrashId string    `json:"trash_id,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Meta    FileMeta  `json:"meta,omitempty"`
+	Replace bool      `json:"replace,omitempty"`
+	Content string    `json:"content,omitempty"`
+	File    *FileInfo `json:"file,omitempty"`
+	Time    int64     `json:"time"`
+}
+
+type OpLogPage struct {
+	FirstSeq int64 `json:"first_seq"`
+	LastSeq  int64 `json:"last_seq"`
+	Ops      []*Op `json:"ops"`
+}
+
+type OpLogStatus struct {
+	Seq         int64            `json:"seq"`
+	Checkpoints map[string]int64 `json:"checkpoints"`
+}
+
+type Tombstone struct {
+	Md5        string `json:"md5"`
+	Node       string `json:"node"`
+	Seq        int64  `json:"seq"`
+	DeleteTime int64  `json:"delete_time"`
+}
+
+func (c *Server) opKey(seq int64) string {
+	return fmt.Sprintf("%s%020d", CONST_OPLOG_KEY_PREFIX, seq)
+}
+
+func (c *Server) getInt64Key(key string) int64 {
+	data, err := c.ldb.Get([]byte(key), nil)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(string(data), 10, 64)
+	return n
+}
+
+// LogOp appends op to the operation log of this node and tells the live
+// peers to pull it.
+func (c *Server) LogOp(op *Op) error {
+	var (
+		err  error
+		data []byte
+	)
+	c.opLock.Lock()
+	op.Seq = c.getInt64Key(CONST_OPLOG_SEQ_KEY) + 1
+	op.Node = c.host
+	op.Time = time.Now().Unix()
+	if data, err = json.Marshal(op); err != nil {
+		c.opLock.Unlock()
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(c.opKey(op.Seq)), data)
+	batch.Put([]byte(CONST_OPLOG_SEQ_KEY), []byte(strconv.FormatInt(op.Seq, 10)))
+	err = c.ldb.Write(batch, nil)
+	c.opLock.Unlock()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	c.saveTombstone(op)
+	go c.notifyOpLog()
+	return nil
+}
+
+func (c *Server) notifyOpLog() {
+	for _, peer := range c.GetLivePeers() {
+		req := httplib.Post(fmt.Sprintf("%s%s", peer, c.getRequestURI("oplog")))
+		req.Param("action", "pull")
+		req.Param("peer", c.host)
+		req.SetTimeout(time.Second*5, time.Second*10)
+		if _, err := req.String(); err != nil {
+			log.Warn(fmt.Sprintf("notify oplog to %s: %s", peer, err.Error()))
+		}
+	}
+}
+
+// GetOps returns at most limit operations of this node after since.
+func (c *Server) GetOps(since int64, limit int) (*OpLogPage, error) {
+	page := &OpLogPage{LastSeq: c.getInt64Key(CONST_OPLOG_SEQ_KEY), Ops: []*Op{}}
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(CONST_OPLOG_KEY_PREFIX)), nil)
+	defer iter.Release()
+	if iter.First() {
+		page.FirstSeq, _ = strconv.ParseInt(string(iter.Key()[len(CONST_OPLOG_KEY_PREFIX):]), 10, 64)
+	}
+	for ok := iter.Seek([]byte(c.opKey(since + 1))); ok && len(page.Ops) < limit; ok = iter.Next() {
+		var op Op
+		if err := json.Unmarshal(iter.Value(), &op); err != nil {
+			log.Error(err)
+			continue
+		}
+		page.Ops = append(page.Ops, &op)
+	}
+	return page, iter.Error()
+}
+
+func (c *Server) getPeerOps(peer string, since int64) (*OpLogPage, error) {
+	var (
+		err  error
+		page OpLogPage
+	)
+	result := JsonResult{Data: &page}
+	req := httplib.Post(fmt.Sprintf("%s%s", peer, c.getRequestURI("oplog")))
+	req.Param("since", strconv.FormatInt(since, 10))
+	req.SetTimeout(time.Second*5, time.Second*30)
+	if err = req.ToJSON(&result); err != nil {
+		return nil, err
+	}
+	if result.Status != "ok" {
+		return nil, errors.New(result.Message)
+	}
+	return &page, nil
+}
+
+// PullOpLog replays the operations of peer after its checkpoint.
+func (c *Server) PullOpLog(peer string) error {
+	var (
+		err  error
+		page *OpLogPage
+	)
+	key := CONST_CHECKPOINT_KEY_PREFIX + peer
+	if c.lockMap.IsLock(key) {
+		return nil
+	}
+	c.lockMap.LockKey(key)
+	defer c.lockMap.UnLockKey(key)
+	since := c.getInt64Key(key)
+	for {
+		if page, err = c.getPeerOps(peer, since); err != nil {
+			return err
+		}
+		if page.LastSeq < since {
+			// the peer lost its log, everything is replayed again
+			log.Warn(fmt.Sprintf("oplog of %s restarted at %d, checkpoint %d", peer, page.LastSeq, since))
+			since = 0
+			continue
+		}
+		if page.FirstSeq > since+1 {
+			log.Warn(fmt.Sprintf("oplog of %s from %d to %d expired, left to the repair", peer, since+1, page.FirstSeq-1))
+		}
+		for _, op := range page.Ops {
+			if err = c.ApplyOp(op); err != nil {
+				log.Warn(fmt.Sprintf("apply op %d of %s: %s", op.Seq, peer, err.Error()))
+			}
+			since = op.Seq
+			if err = c.ldb.Put([]byte(key), []byte(strconv.FormatInt(since, 10)), nil); err != nil {
+				return err
+			}
+		}
+		if len(page.Ops) < CONST_OPLOG_PAGE_SIZE {
+			return nil
+		}
+	}
+}
+
+// ApplyOp does here what op did on its node. Operations on what is not
+// here any more are not errors.
+func (c *Server) ApplyOp(op *Op) error {
+	var (
+		err      error
+		fileInfo *FileInfo
+	)
+	if op.Node == c.host {
+		return nil
+	}
+	switch op.Type {
+	case CONST_OP_DELETE:
+		if fileInfo, err = c.GetFileInfoFromLevelDB(op.Md5); err == nil {
+			_, _, err = c.DeleteFile(fileInfo, op.RefId, op.TrashId)
+		}
+	case CONST_OP_META:
+		if fileInfo, err = c.GetFileInfoFromLevelDB(op.Md5); err == nil {
+			_, err = c.UpdateFileMeta(fileInfo, op.Meta, op.Replace)
+		}
+	case CONST_OP_RESTORE:
+		_, err = c.RestoreTrashFile(op.TrashId)
+	case CONST_OP_PURGE:
+		err = c.PurgeTrashFile(op.TrashId)
+	case CONST_OP_DELETE_VERSION:
+		err = c.DeleteFileVersion(op.Path, op.Version)
+	case CONST_OP_REF:
+		if op.File == nil {
+			return errors.New("(error) no file")
+		}
+		err = c.applyFileRef(op.File)
+	case CONST_OP_VERSION:
+		if op.File == nil || op.File.Version == "" {
+			return errors.New("(error) no file")
+		}
+		err = c.applyFileVersion(op.File)
+	default:
+		err = errors.New("(error) unknown op " + op.Type)
+	}
+	c.saveTombstone(op)
+	return err
+}
+
+// saveTombstone leaves a tombstone of the content of op when nothing refers
+// to it any more, its metadata goes later with the file log.
+func (c *Server) saveTombstone(op *Op) {
+	if op.Content == "" || len(c.GetFileRefs(op.Content)) > 0 {
+		return
+	}
+	if tomb := c.GetTombstone(op.Content); tomb != nil && tomb.DeleteTime >= op.Time {
+		return
+	}
+	data, _ := json.Marshal(&Tombstone{Md5: op.Content, Node: op.Node, Seq: op.Seq, DeleteTime: op.Time})
+	if err := c.ldb.Put([]byte(CONST_TOMBSTONE_KEY_PREFIX+op.Content), data, nil); err != nil {
+		log.Error(err)
+	}
+}
+
+func (c *Server) GetTombstone(md5sum string) *Tombstone {
+	var tomb Tombstone
+	data, err := c.ldb.Get([]byte(CONST_TOMBSTONE_KEY_PREFIX+md5sum), nil)
+	if err != nil || json.Unmarshal(data, &tomb) != nil {
+		return nil
+	}
+	return &tomb
+}
+
+// IsDeleted reports whether fileInfo is a copy of a content deleted after
+// it was stored.
+func (c *Server) IsDeleted(fileInfo *FileInfo) bool {
+	tomb := c.GetTombstone(fileInfo.Md5)
+	return tomb != nil && fileInfo.TimeStamp <= tomb.DeleteTime
+}
+
+// CleanOpLog drops the operations and tombstones older than tombstone_days.
+func (c *Server) CleanOpLog() {
+	var (
+		count int
+	)
+	expire := time.Now().Unix() - int64(Config().TombstoneDays)*24*3600
+	batch := new(leveldb.Batch)
+	for _, prefix := range []string{CONST_OPLOG_KEY_PREFIX, CONST_TOMBSTONE_KEY_PREFIX} {
+		iter := c.ldb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+		for iter.Next() {
+			var (
+				op   Op
+				tomb Tombstone
+			)
+			if prefix == CONST_OPLOG_KEY_PREFIX {
+				if json.Unmarshal(iter.Value(), &op) != nil || op.Time >= expire {
+					// the log is in time order
+					break
+				}
+			} else if json.Unmarshal(iter.Value(), &tomb) != nil || tomb.DeleteTime >= expire {
+				continue
+			}
+			batch.Delete(append([]byte(nil), iter.Key()...))
+			count++
+		}
+		iter.Release()
+	}
+	if err := c.ldb.Write(batch, nil); err != nil {
+		log.Error(err)
+		return
+	}
+	if count > 0 {
+		log.Info(fmt.Sprintf("CleanOpLog drop %d operations and tombstones", count))
+	}
+}
+
+// ReplicateOpLog pulls the operation logs of the live peers.
+func (c *Server) ReplicateOpLog() {
+	var (
+		cleanTime time.Time
+	)
+	for {
+		for _, peer := range c.GetLivePeers() {
+			if err := c.PullOpLog(peer); err != nil {
+				log.Warn(fmt.Sprintf("pull oplog of %s: %s", peer, err.Error()))
+			}
+		}
+		if time.Since(cleanTime) > time.Hour {
+			c.CleanOpLog()
+			cleanTime = time.Now()
+		}
+		time.Sleep(time.Second * time.Duration(Config().OplogInterval))
+	}
+}
+
+func (c *Server) GetOpLogStatus() *OpLogStatus {
+	status := &OpLogStatus{Seq: c.getInt64Key(CONST_OPLOG_SEQ_KEY), Checkpoints: make(map[string]int64)}
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(CONST_CHECKPOINT_KEY_PREFIX)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		n, _ := strconv.ParseInt(string(iter.Value()), 10, 64)
+		status.Checkpoints[string(iter.Key()[len(CONST_CHECKPOINT_KEY_PREFIX):])] = n
+	}
+	return status
+}
+
+// OpLog answers the operations of this node after since. action=pull makes
+// this node pull the log of peer, action=status shows the checkpoints.
+func (c *Server) OpLog(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		result JsonResult
+		page   *OpLogPage
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	switch r.FormValue("action") {
+	case "pull":
+		peer := c.normalizePeer(r.FormValue("peer"))
+		if !c.util.Contains(peer, c.GetKnownPeers()) {
+			result.Message = "(error) unknown peer " + peer
+			w.Write([]byte(c.util.JsonEncodePretty(result)))
+			return
+		}
+		go func() {
+			if err := c.PullOpLog(peer); err != nil {
+				log.Warn(fmt.Sprintf("pull oplog of %s: %s", peer, err.Error()))
+			}
+		}()
+	case "status":
+		result.Data = c.GetOpLogStatus()
+	case "":
+		since, _ := strconv.ParseInt(r.FormValue("since"), 10, 64)
+		if page, err = c.GetOps(since, CONST_OPLOG_PAGE_SIZE); err != nil {
+			result.Message = err.Error()
+			w.Write([]byte(c.util.JsonEncodePretty(result)))
+			return
+		}
+		result.Data = page
+	default:
+		result.Message = "(error) action must be pull or status"
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
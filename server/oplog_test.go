@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpLogReplay(t *testing.T) {
+	var (
+		err      error
+		fileInfo *FileInfo
+	)
+	a := newTestServer(t, "http://a", &GlobalConfig{AdminIps: []string{"127.0.0.1"}, TombstoneDays: 30})
+	b := newTestServer(t, "http://b", nil)
+	dir := STORE_DIR_NAME + "/default"
+	for _, c := range []*Server{a, b} {
+		for _, name := range []string{"gone.txt", "kept.txt"} {
+			c.storage.Put(dir+"/"+name, strings.NewReader(name))
+			c.saveFileMd5Log(&FileInfo{Name: name, Path: dir, Md5: c.util.MD5(name), Size: int64(len(name)), OffSet: -1,
+				TimeStamp: 1000, Peers: []string{"http://a", "http://b"}}, CONST_FILE_Md5_FILE_NAME)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oplog", a.OpLog)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	gone := a.util.MD5("gone.txt")
+	if fileInfo, err = a.GetFileInfoFromLevelDB(gone); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = a.DeleteFile(fileInfo, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	a.RemoveFileFromPeers(gone, fileInfo.RefId, "", gone)
+	if err = b.PullOpLog(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	for b.queueFileLog.Stats().Pending > 0 {
+		item := b.queueFileLog.Take()
+		b.saveFileMd5Log(item.FileInfo, item.FileName)
+		b.queueFileLog.Ack(item)
+	}
+	if ok, _ := b.IsExistFromLevelDB(gone, b.ldb); ok || b.StorageFileExists(dir+"/gone.txt") {
+		t.Fatal("delete not replayed")
+	}
+	for _, c := range []*Server{a, b} {
+		if !c.IsDeleted(fileInfo) {
+			t.Fatalf("no tombstone on %s", c.host)
+		}
+	}
+	if b.IsDeleted(&FileInfo{Md5: gone, TimeStamp: fileInfo.TimeStamp + 2*24*3600*365*100}) {
+		t.Fatal("a newer copy is refused")
+	}
+	// only the operations after the checkpoint are replayed
+	kept := a.util.MD5("kept.txt")
+	a.LogOp(&Op{Type: CONST_OP_META, Md5: kept, Meta: FileMeta{"owner": "bob"}})
+	b.ldb.Delete([]byte(CONST_TOMBSTONE_KEY_PREFIX+gone), nil)
+	if err = b.PullOpLog(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if b.GetTombstone(gone) != nil {
+		t.Fatal("delete replayed twice")
+	}
+	if fileInfo, err = b.GetFileInfoFromLevelDB(kept); err != nil || fileInfo.Meta["owner"] != "bob" {
+		t.Fatalf("meta not replayed: %+v %v", fileInfo, err)
+	}
+	if status := b.GetOpLogStatus(); status.Checkpoints[srv.URL] != 2 {
+		t.Fatalf("checkpoints %+v", status.Checkpoints)
+	}
+	// a reference made on a is there on b after the next pull
+	if fileInfo, err = a.GetFileInfoFromLevelDB(kept); err != nil {
+		t.Fatal(err)
+	}
+	ref := a.AddDedupRef(fileInfo, &FileInfo{Name: "copy.txt", Path: dir, Md5: kept, TimeStamp: 2000})
+	if err = b.PullOpLog(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if refs := b.GetFileRefs(kept); len(refs) != 2 || refs[0].RefId != ref.RefId && refs[1].RefId != ref.RefId {
+		t.Fatalf("ref not replayed: %+v", refs)
+	}
+}
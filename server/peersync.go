@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sjqzhang/seelog"
+)
+
+// Every peer has its own work queue and peer_sync_worker workers, so a slow
+// or dead peer only holds up its own backlog. postFileToPeer only fans the
+// files out to the queues of the peers missing them. The files of a peer
+// that is not alive or read only stay in its queue and count as failures.
+// After breaker_failures failures in a row the circuit of a peer opens: its
+// workers stop sending for breaker_cooldown seconds, then one file probes
+// the peer. A success closes the circuit, a failure opens it again twice as
+// long, up to CONST_QUEUE_MAX_BACKOFF seconds.
+
+type PeerSyncStatus struct {
+	Peer        string `json:"peer"`
+	Backlog     int64  `json:"backlog"`
+	Running     int64  `json:"running"`
+	Dead        int64  `json:"dead"`
+	Lag         int64  `json:"lag"`
+	State       string `json:"state"`
+	Failures    int    `json:"failures"`
+	OpenUntil   int64  `json:"open_until,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+	LastSuccess int64  `json:"last_success"`
+}
+
+type PeerSync struct {
+	sync.Mutex
+	peer        string
+	queue       *WorkQueue
+	state       string
+	failures    int
+	cooldown    time.Duration
+	openUntil   time.Time
+	lastError   string
+	lastSuccess int64
+}
+
+func NewPeerSync(peer string, queue *WorkQueue) *PeerSync {
+	return &PeerSync{peer: peer, queue: queue, state: CONST_BREAKER_CLOSED}
+}
+
+// allow tells whether a file can be sent to the peer now. Once the cooldown
+// of an open circuit is over the first caller probes the peer, the others
+// wait for the result.
+func (ps *PeerSync) allow() bool {
+	ps.Lock()
+	defer ps.Unlock()
+	switch ps.state {
+	case CONST_BREAKER_CLOSED:
+		return true
+	case CONST_BREAKER_OPEN:
+		if time.Now().Before(ps.openUntil) {
+			return false
+		}
+		ps.state = CONST_BREAKER_HALF_OPEN
+		return true
+	}
+	return false
+}
+
+// done records the result of a send to the peer.
+func (ps *PeerSync) done(err error) {
+	ps.Lock()
+	defer ps.Unlock()
+	if err == nil {
+		if ps.state != CONST_BREAKER_CLOSED {
+			log.Info(fmt.Sprintf("peer %s is back, circuit closed", ps.peer))
+		}
+		ps.state = CONST_BREAKER_CLOSED
+		ps.failures = 0
+		ps.cooldown = 0
+		ps.lastSuccess = time.Now().Unix()
+		return
+	}
+	ps.failures++
+	ps.lastError = err.Error()
+	if ps.state == CONST_BREAKER_OPEN {
+		return
+	}
+	if ps.state == CONST_BREAKER_HALF_OPEN || ps.failures >= Config().BreakerFailures {
+		if ps.cooldown = ps.cooldown * 2; ps.cooldown == 0 {
+			ps.cooldown = time.Duration(Config().BreakerCooldown) * time.Second
+		}
+		if max := time.Duration(CONST_QUEUE_MAX_BACKOFF) * time.Second; ps.cooldown > max {
+			ps.cooldown = max
+		}
+		ps.state = CONST_BREAKER_OPEN
+		ps.openUntil = time.Now().Add(ps.cooldown)
+		log.Warn(fmt.Sprintf("peer %s failed %d times, circuit open for %s: %s", ps.peer, ps.failures, ps.cooldown, ps.lastError))
+	}
+}
+
+// skip gives the probe back when nothing was sent to the peer, the next
+// file probes it.
+func (ps *PeerSync) skip() {
+	ps.Lock()
+	defer ps.Unlock()
+	if ps.state == CONST_BREAKER_HALF_OPEN {
+		ps.state = CONST_BREAKER_OPEN
+	}
+}
+
+func (ps *PeerSync) Status() *PeerSyncStatus {
+	stats := ps.queue.Stats()
+	ps.Lock()
+	defer ps.Unlock()
+	status := &PeerSyncStatus{Peer: ps.peer, Backlog: stats.Pending, Running: stats.Running, Dead: stats.Dead,
+		Lag: stats.OldestAge, State: ps.state, Failures: ps.failures, LastError: ps.lastError, LastSuccess: ps.lastSuccess}
+	if ps.state == CONST_BREAKER_OPEN {
+		status.OpenUntil = ps.openUntil.Unix()
+	}
+	return status
+}
+
+// getPeerSync returns the queue and circuit of peer, its workers are started
+// the first time.
+func (c *Server) getPeerSync(peer string) *PeerSync {
+	c.peerSyncLock.Lock()
+	defer c.peerSyncLock.Unlock()
+	if c.peerSyncs == nil {
+		c.peerSyncs = make(map[string]*PeerSync)
+	}
+	if ps, ok := c.peerSyncs[peer]; ok {
+		return ps
+	}
+	ps := NewPeerSync(peer, NewWorkQueue(CONST_QUEUE_PEER_PREFIX+peer, c.ldb))
+	c.peerSyncs[peer] = ps
+	for i := 0; i < Config().PeerSyncWorker; i++ {
+		go c.consumePeerQueue(ps)
+	}
+	return ps
+}
+
+func (c *Server) getPeerSyncs() []*PeerSync {
+	var (
+		syncs []*PeerSync
+	)
+	c.peerSyncLock.Lock()
+	defer c.peerSyncLock.Unlock()
+	for _, ps := range c.peerSyncs {
+		syncs = append(syncs, ps)
+	}
+	sort.Slice(syncs, func(i, j int) bool { return syncs[i].peer < syncs[j].peer })
+	return syncs
+}
+
+func (c *Server) consumePeerQueue(ps *PeerSync) {
+	for {
+		var (
+			err  error
+			sent bool
+		)
+		item := ps.queue.Take()
+		for !ps.allow() {
+			time.Sleep(time.Second)
+		}
+		if !c.IsPeerAlive(ps.peer) {
+			err = fmt.Errorf("peer %s is not alive", ps.peer)
+		} else if c.IsPeerReadOnly(ps.peer) {
+			err = fmt.Errorf("peer %s is read only", ps.peer)
+		}
+		if err != nil {
+			// kept until the peer is back, the attempts are not used up
+			ps.queue.Delay(item, err)
+			ps.done(err)
+			continue
+		}
+		if sent, err = c.postFileToOnePeer(item.FileInfo, ps.peer); sent {
+			ps.done(err)
+		} else {
+			ps.skip()
+		}
+		if err != nil {
+			ps.queue.Retry(item, err)
+		} else {
+			ps.queue.Ack(item)
+		}
+	}
+}
+
+// WatchPeerSyncs starts the workers of the known peers, the backlog a peer
+// had before a restart is sent without waiting for a new file.
+func (c *Server) WatchPeerSyncs() {
+	for {
+		for _, peer := range c.GetKnownPeers() {
+			if peer != c.host {
+				c.getPeerSync(peer)
+			}
+		}
+		time.Sleep(time.Second * 10)
+	}
+}
+
+func (c *Server) GetPeerSyncStatus() []*PeerSyncStatus {
+	status := []*PeerSyncStatus{}
+	for _, ps := range c.getPeerSyncs() {
+		status = append(status, ps.Status())
+	}
+	return status
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerSync(t *testing.T) {
+	block := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer slow.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("http://healthy/file.txt"))
+	}))
+	defer healthy.Close()
+	c := newTestServer(t, "http://a", &GlobalConfig{Peers: []string{"http://a", slow.URL, healthy.URL, "http://readonly"},
+		PeerSyncWorker: 1, BreakerFailures: 2, BreakerCooldown: 60, RetryInterval: 60})
+	c.peerReadOnly.Put("http://readonly", true)
+	dir := STORE_DIR_NAME + "/default"
+	c.storage.Put(dir+"/file.txt", strings.NewReader("file"))
+	fileInfo := &FileInfo{Name: "file.txt", Path: dir, Md5: c.util.MD5("file"), Size: 4, OffSet: -1,
+		TimeStamp: 1000, Peers: []string{"http://a"}}
+	c.SaveFileInfoToLevelDB(fileInfo.Md5, fileInfo, c.ldb)
+	if err := c.postFileToPeer(fileInfo); err != nil {
+		t.Fatal(err)
+	}
+	// the slow peer holds its worker, not the one of the healthy peer
+	for i := 0; ; i++ {
+		if info, _ := c.GetFileInfoFromLevelDB(fileInfo.Md5); info != nil && c.util.Contains(healthy.URL, info.Peers) {
+			break
+		}
+		if i > 50 {
+			t.Fatal("not synced to the healthy peer")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	peerStatus := func(peer string) *PeerSyncStatus {
+		for _, status := range c.GetPeerSyncStatus() {
+			if status.Peer == peer {
+				return status
+			}
+		}
+		t.Fatalf("no status of %s", peer)
+		return nil
+	}
+	if status := peerStatus(healthy.URL); status.Backlog != 0 || status.LastSuccess == 0 {
+		t.Fatalf("status %+v", status)
+	}
+	if status := peerStatus(slow.URL); status.Backlog != 1 || status.Running != 1 {
+		t.Fatalf("status %+v", status)
+	}
+	// the file of a read only peer waits in its queue, no attempt is used
+	for i := 0; peerStatus("http://readonly").Failures == 0; i++ {
+		if i > 50 {
+			t.Fatal("read only peer not tried")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if status := peerStatus("http://readonly"); status.Backlog != 1 || status.Running != 0 || status.Dead != 0 {
+		t.Fatalf("status %+v", status)
+	}
+	// the slow peer fails, the file is retried after the backoff
+	close(block)
+	for i := 0; peerStatus(slow.URL).Running != 0; i++ {
+		if i > 50 {
+			t.Fatal("slow peer still running")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if status := peerStatus(slow.URL); status.Backlog != 1 || status.Failures != 1 || status.State != CONST_BREAKER_CLOSED {
+		t.Fatalf("status %+v", status)
+	}
+	// the circuit opens after breaker_failures failures and is probed once
+	ps := NewPeerSync("http://b", nil)
+	ps.done(errors.New("down"))
+	if !ps.allow() {
+		t.Fatal("open after one failure")
+	}
+	ps.done(errors.New("down"))
+	if ps.allow() || ps.state != CONST_BREAKER_OPEN {
+		t.Fatalf("not open %s", ps.state)
+	}
+	ps.openUntil = time.Now()
+	if !ps.allow() || ps.allow() {
+		t.Fatal("probe not allowed once")
+	}
+	// nothing was sent, the next file probes the peer
+	if ps.skip(); !ps.allow() || ps.state != CONST_BREAKER_HALF_OPEN {
+		t.Fatalf("probe not given back %s", ps.state)
+	}
+	ps.done(errors.New("down"))
+	if ps.cooldown != 120*time.Second || ps.allow() {
+		t.Fatalf("cooldown %s", ps.cooldown)
+	}
+	ps.openUntil = time.Now()
+	ps.allow()
+	if ps.done(nil); ps.state != CONST_BREAKER_CLOSED || ps.failures != 0 || !ps.allow() {
+		t.Fatalf("not closed %s", ps.state)
+	}
+}
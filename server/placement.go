@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sjqzhang/seelog"
+)
+
+// ScenePlacement overrides the replication of one scene, Peers pins the
+// scene to a subset of the group.
+type ScenePlacement struct {
+	ReplicationFactor int      `json:"replication_factor"`
+	Peers             []string `json:"peers"`
+}
+
+func (c *Server) normalizePeer(peer string) string {
+	peer = strings.TrimRight(peer, "/")
+	if !strings.HasPrefix(peer, "http") {
+		peer = "http://" + peer
+	}
+	return peer
+}
+
+// GetClusterNodes returns every node of the group, this node included.
+func (c *Server) GetClusterNodes() []string {
+	var (
+		nodes []string
+	)
+	nodes = append(nodes, c.host)
+	for _, peer := range c.GetKnownPeers() {
+		if !c.util.Contains(peer, nodes) {
+			nodes = append(nodes, peer)
+		}
+	}
+	return nodes
+}
+
+func (c *Server) GetPeerZone(peer string) string {
+	for k, v := range Config().PeerZones {
+		if c.normalizePeer(k) == peer {
+			return v
+		}
+	}
+	return ""
+}
+
+// GetReplicationFactor returns how many nodes keep a copy of files of scene,
+// 0 means every node of the group.
+func (c *Server) GetReplicationFactor(scene string) int {
+	if p, ok := Config().ScenePlacement[scene]; ok && p.ReplicationFactor > 0 {
+		return p.ReplicationFactor
+	}
+	return Config().ReplicationFactor
+}
+
+// GetPlacementNodes returns the nodes a file may be stored on ranked by
+// rendezvous hashing of its md5, so every node computes the same order from
+// the same cfg.json. With peer_zones the order takes one node of every zone
+// before a zone is reused.
+func (c *Server) GetPlacementNodes(fileInfo *FileInfo) []string {
+	var (
+		nodes  []string
+		pinned []string
+		result []string
+		zones  []string
+		byZone map[string][]string
+	)
+	nodes = c.GetClusterNodes()
+	if p, ok := Config().ScenePlacement[fileInfo.Scene]; ok && len(p.Peers) > 0 {
+		for _, peer := range p.Peers {
+			if peer = c.normalizePeer(peer); c.util.Contains(peer, nodes) {
+				pinned = append(pinned, peer)
+			}
+		}
+		if len(pinned) > 0 {
+			nodes = pinned
+		} else {
+			log.Warn("scene_placement peers of ", fileInfo.Scene, " are not in the group")
+		}
+	}
+	scores := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		scores[node] = c.util.MD5(fileInfo.Md5 + "|" + node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return scores[nodes[i]] > scores[nodes[j]] })
+	if len(Config().PeerZones) == 0 {
+		return nodes
+	}
+	byZone = make(map[string][]string)
+	for _, node := range nodes {
+		zone := c.GetPeerZone(node)
+		if zone == "" {
+			// nodes without a zone are each a zone of their own
+			zone = node
+		}
+		if _, ok := byZone[zone]; !ok {
+			zones = append(zones, zone)
+		}
+		byZone[zone] = append(byZone[zone], node)
+	}
+	for len(result) < len(nodes) {
+		for _, zone := range zones {
+			if len(byZone[zone]) > 0 {
+				result = append(result, byZone[zone][0])
+				byZone[zone] = byZone[zone][1:]
+			}
+		}
+	}
+	return result
+}
+
+// GetPlacementPeers returns the nodes that are expected to hold the content of
+// fileInfo, the first replication_factor nodes of GetPlacementNodes. For an
+// erasure coded file these are the nodes its shards were assigned to.
+func (c *Server) GetPlacementPeers(fileInfo *FileInfo) []string {
+	var (
+		nodes []string
+		rf    int
+	)
+	if fileInfo.Shards != nil {
+		for _, peer := range fileInfo.Shards.Peers {
+			if !c.util.Contains(peer, nodes) {
+				nodes = append(nodes, peer)
+			}
+		}
+		return nodes
+	}
+	nodes = c.GetPlacementNodes(fileInfo)
+	rf = c.GetReplicationFactor(fileInfo.Scene)
+	if rf <= 0 || rf >= len(nodes) {
+		return nodes
+	}
+	return nodes[:rf]
+}
+
+func (c *Server) IsPlacedOn(fileInfo *FileInfo, peer string) bool {
+	return c.util.Contains(peer, c.GetPlacementPeers(fileInfo))
+}
+
+// IsReplicated reports whether every node of the placement set is known to
+// hold the file.
+func (c *Server) IsReplicated(fileInfo *FileInfo) bool {
+	for _, peer := range c.GetPlacementPeers(fileInfo) {
+		if !c.util.Contains(peer, fileInfo.Peers) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetHolderPeers returns the other nodes that should be asked for the content
+// of fileInfo: its placement set first, then the nodes it was uploaded to.
+func (c *Server) GetHolderPeers(fileInfo *FileInfo) []string {
+	var (
+		peers []string
+	)
+	for _, peer := range append(c.GetPlacementPeers(fileInfo), fileInfo.Peers...) {
+		if peer != c.host && !c.util.Contains(peer, peers) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// HasUnplacedCopy reports whether this node keeps the bytes of fileInfo
+// without being in its placement set, as the node an upload reached does.
+func (c *Server) HasUnplacedCopy(fileInfo *FileInfo) bool {
+	return fileInfo.OffSet == -1 && fileInfo.Shards == nil && !c.IsPlacedOn(fileInfo, c.host) &&
+		c.StorageFileExists(c.GetFilePathByInfo(fileInfo, false))
+}
+
+// ReleaseUnplacedCopy deletes the bytes of fileInfo kept outside its
+// placement set once every node of the set has them, this node keeps the
+// metadata only. The error tells the copy is still needed.
+func (c *Server) ReleaseUnplacedCopy(fileInfo *FileInfo) error {
+	var (
+		err  error
+		info *FileInfo
+	)
+	key := "file_peers_" + fileInfo.Md5
+	c.lockMap.LockKey(key)
+	defer c.lockMap.UnLockKey(key)
+	if info, err = c.GetFileInfoFromLevelDB(fileInfo.Md5); err != nil || !c.HasUnplacedCopy(info) {
+		// deleted, released already, or placed here by now
+		return nil
+	}
+	for _, peer := range c.GetPlacementPeers(info) {
+		if _, err = c.checkPeerFileExist(peer, info.Md5, ""); err != nil {
+			return fmt.Errorf("%s not on %s yet: %s", info.Md5, peer, err.Error())
+		}
+	}
+	var peers []string
+	for _, peer := range info.Peers {
+		if peer != c.host {
+			peers = append(peers, peer)
+		}
+	}
+	info.Peers = peers
+	fpath := c.GetFilePathByInfo(info, false)
+	if _, err = c.SaveFileInfoToLevelDB(info.Md5, info, c.ldb); err != nil {
+		return err
+	}
+	if _, err = c.SaveFileInfoToLevelDB(c.util.MD5(fpath), info, c.ldb); err != nil {
+		return err
+	}
+	if err = c.storage.Delete(fpath); err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("%s is on its placement set, local copy released", fpath))
+	return nil
+}
+
+// ConsumerRelease releases the copies queued by postFileToPeer, the copies
+// the nodes of the placement set have not fetched yet are tried again later.
+func (c *Server) ConsumerRelease() {
+	for {
+		item := c.queueRelease.Take()
+		if err := c.ReleaseUnplacedCopy(item.FileInfo); err != nil {
+			c.queueRelease.Delay(item, err)
+		} else {
+			c.queueRelease.Ack(item)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/sjqzhang/goutil"
+)
+
+func TestGetPlacementPeers(t *testing.T) {
+	old := atomic.LoadPointer(&ptr)
+	defer atomic.StorePointer(&ptr, old)
+	atomic.StorePointer(&ptr, unsafe.Pointer(&GlobalConfig{
+		Peers:             []string{"http://10.0.0.2:8080", "http://10.0.0.3:8080", "http://10.0.0.4:8080"},
+		ReplicationFactor: 2,
+		PeerZones: map[string]string{
+			"http://10.0.0.1:8080": "a",
+			"10.0.0.2:8080":        "a",
+			"http://10.0.0.3:8080": "b",
+			"http://10.0.0.4:8080": "b",
+		},
+		ScenePlacement: map[string]ScenePlacement{
+			"pinned": {ReplicationFactor: 1, Peers: []string{"10.0.0.4:8080"}},
+		},
+	}))
+	c := &Server{util: &goutil.Common{}, host: "http://10.0.0.1:8080"}
+	for i := 0; i < 100; i++ {
+		fileInfo := &FileInfo{Md5: c.util.MD5(string(rune(i))), Scene: "default"}
+		peers := c.GetPlacementPeers(fileInfo)
+		if len(peers) != 2 {
+			t.Fatal("replication factor", peers)
+		}
+		if c.GetPeerZone(peers[0]) == c.GetPeerZone(peers[1]) {
+			t.Error("replicas in the same zone", peers)
+		}
+		if peers2 := c.GetPlacementPeers(fileInfo); peers2[0] != peers[0] || peers2[1] != peers[1] {
+			t.Error("placement is not deterministic", peers, peers2)
+		}
+	}
+	peers := c.GetPlacementPeers(&FileInfo{Md5: c.util.MD5("pinned"), Scene: "pinned"})
+	if len(peers) != 1 || peers[0] != "http://10.0.0.4:8080" {
+		t.Error("scene pinning", peers)
+	}
+}
+
+func TestReleaseUnplacedCopy(t *testing.T) {
+	var (
+		fetched  int32
+		fileInfo *FileInfo
+	)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fetched) == 1 {
+			w.Write([]byte(`{"md5":"` + r.FormValue("md5") + `"}`))
+		} else {
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer peer.Close()
+	c := newTestServer(t, "http://a", &GlobalConfig{Peers: []string{"http://a", peer.URL}, ReplicationFactor: 1})
+	dir := STORE_DIR_NAME + "/default"
+	for i := 0; fileInfo == nil || c.IsPlacedOn(fileInfo, c.host); i++ {
+		name := fmt.Sprintf("%d.txt", i)
+		fileInfo = &FileInfo{Name: name, Path: dir, Md5: c.util.MD5(name), Size: 1, OffSet: -1, Peers: []string{c.host}}
+	}
+	c.storage.Put(dir+"/"+fileInfo.Name, strings.NewReader("a"))
+	c.saveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
+	if !c.HasUnplacedCopy(fileInfo) {
+		t.Fatal("uploaded copy outside the placement set not found")
+	}
+	// the node of the placement set has not fetched the file yet
+	if err := c.ReleaseUnplacedCopy(fileInfo); err == nil || !c.StorageFileExists(dir+"/"+fileInfo.Name) {
+		t.Fatal("copy released before it was replicated", err)
+	}
+	atomic.StoreInt32(&fetched, 1)
+	if err := c.ReleaseUnplacedCopy(fileInfo); err != nil || c.StorageFileExists(dir+"/"+fileInfo.Name) {
+		t.Fatal("copy not released", err)
+	}
+	if info, err := c.GetFileInfoFromLevelDB(fileInfo.Md5); err != nil || c.util.Contains(c.host, info.Peers) || c.CheckFileExistByInfo(info.Md5, info) {
+		t.Error("metadata still has the copy", info, err)
+	}
+}
@@ -0,0 +1,437 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The syncs to and from the peers and the md5 logs go through work queues
+// kept in leveldb, so the pending work survives a restart. An item stays in
+// its queue until the worker that took it acks it: after a crash the items
+// that were running are delivered again. A failed item is retried after a
+// backoff doubling from retry_interval seconds, with jitter, and moved to
+// the dead letters after retry_count retries, where queue lists, retries or
+// drops them.
+
+type QueueItem struct {
+	Id        int64     `json:"id"`
+	Attempts  int       `json:"attempts"`
+	AddTime   int64     `json:"add_time"`
+	NextTime  int64     `json:"next_time"`
+	LastError string    `json:"last_error,omitempty"`
+	FileName  string    `json:"filename,omitempty"`
+	FileInfo  *FileInfo `json:"fileInfo"`
+	key       string
+}
+
+type QueueStats struct {
+	Name      string `json:"name"`
+	Pending   int64  `json:"pending"`
+	Running   int64  `json:"running"`
+	Dead      int64  `json:"dead"`
+	Enqueued  int64  `json:"enqueued"`
+	Done      int64  `json:"done"`
+	Retried   int64  `json:"retried"`
+	Failed    int64  `json:"failed"`
+	OldestAge int64  `json:"oldest_age"`
+}
+
+type WorkQueue struct {
+	name    string
+	db      *leveldb.DB
+	lock    sync.Mutex
+	seq     int64
+	running map[string]bool
+	wake    chan bool
+	stats   QueueStats
+}
+
+// NewWorkQueue opens the queue name kept in db, the items left by the last
+// run are pending again.
+func NewWorkQueue(name string, db *leveldb.DB) *WorkQueue {
+	q := &WorkQueue{name: name, db: db, running: make(map[string]bool), wake: make(chan bool, 1)}
+	q.stats.Name = name
+	for _, prefix := range []string{q.prefix(), q.deadPrefix()} {
+		iter := db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+		for iter.Next() {
+			var item QueueItem
+			if err := json.Unmarshal(iter.Value(), &item); err != nil {
+				continue
+			}
+			if item.Id > q.seq {
+				q.seq = item.Id
+			}
+			if prefix == q.prefix() {
+				q.stats.Pending++
+			} else {
+				q.stats.Dead++
+			}
+		}
+		iter.Release()
+	}
+	return q
+}
+
+func (q *WorkQueue) prefix() string {
+	return fmt.Sprintf("%s%s_", CONST_QUEUE_KEY_PREFIX, q.name)
+}
+
+func (q *WorkQueue) deadPrefix() string {
+	return fmt.Sprintf("%s%s_", CONST_DEAD_LETTER_KEY_PREFIX, q.name)
+}
+
+// itemKey orders the items by the time they are due, then by arrival.
+func (q *WorkQueue) itemKey(item *QueueItem) string {
+	return fmt.Sprintf("%s%019d_%020d", q.prefix(), item.NextTime, item.Id)
+}
+
+func (q *WorkQueue) deadKey(id int64) string {
+	return fmt.Sprintf("%s%020d", q.deadPrefix(), id)
+}
+
+func (q *WorkQueue) signal() {
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// Put adds item to the queue, it is due at once.
+func (q *WorkQueue) Put(item *QueueItem) error {
+	var (
+		err  error
+		data []byte
+	)
+	q.lock.Lock()
+	q.seq++
+	item.Id = q.seq
+	item.AddTime = time.Now().Unix()
+	item.NextTime = time.Now().UnixNano() / int64(time.Millisecond)
+	if data, err = json.Marshal(item); err == nil {
+		err = q.db.Put([]byte(q.itemKey(item)), data, nil)
+	}
+	if err == nil {
+		q.stats.Pending++
+		q.stats.Enqueued++
+	}
+	q.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	q.signal()
+	return nil
+}
+
+// Take blocks until an item is due and no other worker runs it.
+func (q *WorkQueue) Take() *QueueItem {
+	for {
+		item, wait := q.next()
+		if item != nil {
+			// the next item may be due too, pass the wake up on
+			q.signal()
+			return item
+		}
+		select {
+		case <-q.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// next returns the first due item no worker runs. Only the due range of the
+// keys is read, the items in it that are skipped are the running ones.
+func (q *WorkQueue) next() (*QueueItem, time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	due := &util.Range{Start: []byte(q.prefix()), Limit: []byte(fmt.Sprintf("%s%019d", q.prefix(), now+1))}
+	iter := q.db.NewIterator(due, nil)
+	defer iter.Release()
+	for iter.Next() {
+		var item QueueItem
+		key := string(iter.Key())
+		if q.running[key] {
+			continue
+		}
+		if err := json.Unmarshal(iter.Value(), &item); err != nil || item.FileInfo == nil {
+			log.Error(fmt.Sprintf("drop bad item %s of queue %s", key, q.name))
+			q.db.Delete([]byte(key), nil)
+			q.stats.Pending--
+			continue
+		}
+		item.key = key
+		q.running[key] = true
+		return &item, 0
+	}
+	// nothing due, wait for the first item that is not
+	later := q.db.NewIterator(&util.Range{Start: due.Limit, Limit: util.BytesPrefix([]byte(q.prefix())).Limit}, nil)
+	defer later.Release()
+	if later.First() {
+		var item QueueItem
+		if err := json.Unmarshal(later.Value(), &item); err == nil && item.NextTime > now {
+			if wait := time.Duration(item.NextTime-now) * time.Millisecond; wait < time.Second {
+				return nil, wait
+			}
+		}
+	}
+	return nil, time.Second
+}
+
+// Ack removes item from the queue once it is done.
+func (q *WorkQueue) Ack(item *QueueItem) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.db.Delete([]byte(item.key), nil); err != nil {
+		log.Error(err)
+	}
+	delete(q.running, item.key)
+	q.stats.Pending--
+	q.stats.Done++
+}
+
+// Retry schedules item again after the backoff of its attempts, or moves it
+// to the dead letters when it failed more than retry_count times.
+func (q *WorkQueue) Retry(item *QueueItem, cause error) {
+	q.reschedule(item, cause, true)
+}
+
+// Delay schedules item again after the backoff of its attempts without
+// counting one, for the items that were not tried.
+func (q *WorkQueue) Delay(item *QueueItem, cause error) {
+	q.reschedule(item, cause, false)
+}
+
+func (q *WorkQueue) reschedule(item *QueueItem, cause error, attempt bool) {
+	var (
+		err  error
+		data []byte
+	)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	key := item.key
+	delete(q.running, key)
+	if attempt {
+		item.Attempts++
+	}
+	if cause != nil {
+		item.LastError = cause.Error()
+	}
+	dead := attempt && Config().RetryCount > 0 && item.Attempts > Config().RetryCount
+	if !dead {
+		item.NextTime = time.Now().Add(q.backoff(item.Attempts)).UnixNano() / int64(time.Millisecond)
+	}
+	if data, err = json.Marshal(item); err != nil {
+		log.Error(err)
+		return
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(key))
+	if dead {
+		batch.Put([]byte(q.deadKey(item.Id)), data)
+	} else {
+		batch.Put([]byte(q.itemKey(item)), data)
+	}
+	if err = q.db.Write(batch, nil); err != nil {
+		log.Error(err)
+		return
+	}
+	if item.key = q.itemKey(item); dead {
+		item.key = q.deadKey(item.Id)
+	}
+	if !attempt {
+		return
+	}
+	if dead {
+		log.Error(fmt.Sprintf("queue %s gives up %s after %d attempts: %s", q.name, item.FileInfo.Md5, item.Attempts, item.LastError))
+		q.stats.Pending--
+		q.stats.Dead++
+		q.stats.Failed++
+	} else {
+		q.stats.Retried++
+	}
+}
+
+// backoff doubles retry_interval for each attempt up to
+// CONST_QUEUE_MAX_BACKOFF seconds, half of it is random.
+func (q *WorkQueue) backoff(attempts int) time.Duration {
+	d := time.Duration(Config().RetryInterval) * time.Second
+	max := time.Duration(CONST_QUEUE_MAX_BACKOFF) * time.Second
+	for i := 1; i < attempts && d < max; i++ {
+		d = d * 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (q *WorkQueue) Stats() QueueStats {
+	q.lock.Lock()
+	stats := q.stats
+	stats.Running = int64(len(q.running))
+	q.lock.Unlock()
+	iter := q.db.NewIterator(util.BytesPrefix([]byte(q.prefix())), nil)
+	if iter.First() {
+		var item QueueItem
+		if err := json.Unmarshal(iter.Value(), &item); err == nil {
+			stats.OldestAge = time.Now().Unix() - item.AddTime
+		}
+	}
+	iter.Release()
+	return stats
+}
+
+// DeadLetters returns at most limit items of the dead letters.
+func (q *WorkQueue) DeadLetters(limit int) []*QueueItem {
+	items := []*QueueItem{}
+	iter := q.db.NewIterator(util.BytesPrefix([]byte(q.deadPrefix())), nil)
+	defer iter.Release()
+	for iter.Next() && len(items) < limit {
+		var item QueueItem
+		if err := json.Unmarshal(iter.Value(), &item); err != nil {
+			continue
+		}
+		items = append(items, &item)
+	}
+	return items
+}
+
+// RetryDead puts the dead letter id, or all of them when id is 0, back in
+// the queue with no attempts.
+func (q *WorkQueue) RetryDead(id int64) (int, error) {
+	return q.moveDead(id, true)
+}
+
+// PurgeDead drops the dead letter id, or all of them when id is 0.
+func (q *WorkQueue) PurgeDead(id int64) (int, error) {
+	return q.moveDead(id, false)
+}
+
+func (q *WorkQueue) moveDead(id int64, retry bool) (int, error) {
+	var (
+		err   error
+		data  []byte
+		count int
+	)
+	q.lock.Lock()
+	prefix := q.deadPrefix()
+	if id > 0 {
+		prefix = q.deadKey(id)
+	}
+	batch := new(leveldb.Batch)
+	iter := q.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		var item QueueItem
+		batch.Delete(append([]byte{}, iter.Key()...))
+		count++
+		if !retry || json.Unmarshal(iter.Value(), &item) != nil {
+			continue
+		}
+		item.Attempts = 0
+		item.NextTime = time.Now().UnixNano() / int64(time.Millisecond)
+		if data, err = json.Marshal(&item); err != nil {
+			break
+		}
+		batch.Put([]byte(q.itemKey(&item)), data)
+	}
+	iter.Release()
+	if err == nil {
+		err = q.db.Write(batch, nil)
+	}
+	if err == nil {
+		q.stats.Dead = q.stats.Dead - int64(count)
+		if retry {
+			q.stats.Pending = q.stats.Pending + int64(count)
+		}
+	}
+	q.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 && id > 0 {
+		return 0, errors.New("(error) no dead letter " + strconv.FormatInt(id, 10))
+	}
+	q.signal()
+	return count, nil
+}
+
+func (c *Server) getWorkQueues() []*WorkQueue {
+	queues := []*WorkQueue{c.queueToPeers, c.queueFromPeers, c.queueFileLog, c.queueRelease}
+	for _, ps := range c.getPeerSyncs() {
+		queues = append(queues, ps.queue)
+	}
+	return queues
+}
+
+func (c *Server) GetQueueStats() []QueueStats {
+	stats := []QueueStats{}
+	for _, q := range c.getWorkQueues() {
+		stats = append(stats, q.Stats())
+	}
+	return stats
+}
+
+// Queue shows the stats of the work queues. With name, action=dead lists
+// its dead letters, action=retry puts the dead letter id, or all of them,
+// back in the queue and action=purge drops them.
+func (c *Server) Queue(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		result JsonResult
+		queue  *WorkQueue
+		count  int
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	action := r.FormValue("action")
+	if action != "" {
+		for _, q := range c.getWorkQueues() {
+			if q.name == r.FormValue("name") {
+				queue = q
+			}
+		}
+		if queue == nil {
+			result.Message = "(error) unknown queue " + r.FormValue("name")
+			w.Write([]byte(c.util.JsonEncodePretty(result)))
+			return
+		}
+	}
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	switch action {
+	case "":
+		result.Data = c.GetQueueStats()
+	case "dead":
+		result.Data = queue.DeadLetters(CONST_QUEUE_MAX_DEAD_LETTERS)
+	case "retry":
+		count, err = queue.RetryDead(id)
+		result.Data = count
+	case "purge":
+		count, err = queue.PurgeDead(id)
+		result.Data = count
+	default:
+		err = errors.New("(error) action must be dead, retry or purge")
+	}
+	if err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestWorkQueue(t *testing.T) {
+	old := atomic.LoadPointer(&ptr)
+	defer atomic.StorePointer(&ptr, old)
+	atomic.StorePointer(&ptr, unsafe.Pointer(&GlobalConfig{RetryCount: 2, RetryInterval: 3600}))
+	dir := t.TempDir()
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewWorkQueue(CONST_QUEUE_TO_PEERS, db)
+	for _, md5sum := range []string{"a", "b"} {
+		if err = q.Put(&QueueItem{FileInfo: &FileInfo{Md5: md5sum}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if item := q.Take(); item.FileInfo.Md5 != "a" {
+		t.Fatalf("took %+v", item.FileInfo)
+	}
+	// a crash before the ack, both items are delivered again
+	db.Close()
+	if db, err = leveldb.OpenFile(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	q = NewWorkQueue(CONST_QUEUE_TO_PEERS, db)
+	if stats := q.Stats(); stats.Pending != 2 || stats.Running != 0 {
+		t.Fatalf("stats after restart %+v", stats)
+	}
+	a, b := q.Take(), q.Take()
+	if a.FileInfo.Md5 != "a" || b.FileInfo.Md5 != "b" {
+		t.Fatalf("took %s %s", a.FileInfo.Md5, b.FileInfo.Md5)
+	}
+	q.Ack(a)
+	onDisk := func() int {
+		n := 0
+		iter := db.NewIterator(util.BytesPrefix([]byte(q.prefix())), nil)
+		for iter.Next() {
+			n++
+		}
+		iter.Release()
+		return n
+	}
+	for i := 0; i < 3; i++ {
+		b.FileInfo.Peers = append(b.FileInfo.Peers, "http://a")
+		q.Retry(b, errors.New("down"))
+		if item, _ := q.next(); item != nil {
+			t.Fatalf("retried before the backoff %+v", item)
+		}
+		if n := onDisk(); i < 2 && n != 1 || i == 2 && n != 0 {
+			t.Fatalf("%d items on disk after retry %d", n, i)
+		}
+		if i < 2 {
+			// due again, as if the backoff was over
+			q.lock.Lock()
+			data, _ := db.Get([]byte(b.key), nil)
+			json.Unmarshal(data, b)
+			b.NextTime = 0
+			data, _ = json.Marshal(b)
+			db.Delete([]byte(b.key), nil)
+			db.Put([]byte(q.itemKey(b)), data, nil)
+			q.lock.Unlock()
+			if b = q.Take(); b.Attempts != i+1 {
+				t.Fatalf("took %+v", b)
+			}
+		}
+	}
+	stats := q.Stats()
+	if stats.Pending != 0 || stats.Dead != 1 || stats.Done != 1 || stats.Retried != 2 || stats.Failed != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+	dead := q.DeadLetters(10)
+	if len(dead) != 1 || dead[0].Attempts != 3 || dead[0].LastError != "down" || len(dead[0].FileInfo.Peers) != 3 {
+		t.Fatalf("dead letters %+v", dead)
+	}
+	if d := q.backoff(1); d < 1800e9 || d > 3600e9 {
+		t.Fatalf("backoff %s", d)
+	}
+	if n, err := q.RetryDead(dead[0].Id); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	if item := q.Take(); item.FileInfo.Md5 != "b" || item.Attempts != 0 {
+		t.Fatalf("took %+v", item)
+	}
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sjqzhang/seelog"
+)
+
+// The reconcile job compares the files under files/ with the metadata and
+// reports four kinds of orphans: files on disk without a record, e.g. after
+// a crash between the rename of an upload and its SaveFileMd5Log, records
+// whose file is gone, files whose size differs from their record and
+// temporary files left behind by uploads and downloads. Nothing is changed
+// until an action is applied to the report. Every item is checked again
+// under the lock of its path before it is acted on, and files modified
+// within CONST_RECONCILE_GRACE seconds are left alone, so the job can run
+// on a live node.
+
+type ReconcileItem struct {
+	Category string    `json:"category"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	DiskSize int64     `json:"disk_size"`
+	ModTime  int64     `json:"mtime"`
+	File     *FileInfo `json:"file"`
+}
+
+type ReconcileReport struct {
+	Running   bool                        `json:"running"`
+	StartTime int64                       `json:"start_time"`
+	EndTime   int64                       `json:"end_time"`
+	Counts    map[string]int              `json:"counts"`
+	Items     map[string][]*ReconcileItem `json:"items"`
+}
+
+type ReconcileResult struct {
+	Done    int      `json:"done"`
+	Skipped int      `json:"skipped"`
+	Failed  []string `json:"failed"`
+}
+
+// reconcileActions are the actions allowed on every category.
+var reconcileActions = map[string][]string{
+	CONST_RECONCILE_DISK_ONLY: {CONST_RECONCILE_ADOPT, CONST_RECONCILE_DELETE},
+	CONST_RECONCILE_META_ONLY: {CONST_RECONCILE_REFETCH, CONST_RECONCILE_DELETE},
+	CONST_RECONCILE_SIZE:      {CONST_RECONCILE_ADOPT, CONST_RECONCILE_REFETCH, CONST_RECONCILE_DELETE},
+	CONST_RECONCILE_STALE_TMP: {CONST_RECONCILE_DELETE},
+}
+
+func newReconcileReport() *ReconcileReport {
+	report := &ReconcileReport{Counts: make(map[string]int), Items: make(map[string][]*ReconcileItem)}
+	for category := range reconcileActions {
+		report.Counts[category] = 0
+		report.Items[category] = []*ReconcileItem{}
+	}
+	return report
+}
+
+func (r *ReconcileReport) add(item *ReconcileItem) {
+	r.Counts[item.Category]++
+	if len(r.Items[item.Category]) < CONST_RECONCILE_MAX_ITEMS {
+		r.Items[item.Category] = append(r.Items[item.Category], item)
+	}
+}
+
+// isTmpFile reports whether fpath is a temporary file of a download, a
+// scrub or an erasure coded write.
+func (c *Server) isTmpFile(fpath string) bool {
+	if strings.HasPrefix(fpath, STORE_DIR_NAME+"/_tmp/") {
+		return true
+	}
+	name := path.Base(fpath)
+	return strings.HasPrefix(name, "tmp__") || strings.HasPrefix(name, "scrub__") || strings.HasSuffix(name, "_tmp")
+}
+
+// skipReconcileDir reports whether the files under dir are kept by other
+// means: merged small files, shards, versions, the trash, the parts of S3
+// multipart uploads and the partial tus uploads.
+func (c *Server) skipReconcileDir(dir string) bool {
+	for _, name := range []string{LARGE_DIR_NAME, CONST_SHARD_DIR_NAME, CONST_VERSION_DIR_NAME, CONST_TRASH_DIR_NAME, "_tmp/s3", CONST_BIG_DIR_NAME} {
+		if dir == STORE_DIR_NAME+"/"+name {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyDiskFile returns the category of the file fpath found on disk, ""
+// when it is in order.
+func (c *Server) classifyDiskFile(fpath string, size int64, modTime int64) string {
+	now := time.Now().Unix()
+	if c.isTmpFile(fpath) {
+		if now-modTime > CONST_RECONCILE_TMP_EXPIRE {
+			return CONST_RECONCILE_STALE_TMP
+		}
+		return ""
+	}
+	if now-modTime <= CONST_RECONCILE_GRACE || size == 0 {
+		return ""
+	}
+	if ok, _ := c.IsExistFromLevelDB(c.util.MD5(fpath), c.ldb); ok {
+		return ""
+	}
+	return CONST_RECONCILE_DISK_ONLY
+}
+
+// classifyFileInfo returns the category of the content record fileInfo, ""
+// when its file is in order.
+func (c *Server) classifyFileInfo(fileInfo *FileInfo) (string, int64) {
+	fpath := c.GetFilePathByInfo(fileInfo, false)
+	if fileInfo.OffSet >= 0 {
+		fpath = c.GetSmallFileVolume(fileInfo)
+	}
+	fi, err := c.storage.Stat(fpath)
+	if err != nil {
+		if time.Now().Unix()-fileInfo.TimeStamp <= CONST_RECONCILE_GRACE {
+			// the copy may be on its way from a peer
+			return "", 0
+		}
+		return CONST_RECONCILE_META_ONLY, 0
+	}
+	if fileInfo.OffSet < 0 && fi.Size() != fileInfo.Size && time.Now().Unix()-fi.ModTime().Unix() > CONST_RECONCILE_GRACE {
+		return CONST_RECONCILE_SIZE, fi.Size()
+	}
+	return "", fi.Size()
+}
+
+func (c *Server) walkReconcileDir(dir string, report *ReconcileReport) {
+	fis, err := c.storage.List(dir)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, fi := range fis {
+		fpath := dir + "/" + fi.Name()
+		if fi.IsDir() {
+			if !c.skipReconcileDir(fpath) {
+				c.walkReconcileDir(fpath, report)
+			}
+			continue
+		}
+		if category := c.classifyDiskFile(fpath, fi.Size(), fi.ModTime().Unix()); category != "" {
+			report.add(&ReconcileItem{Category: category, Path: fpath, DiskSize: fi.Size(), ModTime: fi.ModTime().Unix()})
+		}
+	}
+}
+
+// ReconcileFiles builds the report of the orphans of this node.
+func (c *Server) ReconcileFiles() (*ReconcileReport, error) {
+	var (
+		err error
+	)
+	if c.lockMap.IsLock("ReconcileFiles") {
+		return nil, errors.New("reconcile is running")
+	}
+	c.lockMap.LockKey("ReconcileFiles")
+	defer c.lockMap.UnLockKey("ReconcileFiles")
+	report := newReconcileReport()
+	report.Running, report.StartTime = true, time.Now().Unix()
+	c.reconcileState.Store(report)
+	result := newReconcileReport()
+	c.walkReconcileDir(STORE_DIR_NAME, result)
+	iter := c.ldb.NewIterator(nil, nil)
+	for iter.Next() {
+		var fileInfo FileInfo
+		if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil || !c.isScrubCandidate(string(iter.Key()), &fileInfo) {
+			continue
+		}
+		if category, size := c.classifyFileInfo(&fileInfo); category != "" {
+			fpath := c.GetFilePathByInfo(&fileInfo, false)
+			result.add(&ReconcileItem{Category: category, Path: fpath, Size: fileInfo.Size, DiskSize: size,
+				ModTime: fileInfo.TimeStamp, File: &fileInfo})
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		log.Error(err)
+	}
+	result.StartTime = report.StartTime
+	result.EndTime = time.Now().Unix()
+	c.reconcileState.Store(result)
+	log.Info(fmt.Sprintf("reconcile finish: %v", result.Counts))
+	return result, nil
+}
+
+// GetReconcileReport returns the report of the last reconcile job, nil
+// before the first one.
+func (c *Server) GetReconcileReport() *ReconcileReport {
+	if report, ok := c.reconcileState.Load().(*ReconcileReport); ok {
+		return report
+	}
+	return nil
+}
+
+// checkReconcileItem tells whether item is still in its category.
+func (c *Server) checkReconcileItem(item *ReconcileItem) bool {
+	if item.File == nil {
+		fi, err := c.storage.Stat(item.Path)
+		return err == nil && c.classifyDiskFile(item.Path, fi.Size(), fi.ModTime().Unix()) == item.Category
+	}
+	fileInfo, err := c.GetFileInfoFromLevelDB(item.File.Md5)
+	if err != nil || fileInfo.Md5 != item.File.Md5 || c.GetFilePathByInfo(fileInfo, false) != item.Path {
+		return false
+	}
+	category, _ := c.classifyFileInfo(fileInfo)
+	return category == item.Category
+}
+
+// adoptFile records the file fpath found on disk as if it was uploaded. The
+// md5 is the sum of its content with enable_distinct_file unless the content
+// is known already under another path.
+func (c *Server) adoptFile(fpath string) error {
+	fi, err := c.storage.Stat(fpath)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(fpath, "/")
+	fileInfo := &FileInfo{
+		Name:      path.Base(fpath),
+		Path:      path.Dir(fpath),
+		Size:      fi.Size(),
+		TimeStamp: fi.ModTime().Unix(),
+		Peers:     []string{c.host},
+		OffSet:    -1,
+	}
+	if len(parts) > 2 {
+		fileInfo.Scene = parts[1]
+	}
+	fileInfo.Md5 = c.util.MD5(fpath)
+	if Config().EnableDistinctFile {
+		sum, err := c.GetFileSumFromStorage(fpath)
+		if err != nil {
+			return err
+		}
+		if ok, _ := c.IsExistFromLevelDB(sum, c.ldb); !ok {
+			fileInfo.Md5 = sum
+		}
+	}
+	c.saveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
+	c.AppendToQueue(fileInfo)
+	return nil
+}
+
+// removeFileMeta removes the records of every path of the content of
+// fileInfo.
+func (c *Server) removeFileMeta(fileInfo *FileInfo) {
+	refs := c.GetFileRefs(fileInfo.Md5)
+	if len(refs) == 0 {
+		refs = []*FileInfo{fileInfo}
+	}
+	for _, ref := range refs {
+		c.saveFileMd5Log(ref, CONST_REMOME_Md5_FILE_NAME)
+	}
+}
+
+func (c *Server) applyReconcileAction(item *ReconcileItem, action string) error {
+	switch action {
+	case CONST_RECONCILE_ADOPT:
+		if item.File == nil {
+			return c.adoptFile(item.Path)
+		}
+		// the size on disk becomes the one of the record
+		fi, err := c.storage.Stat(item.Path)
+		if err != nil {
+			return err
+		}
+		fileInfo := *item.File
+		fileInfo.Size = fi.Size()
+		if _, err := c.SaveFileInfoToLevelDB(fileInfo.Md5, &fileInfo, c.ldb); err != nil {
+			return err
+		}
+		_, err = c.SaveFileInfoToLevelDB(c.util.MD5(item.Path), &fileInfo, c.ldb)
+		return err
+	case CONST_RECONCILE_REFETCH:
+		if !c.HealFile(item.File) {
+			return errors.New("no peer has a good copy")
+		}
+		return nil
+	case CONST_RECONCILE_DELETE:
+		if item.File != nil {
+			c.removeFileMeta(item.File)
+			if item.Category == CONST_RECONCILE_META_ONLY {
+				return nil
+			}
+		}
+		return c.storage.Delete(item.Path)
+	}
+	return fmt.Errorf("(error) unknown action %s", action)
+}
+
+// ApplyReconcile applies action to the items of category of the last report,
+// to the ones of paths only when given. The items acted on leave the report.
+func (c *Server) ApplyReconcile(category string, action string, paths []string) (*ReconcileResult, error) {
+	var (
+		err    error
+		report *ReconcileReport
+	)
+	if !c.util.Contains(action, reconcileActions[category]) {
+		return nil, fmt.Errorf("(error) action %s is not allowed on %s", action, category)
+	}
+	if report = c.GetReconcileReport(); report == nil || report.Running {
+		return nil, errors.New("(error) no reconcile report, run it first")
+	}
+	c.lockMap.LockKey("ReconcileFiles")
+	defer c.lockMap.UnLockKey("ReconcileFiles")
+	result := &ReconcileResult{Failed: []string{}}
+	var rest []*ReconcileItem
+	for _, item := range report.Items[category] {
+		if len(paths) > 0 && !c.util.Contains(item.Path, paths) {
+			rest = append(rest, item)
+			continue
+		}
+		c.lockMap.LockKey(item.Path)
+		if !c.checkReconcileItem(item) {
+			result.Skipped++
+		} else if err = c.applyReconcileAction(item, action); err != nil {
+			log.Error(fmt.Sprintf("reconcile %s %s: %s", action, item.Path, err.Error()))
+			result.Failed = append(result.Failed, item.Path)
+			rest = append(rest, item)
+		} else {
+			result.Done++
+		}
+		c.lockMap.UnLockKey(item.Path)
+	}
+	next := newReconcileReport()
+	next.StartTime, next.EndTime = report.StartTime, report.EndTime
+	for k, v := range report.Items {
+		next.Items[k], next.Counts[k] = v, report.Counts[k]
+	}
+	if rest == nil {
+		rest = []*ReconcileItem{}
+	}
+	next.Counts[category] = next.Counts[category] - (len(report.Items[category]) - len(rest))
+	next.Items[category] = rest
+	c.reconcileState.Store(next)
+	log.Info(fmt.Sprintf("reconcile %s %s: %+v", action, category, *result))
+	return result, nil
+}
+
+// Reconcile shows the last reconcile report, start=1 builds a new one and
+// action with category, and optionally path, acts on its items.
+func (c *Server) Reconcile(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		res    *ReconcileResult
+		result JsonResult
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	r.ParseForm()
+	if r.FormValue("start") == "1" {
+		if c.lockMap.IsLock("ReconcileFiles") {
+			result.Message = "reconcile is running"
+			w.Write([]byte(c.util.JsonEncodePretty(result)))
+			return
+		}
+		go c.ReconcileFiles()
+		result.Status = "ok"
+		result.Message = "reconcile job start"
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if action := r.FormValue("action"); action != "" {
+		if res, err = c.ApplyReconcile(r.FormValue("category"), action, r.Form["path"]); err != nil {
+			result.Message = err.Error()
+			w.Write([]byte(c.util.JsonEncodePretty(result)))
+			return
+		}
+		result.Status = "ok"
+		result.Data = res
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	result.Data = c.GetReconcileReport()
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
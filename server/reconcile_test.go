@@ -0,0 +1,73 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcileFiles(t *testing.T) {
+	var (
+		err    error
+		report *ReconcileReport
+	)
+	c := newTestServer(t, "http://127.0.0.1:8080", &GlobalConfig{})
+	storage := c.storage.(*MemoryStorage)
+	dir := STORE_DIR_NAME + "/default"
+	for _, name := range []string{"ok.txt", "gone.txt", "size.txt"} {
+		fpath := dir + "/" + name
+		c.saveFileMd5Log(&FileInfo{Name: name, Path: dir, Md5: c.util.MD5(fpath), Size: 5, OffSet: -1,
+			TimeStamp: 1000, Peers: []string{c.host}}, CONST_FILE_Md5_FILE_NAME)
+	}
+	for fpath, content := range map[string]string{
+		dir + "/ok.txt":                      "hello",
+		dir + "/size.txt":                    "hello world",
+		dir + "/disk.txt":                    "hello",
+		STORE_DIR_NAME + "/_tmp/20260101/up": "hello",
+		STORE_DIR_NAME + "/_tmp/s3/upload/1": "hello",
+		STORE_DIR_NAME + "/_big/1/up.bin":    "hello",
+		STORE_DIR_NAME + "/_big/1/up.info":   "{}",
+	} {
+		storage.Put(fpath, strings.NewReader(content))
+		storage.files[fpath].modTime = time.Now().Add(-48 * time.Hour)
+	}
+	// a file being uploaded right now
+	storage.Put(dir+"/new.txt", strings.NewReader("hello"))
+	if report, err = c.ReconcileFiles(); err != nil {
+		t.Fatal(err)
+	}
+	for category, want := range map[string]string{
+		CONST_RECONCILE_DISK_ONLY: dir + "/disk.txt",
+		CONST_RECONCILE_META_ONLY: dir + "/gone.txt",
+		CONST_RECONCILE_SIZE:      dir + "/size.txt",
+		CONST_RECONCILE_STALE_TMP: STORE_DIR_NAME + "/_tmp/20260101/up",
+	} {
+		if items := report.Items[category]; len(items) != 1 || items[0].Path != want || report.Counts[category] != 1 {
+			t.Errorf("%s: %+v", category, items)
+		}
+	}
+	if _, err = c.ApplyReconcile(CONST_RECONCILE_DISK_ONLY, CONST_RECONCILE_REFETCH, nil); err == nil {
+		t.Error("refetch of a file without metadata")
+	}
+	for category, action := range map[string]string{
+		CONST_RECONCILE_DISK_ONLY: CONST_RECONCILE_ADOPT,
+		CONST_RECONCILE_META_ONLY: CONST_RECONCILE_DELETE,
+		CONST_RECONCILE_SIZE:      CONST_RECONCILE_ADOPT,
+		CONST_RECONCILE_STALE_TMP: CONST_RECONCILE_DELETE,
+	} {
+		if result, err := c.ApplyReconcile(category, action, nil); err != nil || result.Done != 1 {
+			t.Errorf("%s %s: %+v %v", action, category, result, err)
+		}
+	}
+	if info, err := c.GetFileInfoFromLevelDB(c.util.MD5(dir + "/size.txt")); err != nil || info.Size != 11 {
+		t.Error("size not adopted", info)
+	}
+	if report, err = c.ReconcileFiles(); err != nil {
+		t.Fatal(err)
+	}
+	for category, count := range report.Counts {
+		if count != 0 {
+			t.Errorf("%s left after actions: %d", category, count)
+		}
+	}
+}
@@ -24,21 +24,43 @@ func (c *Server) initRouter() {
 	http.HandleFunc(fmt.Sprintf("%s/upload", groupRoute), c.Upload)
 	http.HandleFunc(fmt.Sprintf("%s/delete", groupRoute), c.RemoveFile)
 	http.HandleFunc(fmt.Sprintf("%s/get_file_info", groupRoute), c.GetFileInfo)
+	http.HandleFunc(fmt.Sprintf("%s/update_meta", groupRoute), c.UpdateMeta)
 	http.HandleFunc(fmt.Sprintf("%s/sync", groupRoute), c.Sync)
 	http.HandleFunc(fmt.Sprintf("%s/stat", groupRoute), c.Stat)
 	http.HandleFunc(fmt.Sprintf("%s/repair_stat", groupRoute), c.RepairStatWeb)
 	http.HandleFunc(fmt.Sprintf("%s/status", groupRoute), c.Status)
+	http.HandleFunc(fmt.Sprintf("%s/heartbeat", groupRoute), c.HeartBeat)
+	http.HandleFunc(fmt.Sprintf("%s/members", groupRoute), c.Members)
+	http.HandleFunc(fmt.Sprintf("%s/merkle", groupRoute), c.Merkle)
+	http.HandleFunc(fmt.Sprintf("%s/oplog", groupRoute), c.OpLog)
+	http.HandleFunc(fmt.Sprintf("%s/queue", groupRoute), c.Queue)
 	http.HandleFunc(fmt.Sprintf("%s/repair", groupRoute), c.Repair)
 	http.HandleFunc(fmt.Sprintf("%s/report", groupRoute), c.Report)
 	http.HandleFunc(fmt.Sprintf("%s/backup", groupRoute), c.BackUp)
+	http.HandleFunc(fmt.Sprintf("%s/restore_backup", groupRoute), c.RestoreBackUp)
 	http.HandleFunc(fmt.Sprintf("%s/search", groupRoute), c.Search)
+	http.HandleFunc(fmt.Sprintf("%s/rebuild_index", groupRoute), c.RebuildIndex)
+	http.HandleFunc(fmt.Sprintf("%s/list_files", groupRoute), c.ListFiles)
 	http.HandleFunc(fmt.Sprintf("%s/list_dir", groupRoute), c.ListDir)
+	http.HandleFunc(fmt.Sprintf("%s/list_versions", groupRoute), c.ListVersions)
+	http.HandleFunc(fmt.Sprintf("%s/restore_version", groupRoute), c.RestoreVersion)
+	http.HandleFunc(fmt.Sprintf("%s/delete_version", groupRoute), c.DeleteVersion)
+	http.HandleFunc(fmt.Sprintf("%s/list_trash", groupRoute), c.ListTrash)
+	http.HandleFunc(fmt.Sprintf("%s/restore", groupRoute), c.RestoreTrash)
+	http.HandleFunc(fmt.Sprintf("%s/purge", groupRoute), c.PurgeTrash)
 	http.HandleFunc(fmt.Sprintf("%s/remove_empty_dir", groupRoute), c.RemoveEmptyDir)
 	http.HandleFunc(fmt.Sprintf("%s/repair_fileinfo", groupRoute), c.RepairFileInfo)
 	http.HandleFunc(fmt.Sprintf("%s/reload", groupRoute), c.Reload)
 	http.HandleFunc(fmt.Sprintf("%s/syncfile_info", groupRoute), c.SyncFileInfo)
+	http.HandleFunc(fmt.Sprintf("%s/syncfile_ref", groupRoute), c.SyncFileRef)
+	http.HandleFunc(fmt.Sprintf("%s/syncfile_version", groupRoute), c.SyncFileVersion)
 	http.HandleFunc(fmt.Sprintf("%s/get_md5s_by_date", groupRoute), c.GetMd5sForWeb)
 	http.HandleFunc(fmt.Sprintf("%s/receive_md5s", groupRoute), c.ReceiveMd5s)
+	http.HandleFunc(fmt.Sprintf("%s/get_shard", groupRoute), c.GetShard)
+	http.HandleFunc(fmt.Sprintf("%s/compact", groupRoute), c.CompactSmallFileWeb)
+	http.HandleFunc(fmt.Sprintf("%s/repair_haystack", groupRoute), c.RepairSmallFileWeb)
+	http.HandleFunc(fmt.Sprintf("%s/scrub", groupRoute), c.ScrubWeb)
+	http.HandleFunc(fmt.Sprintf("%s/reconcile", groupRoute), c.Reconcile)
 	http.HandleFunc(fmt.Sprintf("%s/gen_google_secret", groupRoute), c.GenGoogleSecret)
 	http.HandleFunc(fmt.Sprintf("%s/gen_google_code", groupRoute), c.GenGoogleCode)
 	http.Handle(fmt.Sprintf("%s/static/", groupRoute), http.StripPrefix(fmt.Sprintf("%s/static/", groupRoute), http.FileServer(http.Dir("./static"))))
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CONST_S3_SIGN_ALGORITHM    = "AWS4-HMAC-SHA256"
+	CONST_S3_UNSIGNED_PAYLOAD  = "UNSIGNED-PAYLOAD"
+	CONST_S3_STREAMING_PAYLOAD = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	CONST_S3_EMPTY_SHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	CONST_S3_TIME_FORMAT       = "20060102T150405Z"
+	CONST_S3_MAX_SKEW          = 15 * time.Minute
+)
+
+// S3Error is an error answered with its S3 error code.
+type S3Error struct {
+	Code    string
+	Message string
+}
+
+func (e *S3Error) Error() string {
+	return e.Message
+}
+
+var (
+	errS3AccessDenied      = &S3Error{"AccessDenied", "access denied"}
+	errS3SignatureMismatch = &S3Error{"SignatureDoesNotMatch", "the request signature does not match"}
+	errS3InvalidAccessKey  = &S3Error{"InvalidAccessKeyId", "the access key id does not exist"}
+	errS3RequestExpired    = &S3Error{"RequestTimeTooSkewed", "the difference between the request time and the server's time is too large"}
+	errS3IncompleteBody    = &S3Error{"IncompleteBody", "invalid aws-chunked body"}
+)
+
+// s3Signature holds the parts of a SigV4 signature, taken either from the
+// Authorization header or from a presigned url.
+type s3Signature struct {
+	accessKey     string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration
+}
+
+func (s *s3Signature) scope() string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", s.date, s.region, s.service)
+}
+
+func (c *Server) getS3SecretKey(accessKey string) (string, bool) {
+	for _, kv := range Config().S3AccessKeys {
+		pair := strings.SplitN(kv, ":", 2)
+		if len(pair) == 2 && pair[0] == accessKey {
+			return pair[1], true
+		}
+	}
+	return "", false
+}
+
+func (c *Server) parseS3Signature(r *http.Request) (*s3Signature, error) {
+	var (
+		err  error
+		sign s3Signature
+		cred string
+	)
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != CONST_S3_SIGN_ALGORITHM {
+			return nil, errS3AccessDenied
+		}
+		sign.presigned = true
+		cred = query.Get("X-Amz-Credential")
+		sign.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+		sign.signature = query.Get("X-Amz-Signature")
+		if sign.amzDate, err = time.Parse(CONST_S3_TIME_FORMAT, query.Get("X-Amz-Date")); err != nil {
+			return nil, errS3AccessDenied
+		}
+		expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+		if err != nil || expires < 0 || expires > 7*24*3600 {
+			return nil, errS3AccessDenied
+		}
+		sign.expires = time.Duration(expires) * time.Second
+		sign.payloadHash = CONST_S3_UNSIGNED_PAYLOAD
+	} else {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, CONST_S3_SIGN_ALGORITHM+" ") {
+			return nil, errS3AccessDenied
+		}
+		for _, field := range strings.Split(auth[len(CONST_S3_SIGN_ALGORITHM)+1:], ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "Credential":
+				cred = kv[1]
+			case "SignedHeaders":
+				sign.signedHeaders = strings.Split(kv[1], ";")
+			case "Signature":
+				sign.signature = kv[1]
+			}
+		}
+		amzDate := r.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			amzDate = r.Header.Get("Date")
+		}
+		if sign.amzDate, err = time.Parse(CONST_S3_TIME_FORMAT, amzDate); err != nil {
+			if sign.amzDate, err = http.ParseTime(amzDate); err != nil {
+				return nil, errS3AccessDenied
+			}
+		}
+		sign.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if sign.payloadHash == "" {
+			sign.payloadHash = CONST_S3_EMPTY_SHA256
+		}
+	}
+	parts := strings.Split(cred, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || sign.signature == "" {
+		return nil, errS3AccessDenied
+	}
+	sign.accessKey, sign.date, sign.region, sign.service = parts[0], parts[1], parts[2], parts[3]
+	return &sign, nil
+}
+
+func s3HmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3SHA256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func s3SigningKey(secretKey string, sign *s3Signature) []byte {
+	key := s3HmacSHA256([]byte("AWS4"+secretKey), sign.date)
+	key = s3HmacSHA256(key, sign.region)
+	key = s3HmacSHA256(key, sign.service)
+	return s3HmacSHA256(key, "aws4_request")
+}
+
+// s3URIEncode encodes like the SigV4 spec: everything but unreserved
+// characters is percent encoded, and '/' is kept when encodeSlash is false.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			buf.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", ch)
+		}
+	}
+	return buf.String()
+}
+
+func s3CanonicalRequest(r *http.Request, sign *s3Signature) string {
+	var (
+		keys    []string
+		query   []string
+		headers []string
+	)
+	values := r.URL.Query()
+	for k := range values {
+		if sign.presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vs := values[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			query = append(query, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	for _, h := range sign.signedHeaders {
+		var v string
+		if h == "host" {
+			v = r.Host
+		} else if h == "content-length" && r.ContentLength >= 0 && r.Header.Get("Content-Length") == "" {
+			v = strconv.FormatInt(r.ContentLength, 10)
+		} else {
+			v = strings.Join(r.Header[http.CanonicalHeaderKey(h)], ",")
+		}
+		headers = append(headers, h+":"+strings.Join(strings.Fields(v), " ")+"\n")
+	}
+	uri := r.URL.Path
+	if uri == "" {
+		uri = "/"
+	}
+	return strings.Join([]string{
+		r.Method,
+		s3URIEncode(uri, false),
+		strings.Join(query, "&"),
+		strings.Join(headers, ""),
+		strings.Join(sign.signedHeaders, ";"),
+		sign.payloadHash,
+	}, "\n")
+}
+
+func s3StringToSign(canonicalRequest string, sign *s3Signature) string {
+	return strings.Join([]string{
+		CONST_S3_SIGN_ALGORITHM,
+		sign.amzDate.UTC().Format(CONST_S3_TIME_FORMAT),
+		sign.scope(),
+		s3SHA256Hex([]byte(canonicalRequest)),
+	}, "\n")
+}
+
+// VerifyS3Signature checks the SigV4 signature of r against the access keys
+// in cfg.json and returns the parsed signature, which is needed to verify
+// the payload afterwards.
+func (c *Server) VerifyS3Signature(r *http.Request, now time.Time) (*s3Signature, error) {
+	var (
+		err       error
+		sign      *s3Signature
+		secretKey string
+		ok        bool
+	)
+	if sign, err = c.parseS3Signature(r); err != nil {
+		return nil, err
+	}
+	if secretKey, ok = c.getS3SecretKey(sign.accessKey); !ok {
+		return nil, errS3InvalidAccessKey
+	}
+	if sign.presigned {
+		if now.Before(sign.amzDate.Add(-CONST_S3_MAX_SKEW)) || now.After(sign.amzDate.Add(sign.expires)) {
+			return nil, errS3AccessDenied
+		}
+	} else if now.Sub(sign.amzDate) > CONST_S3_MAX_SKEW || sign.amzDate.Sub(now) > CONST_S3_MAX_SKEW {
+		return nil, errS3RequestExpired
+	}
+	stringToSign := s3StringToSign(s3CanonicalRequest(r, sign), sign)
+	expected := hex.EncodeToString(s3HmacSHA256(s3SigningKey(secretKey, sign), stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(sign.signature)) {
+		return nil, errS3SignatureMismatch
+	}
+	return sign, nil
+}
+
+// s3ChunkedReader decodes an aws-chunked body and verifies the signature of
+// every chunk, chained from the seed signature of the request.
+type s3ChunkedReader struct {
+	reader     *bufio.Reader
+	signingKey []byte
+	sign       *s3Signature
+	prevSign   string
+	buffer     []byte
+	done       bool
+	err        error
+}
+
+func (c *Server) newS3ChunkedReader(body io.Reader, sign *s3Signature) (*s3ChunkedReader, error) {
+	secretKey, ok := c.getS3SecretKey(sign.accessKey)
+	if !ok {
+		return nil, errS3InvalidAccessKey
+	}
+	return &s3ChunkedReader{
+		reader:     bufio.NewReader(body),
+		signingKey: s3SigningKey(secretKey, sign),
+		sign:       sign,
+		prevSign:   sign.signature,
+	}, nil
+}
+
+func (cr *s3ChunkedReader) readChunk() error {
+	var (
+		err   error
+		line  string
+		size  int64
+		chunk []byte
+	)
+	if line, err = cr.reader.ReadString('\n'); err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	parts := strings.SplitN(line, ";chunk-signature=", 2)
+	if len(parts) != 2 {
+		return errS3IncompleteBody
+	}
+	if size, err = strconv.ParseInt(parts[0], 16, 64); err != nil || size < 0 || size > 16*1024*1024 {
+		return errS3IncompleteBody
+	}
+	chunk = make([]byte, size)
+	if _, err = io.ReadFull(cr.reader, chunk); err != nil {
+		return err
+	}
+	if _, err = cr.reader.Discard(2); err != nil && size > 0 {
+		return err
+	}
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256-PAYLOAD",
+		cr.sign.amzDate.UTC().Format(CONST_S3_TIME_FORMAT),
+		cr.sign.scope(),
+		cr.prevSign,
+		CONST_S3_EMPTY_SHA256,
+		s3SHA256Hex(chunk),
+	}, "\n")
+	expected := hex.EncodeToString(s3HmacSHA256(cr.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return errS3SignatureMismatch
+	}
+	cr.prevSign = expected
+	cr.buffer = chunk
+	if size == 0 {
+		cr.done = true
+	}
+	return nil
+}
+
+func (cr *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(cr.buffer) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		if cr.done {
+			return 0, io.EOF
+		}
+		if cr.err = cr.readChunk(); cr.err != nil {
+			return 0, cr.err
+		}
+	}
+	n := copy(p, cr.buffer)
+	cr.buffer = cr.buffer[n:]
+	return n, nil
+}
+
+// s3ObjectURL rebuilds a request url for the object api from bucket and key.
+func s3ObjectURL(bucket string, key string) string {
+	return "/" + bucket + "/" + (&url.URL{Path: key}).EscapedPath()
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/httplib"
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The scrubber reads back every file stored on this node and compares its
+// content with the md5 or sha1 recorded at upload, file_sum_arithmetic. A
+// file whose md5 is the one of its path, when enable_distinct_file is off or
+// for a file found on disk by repair, is checked by its size only. A missing
+// or corrupt copy is recorded under scrub_bad_<md5> and replaced with the one
+// of a peer that passes the same check. Reads are throttled to
+// scrub_rate_limit MB/s.
+
+type ScrubStatus struct {
+	Running   bool  `json:"running"`
+	StartTime int64 `json:"start_time"`
+	EndTime   int64 `json:"end_time"`
+	Total     int   `json:"total"`
+	Checked   int   `json:"checked"`
+	Bytes     int64 `json:"bytes"`
+	Corrupt   int   `json:"corrupt"`
+	Missing   int   `json:"missing"`
+	Healed    int   `json:"healed"`
+}
+
+type ScrubEntry struct {
+	State     string    `json:"state"`
+	Sum       string    `json:"sum"`
+	CheckTime int64     `json:"check_time"`
+	File      *FileInfo `json:"file"`
+}
+
+type ScrubReport struct {
+	Status *ScrubStatus  `json:"status"`
+	Files  []*ScrubEntry `json:"files"`
+}
+
+// RateLimiter spreads reads so that no more than rate bytes are read per
+// second on average, a rate of 0 does not limit.
+type RateLimiter struct {
+	sync.Mutex
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+type rateReader struct {
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate, start: time.Now()}
+}
+
+// Wait accounts n bytes read and sleeps until they are within the rate.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || l.rate <= 0 {
+		return
+	}
+	l.Lock()
+	l.n = l.n + int64(n)
+	due := l.start.Add(time.Duration(l.n * int64(time.Second) / l.rate))
+	l.Unlock()
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.limiter.Wait(n)
+	return n, err
+}
+
+// CanVerifyFileSum reports whether the md5 of fileInfo is the sum of its
+// content rather than the md5 of its path.
+func (c *Server) CanVerifyFileSum(fileInfo *FileInfo) bool {
+	if !Config().EnableDistinctFile || fileInfo.OffSet == -2 {
+		return false
+	}
+	if strings.ToLower(Config().FileSumArithmetic) == "sha1" {
+		return len(fileInfo.Md5) == 40
+	}
+	return len(fileInfo.Md5) == 32 && fileInfo.Md5 != c.util.MD5(c.GetFilePathByInfo(fileInfo, false))
+}
+
+// GetContentSum returns the sum of the content of fileInfo, decrypted and
+// decompressed, and the number of bytes read through limiter.
+func (c *Server) GetContentSum(fileInfo *FileInfo, limiter *RateLimiter) (string, int64, error) {
+	var (
+		err    error
+		n      int64
+		reader io.ReadCloser
+	)
+	if reader, err = c.GetFileReaderByInfo(fileInfo); err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+	h := c.NewFileSumHash()
+	if n, err = io.Copy(h, &rateReader{reader: reader, limiter: limiter}); err != nil {
+		return "", n, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), n, nil
+}
+
+// isScrubCandidate reports whether the content record fileInfo, kept under
+// key, describes bytes stored whole on this node.
+func (c *Server) isScrubCandidate(key string, fileInfo *FileInfo) bool {
+	if fileInfo.Md5 != key || fileInfo.Ref || fileInfo.Shards != nil {
+		// references have no bytes of their own, shards are checked by erasure
+		return false
+	}
+	return c.IsPlacedOn(fileInfo, c.host) || c.util.Contains(c.host, fileInfo.Peers)
+}
+
+// ScrubFile checks the copy of fileInfo on this node. It returns the state of
+// a bad copy, empty for a good one, the sum found and the bytes read.
+func (c *Server) ScrubFile(fileInfo *FileInfo, limiter *RateLimiter) (string, string, int64) {
+	var (
+		err error
+		sum string
+		n   int64
+	)
+	fpath := c.GetFilePathByInfo(fileInfo, false)
+	if fileInfo.OffSet >= 0 {
+		fpath = c.GetSmallFileVolume(fileInfo)
+	}
+	fi, err := c.storage.Stat(fpath)
+	if err != nil {
+		return CONST_SCRUB_STATE_MISSING, "", 0
+	}
+	if fileInfo.OffSet < 0 && fi.Size() != fileInfo.Size {
+		return CONST_SCRUB_STATE_CORRUPT, "", 0
+	}
+	if !c.CanVerifyFileSum(fileInfo) {
+		if fileInfo.OffSet < 0 {
+			return "", "", 0
+		}
+		// a needle carries a crc32 of its own
+		sum, n, err = c.GetContentSum(fileInfo, limiter)
+		if err != nil {
+			return CONST_SCRUB_STATE_CORRUPT, "", n
+		}
+		return "", sum, n
+	}
+	if sum, n, err = c.GetContentSum(fileInfo, limiter); err != nil || sum != fileInfo.Md5 {
+		return CONST_SCRUB_STATE_CORRUPT, sum, n
+	}
+	return "", sum, n
+}
+
+// ListScrubEntries returns the bad copies found and not healed yet.
+func (c *Server) ListScrubEntries() []*ScrubEntry {
+	var (
+		entries []*ScrubEntry
+	)
+	entries = []*ScrubEntry{}
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(CONST_SCRUB_KEY_PREFIX)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var entry ScrubEntry
+		if err := json.Unmarshal(iter.Value(), &entry); err != nil || entry.File == nil {
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	return entries
+}
+
+// HealFile replaces the copy of fileInfo with the first one of its holders
+// that passes verification.
+func (c *Server) HealFile(fileInfo *FileInfo) bool {
+	for _, peer := range c.GetHolderPeers(fileInfo) {
+		if strings.Contains(peer, "127.0.0.1") {
+			continue
+		}
+		if err := c.fetchVerifiedCopy(peer, fileInfo); err != nil {
+			log.Warn(fmt.Sprintf("heal %s from %s: %s", fileInfo.Md5, peer, err.Error()))
+			continue
+		}
+		log.Info(fmt.Sprintf("healed %s from %s", c.GetFilePathByInfo(fileInfo, false), peer))
+		return true
+	}
+	return false
+}
+
+// fetchVerifiedCopy downloads the stored form of fileInfo from peer and puts
+// it in place when its content passes verification.
+func (c *Server) fetchVerifiedCopy(peer string, fileInfo *FileInfo) error {
+	var (
+		err  error
+		data []byte
+		sum  string
+		info *FileInfo
+	)
+	if c.IsReadOnly() {
+		return errors.New("read only")
+	}
+	timeout := fileInfo.Size/1024/1024/1 + 30
+	if Config().SyncTimeout > 0 {
+		timeout = Config().SyncTimeout
+	}
+	req := httplib.Get(c.getPeerFileURL(peer, fileInfo))
+	req.SetTimeout(time.Second*30, time.Second*time.Duration(timeout))
+	if fileInfo.Codec != "" {
+		// take the stored form, the peer decompresses otherwise
+		req.Header("Accept-Encoding", fileInfo.Codec)
+	}
+	if fileInfo.OffSet >= 0 {
+		if data, err = req.Bytes(); err != nil {
+			return err
+		}
+		content := data
+		if fileInfo.KeyId != "" {
+			if content, err = c.DecryptBytes(data); err != nil {
+				return err
+			}
+		}
+		if c.CanVerifyFileSum(fileInfo) {
+			h := c.NewFileSumHash()
+			h.Write(content)
+			if sum = fmt.Sprintf("%x", h.Sum(nil)); sum != fileInfo.Md5 {
+				return fmt.Errorf("sum mismatch %s", sum)
+			}
+		} else if int64(len(content)) != fileInfo.Size {
+			return errors.New("size mismatch")
+		}
+		needle := NewNeedle(fileInfo, data)
+		if _, _, length, _ := c.ParseSmallFile(fileInfo.ReName); needle.Size() != length {
+			// the volume was written before needles had a header
+			if needle.Legacy = true; needle.Size() != length {
+				return errors.New("needle size mismatch")
+			}
+		}
+		volume := c.GetSmallFileVolume(fileInfo)
+		c.lockMap.LockKey(volume)
+		defer c.lockMap.UnLockKey(volume)
+		if info, err = c.GetFileInfoFromLevelDB(fileInfo.Md5); err != nil || info.ReName != fileInfo.ReName {
+			return errors.New("needle moved")
+		}
+		_, err = c.WriteNeedle(volume, fileInfo.OffSet, needle)
+		return err
+	}
+	fpath := c.GetFilePathByInfo(fileInfo, false)
+	fpathTmp := fileInfo.Path + "/" + fmt.Sprintf("%s_%s", "scrub_", path.Base(fpath))
+	c.lockMap.LockKey(fpath)
+	defer c.lockMap.UnLockKey(fpath)
+	if err = c.DownloadToStorage(req, fpathTmp); err != nil {
+		c.storage.Delete(fpathTmp)
+		return err
+	}
+	if fi, err := c.storage.Stat(fpathTmp); err != nil || fi.Size() != fileInfo.Size {
+		c.storage.Delete(fpathTmp)
+		return errors.New("size mismatch")
+	}
+	if c.CanVerifyFileSum(fileInfo) {
+		tmpInfo := *fileInfo
+		tmpInfo.ReName = path.Base(fpathTmp)
+		if sum, _, err = c.GetContentSum(&tmpInfo, nil); err != nil || sum != fileInfo.Md5 {
+			c.storage.Delete(fpathTmp)
+			return fmt.Errorf("sum mismatch %s", sum)
+		}
+	}
+	return c.storage.Rename(fpathTmp, fpath)
+}
+
+// ScrubFiles checks every file stored on this node once and heals the bad
+// copies.
+func (c *Server) ScrubFiles() {
+	var (
+		err    error
+		status *ScrubStatus
+	)
+	if c.lockMap.IsLock("ScrubFiles") {
+		log.Warn("Lock ScrubFiles")
+		return
+	}
+	c.lockMap.LockKey("ScrubFiles")
+	defer c.lockMap.UnLockKey("ScrubFiles")
+	status = &ScrubStatus{Running: true, StartTime: time.Now().Unix()}
+	report := func() {
+		st := *status
+		c.scrubState.Store(&st)
+	}
+	iter := c.ldb.NewIterator(nil, nil)
+	for iter.Next() {
+		var fileInfo FileInfo
+		if err = json.Unmarshal(iter.Value(), &fileInfo); err == nil && c.isScrubCandidate(string(iter.Key()), &fileInfo) {
+			status.Total++
+		}
+	}
+	iter.Release()
+	report()
+	log.Info(fmt.Sprintf("scrub %d files ....", status.Total))
+	limiter := NewRateLimiter(int64(Config().ScrubRateLimit) * 1024 * 1024)
+	iter = c.ldb.NewIterator(nil, nil)
+	for iter.Next() {
+		var fileInfo FileInfo
+		key := string(iter.Key())
+		if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil || !c.isScrubCandidate(key, &fileInfo) {
+			continue
+		}
+		state, sum, n := c.ScrubFile(&fileInfo, limiter)
+		status.Checked++
+		status.Bytes = status.Bytes + n
+		if state != "" {
+			if info, err := c.GetFileInfoFromLevelDB(key); err != nil || info.Md5 != key || info.ReName != fileInfo.ReName {
+				// removed or moved by a compaction meanwhile
+				report()
+				continue
+			}
+			log.Warn(fmt.Sprintf("scrub %s %s", state, c.GetFilePathByInfo(&fileInfo, false)))
+			if state == CONST_SCRUB_STATE_MISSING {
+				status.Missing++
+			} else {
+				status.Corrupt++
+			}
+			if c.HealFile(&fileInfo) {
+				status.Healed++
+				state = ""
+			}
+		}
+		if state == "" {
+			c.ldb.Delete([]byte(CONST_SCRUB_KEY_PREFIX+key), nil)
+		} else {
+			entry := &ScrubEntry{State: state, Sum: sum, CheckTime: time.Now().Unix(), File: &fileInfo}
+			if data, err := json.Marshal(entry); err == nil {
+				c.ldb.Put([]byte(CONST_SCRUB_KEY_PREFIX+key), data, nil)
+			}
+		}
+		report()
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		log.Error(err)
+	}
+	status.Running = false
+	status.EndTime = time.Now().Unix()
+	report()
+	c.ldb.Put([]byte(CONST_SCRUB_TIME_KEY), []byte(strconv.FormatInt(status.EndTime, 10)), nil)
+	log.Info(fmt.Sprintf("scrub finish: %+v", *status))
+}
+
+// Scrub runs ScrubFiles every scrub_interval hours when enable_scrub is on.
+func (c *Server) Scrub() {
+	for {
+		time.Sleep(time.Minute)
+		if !Config().EnableScrub {
+			continue
+		}
+		last := int64(0)
+		if data, err := c.ldb.Get([]byte(CONST_SCRUB_TIME_KEY), nil); err == nil {
+			last, _ = strconv.ParseInt(string(data), 10, 64)
+		}
+		if time.Now().Unix()-last >= int64(Config().ScrubInterval)*3600 {
+			c.ScrubFiles()
+		}
+	}
+}
+
+// GetScrubStatus returns the progress of the running pass or the result of
+// the last one.
+func (c *Server) GetScrubStatus() *ScrubStatus {
+	if status, ok := c.scrubState.Load().(*ScrubStatus); ok {
+		return status
+	}
+	status := &ScrubStatus{}
+	if data, err := c.ldb.Get([]byte(CONST_SCRUB_TIME_KEY), nil); err == nil {
+		status.EndTime, _ = strconv.ParseInt(string(data), 10, 64)
+	}
+	return status
+}
+
+// ScrubWeb reports the progress of the scrubber and the bad copies it found,
+// start=1 starts a pass.
+func (c *Server) ScrubWeb(w http.ResponseWriter, r *http.Request) {
+	var (
+		result JsonResult
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if r.FormValue("start") == "1" {
+		if c.lockMap.IsLock("ScrubFiles") {
+			result.Message = "scrub is running"
+			w.Write([]byte(c.util.JsonEncodePretty(result)))
+			return
+		}
+		go c.ScrubFiles()
+		result.Status = "ok"
+		result.Message = "scrub job start"
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	result.Data = &ScrubReport{Status: c.GetScrubStatus(), Files: c.ListScrubEntries()}
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
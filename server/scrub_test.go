@@ -0,0 +1,41 @@
+package server
+
+import (
+	"crypto/md5"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestScrubFiles(t *testing.T) {
+	c := newTestServer(t, "http://127.0.0.1:8080", &GlobalConfig{EnableDistinctFile: true})
+	fileInfo := &FileInfo{Name: "a.txt", Path: STORE_DIR_NAME + "/default", Md5: fmt.Sprintf("%x", md5.Sum([]byte("hello"))),
+		Size: 5, OffSet: -1, Peers: []string{c.host}}
+	c.SaveFileInfoToLevelDB(fileInfo.Md5, fileInfo, c.ldb)
+	fpath := c.GetFilePathByInfo(fileInfo, false)
+	for _, v := range []struct {
+		content string
+		state   string
+	}{
+		{"hello", ""},
+		{"hellp", CONST_SCRUB_STATE_CORRUPT},
+		{"", CONST_SCRUB_STATE_MISSING},
+		{"hello", ""},
+	} {
+		c.storage.Delete(fpath)
+		if v.content != "" {
+			c.storage.Put(fpath, strings.NewReader(v.content))
+		}
+		c.ScrubFiles()
+		status, entries := c.GetScrubStatus(), c.ListScrubEntries()
+		if status.Running || status.Total != 1 || status.Checked != 1 || status.Healed != 0 {
+			t.Errorf("%q: status %+v", v.content, *status)
+		}
+		if v.state == "" && len(entries) != 0 {
+			t.Errorf("%q: %d bad files", v.content, len(entries))
+		}
+		if v.state != "" && (len(entries) != 1 || entries[0].State != v.state || entries[0].File.Md5 != fileInfo.Md5) {
+			t.Errorf("%q: want %s", v.content, v.state)
+		}
+	}
+}
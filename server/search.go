@@ -0,0 +1,541 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The search indexes are the keys idx_<field>_<value>_<md5 of the path>
+// pointing at the metadata of a path, idx_doc_<md5 of the path> lists the
+// keys of a path so they are replaced when it changes. The fields are name
+// (the lowercase words of the name), fname (the lowercase name, for
+// sorting), scene, ext, time (upload time), size and meta (<key>=<value>);
+// time and size are zero padded so their keys sort by value. The directory
+// index of list.go is kept with them.
+
+const (
+	indexName  = "name"
+	indexFname = "fname"
+	indexScene = "scene"
+	indexExt   = "ext"
+	indexTime  = "time"
+	indexSize  = "size"
+	indexMeta  = "meta"
+)
+
+type SearchQuery struct {
+	Keywords []string
+	Scene    string
+	Ext      string
+	TimeFrom int64
+	TimeTo   int64
+	SizeMin  int64
+	SizeMax  int64
+	Meta     FileMeta
+	Sort     string
+	Desc     bool
+	Limit    int
+	Cursor   string
+}
+
+type SearchResult struct {
+	Files  []*FileInfo `json:"files"`
+	Cursor string      `json:"cursor"`
+}
+
+func (c *Server) indexKey(field string, value string, pathMd5 string) string {
+	return CONST_INDEX_KEY_PREFIX + field + "_" + value + "_" + pathMd5
+}
+
+func (c *Server) indexDocKey(pathMd5 string) string {
+	return CONST_INDEX_KEY_PREFIX + "doc_" + pathMd5
+}
+
+func (c *Server) indexNumber(n int64) string {
+	return fmt.Sprintf("%020d", n)
+}
+
+// parseIndexKey returns the value and the md5 of the path of an index key
+// of field.
+func (c *Server) parseIndexKey(field string, key []byte) (string, string, bool) {
+	prefix := len(CONST_INDEX_KEY_PREFIX) + len(field) + 1
+	if len(key) < prefix+33 {
+		return "", "", false
+	}
+	return string(key[prefix : len(key)-33]), string(key[len(key)-32:]), true
+}
+
+// GetNameTokens returns the lowercase words of name and name itself.
+func (c *Server) GetNameTokens(name string) []string {
+	var (
+		tokens []string
+	)
+	name = strings.ToLower(name)
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, v := range append([]string{name}, words...) {
+		if len(v) > CONST_INDEX_MAX_TOKEN {
+			v = v[:CONST_INDEX_MAX_TOKEN]
+		}
+		if v != "" && !c.util.Contains(v, tokens) {
+			tokens = append(tokens, v)
+		}
+		if len(tokens) >= CONST_INDEX_MAX_TOKENS {
+			break
+		}
+	}
+	return tokens
+}
+
+func (c *Server) getFileExt(fileInfo *FileInfo) string {
+	return strings.TrimPrefix(strings.ToLower(path.Ext(fileInfo.Name)), ".")
+}
+
+// getSortValue is the value of fileInfo in the index field sorts by.
+func (c *Server) getSortValue(fileInfo *FileInfo, field string) string {
+	switch field {
+	case indexFname:
+		name := strings.ToLower(fileInfo.Name)
+		if len(name) > CONST_INDEX_MAX_TOKEN {
+			name = name[:CONST_INDEX_MAX_TOKEN]
+		}
+		return name
+	case indexSize:
+		return c.indexNumber(c.GetContentSize(fileInfo))
+	}
+	return c.indexNumber(fileInfo.TimeStamp)
+}
+
+// IsIndexedPath reports whether the file at fpath is found by the search,
+// the files in the trash and the older versions are not.
+func (c *Server) IsIndexedPath(fpath string) bool {
+	return !c.IsTrashPath(fpath) && !strings.HasPrefix(fpath, STORE_DIR_NAME+"/"+CONST_VERSION_DIR_NAME+"/")
+}
+
+func (c *Server) getIndexKeys(fileInfo *FileInfo, pathMd5 string) []string {
+	var (
+		keys []string
+	)
+	for _, token := range c.GetNameTokens(fileInfo.Name) {
+		keys = append(keys, c.indexKey(indexName, token, pathMd5))
+	}
+	keys = append(keys, c.indexKey(indexFname, c.getSortValue(fileInfo, indexFname), pathMd5))
+	keys = append(keys, c.indexKey(indexTime, c.getSortValue(fileInfo, indexTime), pathMd5))
+	keys = append(keys, c.indexKey(indexSize, c.getSortValue(fileInfo, indexSize), pathMd5))
+	if fileInfo.Scene != "" {
+		keys = append(keys, c.indexKey(indexScene, fileInfo.Scene, pathMd5))
+	}
+	if ext := c.getFileExt(fileInfo); ext != "" {
+		keys = append(keys, c.indexKey(indexExt, ext, pathMd5))
+	}
+	for k, v := range fileInfo.Meta {
+		keys = append(keys, c.indexKey(indexMeta, k+"="+v, pathMd5))
+	}
+	return keys
+}
+
+// IndexFile replaces the index keys of the path of fileInfo.
+func (c *Server) IndexFile(fileInfo *FileInfo) {
+	fpath := c.GetFilePathByInfo(fileInfo, false)
+	if !c.IsIndexedPath(fpath) {
+		return
+	}
+	pathMd5 := c.util.MD5(fpath)
+	batch := new(leveldb.Batch)
+	c.unindexBatch(batch, pathMd5)
+	keys := c.getIndexKeys(fileInfo, pathMd5)
+	for _, key := range keys {
+		batch.Put([]byte(key), nil)
+	}
+	if data, err := json.Marshal(fileInfo); err == nil {
+		dirKey := c.dirIndexKey(fileInfo, pathMd5)
+		batch.Put([]byte(dirKey), data)
+		keys = append(keys, dirKey)
+	}
+	batch.Put([]byte(c.indexDocKey(pathMd5)), []byte(strings.Join(keys, "\n")))
+	if err := c.ldb.Write(batch, nil); err != nil {
+		log.Error(err)
+	}
+}
+
+// UnindexFile removes the index keys of fpath.
+func (c *Server) UnindexFile(fpath string) {
+	batch := new(leveldb.Batch)
+	c.unindexBatch(batch, c.util.MD5(fpath))
+	if batch.Len() == 0 {
+		return
+	}
+	if err := c.ldb.Write(batch, nil); err != nil {
+		log.Error(err)
+	}
+}
+
+func (c *Server) unindexBatch(batch *leveldb.Batch, pathMd5 string) {
+	data, err := c.ldb.Get([]byte(c.indexDocKey(pathMd5)), nil)
+	if err != nil {
+		return
+	}
+	for _, key := range strings.Split(string(data), "\n") {
+		batch.Delete([]byte(key))
+	}
+	batch.Delete([]byte(c.indexDocKey(pathMd5)))
+}
+
+// RebuildSearchIndex drops the search indexes and indexes the metadata of
+// every path again.
+func (c *Server) RebuildSearchIndex() {
+	var (
+		err   error
+		count int
+	)
+	if c.lockMap.IsLock(CONST_INDEX_VERSION_KEY) {
+		log.Warn("search index rebuilding already")
+		return
+	}
+	c.lockMap.LockKey(CONST_INDEX_VERSION_KEY)
+	defer c.lockMap.UnLockKey(CONST_INDEX_VERSION_KEY)
+	log.Info("rebuild search index ....")
+	batch := new(leveldb.Batch)
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(CONST_INDEX_KEY_PREFIX)), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+		if batch.Len() >= 10000 {
+			c.ldb.Write(batch, nil)
+			batch.Reset()
+		}
+	}
+	iter.Release()
+	c.ldb.Write(batch, nil)
+	iter = c.ldb.NewIterator(nil, nil)
+	for iter.Next() {
+		var fileInfo FileInfo
+		if len(iter.Key()) != 32 {
+			continue
+		}
+		if err = json.Unmarshal(iter.Value(), &fileInfo); err != nil || fileInfo.Md5 == "" {
+			continue
+		}
+		// the metadata of a path, not the one of a content by its md5
+		if c.util.MD5(c.GetFilePathByInfo(&fileInfo, false)) != string(iter.Key()) {
+			continue
+		}
+		c.IndexFile(&fileInfo)
+		count++
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		log.Error(err)
+		return
+	}
+	c.ldb.Put([]byte(CONST_INDEX_VERSION_KEY), []byte(CONST_SEARCH_INDEX_VERSION), nil)
+	log.Info(fmt.Sprintf("search index rebuilt, %d files", count))
+}
+
+// BuildSearchIndex indexes the files stored before the search indexes were,
+// or before the indexes changed.
+func (c *Server) BuildSearchIndex() {
+	if data, err := c.ldb.Get([]byte(CONST_INDEX_VERSION_KEY), nil); err != nil || string(data) != CONST_SEARCH_INDEX_VERSION {
+		c.RebuildSearchIndex()
+	}
+}
+
+// matchSearch reports whether fileInfo passes every filter of q.
+func (c *Server) matchSearch(fileInfo *FileInfo, q *SearchQuery) bool {
+	if q.Scene != "" && fileInfo.Scene != q.Scene {
+		return false
+	}
+	if q.Ext != "" && c.getFileExt(fileInfo) != q.Ext {
+		return false
+	}
+	if (q.TimeFrom > 0 && fileInfo.TimeStamp < q.TimeFrom) || (q.TimeTo > 0 && fileInfo.TimeStamp > q.TimeTo) {
+		return false
+	}
+	size := c.GetContentSize(fileInfo)
+	if (q.SizeMin > 0 && size < q.SizeMin) || (q.SizeMax > 0 && size > q.SizeMax) {
+		return false
+	}
+	tokens := c.GetNameTokens(fileInfo.Name)
+	for _, kw := range q.Keywords {
+		found := false
+		for _, token := range tokens {
+			if strings.HasPrefix(token, kw) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return c.MatchFileMeta(fileInfo, q.Meta)
+}
+
+// getSearchRange returns the index range of the most selective filter of q,
+// false when q has no filter.
+func (c *Server) getSearchRange(q *SearchQuery) (string, *util.Range, bool) {
+	for k, v := range q.Meta {
+		if v != "" {
+			return indexMeta, util.BytesPrefix([]byte(c.indexKey(indexMeta, k+"="+v, ""))), true
+		}
+	}
+	if len(q.Keywords) > 0 {
+		return indexName, util.BytesPrefix([]byte(CONST_INDEX_KEY_PREFIX + indexName + "_" + q.Keywords[0])), true
+	}
+	if q.Ext != "" {
+		return indexExt, util.BytesPrefix([]byte(c.indexKey(indexExt, q.Ext, ""))), true
+	}
+	if q.TimeFrom > 0 || q.TimeTo > 0 {
+		return indexTime, c.getNumberRange(indexTime, q.TimeFrom, q.TimeTo), true
+	}
+	if q.SizeMin > 0 || q.SizeMax > 0 {
+		return indexSize, c.getNumberRange(indexSize, q.SizeMin, q.SizeMax), true
+	}
+	if q.Scene != "" {
+		return indexScene, util.BytesPrefix([]byte(c.indexKey(indexScene, q.Scene, ""))), true
+	}
+	return "", nil, false
+}
+
+func (c *Server) getNumberRange(field string, min int64, max int64) *util.Range {
+	r := &util.Range{Start: []byte(CONST_INDEX_KEY_PREFIX + field + "_" + c.indexNumber(min))}
+	if max > 0 {
+		r.Limit = []byte(CONST_INDEX_KEY_PREFIX + field + "_" + c.indexNumber(max+1))
+	} else {
+		r.Limit = util.BytesPrefix([]byte(CONST_INDEX_KEY_PREFIX + field + "_")).Limit
+	}
+	return r
+}
+
+func (c *Server) encodeSearchCursor(value string, pathMd5 string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value + "_" + pathMd5))
+}
+
+// decodeSearchCursor returns the sort value and the md5 of the path the
+// previous page ended at.
+func (c *Server) decodeSearchCursor(cursor string) (string, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(data) < 33 {
+		return "", "", errors.New("(error) invalid cursor")
+	}
+	return string(data[:len(data)-33]), string(data[len(data)-32:]), nil
+}
+
+// SearchFiles returns a page of the files matching q in the order of q.Sort.
+// The files found through the index of the most selective filter are sorted
+// in memory, up to search_max_candidates of them, more are found by walking
+// the index of the sort order instead.
+func (c *Server) SearchFiles(q *SearchQuery) (*SearchResult, error) {
+	var (
+		err         error
+		cursorValue string
+		cursorMd5   string
+		files       []*FileInfo
+		seen        map[string]bool
+	)
+	if q.Cursor != "" {
+		if cursorValue, cursorMd5, err = c.decodeSearchCursor(q.Cursor); err != nil {
+			return nil, err
+		}
+	}
+	after := func(value string, pathMd5 string) bool {
+		if q.Cursor == "" {
+			return true
+		}
+		if value == cursorValue {
+			return pathMd5 != cursorMd5 && (pathMd5 > cursorMd5) != q.Desc
+		}
+		return (value > cursorValue) != q.Desc
+	}
+	if field, rng, ok := c.getSearchRange(q); ok {
+		seen = make(map[string]bool)
+		iter := c.ldb.NewIterator(rng, nil)
+		for iter.Next() && len(seen) <= Config().SearchMaxCandidates {
+			if _, pathMd5, ok := c.parseIndexKey(field, iter.Key()); ok {
+				seen[pathMd5] = true
+			}
+		}
+		iter.Release()
+	}
+	if seen != nil && len(seen) <= Config().SearchMaxCandidates {
+		type match struct {
+			value    string
+			pathMd5  string
+			fileInfo *FileInfo
+		}
+		var matches []match
+		for pathMd5 := range seen {
+			fileInfo, err := c.GetFileInfoFromLevelDB(pathMd5)
+			if err != nil || !c.matchSearch(fileInfo, q) {
+				continue
+			}
+			if value := c.getSortValue(fileInfo, q.Sort); after(value, pathMd5) {
+				matches = append(matches, match{value, pathMd5, fileInfo})
+			}
+		}
+		sort.Slice(matches, func(i, j int) bool {
+			if matches[i].value == matches[j].value {
+				return (matches[i].pathMd5 < matches[j].pathMd5) != q.Desc
+			}
+			return (matches[i].value < matches[j].value) != q.Desc
+		})
+		result := &SearchResult{Files: []*FileInfo{}}
+		for i, m := range matches {
+			if i == q.Limit {
+				last := matches[i-1]
+				result.Cursor = c.encodeSearchCursor(last.value, last.pathMd5)
+				break
+			}
+			files = append(files, m.fileInfo)
+		}
+		if files != nil {
+			result.Files = files
+		}
+		return result, nil
+	}
+	return c.walkSortIndex(q, cursorValue, cursorMd5)
+}
+
+// walkSortIndex walks the index of the sort order from the cursor on.
+func (c *Server) walkSortIndex(q *SearchQuery, cursorValue string, cursorMd5 string) (*SearchResult, error) {
+	var (
+		ok    bool
+		value string
+		last  string
+	)
+	result := &SearchResult{Files: []*FileInfo{}}
+	prefix := []byte(CONST_INDEX_KEY_PREFIX + q.Sort + "_")
+	iter := c.ldb.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	var next func() bool
+	if q.Desc {
+		next = iter.Prev
+		if q.Cursor == "" {
+			ok = iter.Last()
+		} else if iter.Seek([]byte(c.indexKey(q.Sort, cursorValue, cursorMd5))) {
+			ok = iter.Prev()
+		} else {
+			ok = iter.Last()
+		}
+	} else {
+		next = iter.Next
+		if q.Cursor == "" {
+			ok = iter.First()
+		} else {
+			cursorKey := []byte(c.indexKey(q.Sort, cursorValue, cursorMd5))
+			if ok = iter.Seek(cursorKey); ok && bytes.Equal(iter.Key(), cursorKey) {
+				ok = iter.Next()
+			}
+		}
+	}
+	for ; ok; ok = next() {
+		var pathMd5 string
+		if value, pathMd5, ok = c.parseIndexKey(q.Sort, iter.Key()); !ok {
+			continue
+		}
+		fileInfo, err := c.GetFileInfoFromLevelDB(pathMd5)
+		if err != nil || c.getSortValue(fileInfo, q.Sort) != value || !c.matchSearch(fileInfo, q) {
+			continue
+		}
+		if len(result.Files) == q.Limit {
+			result.Cursor = last
+			break
+		}
+		result.Files = append(result.Files, fileInfo)
+		last = c.encodeSearchCursor(value, pathMd5)
+	}
+	return result, iter.Error()
+}
+
+// ParseSearchQuery reads the filters of /search: kw (words the name has
+// words starting with), scene, ext, date_from and date_to (yyyyMMdd),
+// size_min and size_max (bytes), meta_<key>, sort (time, name or size),
+// order (asc or desc), limit and cursor.
+func (c *Server) ParseSearchQuery(r *http.Request) (*SearchQuery, error) {
+	var (
+		err error
+		t   time.Time
+	)
+	q := &SearchQuery{Scene: r.FormValue("scene"), Cursor: r.FormValue("cursor"), Limit: CONST_SEARCH_PAGE_SIZE}
+	q.Keywords = c.GetNameTokens(r.FormValue("kw"))
+	if len(q.Keywords) > 1 {
+		// the words only, the whole input is one of the tokens too
+		q.Keywords = q.Keywords[1:]
+	}
+	q.Ext = strings.TrimPrefix(strings.ToLower(r.FormValue("ext")), ".")
+	if v := r.FormValue("date_from"); v != "" {
+		if t, err = time.ParseInLocation("20060102", v, time.Local); err != nil {
+			return nil, errors.New("(error) date_from must be yyyyMMdd")
+		}
+		q.TimeFrom = t.Unix()
+	}
+	if v := r.FormValue("date_to"); v != "" {
+		if t, err = time.ParseInLocation("20060102", v, time.Local); err != nil {
+			return nil, errors.New("(error) date_to must be yyyyMMdd")
+		}
+		q.TimeTo = t.Unix() + 24*3600 - 1
+	}
+	if v := r.FormValue("size_min"); v != "" {
+		if q.SizeMin, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("(error) invalid size_min")
+		}
+	}
+	if v := r.FormValue("size_max"); v != "" {
+		if q.SizeMax, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("(error) invalid size_max")
+		}
+	}
+	if q.Meta, err = c.GetRequestMeta(r); err != nil {
+		return nil, err
+	}
+	switch r.FormValue("sort") {
+	case "", "time":
+		q.Sort = indexTime
+		q.Desc = r.FormValue("order") != "asc"
+	case "name":
+		q.Sort = indexFname
+		q.Desc = r.FormValue("order") == "desc"
+	case "size":
+		q.Sort = indexSize
+		q.Desc = r.FormValue("order") == "desc"
+	default:
+		return nil, errors.New("(error) sort must be time, name or size")
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			return nil, errors.New("(error) invalid limit")
+		}
+		if q.Limit > CONST_SEARCH_MAX_PAGE_SIZE {
+			q.Limit = CONST_SEARCH_MAX_PAGE_SIZE
+		}
+	}
+	return q, nil
+}
+
+func (c *Server) RebuildIndex(w http.ResponseWriter, r *http.Request) {
+	var (
+		result JsonResult
+	)
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	result.Message = "rebuild index job start ..,don't try again!!!"
+	go c.RebuildSearchIndex()
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
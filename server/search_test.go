@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestSearchIndex(t *testing.T) {
+	var (
+		err    error
+		result *SearchResult
+	)
+	c := newTestServer(t, "", &GlobalConfig{EnableDistinctFile: true, SearchMaxCandidates: 2})
+	dir := STORE_DIR_NAME + "/default"
+	for i, name := range []string{"Annual-Report.pdf", "report_draft.txt", "photo.jpg", "notes.txt"} {
+		c.saveFileMd5Log(&FileInfo{Name: name, Path: dir, Scene: "default", Md5: c.util.MD5(name),
+			Size: int64(100 * (i + 1)), TimeStamp: int64(1000 + i), OffSet: -1}, CONST_FILE_Md5_FILE_NAME)
+	}
+	names := func(files []*FileInfo) string {
+		s := ""
+		for _, v := range files {
+			s += v.Name + ","
+		}
+		return s
+	}
+	for _, v := range []struct {
+		q    SearchQuery
+		want string
+	}{
+		{SearchQuery{Keywords: []string{"rep"}, Sort: indexFname}, "Annual-Report.pdf,report_draft.txt,"},
+		{SearchQuery{Ext: "txt", Sort: indexSize, Desc: true}, "notes.txt,report_draft.txt,"},
+		{SearchQuery{SizeMin: 200, SizeMax: 300, Sort: indexTime}, "report_draft.txt,photo.jpg,"},
+		// more candidates than search_max_candidates walk the sort index
+		{SearchQuery{Scene: "default", Sort: indexTime, Desc: true}, "notes.txt,photo.jpg,report_draft.txt,Annual-Report.pdf,"},
+	} {
+		v.q.Limit = 10
+		if result, err = c.SearchFiles(&v.q); err != nil || names(result.Files) != v.want || result.Cursor != "" {
+			t.Errorf("search %+v: %s %v", v.q, names(result.Files), err)
+		}
+	}
+	// pages follow the cursor, with and without filters
+	for _, v := range []struct {
+		q    SearchQuery
+		want string
+	}{
+		{SearchQuery{Sort: indexFname}, "Annual-Report.pdf,notes.txt,photo.jpg,report_draft.txt,"},
+		{SearchQuery{Keywords: []string{"txt"}, Sort: indexFname, Desc: true}, "report_draft.txt,notes.txt,"},
+	} {
+		got := ""
+		v.q.Limit = 1
+		for i := 0; i < 5; i++ {
+			if result, err = c.SearchFiles(&v.q); err != nil {
+				t.Fatal(err)
+			}
+			got += names(result.Files)
+			if v.q.Cursor = result.Cursor; v.q.Cursor == "" {
+				break
+			}
+		}
+		if got != v.want {
+			t.Errorf("pages %v: %s", v.q.Keywords, got)
+		}
+	}
+	// a removed file leaves the indexes, a rebuild brings back the rest
+	c.saveFileMd5Log(&FileInfo{Name: "photo.jpg", Path: dir, Md5: c.util.MD5("photo.jpg"), OffSet: -1}, CONST_REMOME_Md5_FILE_NAME)
+	c.RebuildSearchIndex()
+	if result, _ = c.SearchFiles(&SearchQuery{Sort: indexTime, Limit: 10}); names(result.Files) != "Annual-Report.pdf,report_draft.txt,notes.txt," {
+		t.Error("after rebuild", names(result.Files))
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"path/filepath"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/astaxie/beego/httplib"
@@ -19,17 +21,29 @@ import (
 type Server struct {
 	ldb            *leveldb.DB
 	logDB          *leveldb.DB
+	storage        Storage
 	util           *goutil.Common
 	statMap        *goutil.CommonMap
 	sumMap         *goutil.CommonMap
 	rtMap          *goutil.CommonMap
-	queueToPeers   chan FileInfo
-	queueFromPeers chan FileInfo
-	queueFileLog   chan *FileLog
+	queueToPeers   *WorkQueue
+	queueFromPeers *WorkQueue
+	queueFileLog   *WorkQueue
+	queueRelease   *WorkQueue
 	queueUpload    chan WrapReqResp
 	lockMap        *goutil.CommonMap
 	sceneMap       *goutil.CommonMap
-	searchMap      *goutil.CommonMap
+	volumes        *VolumeCache
+	keyRing        atomic.Value
+	diskState      atomic.Value
+	scrubState     atomic.Value
+	reconcileState atomic.Value
+	repairState    atomic.Value
+	peerReadOnly   *goutil.CommonMap
+	members        *Membership
+	peerSyncs      map[string]*PeerSync
+	peerSyncLock   sync.Mutex
+	opLock         sync.Mutex
 	curDate        string
 	host           string
 }
@@ -63,7 +77,6 @@ func InitServer() {
 	CONST_CONF_FILE_NAME = CONF_DIR + "/cfg.json"
 	CONST_SERVER_CRT_FILE_NAME = CONF_DIR + "/server.crt"
 	CONST_SERVER_KEY_FILE_NAME = CONF_DIR + "/server.key"
-	CONST_SEARCH_FILE_NAME = DATA_DIR + "/search.txt"
 	FOLDERS = []string{DATA_DIR, STORE_DIR, CONF_DIR, STATIC_DIR}
 	logAccessConfigStr = strings.Replace(logAccessConfigStr, "{DOCKER_DIR}", DOCKER_DIR, -1)
 	logConfigStr = strings.Replace(logConfigStr, "{DOCKER_DIR}", DOCKER_DIR, -1)
@@ -115,10 +128,15 @@ func InitServer() {
 	if Config().PeerId == "" {
 		Config().PeerId = peerId
 	}
+	if len(Config().StoreDirs) > 0 {
+		storage := NewDiskStorage(DOCKER_DIR, Config().StoreDirs)
+		storage.Resolve = server.resolveDisk
+		server.SetStorage(storage)
+	}
 	if Config().SupportGroupManage {
-		staticHandler = http.StripPrefix("/"+Config().Group+"/", http.FileServer(http.Dir(STORE_DIR)))
+		staticHandler = http.StripPrefix("/"+Config().Group+"/", http.FileServer(NewStorageFS(server)))
 	} else {
-		staticHandler = http.StripPrefix("/", http.FileServer(http.Dir(STORE_DIR)))
+		staticHandler = http.StripPrefix("/", http.FileServer(NewStorageFS(server)))
 	}
 	server.initComponent(false)
 }
@@ -132,17 +150,17 @@ func NewServer() *Server {
 		return server
 	}
 	server = &Server{
-		util:           &goutil.Common{},
-		statMap:        goutil.NewCommonMap(0),
-		lockMap:        goutil.NewCommonMap(0),
-		rtMap:          goutil.NewCommonMap(0),
-		sceneMap:       goutil.NewCommonMap(0),
-		searchMap:      goutil.NewCommonMap(0),
-		queueToPeers:   make(chan FileInfo, CONST_QUEUE_SIZE),
-		queueFromPeers: make(chan FileInfo, CONST_QUEUE_SIZE),
-		queueFileLog:   make(chan *FileLog, CONST_QUEUE_SIZE),
-		queueUpload:    make(chan WrapReqResp, 100),
-		sumMap:         goutil.NewCommonMap(365 * 3),
+		util:         &goutil.Common{},
+		storage:      NewLocalStorage(DOCKER_DIR),
+		statMap:      goutil.NewCommonMap(0),
+		lockMap:      goutil.NewCommonMap(0),
+		rtMap:        goutil.NewCommonMap(0),
+		sceneMap:     goutil.NewCommonMap(0),
+		peerReadOnly: goutil.NewCommonMap(0),
+		members:      NewMembership(),
+		queueUpload:  make(chan WrapReqResp, 100),
+		sumMap:       goutil.NewCommonMap(365 * 3),
+		volumes:      NewVolumeCache(CONST_VOLUME_CACHE_SIZE),
 	}
 
 	defaultTransport := &http.Transport{
@@ -182,6 +200,10 @@ func NewServer() *Server {
 		panic(err)
 
 	}
+	server.queueToPeers = NewWorkQueue(CONST_QUEUE_TO_PEERS, server.ldb)
+	server.queueFromPeers = NewWorkQueue(CONST_QUEUE_FROM_PEERS, server.ldb)
+	server.queueFileLog = NewWorkQueue(CONST_QUEUE_FILE_LOG, server.ldb)
+	server.queueRelease = NewWorkQueue(CONST_QUEUE_RELEASE, server.ldb)
 	return server
 }
 
@@ -196,22 +218,45 @@ func (c *Server) Start() {
 	}()
 	go c.CleanAndBackUp()
 	go c.CheckClusterStatus()
-	go c.LoadQueueSendToPeer()
 	go c.ConsumerPostToPeer()
+	go c.WatchPeerSyncs()
 	go c.ConsumerLog()
+	go c.ConsumerRelease()
 	go c.ConsumerDownLoad()
 	go c.ConsumerUpload()
 	go c.RemoveDownloading()
+	go c.WatchStoreDisks()
+	go c.WatchPeerStatus()
+	go c.Gossip()
+	go c.ReplicateOpLog()
 
 	if Config().EnableFsNotify {
 		go c.WatchFilesChange()
 	}
 
-	//go c.LoadSearchDict()
+	go c.MigrateFileRefs()
+	go c.CleanTrash()
+	go c.BuildSearchIndex()
+	go c.BuildMerkleTrees()
+	go c.Scrub()
+	if Config().EnableS3 {
+		go c.RebuildS3ObjectIndex()
+		go c.StartS3()
+	}
+
 	if Config().EnableMigrate {
 		go c.RepairFileInfoFromFile()
 	}
 
+	if Config().EnableMergeSmallFile {
+		go func() {
+			for {
+				time.Sleep(time.Hour * 6)
+				c.CompactSmallFiles()
+			}
+		}()
+	}
+
 	if Config().AutoRepair {
 		go func() {
 			for {
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/sjqzhang/goutil"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// newTestServer returns a Server at host on a memory storage, with its
+// leveldb files in the temporary dirs of t. cfg, when not nil, is the config
+// until t ends.
+func newTestServer(t *testing.T, host string, cfg *GlobalConfig) *Server {
+	var err error
+	if cfg != nil {
+		old := atomic.LoadPointer(&ptr)
+		t.Cleanup(func() { atomic.StorePointer(&ptr, old) })
+		atomic.StorePointer(&ptr, unsafe.Pointer(cfg))
+	}
+	c := &Server{
+		util:         &goutil.Common{},
+		storage:      NewMemoryStorage(),
+		statMap:      goutil.NewCommonMap(0),
+		lockMap:      goutil.NewCommonMap(0),
+		peerReadOnly: goutil.NewCommonMap(0),
+		host:         host,
+	}
+	if c.ldb, err = leveldb.OpenFile(t.TempDir(), nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.ldb.Close() })
+	if c.logDB, err = leveldb.OpenFile(t.TempDir(), nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.logDB.Close() })
+	c.queueToPeers = NewWorkQueue(CONST_QUEUE_TO_PEERS, c.ldb)
+	c.queueFromPeers = NewWorkQueue(CONST_QUEUE_FROM_PEERS, c.ldb)
+	c.queueFileLog = NewWorkQueue(CONST_QUEUE_FILE_LOG, c.ldb)
+	c.queueRelease = NewWorkQueue(CONST_QUEUE_RELEASE, c.ldb)
+	return c
+}
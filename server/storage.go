@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Storage is the physical layer behind every file the server reads or writes.
+// Paths are relative to DOCKER_DIR and use the same layout as FileInfo.Path
+// (files/default/20190101/10/00/1/a.jpg), so the metadata in leveldb does not
+// depend on the backend.
+type Storage interface {
+	// Put writes reader to fpath, replacing any existing content.
+	Put(fpath string, reader io.Reader) (int64, error)
+	// Append writes reader to the end of fpath and returns the offset it starts at.
+	Append(fpath string, reader io.Reader) (int64, int64, error)
+	// WriteAt writes data into fpath at offset, creating the file if needed.
+	WriteAt(fpath string, offset int64, data []byte) error
+	Get(fpath string) (StorageFile, error)
+	// Range reads exactly length bytes of fpath starting at offset.
+	Range(fpath string, offset int64, length int64) ([]byte, error)
+	Stat(fpath string) (os.FileInfo, error)
+	Rename(src string, dst string) error
+	Delete(fpath string) error
+	List(dir string) ([]os.FileInfo, error)
+}
+
+// Linker is implemented by the backends that can give a file a second path
+// without copying it, e.g. with a hardlink.
+type Linker interface {
+	Link(src string, dst string) error
+}
+
+type StorageFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// LocalStorage keeps files on the local disk under Root, which is the layout
+// the server has always used.
+type LocalStorage struct {
+	Root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+func (s *LocalStorage) fullPath(fpath string) string {
+	return s.Root + fpath
+}
+
+func (s *LocalStorage) Put(fpath string, reader io.Reader) (int64, error) {
+	var (
+		err     error
+		outFile *os.File
+		n       int64
+	)
+	fpath = s.fullPath(fpath)
+	if err = os.MkdirAll(path.Dir(fpath), 0775); err != nil {
+		return 0, err
+	}
+	if outFile, err = os.Create(fpath); err != nil {
+		return 0, err
+	}
+	defer outFile.Close()
+	if n, err = io.Copy(outFile, reader); err != nil {
+		return n, err
+	}
+	return n, outFile.Close()
+}
+
+func (s *LocalStorage) Append(fpath string, reader io.Reader) (int64, int64, error) {
+	var (
+		err     error
+		outFile *os.File
+		offset  int64
+		n       int64
+	)
+	fpath = s.fullPath(fpath)
+	if err = os.MkdirAll(path.Dir(fpath), 0775); err != nil {
+		return -1, 0, err
+	}
+	if outFile, err = os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, 0664); err != nil {
+		return -1, 0, err
+	}
+	defer outFile.Close()
+	if offset, err = outFile.Seek(0, 2); err != nil {
+		return -1, 0, err
+	}
+	n, err = io.Copy(outFile, reader)
+	return offset, n, err
+}
+
+func (s *LocalStorage) WriteAt(fpath string, offset int64, data []byte) error {
+	var (
+		err     error
+		outFile *os.File
+		n       int
+	)
+	fpath = s.fullPath(fpath)
+	if err = os.MkdirAll(path.Dir(fpath), 0775); err != nil {
+		return err
+	}
+	if outFile, err = os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, 0664); err != nil {
+		return err
+	}
+	defer outFile.Close()
+	if n, err = outFile.WriteAt(data, offset); err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("write %s error", fpath)
+	}
+	return nil
+}
+
+func (s *LocalStorage) Get(fpath string) (StorageFile, error) {
+	return os.Open(s.fullPath(fpath))
+}
+
+func (s *LocalStorage) Range(fpath string, offset int64, length int64) ([]byte, error) {
+	var (
+		err    error
+		file   *os.File
+		result []byte
+		n      int
+	)
+	if file, err = os.Open(s.fullPath(fpath)); err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	result = make([]byte, length)
+	if n, err = file.ReadAt(result, offset); err != nil {
+		return nil, err
+	}
+	if int64(n) != length {
+		return nil, errors.New("read error")
+	}
+	return result, nil
+}
+
+func (s *LocalStorage) Stat(fpath string) (os.FileInfo, error) {
+	return os.Stat(s.fullPath(fpath))
+}
+
+func (s *LocalStorage) Rename(src string, dst string) error {
+	dst = s.fullPath(dst)
+	if err := os.MkdirAll(path.Dir(dst), 0775); err != nil {
+		return err
+	}
+	return os.Rename(s.fullPath(src), dst)
+}
+
+func (s *LocalStorage) Link(src string, dst string) error {
+	dst = s.fullPath(dst)
+	if err := os.MkdirAll(path.Dir(dst), 0775); err != nil {
+		return err
+	}
+	return os.Link(s.fullPath(src), dst)
+}
+
+func (s *LocalStorage) Delete(fpath string) error {
+	return os.Remove(s.fullPath(fpath))
+}
+
+func (s *LocalStorage) List(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(s.fullPath(dir))
+}
+
+// SetStorage replaces the backend used for all file I/O, e.g. with
+// NewMemoryStorage() in tests.
+func (c *Server) SetStorage(storage Storage) {
+	c.storage = storage
+}
+
+// GetStoragePath converts a path that may carry the DOCKER_DIR prefix
+// (as returned by GetFilePathFromRequest) into a Storage path.
+func (c *Server) GetStoragePath(fullpath string) string {
+	if DOCKER_DIR != "" && strings.HasPrefix(fullpath, DOCKER_DIR) {
+		return fullpath[len(DOCKER_DIR):]
+	}
+	return fullpath
+}
+
+// StorageFS serves files/ of the storage of a Server to http.FileServer, so
+// the directory listings merge every store dir.
+type StorageFS struct {
+	server *Server
+}
+
+func NewStorageFS(server *Server) *StorageFS {
+	return &StorageFS{server: server}
+}
+
+func (fs *StorageFS) Open(name string) (http.File, error) {
+	var (
+		err  error
+		fi   os.FileInfo
+		file StorageFile
+	)
+	fpath := path.Join(STORE_DIR_NAME, path.Clean("/"+name))
+	if fi, err = fs.server.storage.Stat(fpath); err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &storageDir{storage: fs.server.storage, fpath: fpath, fi: fi}, nil
+	}
+	if file, err = fs.server.storage.Get(fpath); err != nil {
+		return nil, err
+	}
+	return &storageFile{StorageFile: file, fi: fi}, nil
+}
+
+type storageFile struct {
+	StorageFile
+	fi os.FileInfo
+}
+
+func (f *storageFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *storageFile) Stat() (os.FileInfo, error) {
+	return f.fi, nil
+}
+
+// storageDir is listed from the storage the first time it is read.
+type storageDir struct {
+	storage Storage
+	fpath   string
+	fi      os.FileInfo
+	list    []os.FileInfo
+	read    bool
+}
+
+func (d *storageDir) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *storageDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (d *storageDir) Close() error {
+	return nil
+}
+
+func (d *storageDir) Stat() (os.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *storageDir) Readdir(count int) ([]os.FileInfo, error) {
+	var (
+		err  error
+		list []os.FileInfo
+	)
+	if !d.read {
+		if d.list, err = d.storage.List(d.fpath); err != nil {
+			return nil, err
+		}
+		d.read = true
+	}
+	if count <= 0 {
+		list, d.list = d.list, nil
+		return list, nil
+	}
+	if len(d.list) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.list) {
+		count = len(d.list)
+	}
+	list, d.list = d.list[:count], d.list[count:]
+	return list, nil
+}
+
+func (c *Server) NewFileSumHash() hash.Hash {
+	if strings.ToLower(Config().FileSumArithmetic) == "sha1" {
+		return sha1.New()
+	}
+	return md5.New()
+}
+
+func (c *Server) GetFileSumFromStorage(fpath string) (string, error) {
+	var (
+		err  error
+		file StorageFile
+	)
+	if file, err = c.storage.Get(fpath); err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := c.NewFileSumHash()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func (c *Server) StorageFileExists(fpath string) bool {
+	_, err := c.storage.Stat(fpath)
+	return err == nil
+}
+
+// GetFileReaderByInfo opens the content described by fileInfo, reading merged
+// small files out of their haystack volume and erasure coded files from their
+// shards. Encrypted and compressed files are decoded.
+func (c *Server) GetFileReaderByInfo(fileInfo *FileInfo) (io.ReadCloser, error) {
+	var (
+		err    error
+		offset int64
+		length int
+		needle *Needle
+		fpath  string
+		info   *FileInfo
+		data   []byte
+		reader io.ReadSeekCloser
+	)
+	fpath = c.GetFilePathByInfo(fileInfo, false)
+	if fileInfo.Shards == nil && fileInfo.OffSet < 0 && !c.StorageFileExists(fpath) {
+		// fileInfo may predate the encoding of the file
+		if info, err = c.GetFileInfoFromLevelDB(c.util.MD5(fpath)); err == nil && info.Md5 == fileInfo.Md5 {
+			fileInfo = info
+		}
+	}
+	if fileInfo.Shards != nil {
+		if reader, err = c.NewErasureReader(fileInfo); err != nil {
+			return nil, err
+		}
+		return c.decodeContent(fileInfo, reader)
+	}
+	if fileInfo.OffSet < 0 {
+		if reader, err = c.storage.Get(fpath); err != nil {
+			return nil, err
+		}
+		return c.decodeContent(fileInfo, reader)
+	}
+	if _, offset, length, err = c.ParseSmallFile(fileInfo.ReName); err != nil {
+		return nil, err
+	}
+	if needle, err = c.ReadNeedle(strings.Split(fpath, ",")[0], offset, length); err != nil {
+		return nil, err
+	}
+	if needle.Flag != '1' {
+		return nil, errors.New("data no sync")
+	}
+	data = needle.Data
+	if fileInfo.KeyId != "" {
+		if data, err = c.DecryptBytes(data); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *Server) decodeContent(fileInfo *FileInfo, reader io.ReadSeekCloser) (io.ReadCloser, error) {
+	if fileInfo.KeyId != "" {
+		decrypted, err := c.NewDecryptReader(reader)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		reader = decrypted
+	}
+	if fileInfo.Codec == "" {
+		return reader, nil
+	}
+	result, err := NewDecompressReader(fileInfo.Codec, reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return result, nil
+}
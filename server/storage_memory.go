@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps every file in memory. It is meant for tests and for
+// nodes that only act as a cache.
+type MemoryStorage struct {
+	sync.RWMutex
+	files map[string]*memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (f memoryFile) Close() error {
+	return nil
+}
+
+func (fi *memoryFileInfo) Name() string       { return fi.name }
+func (fi *memoryFileInfo) Size() int64        { return fi.size }
+func (fi *memoryFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memoryFileInfo) IsDir() bool        { return fi.isDir }
+func (fi *memoryFileInfo) Sys() interface{}   { return nil }
+func (fi *memoryFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0775
+	}
+	return 0664
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]*memoryObject)}
+}
+
+func (s *MemoryStorage) cleanPath(fpath string) string {
+	return strings.TrimPrefix(path.Clean("/"+fpath), "/")
+}
+
+func (s *MemoryStorage) Put(fpath string, reader io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.files[s.cleanPath(fpath)] = &memoryObject{data: data, modTime: time.Now()}
+	return int64(len(data)), nil
+}
+
+func (s *MemoryStorage) Append(fpath string, reader io.Reader) (int64, int64, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return -1, 0, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	fpath = s.cleanPath(fpath)
+	obj, ok := s.files[fpath]
+	if !ok {
+		obj = &memoryObject{}
+		s.files[fpath] = obj
+	}
+	offset := int64(len(obj.data))
+	obj.data = append(obj.data, data...)
+	obj.modTime = time.Now()
+	return offset, int64(len(data)), nil
+}
+
+func (s *MemoryStorage) WriteAt(fpath string, offset int64, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	fpath = s.cleanPath(fpath)
+	obj, ok := s.files[fpath]
+	if !ok {
+		obj = &memoryObject{}
+		s.files[fpath] = obj
+	}
+	if end := offset + int64(len(data)); end > int64(len(obj.data)) {
+		buf := make([]byte, end)
+		copy(buf, obj.data)
+		obj.data = buf
+	}
+	copy(obj.data[offset:], data)
+	obj.modTime = time.Now()
+	return nil
+}
+
+func (s *MemoryStorage) Get(fpath string) (StorageFile, error) {
+	s.RLock()
+	defer s.RUnlock()
+	obj, ok := s.files[s.cleanPath(fpath)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memoryFile{bytes.NewReader(obj.data)}, nil
+}
+
+func (s *MemoryStorage) Range(fpath string, offset int64, length int64) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	obj, ok := s.files[s.cleanPath(fpath)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if offset < 0 || offset+length > int64(len(obj.data)) {
+		return nil, errors.New("read error")
+	}
+	result := make([]byte, length)
+	copy(result, obj.data[offset:offset+length])
+	return result, nil
+}
+
+func (s *MemoryStorage) Stat(fpath string) (os.FileInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+	fpath = s.cleanPath(fpath)
+	if obj, ok := s.files[fpath]; ok {
+		return &memoryFileInfo{name: path.Base(fpath), size: int64(len(obj.data)), modTime: obj.modTime}, nil
+	}
+	prefix := fpath + "/"
+	for k := range s.files {
+		if fpath == "" || strings.HasPrefix(k, prefix) {
+			return &memoryFileInfo{name: path.Base(fpath), isDir: true, modTime: time.Now()}, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (s *MemoryStorage) Rename(src string, dst string) error {
+	s.Lock()
+	defer s.Unlock()
+	src = s.cleanPath(src)
+	obj, ok := s.files[src]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(s.files, src)
+	s.files[s.cleanPath(dst)] = obj
+	return nil
+}
+
+func (s *MemoryStorage) Delete(fpath string) error {
+	s.Lock()
+	defer s.Unlock()
+	fpath = s.cleanPath(fpath)
+	if _, ok := s.files[fpath]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.files, fpath)
+	return nil
+}
+
+func (s *MemoryStorage) List(dir string) ([]os.FileInfo, error) {
+	var (
+		result []os.FileInfo
+		seen   map[string]bool
+		prefix string
+	)
+	s.RLock()
+	defer s.RUnlock()
+	seen = make(map[string]bool)
+	if prefix = s.cleanPath(dir); prefix != "" {
+		prefix = prefix + "/"
+	}
+	for k, obj := range s.files {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		name := k[len(prefix):]
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i]
+			if !seen[name] {
+				seen[name] = true
+				result = append(result, &memoryFileInfo{name: name, isDir: true, modTime: obj.modTime})
+			}
+			continue
+		}
+		seen[name] = true
+		result = append(result, &memoryFileInfo{name: name, size: int64(len(obj.data)), modTime: obj.modTime})
+	}
+	if len(result) == 0 {
+		return nil, os.ErrNotExist
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
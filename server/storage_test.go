@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testStorage(t *testing.T, storage Storage) {
+	var (
+		err    error
+		offset int64
+		data   []byte
+		file   StorageFile
+		fi     os.FileInfo
+		fis    []os.FileInfo
+	)
+	if _, err = storage.Put("files/default/a.txt", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if offset, _, err = storage.Append("files/haystack/1/100", bytes.NewReader([]byte("1abc"))); err != nil || offset != 0 {
+		t.Error("append fail", offset, err)
+	}
+	if offset, _, err = storage.Append("files/haystack/1/100", bytes.NewReader([]byte("1def"))); err != nil || offset != 4 {
+		t.Error("append fail", offset, err)
+	}
+	if data, err = storage.Range("files/haystack/1/100", 4, 4); err != nil || string(data) != "1def" {
+		t.Error("range fail", string(data), err)
+	}
+	if err = storage.WriteAt("files/haystack/1/100", 4, []byte("0")); err != nil {
+		t.Error(err)
+	}
+	if file, err = storage.Get("files/haystack/1/100"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(file)
+	file.Close()
+	if string(data) != "1abc0def" {
+		t.Error("write at fail", string(data))
+	}
+	if err = storage.Rename("files/default/a.txt", "files/default/b/a.txt"); err != nil {
+		t.Error(err)
+	}
+	if fi, err = storage.Stat("files/default/b/a.txt"); err != nil || fi.Size() != 5 {
+		t.Error("stat fail", err)
+	}
+	if fis, err = storage.List("files/default"); err != nil || len(fis) != 1 || !fis[0].IsDir() {
+		t.Error("list fail", fis, err)
+	}
+	if err = storage.Delete("files/default/b/a.txt"); err != nil {
+		t.Error(err)
+	}
+	if _, err = storage.Stat("files/default/b/a.txt"); err == nil {
+		t.Error("delete fail")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage())
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testStorage(t, NewLocalStorage(dir+"/"))
+}
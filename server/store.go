@@ -1,15 +1,20 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/astaxie/beego/httplib"
-	log "github.com/sjqzhang/seelog"
 	"github.com/busyfree/tusd/pkg/handler"
+	log "github.com/sjqzhang/seelog"
 )
 
 type hookDataStore struct {
@@ -20,6 +25,12 @@ func (store hookDataStore) NewUpload(ctx context.Context, info handler.FileInfo)
 	var (
 		jsonResult JsonResult
 	)
+	if err = server.CheckDiskSpace(info.Size); err != nil {
+		return nil, httpError{error: err, statusCode: http.StatusInsufficientStorage}
+	}
+	if _, err = server.GetTusMeta(info.MetaData); err != nil {
+		return nil, httpError{error: err, statusCode: http.StatusBadRequest}
+	}
 	if Config().AuthUrl != "" {
 		if auth_token, ok := info.MetaData["auth_token"]; !ok {
 			msg := "token auth fail,auth_token is not in http header Upload-Metadata," +
@@ -54,6 +65,180 @@ func (store hookDataStore) NewUpload(ctx context.Context, info handler.FileInfo)
 	return store.DataStore.NewUpload(ctx, info)
 }
 
+// StorageTusStore is the tus DataStore of the server. In-flight uploads live
+// in the Storage under Path as <id>.bin and <id>.info; once an upload has been
+// moved into the file tree it is served from its FileInfo in leveldb.
+type StorageTusStore struct {
+	Path   string
+	server *Server
+}
+
+type storageTusUpload struct {
+	store    *StorageTusStore
+	info     handler.FileInfo
+	fileInfo *FileInfo
+}
+
+func (store *StorageTusStore) UseIn(composer *handler.StoreComposer) {
+	composer.UseCore(store)
+	composer.UseTerminater(store)
+	composer.UseConcater(store)
+	composer.UseLengthDeferrer(store)
+}
+
+func (store *StorageTusStore) binPath(id string) string {
+	return store.Path + "/" + id + ".bin"
+}
+
+func (store *StorageTusStore) infoPath(id string) string {
+	return store.Path + "/" + id + ".info"
+}
+
+func (store *StorageTusStore) NewUpload(ctx context.Context, info handler.FileInfo) (handler.Upload, error) {
+	var (
+		err error
+	)
+	info.ID = store.server.util.MD5(store.server.util.GetUUID())
+	info.Storage = map[string]string{
+		"Type": "storage",
+		"Path": store.binPath(info.ID),
+	}
+	if _, err = store.server.storage.Put(store.binPath(info.ID), bytes.NewReader(nil)); err != nil {
+		return nil, err
+	}
+	upload := &storageTusUpload{store: store, info: info}
+	if err = upload.writeInfo(); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *StorageTusStore) GetUpload(ctx context.Context, id string) (handler.Upload, error) {
+	var (
+		err      error
+		file     StorageFile
+		data     []byte
+		fi       os.FileInfo
+		info     handler.FileInfo
+		fileInfo *FileInfo
+	)
+	if file, err = store.server.storage.Get(store.infoPath(id)); err != nil {
+		// finished upload, support raw tus download
+		if fileInfo, err = store.server.GetFileInfoFromLevelDB(id); err != nil {
+			return nil, handler.ErrNotFound
+		}
+		info.ID = id
+		info.Size = store.server.GetContentSize(fileInfo)
+		info.Offset = info.Size
+		info.MetaData = handler.MetaData{"filename": fileInfo.Name}
+		return &storageTusUpload{store: store, info: info, fileInfo: fileInfo}, nil
+	}
+	defer file.Close()
+	if data, err = ioutil.ReadAll(file); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	if fi, err = store.server.storage.Stat(store.binPath(id)); err != nil {
+		return nil, handler.ErrNotFound
+	}
+	info.Offset = fi.Size()
+	return &storageTusUpload{store: store, info: info}, nil
+}
+
+func (store *StorageTusStore) AsTerminatableUpload(upload handler.Upload) handler.TerminatableUpload {
+	return upload.(*storageTusUpload)
+}
+
+func (store *StorageTusStore) AsLengthDeclarableUpload(upload handler.Upload) handler.LengthDeclarableUpload {
+	return upload.(*storageTusUpload)
+}
+
+func (store *StorageTusStore) AsConcatableUpload(upload handler.Upload) handler.ConcatableUpload {
+	return upload.(*storageTusUpload)
+}
+
+func (upload *storageTusUpload) GetInfo(ctx context.Context) (handler.FileInfo, error) {
+	return upload.info, nil
+}
+
+func (upload *storageTusUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if upload.fileInfo != nil {
+		return 0, errors.New("upload is finished")
+	}
+	if err := upload.store.server.CheckDiskSpace(0); err != nil {
+		return 0, httpError{error: err, statusCode: http.StatusInsufficientStorage}
+	}
+	_, n, err := upload.store.server.storage.Append(upload.store.binPath(upload.info.ID), src)
+	upload.info.Offset += n
+	return n, err
+}
+
+func (upload *storageTusUpload) GetReader(ctx context.Context) (io.Reader, error) {
+	var (
+		c = upload.store.server
+	)
+	if upload.fileInfo == nil {
+		return c.storage.Get(upload.store.binPath(upload.info.ID))
+	}
+	if Config().AuthUrl != "" {
+		fileResult := c.util.JsonEncodePretty(c.BuildFileResult(upload.fileInfo, nil))
+		return bytes.NewBuffer([]byte(fileResult)), nil
+	}
+	log.Info(fmt.Sprintf("download:%s", c.GetFilePathByInfo(upload.fileInfo, false)))
+	return c.GetFileReaderByInfo(upload.fileInfo)
+}
+
+func (upload *storageTusUpload) Terminate(ctx context.Context) error {
+	if upload.fileInfo != nil {
+		return handler.ErrNotFound
+	}
+	if err := upload.store.server.storage.Delete(upload.store.infoPath(upload.info.ID)); err != nil {
+		return err
+	}
+	return upload.store.server.storage.Delete(upload.store.binPath(upload.info.ID))
+}
+
+func (upload *storageTusUpload) ConcatUploads(ctx context.Context, uploads []handler.Upload) error {
+	var (
+		err     error
+		src     StorageFile
+		storage = upload.store.server.storage
+	)
+	for _, partialUpload := range uploads {
+		partial := partialUpload.(*storageTusUpload)
+		if src, err = storage.Get(upload.store.binPath(partial.info.ID)); err != nil {
+			return err
+		}
+		_, _, err = storage.Append(upload.store.binPath(upload.info.ID), src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (upload *storageTusUpload) DeclareLength(ctx context.Context, length int64) error {
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo()
+}
+
+func (upload *storageTusUpload) FinishUpload(ctx context.Context) error {
+	return nil
+}
+
+func (upload *storageTusUpload) writeInfo() error {
+	data, err := json.Marshal(upload.info)
+	if err != nil {
+		return err
+	}
+	_, err = upload.store.server.storage.Put(upload.store.infoPath(upload.info.ID), bytes.NewReader(data))
+	return err
+}
+
 //
 //func (store hookDataStore) NewUpload(info tusd.FileInfo) (id string, err error) {
 //	var (
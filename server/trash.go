@@ -0,0 +1,320 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// With enable_trash /delete moves a file to the trash of its scene instead
+// of deleting it. The entry trash_<id> keeps the metadata of the deleted
+// path, and the reference trash_<id> keeps the content alive; the content
+// moves to files/_trash/<scene>/<id>/ when nothing else references it. The
+// node the delete reached chooses the id, so the peers restore and purge the
+// same entry.
+
+type TrashFile struct {
+	Id         string    `json:"id"`
+	Scene      string    `json:"scene"`
+	DeleteTime int64     `json:"delete_time"`
+	File       *FileInfo `json:"file"`
+}
+
+func (c *Server) NewTrashId(md5sum string) string {
+	return c.util.MD5(fmt.Sprintf("%s_%d", md5sum, time.Now().UnixNano()))
+}
+
+func (c *Server) trashKey(id string) string {
+	return CONST_TRASH_KEY_PREFIX + id
+}
+
+func (c *Server) GetTrashDir(trash *TrashFile) string {
+	scene := trash.Scene
+	if scene == "" {
+		scene = Config().DefaultScene
+	}
+	return path.Join(STORE_DIR_NAME, CONST_TRASH_DIR_NAME, scene, trash.Id)
+}
+
+func (c *Server) IsTrashPath(fpath string) bool {
+	return strings.HasPrefix(path.Clean(fpath), STORE_DIR_NAME+"/"+CONST_TRASH_DIR_NAME+"/")
+}
+
+func (c *Server) IsTrashRef(ref *FileInfo) bool {
+	return strings.HasPrefix(ref.RefId, CONST_TRASH_KEY_PREFIX)
+}
+
+func (c *Server) SaveTrashFile(trash *TrashFile) error {
+	data, err := json.Marshal(trash)
+	if err != nil {
+		return err
+	}
+	return c.ldb.Put([]byte(c.trashKey(trash.Id)), data, nil)
+}
+
+func (c *Server) GetTrashFile(id string) (*TrashFile, error) {
+	var (
+		err   error
+		data  []byte
+		trash TrashFile
+	)
+	if data, err = c.ldb.Get([]byte(c.trashKey(id)), nil); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &trash); err != nil {
+		return nil, err
+	}
+	return &trash, nil
+}
+
+// ListTrashFiles returns the trash of scene, or of every scene when scene is
+// empty, the latest deleted first.
+func (c *Server) ListTrashFiles(scene string) []*TrashFile {
+	var (
+		files []*TrashFile
+	)
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(CONST_TRASH_KEY_PREFIX)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var trash TrashFile
+		if err := json.Unmarshal(iter.Value(), &trash); err != nil || trash.File == nil {
+			continue
+		}
+		if scene == "" || trash.Scene == scene {
+			files = append(files, &trash)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].DeleteTime > files[j].DeleteTime
+	})
+	return files
+}
+
+// MoveToTrash drops the reference refId, or one at the path of fileInfo,
+// like ReleaseFileRef does and keeps it in the trash as id. Merged small
+// files and erasure coded files stay in their volume or shards, the trash
+// only keeps them referenced.
+func (c *Server) MoveToTrash(fileInfo *FileInfo, refId string, id string) (*TrashFile, error) {
+	var (
+		err     error
+		content *FileInfo
+		refs    []*FileInfo
+	)
+	if content, err = c.GetFileInfoFromLevelDB(fileInfo.Md5); err != nil {
+		content = fileInfo
+	}
+	if refs = c.GetFileRefs(fileInfo.Md5); len(refs) == 0 {
+		return nil, errors.New("(error) file references not migrated yet")
+	}
+	trash := &TrashFile{Id: id, Scene: fileInfo.Scene, DeleteTime: time.Now().Unix()}
+	hold := c.NewFileRef(content, &FileInfo{Name: content.Name, ReName: content.ReName,
+		Path: c.GetTrashDir(trash), Scene: trash.Scene})
+	hold.RefId = c.trashKey(id)
+	if err = c.AddFileRef(hold); err != nil {
+		return nil, err
+	}
+	if refId, _ = c.ReleaseFileRef(fileInfo, refId); refId == "" {
+		c.RemoveKeyFromLevelDB(c.fileRefKey(hold.Md5, hold.RefId), c.ldb)
+		return nil, errors.New("no reference at this path")
+	}
+	for _, v := range refs {
+		if v.RefId == refId {
+			trash.File = v
+		}
+	}
+	if err = c.SaveTrashFile(trash); err != nil {
+		return nil, err
+	}
+	log.Info(fmt.Sprintf("%s moved to the trash as %s", c.GetFilePathByInfo(trash.File, false), id))
+	return trash, nil
+}
+
+// RestoreTrashFile brings the file in the trash as id back to its path.
+func (c *Server) RestoreTrashFile(id string) (*FileInfo, error) {
+	var (
+		err     error
+		trash   *TrashFile
+		content *FileInfo
+		ref     *FileInfo
+	)
+	if trash, err = c.GetTrashFile(id); err != nil {
+		return nil, errors.New("not found in the trash")
+	}
+	fpath := c.GetFilePathByInfo(trash.File, false)
+	c.lockMap.LockKey(fpath)
+	defer c.lockMap.UnLockKey(fpath)
+	if content, err = c.GetFileInfoFromLevelDB(trash.File.Md5); err != nil {
+		return nil, errors.New("(error) the content of the file is gone")
+	}
+	cpath := c.GetFilePathByInfo(content, false)
+	if cpath != fpath {
+		if ok, _ := c.IsExistFromLevelDB(c.util.MD5(fpath), c.ldb); ok || c.StorageFileExists(fpath) {
+			return nil, errors.New("(error) another file took the path")
+		}
+	} else if info, err := c.GetFileInfoFromLevelDB(c.util.MD5(fpath)); err == nil && info.Md5 != content.Md5 {
+		return nil, errors.New("(error) another file took the path")
+	}
+	c.RemoveKeyFromLevelDB(c.fileRefKey(content.Md5, c.trashKey(id)), c.ldb)
+	if strings.HasPrefix(cpath, c.GetTrashDir(trash)+"/") {
+		// the content kept in the trash goes back to the path
+		ref = trash.File
+		ref.Ref = true
+		c.promoteFileRef(content, ref)
+		ref.Ref = false
+	} else if cpath == fpath {
+		ref = trash.File
+		if err = c.AddFileRef(ref); err == nil && (content.OffSet >= 0 || content.Shards != nil) {
+			// the path of merged or erasure coded content was dropped
+			_, err = c.SaveFileInfoToLevelDB(c.util.MD5(fpath), content, c.ldb)
+			c.SaveS3ObjectIndex(content)
+			c.IndexFile(content)
+		}
+	} else {
+		ref = c.NewFileRef(content, trash.File)
+		ref.RefId = trash.File.RefId
+		if !trash.File.Ref {
+			c.linkFileRef(content, ref)
+		}
+		err = c.SaveFileRef(ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = c.RemoveKeyFromLevelDB(c.trashKey(id), c.ldb); err != nil {
+		return nil, err
+	}
+	// the directory of the entry, left empty
+	c.storage.Delete(c.GetTrashDir(trash))
+	log.Info(fmt.Sprintf("%s restored from the trash", fpath))
+	return ref, nil
+}
+
+// PurgeTrashFile deletes the file in the trash as id, its content goes with
+// its last reference.
+func (c *Server) PurgeTrashFile(id string) error {
+	var (
+		err     error
+		trash   *TrashFile
+		content *FileInfo
+	)
+	if trash, err = c.GetTrashFile(id); err != nil {
+		return errors.New("not found in the trash")
+	}
+	if _, last := c.ReleaseFileRef(trash.File, c.trashKey(id)); last {
+		if content, err = c.GetFileInfoFromLevelDB(trash.File.Md5); err == nil {
+			if err = c.RemoveFileContent(content); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	c.storage.Delete(c.GetTrashDir(trash))
+	return c.RemoveKeyFromLevelDB(c.trashKey(id), c.ldb)
+}
+
+// CleanTrash purges the files kept longer than trash_expire_days, every node
+// does so by itself.
+func (c *Server) CleanTrash() {
+	for {
+		if Config().EnableTrash {
+			expire := time.Now().Unix() - int64(Config().TrashExpireDays)*24*3600
+			for _, trash := range c.ListTrashFiles("") {
+				if trash.DeleteTime >= expire {
+					continue
+				}
+				if err := c.PurgeTrashFile(trash.Id); err != nil {
+					log.Error(err)
+				}
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func (c *Server) ListTrash(w http.ResponseWriter, r *http.Request) {
+	var (
+		result JsonResult
+	)
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	result.Data = c.ListTrashFiles(r.FormValue("scene"))
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+func (c *Server) RestoreTrash(w http.ResponseWriter, r *http.Request) {
+	var (
+		err      error
+		result   JsonResult
+		fileInfo *FileInfo
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	id := r.FormValue("id")
+	if fileInfo, err = c.RestoreTrashFile(id); err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if r.FormValue("inner") != "1" {
+		c.LogOp(&Op{Type: CONST_OP_RESTORE, TrashId: id})
+	}
+	result.Status = "ok"
+	result.Data = fileInfo
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+// PurgeTrash deletes the file in the trash as id, or the whole trash of
+// scene when no id is given.
+func (c *Server) PurgeTrash(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		result JsonResult
+		ids    []string
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	id, scene := r.FormValue("id"), r.FormValue("scene")
+	if id != "" {
+		ids = append(ids, id)
+	} else {
+		for _, trash := range c.ListTrashFiles(scene) {
+			ids = append(ids, trash.Id)
+		}
+	}
+	for _, v := range ids {
+		op := &Op{Type: CONST_OP_PURGE, TrashId: v}
+		if trash, err := c.GetTrashFile(v); err == nil {
+			op.Content = trash.File.Md5
+		}
+		if err = c.PurgeTrashFile(v); err != nil && id != "" {
+			result.Message = err.Error()
+			w.Write([]byte(c.util.JsonEncodePretty(result)))
+			return
+		}
+		if r.FormValue("inner") != "1" {
+			// one by one, the trash of the scene may differ on the peers
+			c.LogOp(op)
+		}
+	}
+	result.Status = "ok"
+	result.Message = fmt.Sprintf("%d purged", len(ids))
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
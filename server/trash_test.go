@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTrash(t *testing.T) {
+	var (
+		err      error
+		trash    *TrashFile
+		fileInfo *FileInfo
+	)
+	c := newTestServer(t, "http://10.0.0.1:8080", &GlobalConfig{EnableDistinctFile: true, EnableTrash: true})
+	dir := STORE_DIR_NAME + "/default"
+	md5sum := c.util.MD5("a")
+	c.storage.Put(dir+"/a.txt", strings.NewReader("a"))
+	c.saveFileMd5Log(&FileInfo{Name: "a.txt", Path: dir, Scene: "default", Md5: md5sum, Size: 1, OffSet: -1}, CONST_FILE_Md5_FILE_NAME)
+	content, _ := c.GetFileInfoFromLevelDB(md5sum)
+	if trash, err = c.MoveToTrash(content, "", "t1"); err != nil || trash == nil {
+		t.Fatal("move to trash", err)
+	}
+	// the content waits in the trash of its scene
+	if c.StorageFileExists(dir+"/a.txt") || !c.StorageFileExists(STORE_DIR_NAME+"/_trash/default/t1/a.txt") {
+		t.Fatal("content not moved to the trash")
+	}
+	if files := c.ListTrashFiles("default"); len(files) != 1 || files[0].File.Name != "a.txt" {
+		t.Fatal("list trash", files)
+	}
+	if fileInfo, err = c.RestoreTrashFile("t1"); err != nil || fileInfo.Path != dir || !c.StorageFileExists(dir+"/a.txt") {
+		t.Fatal("restore", fileInfo, err)
+	}
+	if refs := c.GetFileRefs(md5sum); len(refs) != 1 || c.IsTrashRef(refs[0]) {
+		t.Fatal("refs after restore", refs)
+	}
+	if len(c.ListTrashFiles("")) != 0 {
+		t.Error("restored file still in the trash")
+	}
+	// purging the last reference deletes the content
+	if _, err = c.MoveToTrash(fileInfo, "", "t2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.PurgeTrashFile("t2"); err != nil {
+		t.Fatal(err)
+	}
+	if c.StorageFileExists(STORE_DIR_NAME + "/_trash/default/t2/a.txt") {
+		t.Error("purged content kept")
+	}
+	if _, err = c.RestoreTrashFile("t2"); err == nil {
+		t.Error("purged file restored")
+	}
+}
+
+func TestTrashMergedFile(t *testing.T) {
+	var (
+		err      error
+		offset   int64
+		needle   *Needle
+		fileInfo *FileInfo
+	)
+	c := newTestServer(t, "http://10.0.0.1:8080", &GlobalConfig{EnableDistinctFile: true, EnableTrash: true})
+	c.volumes = NewVolumeCache(2)
+	dir := STORE_DIR_NAME + "/" + LARGE_DIR_NAME + "/1"
+	data := []byte("merged")
+	fileInfo = &FileInfo{Name: "m.txt", Path: dir, Scene: "default", Md5: c.util.MD5(string(data)), Size: int64(len(data))}
+	needle = NewNeedle(fileInfo, data)
+	if offset, err = c.WriteNeedle(dir+"/100", -1, needle); err != nil {
+		t.Fatal(err)
+	}
+	fileInfo.OffSet = offset
+	fileInfo.ReName = fmt.Sprintf("100,%d,%d,.txt", offset, needle.Size())
+	c.saveFileMd5Log(fileInfo, CONST_FILE_Md5_FILE_NAME)
+	fpath := c.GetFilePathByInfo(fileInfo, false)
+	if _, err = c.MoveToTrash(fileInfo, "", "t1"); err != nil {
+		t.Fatal("move to trash", err)
+	}
+	// the needle stays in its volume, the path is gone
+	if ok, _ := c.IsExistFromLevelDB(c.util.MD5(fpath), c.ldb); ok {
+		t.Error("path of the merged file still served")
+	}
+	if needle, err = c.ReadNeedle(dir+"/100", offset, needle.Size()); err != nil || needle.Deleted() {
+		t.Fatal("needle deleted", err)
+	}
+	if files := c.ListTrashFiles("default"); len(files) != 1 || files[0].File.OffSet != offset {
+		t.Fatal("list trash", files)
+	}
+	if _, err = c.RestoreTrashFile("t1"); err != nil {
+		t.Fatal("restore", err)
+	}
+	if info, err := c.GetFileInfoFromLevelDB(c.util.MD5(fpath)); err != nil || info.OffSet != offset {
+		t.Fatal("path not restored", info, err)
+	}
+	if _, err = c.MoveToTrash(fileInfo, "", "t2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.PurgeTrashFile("t2"); err != nil {
+		t.Fatal(err)
+	}
+	if needle, err = c.ReadNeedle(dir+"/100", offset, needle.Size()); err != nil || !needle.Deleted() {
+		t.Error("purged needle not deleted", err)
+	}
+}
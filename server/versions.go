@@ -0,0 +1,454 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sjqzhang/seelog"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// In the scenes of version_scenes an upload to a custom path that is taken
+// moves the file there to files/_versions/<md5 of the path>/<version>/ and
+// records it as file_version_<md5 of the path>_<version>. Versions are ids
+// sortable by time, given by the node the upload reached and kept by the
+// peers, so every node orders them the same way.
+
+type FileVersion struct {
+	Version   string `json:"version"`
+	Md5       string `json:"md5"`
+	Size      int64  `json:"size"`
+	TimeStamp int64  `json:"timeStamp"`
+	Latest    bool   `json:"latest"`
+}
+
+func (c *Server) IsVersionedScene(scene string) bool {
+	return scene != "" && c.util.Contains(scene, Config().VersionScenes)
+}
+
+func (c *Server) NewFileVersion() string {
+	return fmt.Sprintf("%019d", time.Now().UnixNano())
+}
+
+// GetFileVersion returns the version of fileInfo, files stored before the
+// scene was versioned get one from their upload time.
+func (c *Server) GetFileVersion(fileInfo *FileInfo) string {
+	if fileInfo.Version != "" {
+		return fileInfo.Version
+	}
+	return fmt.Sprintf("%019d", fileInfo.TimeStamp*int64(time.Second))
+}
+
+func (c *Server) GetVersionDir(pathMd5 string, version string) string {
+	return STORE_DIR_NAME + "/" + CONST_VERSION_DIR_NAME + "/" + pathMd5 + "/" + version
+}
+
+func (c *Server) fileVersionKey(pathMd5 string, version string) string {
+	return CONST_FILE_VERSION_KEY_PREFIX + pathMd5 + "_" + version
+}
+
+// getVersionPath reads the path parameter the way /delete does.
+func (c *Server) getVersionPath(r *http.Request) string {
+	fpath := strings.Replace(r.FormValue("path"), "/"+Config().Group+"/", STORE_DIR_NAME+"/", 1)
+	if !strings.HasPrefix(fpath, STORE_DIR_NAME+"/") {
+		fpath = STORE_DIR_NAME + "/" + strings.TrimLeft(fpath, "/")
+	}
+	return fpath
+}
+
+// getUploadVersionPath returns the path the upload of filename replaces in a
+// versioned scene the way SaveUploadFile names it, "" when it replaces none.
+func (c *Server) getUploadVersionPath(fileInfo *FileInfo, filename string) string {
+	if fileInfo.Path == "" || !c.IsVersionedScene(fileInfo.Scene) || Config().RenameFile {
+		return ""
+	}
+	folder := fileInfo.Path
+	if !strings.HasPrefix(folder, STORE_DIR) {
+		folder = STORE_DIR + "/" + folder
+	}
+	if fileInfo.ReName != "" {
+		return c.GetStoragePath(folder + "/" + fileInfo.ReName)
+	}
+	_, name := filepath.Split(filename)
+	return c.GetStoragePath(folder + "/" + name)
+}
+
+func (c *Server) SaveFileVersion(pathMd5 string, fileInfo *FileInfo) error {
+	data, err := json.Marshal(fileInfo)
+	if err != nil {
+		return err
+	}
+	return c.ldb.Put([]byte(c.fileVersionKey(pathMd5, fileInfo.Version)), data, nil)
+}
+
+// GetArchivedVersion returns the metadata at the path an older version of
+// fpath is kept at.
+func (c *Server) GetArchivedVersion(fpath string, version string) (*FileInfo, error) {
+	var (
+		err     error
+		data    []byte
+		archive FileInfo
+	)
+	if data, err = c.ldb.Get([]byte(c.fileVersionKey(c.util.MD5(fpath), version)), nil); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &archive); err != nil {
+		return nil, err
+	}
+	return c.GetFileInfoFromLevelDB(c.util.MD5(c.GetFilePathByInfo(&archive, false)))
+}
+
+// ListFileVersions returns the versions of fpath, the latest first.
+func (c *Server) ListFileVersions(fpath string) []FileVersion {
+	var (
+		versions []FileVersion
+	)
+	pathMd5 := c.util.MD5(fpath)
+	if cur, err := c.GetFileInfoFromLevelDB(pathMd5); err == nil {
+		versions = append(versions, FileVersion{Version: c.GetFileVersion(cur), Md5: cur.Md5,
+			Size: c.GetContentSize(cur), TimeStamp: cur.TimeStamp, Latest: true})
+	}
+	iter := c.ldb.NewIterator(util.BytesPrefix([]byte(c.fileVersionKey(pathMd5, ""))), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var archive FileInfo
+		if err := json.Unmarshal(iter.Value(), &archive); err != nil {
+			continue
+		}
+		// a version removed by its own path is gone
+		if ok, _ := c.IsExistFromLevelDB(c.util.MD5(c.GetFilePathByInfo(&archive, false)), c.ldb); !ok {
+			continue
+		}
+		if len(versions) > 0 && versions[0].Version == archive.Version {
+			continue
+		}
+		versions = append(versions, FileVersion{Version: archive.Version, Md5: archive.Md5,
+			Size: c.GetContentSize(&archive), TimeStamp: archive.TimeStamp})
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+	return versions
+}
+
+// ArchiveFileVersion moves cur, the latest version of its path, to the
+// directory of its version.
+func (c *Server) ArchiveFileVersion(cur *FileInfo) (*FileInfo, error) {
+	var (
+		err     error
+		content *FileInfo
+	)
+	src := c.GetFilePathByInfo(cur, false)
+	pathMd5 := c.util.MD5(src)
+	info := *cur
+	info.Version = c.GetFileVersion(cur)
+	info.Path = c.GetVersionDir(pathMd5, info.Version)
+	dst := c.GetFilePathByInfo(&info, false)
+	if !Config().EnableDistinctFile {
+		// the md5 is the one of the path
+		info.Md5 = c.util.MD5(dst)
+	}
+	if c.StorageFileExists(src) {
+		if err = c.storage.Rename(src, dst); err != nil {
+			return nil, err
+		}
+	}
+	if content, _ = c.GetFileInfoFromLevelDB(cur.Md5); content != nil && c.GetFilePathByInfo(content, false) == src {
+		c.saveFileMd5Log(cur, CONST_REMOME_Md5_FILE_NAME)
+		c.saveFileMd5Log(&info, CONST_FILE_Md5_FILE_NAME)
+		// the references sharing the url keep the content they were made for
+		for _, ref := range c.GetFileRefs(cur.Md5) {
+			if ref.RefId == cur.RefId || c.GetFilePathByInfo(ref, false) != src {
+				continue
+			}
+			c.RemoveKeyFromLevelDB(c.fileRefKey(ref.Md5, ref.RefId), c.ldb)
+			ref.Path, ref.Md5 = info.Path, info.Md5
+			if err = c.AddFileRef(ref); err != nil {
+				log.Error(err)
+			}
+		}
+	} else {
+		c.RemoveKeyFromLevelDB(pathMd5, c.ldb)
+		c.RemoveS3ObjectIndex(cur)
+		c.UnindexFile(src)
+		if err = c.AddFileRef(&info); err != nil {
+			return nil, err
+		}
+		if err = c.saveRefPath(&info); err != nil {
+			return nil, err
+		}
+	}
+	if err = c.SaveFileVersion(pathMd5, &info); err != nil {
+		return nil, err
+	}
+	log.Info(fmt.Sprintf("version %s of %s archived", info.Version, src))
+	return &info, nil
+}
+
+// acceptFileVersion is called on the peers before fileInfo replaces the file
+// at its path. The version held here is archived when fileInfo is newer, and
+// false is returned when fileInfo is older than it.
+func (c *Server) acceptFileVersion(fileInfo *FileInfo) bool {
+	if fileInfo.Version == "" {
+		return true
+	}
+	cur, err := c.GetFileInfoFromLevelDB(c.util.MD5(c.GetFilePathByInfo(fileInfo, false)))
+	if err != nil || cur.Version == fileInfo.Version {
+		return true
+	}
+	if c.GetFileVersion(cur) > fileInfo.Version {
+		return false
+	}
+	if _, err = c.ArchiveFileVersion(cur); err != nil {
+		log.Error(err)
+	}
+	return true
+}
+
+// SyncFileVersionToPeers logs the archive of a version, the peers replay it
+// from the operation log.
+func (c *Server) SyncFileVersionToPeers(archive *FileInfo) {
+	if err := c.LogOp(&Op{Type: CONST_OP_VERSION, Md5: archive.Md5, Path: archive.Path, Version: archive.Version, File: archive}); err != nil {
+		log.Error(err)
+	}
+}
+
+// applyFileVersion saves the archive of a version a peer made.
+func (c *Server) applyFileVersion(archive *FileInfo) error {
+	var (
+		err error
+		cur *FileInfo
+	)
+	pathMd5 := path.Base(path.Dir(archive.Path))
+	if cur, err = c.GetFileInfoFromLevelDB(pathMd5); err == nil && c.GetFileVersion(cur) == archive.Version {
+		_, err = c.ArchiveFileVersion(cur)
+		return err
+	}
+	if ok, _ := c.IsExistFromLevelDB(c.util.MD5(c.GetFilePathByInfo(archive, false)), c.ldb); ok {
+		return c.SaveFileVersion(pathMd5, archive)
+	}
+	if archive.Ref {
+		if err = c.AddFileRef(archive); err == nil {
+			err = c.saveRefPath(archive)
+		}
+		if err == nil {
+			err = c.SaveFileVersion(pathMd5, archive)
+		}
+		return err
+	}
+	if c.IsPlacedOn(archive, c.host) {
+		c.SaveFileMd5Log(archive, CONST_Md5_QUEUE_FILE_NAME)
+		c.AppendToDownloadQueue(archive)
+	} else {
+		c.SaveFileMd5Log(archive, CONST_FILE_Md5_FILE_NAME)
+	}
+	return c.SaveFileVersion(pathMd5, archive)
+}
+
+// SyncFileVersion archives the version a peer archived, or fetches it when
+// this node never had it.
+func (c *Server) SyncFileVersion(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		archive FileInfo
+		result  JsonResult
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		w.Write([]byte(c.GetClusterNotPermitMessage(r)))
+		return
+	}
+	if err = json.Unmarshal([]byte(r.FormValue("fileInfo")), &archive); err != nil || archive.Version == "" {
+		result.Message = "invalid fileInfo"
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if err = c.applyFileVersion(&archive); err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+// RestoreFileVersion makes a new latest version of fpath out of version.
+func (c *Server) RestoreFileVersion(fpath string, version string) (*FileInfo, error) {
+	var (
+		err     error
+		archive *FileInfo
+		cur     *FileInfo
+		content *FileInfo
+		file    StorageFile
+	)
+	c.lockMap.LockKey(fpath)
+	defer c.lockMap.UnLockKey(fpath)
+	if cur, _ = c.GetFileInfoFromLevelDB(c.util.MD5(fpath)); cur != nil && c.GetFileVersion(cur) == version {
+		return cur, nil
+	}
+	if archive, err = c.GetArchivedVersion(fpath, version); err != nil {
+		return nil, errors.New("version not found")
+	}
+	if !Config().EnableDistinctFile && (archive.Shards != nil || archive.OffSet >= 0) {
+		return nil, errors.New("(error) the version can't be copied")
+	}
+	if cur != nil {
+		if cur, err = c.ArchiveFileVersion(cur); err != nil {
+			return nil, err
+		}
+		c.SyncFileVersionToPeers(cur)
+	}
+	target := &FileInfo{Name: archive.Name, ReName: archive.ReName, Path: path.Dir(fpath),
+		Scene: archive.Scene, Version: c.NewFileVersion()}
+	if Config().EnableDistinctFile {
+		// the new version references the content of the old one
+		if content, err = c.GetFileInfoFromLevelDB(archive.Md5); err != nil {
+			return nil, err
+		}
+		ref := c.NewFileRef(content, target)
+		if Config().DistinctLink == CONST_DISTINCT_LINK_HARDLINK {
+			c.linkFileRef(content, ref)
+		}
+		if err = c.SaveFileRef(ref); err != nil {
+			return nil, err
+		}
+		c.SyncFileRefToPeers(ref)
+		return ref, nil
+	}
+	if file, err = c.storage.Get(c.GetFilePathByInfo(archive, false)); err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err = c.storage.Put(fpath, file); err != nil {
+		c.storage.Delete(fpath)
+		return nil, err
+	}
+	info := *archive
+	info.Path, info.Version = target.Path, target.Version
+	info.Md5 = c.util.MD5(fpath)
+	info.TimeStamp = time.Now().Unix()
+	info.RefId = ""
+	info.Disk = ""
+	info.Peers = []string{c.host}
+	c.saveFileMd5Log(&info, CONST_FILE_Md5_FILE_NAME)
+	go c.postFileToPeer(&info)
+	return &info, nil
+}
+
+// DeleteFileVersion drops an older version of fpath, its content goes with
+// its last reference.
+func (c *Server) DeleteFileVersion(fpath string, version string) error {
+	var (
+		err     error
+		archive *FileInfo
+		content *FileInfo
+	)
+	c.lockMap.LockKey(fpath)
+	defer c.lockMap.UnLockKey(fpath)
+	if cur, err := c.GetFileInfoFromLevelDB(c.util.MD5(fpath)); err == nil && c.GetFileVersion(cur) == version {
+		return errors.New("(error) the latest version is removed with /delete")
+	}
+	if archive, err = c.GetArchivedVersion(fpath, version); err == nil {
+		if _, last := c.ReleaseFileRef(archive, archive.RefId); last {
+			if content, err = c.GetFileInfoFromLevelDB(archive.Md5); err != nil {
+				content = archive
+			}
+			if err = c.RemoveFileContent(content); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	return c.RemoveKeyFromLevelDB(c.fileVersionKey(c.util.MD5(fpath), version), c.ldb)
+}
+
+func (c *Server) ListVersions(w http.ResponseWriter, r *http.Request) {
+	var (
+		result JsonResult
+	)
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	result.Data = c.ListFileVersions(c.getVersionPath(r))
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+func (c *Server) RestoreVersion(w http.ResponseWriter, r *http.Request) {
+	var (
+		err      error
+		result   JsonResult
+		fileInfo *FileInfo
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if fileInfo, err = c.RestoreFileVersion(c.getVersionPath(r), r.FormValue("version")); err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	result.Status = "ok"
+	result.Data = c.BuildFileResult(fileInfo, r)
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+func (c *Server) DeleteVersion(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		result JsonResult
+	)
+	result.Status = "fail"
+	if !c.IsPeer(r) {
+		result.Message = c.GetClusterNotPermitMessage(r)
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	fpath, version := c.getVersionPath(r), r.FormValue("version")
+	if err = c.DeleteFileVersion(fpath, version); err != nil {
+		result.Message = err.Error()
+		w.Write([]byte(c.util.JsonEncodePretty(result)))
+		return
+	}
+	if r.FormValue("inner") != "1" {
+		c.LogOp(&Op{Type: CONST_OP_DELETE_VERSION, Path: fpath, Version: version})
+	}
+	result.Status = "ok"
+	result.Message = "remove success"
+	w.Write([]byte(c.util.JsonEncodePretty(result)))
+}
+
+// DownloadVersionFileByURI serves ?version= of an older version.
+func (c *Server) DownloadVersionFileByURI(w http.ResponseWriter, r *http.Request) (bool, error) {
+	var (
+		err      error
+		fullpath string
+		archive  *FileInfo
+		content  *FileInfo
+	)
+	fullpath, _ = c.GetFilePathFromRequest(w, r)
+	fullpath = c.GetStoragePath(fullpath)
+	if archive, err = c.GetArchivedVersion(fullpath, r.FormValue("version")); err != nil {
+		return false, err
+	}
+	content = archive
+	if archive.Ref {
+		if content, err = c.GetFileInfoFromLevelDB(archive.Md5); err != nil {
+			return false, err
+		}
+	}
+	if !c.IsRawRequest(r) && (r.FormValue("download") == "1" || (r.FormValue("download") == "" && Config().DefaultDownload)) {
+		c.SetDownloadHeader(w, r)
+	}
+	return c.ServeFileByInfo(w, r, content, archive.Name, time.Unix(archive.TimeStamp, 0))
+}
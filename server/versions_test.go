@@ -0,0 +1,76 @@
+package server
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFileVersions(t *testing.T) {
+	var (
+		err      error
+		cur      *FileInfo
+		versions []FileVersion
+	)
+	c := newTestServer(t, "http://10.0.0.1:8080", &GlobalConfig{EnableDistinctFile: true, VersionScenes: []string{"docs"}})
+	dir := STORE_DIR_NAME + "/docs/manual"
+	fpath := dir + "/a.txt"
+	upload := func(data string, version string) {
+		c.storage.Put(fpath, strings.NewReader(data))
+		c.saveFileMd5Log(&FileInfo{Name: "a.txt", Path: dir, Scene: "docs", Md5: c.util.MD5(data),
+			Size: int64(len(data)), OffSet: -1, Version: version}, CONST_FILE_Md5_FILE_NAME)
+	}
+	read := func(fileInfo *FileInfo) string {
+		reader, err := c.GetFileReaderByInfo(fileInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		data, _ := ioutil.ReadAll(reader)
+		return string(data)
+	}
+	upload("v1", "0000000000000000001")
+	if cur, err = c.GetFileInfoFromLevelDB(c.util.MD5(fpath)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.ArchiveFileVersion(cur); err != nil {
+		t.Fatal(err)
+	}
+	upload("v2", "0000000000000000002")
+	if versions = c.ListFileVersions(fpath); len(versions) != 2 || !versions[0].Latest || versions[1].Version != "0000000000000000001" {
+		t.Fatal("versions", versions)
+	}
+	if archive, err := c.GetArchivedVersion(fpath, "0000000000000000001"); err != nil || read(archive) != "v1" {
+		t.Fatal("archived version", err)
+	}
+	// a peer ignores an older version arriving late
+	if c.acceptFileVersion(&FileInfo{Name: "a.txt", Path: dir, Version: "0000000000000000001"}) {
+		t.Error("older version accepted")
+	}
+	if cur, err = c.RestoreFileVersion(fpath, "0000000000000000001"); err != nil {
+		t.Fatal(err)
+	}
+	if versions = c.ListFileVersions(fpath); len(versions) != 3 || versions[0].Version != cur.Version || versions[0].Md5 != c.util.MD5("v1") {
+		t.Fatal("restore", versions)
+	}
+	// the peers replay the archive from the operation log
+	if page, _ := c.GetOps(0, 10); len(page.Ops) == 0 || page.Ops[0].Type != CONST_OP_VERSION || page.Ops[0].Version != "0000000000000000002" {
+		t.Fatalf("archive not logged %+v", page)
+	}
+	if p := c.getUploadVersionPath(&FileInfo{Path: "docs/manual", Scene: "docs"}, "a.txt"); p != fpath {
+		t.Errorf("upload locks %s", p)
+	}
+	// the restored version keeps the content of the deleted one
+	if err = c.DeleteFileVersion(fpath, "0000000000000000001"); err != nil {
+		t.Fatal(err)
+	}
+	if cur, err = c.GetFileInfoFromLevelDB(c.util.MD5(fpath)); err != nil || cur.Ref || read(cur) != "v1" {
+		t.Fatal("content not moved to the latest version", cur, err)
+	}
+	if versions = c.ListFileVersions(fpath); len(versions) != 2 {
+		t.Error("delete version", versions)
+	}
+	if err = c.DeleteFileVersion(fpath, cur.Version); err == nil {
+		t.Error("latest version deleted")
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/astaxie/beego/httplib"
+	"github.com/shirou/gopsutil/v3/disk"
+	log "github.com/sjqzhang/seelog"
+)
+
+var ErrInsufficientStorage = errors.New("(error) insufficient storage")
+
+// getPlacementUsage returns the usage of the disk new files are written to.
+func (c *Server) getPlacementUsage() (*disk.UsageStat, error) {
+	dir := STORE_DIR
+	if s, ok := c.storage.(*DiskStorage); ok {
+		d, err := s.Pick()
+		if err != nil {
+			return nil, err
+		}
+		dir = d.Dir
+	}
+	return disk.Usage(dir)
+}
+
+// usedPercent is the used space of usage once size more bytes are written.
+func usedPercent(usage *disk.UsageStat, size uint64) float64 {
+	if usage.Used+usage.Free == 0 {
+		return 100
+	}
+	return float64(usage.Used+size) / float64(usage.Used+usage.Free) * 100
+}
+
+func (c *Server) GetDiskState() string {
+	if state, ok := c.diskState.Load().(string); ok {
+		return state
+	}
+	return CONST_DISK_STATE_OK
+}
+
+// IsReadOnly reports whether the node takes no new files, because of
+// read_only or because its disk passed the critical watermark.
+func (c *Server) IsReadOnly() bool {
+	return Config().ReadOnly || c.GetDiskState() == CONST_DISK_STATE_CRITICAL
+}
+
+// CheckDiskSpace returns ErrInsufficientStorage when a file of size bytes
+// would take the disk over the critical watermark, size may be unknown (<= 0).
+func (c *Server) CheckDiskSpace(size int64) error {
+	if c.GetDiskState() == CONST_DISK_STATE_CRITICAL {
+		return ErrInsufficientStorage
+	}
+	if size <= 0 {
+		return nil
+	}
+	if usage, err := c.getPlacementUsage(); err == nil && usedPercent(usage, uint64(size)) >= Config().DiskCritWatermark {
+		return ErrInsufficientStorage
+	}
+	return nil
+}
+
+// CheckDiskWatermark moves the node between the ok, low and critical states
+// and alerts on every change.
+func (c *Server) CheckDiskWatermark() {
+	var (
+		state   string
+		percent float64
+	)
+	usage, err := c.getPlacementUsage()
+	if err != nil {
+		log.Error(err)
+		state = CONST_DISK_STATE_CRITICAL
+		percent = 100
+	} else {
+		percent = usedPercent(usage, 0)
+		state = CONST_DISK_STATE_OK
+		if percent >= Config().DiskCritWatermark {
+			state = CONST_DISK_STATE_CRITICAL
+		} else if percent >= Config().DiskLowWatermark {
+			state = CONST_DISK_STATE_LOW
+		}
+	}
+	old := c.GetDiskState()
+	if state == old {
+		return
+	}
+	c.diskState.Store(state)
+	subject := fmt.Sprintf("fastdfs disk %s", state)
+	body := fmt.Sprintf("%s\nserver:%s\nused:%.2f\nstate:%s -> %s", subject, c.host, percent, old, state)
+	switch state {
+	case CONST_DISK_STATE_CRITICAL:
+		body = body + "\nuploads and replicas are rejected until space is freed"
+		log.Error(body)
+	case CONST_DISK_STATE_LOW:
+		log.Warn(body)
+	default:
+		log.Info(body)
+	}
+	c.SendAlarm(subject, body)
+}
+
+// WatchPeerStatus keeps whether each peer reports itself read-only in
+// /status, files are not pushed to such a peer. With gossip the members
+// carry it, and nothing is polled.
+func (c *Server) WatchPeerStatus() {
+	if c.gossipEnabled() {
+		return
+	}
+	for {
+		for _, peer := range c.GetKnownPeers() {
+			if peer == c.host {
+				continue
+			}
+			var status JsonResult
+			req := httplib.Get(fmt.Sprintf("%s%s", peer, c.getRequestURI("status")))
+			req.SetTimeout(time.Second*5, time.Second*5)
+			if err := req.ToJSON(&status); err != nil || status.Status != "ok" {
+				continue
+			}
+			if data, ok := status.Data.(map[string]interface{}); ok {
+				readOnly, _ := data["Fs.ReadOnly"].(bool)
+				c.peerReadOnly.Put(peer, readOnly)
+			}
+		}
+		time.Sleep(time.Second * CONST_DISK_CHECK_INTERVAL)
+	}
+}
+
+func (c *Server) IsPeerReadOnly(peer string) bool {
+	if v, ok := c.peerReadOnly.GetValue(peer); ok {
+		return v.(bool)
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+func TestDiskWatermark(t *testing.T) {
+	old := atomic.LoadPointer(&ptr)
+	defer atomic.StorePointer(&ptr, old)
+	cfg := &GlobalConfig{DiskLowWatermark: 100, DiskCritWatermark: 100}
+	atomic.StorePointer(&ptr, unsafe.Pointer(cfg))
+	c := &Server{storage: NewDiskStorage(t.TempDir()+"/", []string{"disk1"})}
+	if p := usedPercent(&disk.UsageStat{Used: 30, Free: 70}, 20); p != 50 {
+		t.Error("used percent", p)
+	}
+	c.CheckDiskWatermark()
+	if c.GetDiskState() != CONST_DISK_STATE_OK || c.IsReadOnly() || c.CheckDiskSpace(1024) != nil {
+		t.Fatal("state", c.GetDiskState())
+	}
+	usage, err := c.getPlacementUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CheckDiskSpace(int64(usage.Free)+1) != ErrInsufficientStorage {
+		t.Error("file larger than the free space accepted")
+	}
+	cfg.DiskLowWatermark = 0.001
+	c.CheckDiskWatermark()
+	if c.GetDiskState() != CONST_DISK_STATE_LOW || c.IsReadOnly() {
+		t.Error("low watermark", c.GetDiskState())
+	}
+	cfg.DiskCritWatermark = 0.001
+	c.CheckDiskWatermark()
+	if !c.IsReadOnly() || c.CheckDiskSpace(0) != ErrInsufficientStorage {
+		t.Error("critical watermark", c.GetDiskState())
+	}
+	// space freed
+	cfg.DiskLowWatermark, cfg.DiskCritWatermark = 100, 100
+	c.CheckDiskWatermark()
+	if c.GetDiskState() != CONST_DISK_STATE_OK || c.IsReadOnly() {
+		t.Error("not recovered", c.GetDiskState())
+	}
+}